@@ -0,0 +1,722 @@
+package lazydb
+
+import (
+	"encoding/binary"
+	"errors"
+	"lazydb/logfile"
+	"math"
+	"math/big"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrBitOffsetOutOfRange  = errors.New("bit offset is not an integer or out of range")
+	ErrInvalidBitFieldType  = errors.New("invalid bitfield type, use something like i16 u8")
+	ErrBitOpNotSingleSource = errors.New("BITOP NOT must be called with a single source key")
+)
+
+// maxBitOffset limits the strings grown by the bit commands to 512MB, like redis.
+const maxBitOffset = 1<<32 - 1
+
+// The bit commands see a string as an array of bits, the bit 0 is the most significant bit of the first byte.
+// Bits beyond the end of the string are 0, and the string is grown with zero bytes when they are set.
+// The ttl of the string is kept when its bits are set.
+
+// BitRange is a range of BitCount and BitPos. Start and End are inclusive, and negative offsets count from the end.
+type BitRange struct {
+	Start int64
+	End   int64
+	// Bits makes Start and End offsets of bits instead of bytes.
+	Bits bool
+}
+
+// BitOperation is the operation of BitOp.
+type BitOperation int
+
+const (
+	BitAnd BitOperation = iota
+	BitOr
+	BitXor
+	BitNot
+)
+
+// BitFieldKind is the kind of a BitFieldOp.
+type BitFieldKind int
+
+const (
+	BitFieldGet BitFieldKind = iota
+	BitFieldSet
+	BitFieldIncrBy
+)
+
+// BitFieldOverflow is the behavior of BitFieldSet and BitFieldIncrBy when the value does not fit into the field.
+type BitFieldOverflow int
+
+const (
+	// BitFieldWrap wraps around the value, which is the default.
+	BitFieldWrap BitFieldOverflow = iota
+	// BitFieldSat saturates the value to the minimum or maximum value of the field.
+	BitFieldSat
+	// BitFieldFail leaves the field unchanged, and the result of the operation is nil.
+	BitFieldFail
+)
+
+// BitFieldOp is an operation of BitField.
+type BitFieldOp struct {
+	Kind BitFieldKind
+	// Type is the integer type of the field, like "i8" or "u16". Signed fields have at most 64 bits
+	// and unsigned ones at most 63 bits.
+	Type string
+	// Offset is the offset of the first bit of the field. Multiply it by the width of the type
+	// to address the fields like an array, the same as "#<n>" of redis.
+	Offset int64
+	// Value is the value set by BitFieldSet, or the increment of BitFieldIncrBy.
+	Value    int64
+	Overflow BitFieldOverflow
+}
+
+// SetBit sets or clears the bit at offset of the string value stored at key, and returns the original bit.
+func (db *LazyDB) SetBit(key []byte, offset int64, bit int) (int, error) {
+	if offset < 0 || offset > maxBitOffset {
+		return 0, ErrBitOffsetOutOfRange
+	}
+	if bit != 0 && bit != 1 {
+		return 0, ErrInvalidParam
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	bm, err := db.openBitmap(key)
+	if err != nil {
+		return 0, err
+	}
+	old, err := bm.bit(offset)
+	if err != nil {
+		return 0, err
+	}
+	if err := bm.setBit(offset, bit); err != nil {
+		return 0, err
+	}
+	if err := bm.save(); err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyString, "setbit", key)
+	return old, nil
+}
+
+// GetBit returns the bit at offset of the string value stored at key.
+func (db *LazyDB) GetBit(key []byte, offset int64) (int, error) {
+	if offset < 0 || offset > maxBitOffset {
+		return 0, ErrBitOffsetOutOfRange
+	}
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	bm, err := db.openBitmap(key)
+	if err != nil {
+		return 0, err
+	}
+	return bm.bit(offset)
+}
+
+// BitCount returns the number of bits set to 1 in the string value stored at key,
+// or in the given range of it if r is not nil.
+func (db *LazyDB) BitCount(key []byte, r *BitRange) (int64, error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	val, _, err := db.strValue(key)
+	if err != nil {
+		return 0, err
+	}
+	first, last, ok := bitRangeBounds(val, r)
+	if !ok {
+		return 0, nil
+	}
+	var count int64
+	for ; first <= last && first&7 != 0; first++ {
+		count += int64(getBit(val, first))
+	}
+	for ; first+7 <= last; first += 8 {
+		count += int64(bits.OnesCount8(val[first>>3]))
+	}
+	for ; first <= last; first++ {
+		count += int64(getBit(val, first))
+	}
+	return count, nil
+}
+
+// BitPos returns the offset of the first bit set to bit in the string value stored at key,
+// or in the given range of it if r is not nil. It returns -1 if there is none, except when
+// clear bits are looked for in the whole string, whose bits beyond the end are considered clear.
+func (db *LazyDB) BitPos(key []byte, bit int, r *BitRange) (int64, error) {
+	if bit != 0 && bit != 1 {
+		return 0, ErrInvalidParam
+	}
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	val, _, err := db.strValue(key)
+	if err != nil {
+		return 0, err
+	}
+	first, last, ok := bitRangeBounds(val, r)
+	if ok {
+		// whole bytes without the bit are skipped
+		skip := byte(0)
+		if bit == 0 {
+			skip = 0xff
+		}
+		for offset := first; offset <= last; offset++ {
+			if offset&7 == 0 && offset+7 <= last && val[offset>>3] == skip {
+				offset += 7
+				continue
+			}
+			if getBit(val, offset) == bit {
+				return offset, nil
+			}
+		}
+	}
+	if bit == 0 && r == nil {
+		return int64(len(val)) * 8, nil
+	}
+	return -1, nil
+}
+
+// BitOp performs a bitwise operation between the string values stored at keys, and stores the result in destination.
+// Missing keys are considered as empty strings, and shorter strings are padded with zero bytes.
+// It returns the length of the result, destination is deleted if it is empty.
+func (db *LazyDB) BitOp(op BitOperation, destination []byte, keys ...[]byte) (int, error) {
+	if len(keys) == 0 || op < BitAnd || op > BitNot {
+		return 0, ErrInvalidParam
+	}
+	if op == BitNot && len(keys) != 1 {
+		return 0, ErrBitOpNotSingleSource
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	values := make([][]byte, len(keys))
+	var size int
+	for i, key := range keys {
+		val, _, err := db.strValue(key)
+		if err != nil {
+			return 0, err
+		}
+		values[i] = val
+		if len(val) > size {
+			size = len(val)
+		}
+	}
+
+	result := make([]byte, size)
+	copy(result, values[0])
+	for _, val := range values[1:] {
+		for i := range result {
+			var b byte
+			if i < len(val) {
+				b = val[i]
+			}
+			switch op {
+			case BitAnd:
+				result[i] &= b
+			case BitOr:
+				result[i] |= b
+			case BitXor:
+				result[i] ^= b
+			}
+		}
+	}
+	if op == BitNot {
+		for i := range result {
+			result[i] = ^result[i]
+		}
+	}
+
+	if size == 0 {
+		if db.strIndex.idxTree.Get(destination) != nil {
+			if err := db.deleteStr(destination); err != nil {
+				return 0, err
+			}
+			db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+		}
+		return 0, nil
+	}
+	if err := db.setEX(destination, result, 0); err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyString, "set", destination)
+	return size, nil
+}
+
+// BitField performs the operations on the integer fields of the string value stored at key in order,
+// and returns their results: the value of BitFieldGet, the old value of BitFieldSet and the new value
+// of BitFieldIncrBy. The result is nil if the operation fails with BitFieldFail.
+func (db *LazyDB) BitField(key []byte, ops ...BitFieldOp) ([]*int64, error) {
+	types := make([]bitFieldType, len(ops))
+	write := false
+	for i, op := range ops {
+		typ, err := parseBitFieldType(op.Type)
+		if err != nil {
+			return nil, err
+		}
+		if op.Offset < 0 || op.Offset+int64(typ.bits)-1 > maxBitOffset {
+			return nil, ErrBitOffsetOutOfRange
+		}
+		types[i] = typ
+		write = write || op.Kind != BitFieldGet
+	}
+	if write {
+		db.strIndex.mu.Lock()
+		defer db.strIndex.mu.Unlock()
+	} else {
+		db.strIndex.mu.RLock()
+		defer db.strIndex.mu.RUnlock()
+	}
+
+	bm, err := db.openBitmap(key)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*int64, len(ops))
+	changed := false
+	for i, op := range ops {
+		typ := types[i]
+		raw, err := bm.bits(op.Offset, typ.bits)
+		if err != nil {
+			return nil, err
+		}
+		old := typ.decode(raw)
+		if op.Kind == BitFieldGet {
+			results[i] = &old
+			continue
+		}
+
+		target := big.NewInt(op.Value)
+		if op.Kind == BitFieldIncrBy {
+			target.Add(target, big.NewInt(old))
+		}
+		v, ok := typ.fit(target, op.Overflow)
+		if !ok {
+			continue
+		}
+		if err := bm.setBits(op.Offset, typ.bits, uint64(v)); err != nil {
+			return nil, err
+		}
+		changed = true
+		if op.Kind == BitFieldSet {
+			results[i] = &old
+		} else {
+			results[i] = &v
+		}
+	}
+	if changed {
+		if err := bm.save(); err != nil {
+			return nil, err
+		}
+		db.notifyKeyspaceEvent(notifyString, "setbit", key)
+	}
+	return results, nil
+}
+
+// strValue returns the value of the string stored at key with the unix time it expires at,
+// or nil if it does not exist. The caller must hold the lock of strIndex.
+func (db *LazyDB) strValue(key []byte) ([]byte, int64, error) {
+	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+	if err == ErrKeyNotFound {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var expiredAt int64
+	if idxNode, _ := db.strIndex.idxTree.Get(key).(*Value); idxNode != nil {
+		expiredAt = idxNode.expiredAt
+	}
+	return val, expiredAt, nil
+}
+
+func getBit(val []byte, offset int64) int {
+	if offset>>3 >= int64(len(val)) {
+		return 0
+	}
+	return int(val[offset>>3]>>(7-offset&7)) & 1
+}
+
+// bitmapPageSize is the size of the pages a bitmap is stored in.
+const bitmapPageSize = 4096
+
+// A string written by SetBit and BitField is stored as a bitmap in pages, so that a write only appends the pages it changes.
+// The header entry at the key holds the length of the string, and every page that is not all zeros has an entry
+// keyed by the key and the page number. Pages are written before the header, and any other write of the key drops them.
+
+// bitmap is a string loaded page by page by the bit commands. The caller must hold the lock of strIndex.
+type bitmap struct {
+	db     *LazyDB
+	key    []byte
+	exists bool
+	// paged reports whether the string is stored in pages, plain holds its value otherwise.
+	paged     bool
+	plain     []byte
+	length    int64 // in bytes
+	expiredAt int64
+	// the header is written again only when the length or the ttl has changed.
+	savedLength    int64
+	savedExpiredAt int64
+	pages          map[uint32][]byte
+	dirty          map[uint32]bool
+}
+
+func (db *LazyDB) openBitmap(key []byte) (*bitmap, error) {
+	bm := &bitmap{db: db, key: key, pages: make(map[uint32][]byte), dirty: make(map[uint32]bool)}
+	idxNode, _ := db.strIndex.idxTree.Get(key).(*Value)
+	ts := time.Now().Unix()
+	if idxNode == nil || (idxNode.expiredAt != 0 && idxNode.expiredAt < ts) {
+		return bm, nil
+	}
+	ent, err := db.readLogEntry(valueTypeString, idxNode.fid, idxNode.offset)
+	if err != nil {
+		return nil, err
+	}
+	if ent.Stat == logfile.SDelete || (ent.ExpiredAt != 0 && ent.ExpiredAt < ts) {
+		return bm, nil
+	}
+	bm.exists, bm.expiredAt = true, ent.ExpiredAt
+	if ent.Stat == logfile.SBitmap {
+		bm.paged = true
+		bm.length = int64(binary.LittleEndian.Uint64(ent.Value))
+	} else {
+		bm.plain = ent.Value
+		bm.length = int64(len(ent.Value))
+	}
+	bm.savedLength, bm.savedExpiredAt = bm.length, bm.expiredAt
+	return bm, nil
+}
+
+// page returns the bytes of page n, the trailing zero bytes may be missing.
+// Bytes beyond the saved length are left by a write that did not finish, and are ignored.
+func (bm *bitmap) page(n uint32) ([]byte, error) {
+	if p, ok := bm.pages[n]; ok {
+		return p, nil
+	}
+	start := int64(n) * bitmapPageSize
+	var p []byte
+	if !bm.paged {
+		if start < int64(len(bm.plain)) {
+			p = bm.plain[start:]
+		}
+	} else if tree := bm.db.strIndex.bitmaps[string(bm.key)]; tree != nil && start < bm.savedLength {
+		val, err := bm.db.getValue(tree, bitmapPageKey(n), valueTypeString)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		p = val
+	}
+	if end := bm.savedLength - start; end >= 0 && int64(len(p)) > end {
+		p = p[:end]
+	}
+	if len(p) > bitmapPageSize {
+		p = p[:bitmapPageSize]
+	}
+	bm.pages[n] = p
+	return p, nil
+}
+
+// markDirty makes page n a full page that can be modified, and writes it on save.
+func (bm *bitmap) markDirty(n uint32) ([]byte, error) {
+	p, err := bm.page(n)
+	if err != nil {
+		return nil, err
+	}
+	if !bm.dirty[n] {
+		buf := make([]byte, bitmapPageSize)
+		copy(buf, p)
+		p = buf
+		bm.pages[n], bm.dirty[n] = p, true
+	}
+	return p, nil
+}
+
+func (bm *bitmap) bit(offset int64) (int, error) {
+	if offset>>3 >= bm.length {
+		return 0, nil
+	}
+	n := uint32(offset >> 3 / bitmapPageSize)
+	p, err := bm.page(n)
+	if err != nil {
+		return 0, err
+	}
+	return getBit(p, offset-int64(n)*bitmapPageSize*8), nil
+}
+
+// bits reads n bits from offset as an unsigned integer, the first bit is the most significant one.
+func (bm *bitmap) bits(offset int64, n int) (uint64, error) {
+	var v uint64
+	for i := int64(0); i < int64(n); i++ {
+		b, err := bm.bit(offset + i)
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | uint64(b)
+	}
+	return v, nil
+}
+
+// setBit sets the bit at offset, and grows the string to hold it.
+func (bm *bitmap) setBit(offset int64, bit int) error {
+	n := uint32(offset >> 3 / bitmapPageSize)
+	p, err := bm.markDirty(n)
+	if err != nil {
+		return err
+	}
+	pos := offset - int64(n)*bitmapPageSize*8
+	if bit == 1 {
+		p[pos>>3] |= 0x80 >> (pos & 7)
+	} else {
+		p[pos>>3] &^= 0x80 >> (pos & 7)
+	}
+	if offset>>3 >= bm.length {
+		bm.length = offset>>3 + 1
+	}
+	return nil
+}
+
+// setBits writes the n low bits of v from offset.
+func (bm *bitmap) setBits(offset int64, n int, v uint64) error {
+	for i := int64(0); i < int64(n); i++ {
+		if err := bm.setBit(offset+i, int(v>>(n-1-int(i))&1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the dirty pages and then the header. A plain string is converted by writing all its pages.
+func (bm *bitmap) save() error {
+	db := bm.db
+	tree := db.strIndex.bitmaps[string(bm.key)]
+	// the pages left by an earlier bitmap, or beyond the old end of the string, are cleared.
+	var from uint32
+	if !bm.paged {
+		for n := uint32(0); int64(n)*bitmapPageSize < bm.length; n++ {
+			if _, err := bm.markDirty(n); err != nil {
+				return err
+			}
+		}
+	} else {
+		from = uint32(bm.savedLength / bitmapPageSize)
+	}
+	if tree != nil && (!bm.paged || bm.length > bm.savedLength) {
+		var stale []uint32
+		tree.Ascend(bitmapPageKey(from), func(page []byte, _ interface{}) bool {
+			n := binary.BigEndian.Uint32(page)
+			if bm.paged && int64(n)*bitmapPageSize >= bm.length {
+				return false
+			}
+			stale = append(stale, n)
+			return true
+		})
+		for _, n := range stale {
+			if _, err := bm.markDirty(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	pages := make([]uint32, 0, len(bm.dirty))
+	for n := range bm.dirty {
+		pages = append(pages, n)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i] < pages[j]
+	})
+	entries := make([]*logfile.LogEntry, 0, len(pages)+1)
+	for _, n := range pages {
+		val := bm.pages[n]
+		for len(val) > 0 && val[len(val)-1] == 0 {
+			val = val[:len(val)-1]
+		}
+		// an empty page clears the page
+		if len(val) == 0 && (tree == nil || tree.Get(bitmapPageKey(n)) == nil) {
+			continue
+		}
+		entries = append(entries, &logfile.LogEntry{
+			Key:   encodeKey(bm.key, bitmapPageKey(n)),
+			Value: val,
+			Stat:  logfile.SBitmapPage,
+		})
+	}
+	var header *logfile.LogEntry
+	if !bm.paged || bm.length != bm.savedLength || bm.expiredAt != bm.savedExpiredAt {
+		length := make([]byte, 8)
+		binary.LittleEndian.PutUint64(length, uint64(bm.length))
+		header = &logfile.LogEntry{Key: bm.key, Value: length, Stat: logfile.SBitmap, ExpiredAt: bm.expiredAt}
+		entries = append(entries, header)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	positions, err := db.writeLogEntries(valueTypeString, entries)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if entry == header {
+			if err := db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, positions[i], true); err != nil {
+				return err
+			}
+			continue
+		}
+		_ = db.sendDiscard(db.buildBitmapPage(entry, positions[i]), true, valueTypeString)
+		if len(entry.Value) == 0 {
+			_ = db.sendDiscard(&Value{fid: positions[i].fid, entrySize: positions[i].entrySize}, true, valueTypeString)
+		}
+	}
+	bm.paged, bm.savedLength, bm.savedExpiredAt = true, bm.length, bm.expiredAt
+	bm.dirty = make(map[uint32]bool)
+
+	// subscribers of the changes see the whole string, the same as any other string write.
+	if db.changes.active() {
+		val, err := db.getValue(db.strIndex.idxTree, bm.key, valueTypeString)
+		if err != nil {
+			return err
+		}
+		db.notifyChange(valueTypeString, &logfile.LogEntry{Key: bm.key, Value: val, ExpiredAt: bm.expiredAt})
+	}
+	return nil
+}
+
+func bitmapPageKey(n uint32) []byte {
+	page := make([]byte, 4)
+	binary.BigEndian.PutUint32(page, n)
+	return page
+}
+
+// bitmapValue assembles the string stored in pages at key from its header.
+// The caller must hold the lock of strIndex.
+func (db *LazyDB) bitmapValue(key []byte, header *logfile.LogEntry) ([]byte, error) {
+	val := make([]byte, binary.LittleEndian.Uint64(header.Value))
+	tree := db.strIndex.bitmaps[string(key)]
+	if tree == nil {
+		return val, nil
+	}
+	var err error
+	tree.Ascend(nil, func(page []byte, _ interface{}) bool {
+		start := int64(binary.BigEndian.Uint32(page)) * bitmapPageSize
+		if start >= int64(len(val)) {
+			return false
+		}
+		var p []byte
+		if p, err = db.getValue(tree, page, valueTypeString); err != nil {
+			return false
+		}
+		copy(val[start:], p)
+		return true
+	})
+	return val, err
+}
+
+// dropBitmapPages removes the pages of the bitmap stored at key, when it is overwritten or deleted.
+// The caller must hold the lock of strIndex.
+func (db *LazyDB) dropBitmapPages(key []byte, discard bool) {
+	tree := db.strIndex.bitmaps[string(key)]
+	if tree == nil {
+		return
+	}
+	delete(db.strIndex.bitmaps, string(key))
+	if discard {
+		tree.Ascend(nil, func(_ []byte, value interface{}) bool {
+			_ = db.sendDiscard(value, true, valueTypeString)
+			return true
+		})
+	}
+}
+
+// bitRangeBounds returns the first and last bit offsets of r in val, and reports false if the range is empty.
+func bitRangeBounds(val []byte, r *BitRange) (int64, int64, bool) {
+	length := int64(len(val))
+	if r == nil {
+		return 0, length*8 - 1, length > 0
+	}
+	if r.Bits {
+		length *= 8
+	}
+	start, end := r.Start, r.End
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if length == 0 || end < 0 || start > end {
+		return 0, 0, false
+	}
+	if r.Bits {
+		return start, end, true
+	}
+	return start * 8, end*8 + 7, true
+}
+
+type bitFieldType struct {
+	signed bool
+	bits   int
+}
+
+func parseBitFieldType(s string) (bitFieldType, error) {
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u') {
+		return bitFieldType{}, ErrInvalidBitFieldType
+	}
+	n, err := strconv.Atoi(s[1:])
+	typ := bitFieldType{signed: s[0] == 'i', bits: n}
+	if err != nil || n < 1 || n > 64 || (!typ.signed && n > 63) {
+		return bitFieldType{}, ErrInvalidBitFieldType
+	}
+	return typ, nil
+}
+
+// decode converts the raw bits of the field to its value, sign extending signed fields.
+func (typ bitFieldType) decode(raw uint64) int64 {
+	if typ.signed && typ.bits < 64 && raw>>(typ.bits-1)&1 == 1 {
+		raw |= math.MaxUint64 << typ.bits
+	}
+	return int64(raw)
+}
+
+// fit returns v if it fits into the field, or handles the overflow, and reports false if the operation fails.
+func (typ bitFieldType) fit(v *big.Int, overflow BitFieldOverflow) (int64, bool) {
+	min, max := new(big.Int), new(big.Int).Lsh(big.NewInt(1), uint(typ.bits))
+	if typ.signed {
+		max.Rsh(max, 1)
+		min.Neg(max)
+	}
+	max.Sub(max, big.NewInt(1))
+	if v.Cmp(min) >= 0 && v.Cmp(max) <= 0 {
+		return v.Int64(), true
+	}
+	switch overflow {
+	case BitFieldSat:
+		if v.Sign() < 0 {
+			return min.Int64(), true
+		}
+		return max.Int64(), true
+	case BitFieldFail:
+		return 0, false
+	}
+	// the low bits are kept, And works on the two's complement of negative numbers.
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(typ.bits)), big.NewInt(1))
+	wrapped := new(big.Int).And(v, mask)
+	if typ.signed && wrapped.Bit(typ.bits-1) == 1 {
+		wrapped.Sub(wrapped, new(big.Int).Lsh(big.NewInt(1), uint(typ.bits)))
+	}
+	return wrapped.Int64(), true
+}
@@ -0,0 +1,347 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestBitmapDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_bitmap")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func bitFieldValues(results []*int64) []interface{} {
+	values := make([]interface{}, len(results))
+	for i, r := range results {
+		if r != nil {
+			values[i] = *r
+		}
+	}
+	return values
+}
+
+func TestLazyDB_SetBit_GetBit(t *testing.T) {
+	db := initTestBitmapDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("dau")
+	old, err := db.SetBit(key, 7, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, old)
+	old, err = db.SetBit(key, 7, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, old)
+	val, _ := db.Get(key)
+	assert.Equal(t, []byte{0x01}, val)
+
+	// the string is grown with zero bytes
+	_, err = db.SetBit(key, 17, 1)
+	assert.NoError(t, err)
+	val, _ = db.Get(key)
+	assert.Equal(t, []byte{0x01, 0x00, 0x40}, val)
+	old, _ = db.SetBit(key, 7, 0)
+	assert.Equal(t, 1, old)
+
+	for offset, want := range map[int64]int{0: 0, 7: 0, 17: 1, 1000: 0} {
+		bit, err := db.GetBit(key, offset)
+		assert.NoError(t, err)
+		assert.Equal(t, want, bit)
+	}
+	bit, err := db.GetBit([]byte("missing"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, bit)
+
+	_, err = db.SetBit(key, -1, 1)
+	assert.Equal(t, ErrBitOffsetOutOfRange, err)
+	_, err = db.SetBit(key, 1<<32, 1)
+	assert.Equal(t, ErrBitOffsetOutOfRange, err)
+	_, err = db.SetBit(key, 1, 2)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	// the ttl is kept
+	assert.NoError(t, db.SetEX([]byte("ttl"), []byte{0}, time.Hour))
+	_, _ = db.SetBit([]byte("ttl"), 0, 1)
+	ttl, err := db.TTL([]byte("ttl"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+}
+
+func TestLazyDB_BitCount_BitPos(t *testing.T) {
+	db := initTestBitmapDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("k")
+	assert.NoError(t, db.Set(key, []byte("foobar")))
+
+	counts := []struct {
+		name string
+		r    *BitRange
+		want int64
+	}{
+		{"all", nil, 26},
+		{"bytes", &BitRange{Start: 0, End: 0}, 4},
+		{"bytes 1 1", &BitRange{Start: 1, End: 1}, 6},
+		{"negative", &BitRange{Start: -2, End: -1}, 7},
+		{"bits", &BitRange{Start: 5, End: 30, Bits: true}, 17},
+		{"out of range", &BitRange{Start: 10, End: 20}, 0},
+		{"reversed", &BitRange{Start: 3, End: 1}, 0},
+	}
+	for _, tt := range counts {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := db.BitCount(key, tt.r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, count)
+		})
+	}
+
+	assert.NoError(t, db.Set([]byte("p"), []byte{0xff, 0xf0, 0x00}))
+	positions := []struct {
+		name string
+		bit  int
+		r    *BitRange
+		want int64
+	}{
+		{"first 0", 0, nil, 12},
+		{"first 1", 1, nil, 0},
+		{"1 from byte", 1, &BitRange{Start: 2, End: -1}, -1},
+		{"0 from byte", 0, &BitRange{Start: 1, End: -1}, 12},
+		{"1 in bits", 1, &BitRange{Start: 9, End: 15, Bits: true}, 9},
+		{"0 in bits", 0, &BitRange{Start: 2, End: 11, Bits: true}, -1},
+	}
+	for _, tt := range positions {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, err := db.BitPos([]byte("p"), tt.bit, tt.r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, pos)
+		})
+	}
+
+	// clear bits beyond the end of the string are found only without range
+	assert.NoError(t, db.Set([]byte("ones"), []byte{0xff, 0xff}))
+	pos, _ := db.BitPos([]byte("ones"), 0, nil)
+	assert.Equal(t, int64(16), pos)
+	pos, _ = db.BitPos([]byte("ones"), 0, &BitRange{Start: 0, End: -1})
+	assert.Equal(t, int64(-1), pos)
+	pos, _ = db.BitPos([]byte("missing"), 0, nil)
+	assert.Equal(t, int64(0), pos)
+	pos, _ = db.BitPos([]byte("missing"), 1, nil)
+	assert.Equal(t, int64(-1), pos)
+}
+
+func TestLazyDB_BitOp(t *testing.T) {
+	db := initTestBitmapDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.Set([]byte("a"), []byte{0xf0, 0x0f})
+	_ = db.Set([]byte("b"), []byte{0x3c})
+
+	tests := []struct {
+		name string
+		op   BitOperation
+		keys []string
+		want []byte
+	}{
+		{"and", BitAnd, []string{"a", "b"}, []byte{0x30, 0x00}},
+		{"or", BitOr, []string{"a", "b"}, []byte{0xfc, 0x0f}},
+		{"xor", BitXor, []string{"a", "b"}, []byte{0xcc, 0x0f}},
+		{"not", BitNot, []string{"a"}, []byte{0x0f, 0xf0}},
+		{"missing", BitOr, []string{"b", "missing"}, []byte{0x3c}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := make([][]byte, len(tt.keys))
+			for i, k := range tt.keys {
+				keys[i] = []byte(k)
+			}
+			n, err := db.BitOp(tt.op, []byte("dst"), keys...)
+			assert.NoError(t, err)
+			assert.Equal(t, len(tt.want), n)
+			val, err := db.Get([]byte("dst"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, val)
+		})
+	}
+
+	_, err := db.BitOp(BitNot, []byte("dst"), []byte("a"), []byte("b"))
+	assert.Equal(t, ErrBitOpNotSingleSource, err)
+	// an empty result deletes the destination
+	n, err := db.BitOp(BitAnd, []byte("dst"), []byte("missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = db.Get([]byte("dst"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_BitField(t *testing.T) {
+	db := initTestBitmapDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("bf")
+	results, err := db.BitField(key,
+		BitFieldOp{Kind: BitFieldSet, Type: "i8", Offset: 0, Value: -100},
+		BitFieldOp{Kind: BitFieldGet, Type: "i8", Offset: 0},
+		BitFieldOp{Kind: BitFieldGet, Type: "u8", Offset: 0},
+		BitFieldOp{Kind: BitFieldSet, Type: "u4", Offset: 8, Value: 15},
+		BitFieldOp{Kind: BitFieldGet, Type: "u4", Offset: 8},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(0), int64(-100), int64(156), int64(0), int64(15)}, bitFieldValues(results))
+	val, _ := db.Get(key)
+	assert.Equal(t, []byte{0x9c, 0xf0}, val)
+
+	tests := []struct {
+		name string
+		op   BitFieldOp
+		want interface{}
+	}{
+		{"incr", BitFieldOp{Kind: BitFieldIncrBy, Type: "u8", Offset: 16, Value: 200}, int64(200)},
+		{"wrap", BitFieldOp{Kind: BitFieldIncrBy, Type: "u8", Offset: 16, Value: 100}, int64(44)},
+		{"sat", BitFieldOp{Kind: BitFieldIncrBy, Type: "u8", Offset: 16, Value: 300, Overflow: BitFieldSat}, int64(255)},
+		{"fail", BitFieldOp{Kind: BitFieldIncrBy, Type: "u8", Offset: 16, Value: 1, Overflow: BitFieldFail}, nil},
+		{"signed wrap", BitFieldOp{Kind: BitFieldIncrBy, Type: "i8", Offset: 24, Value: 130}, int64(-126)},
+		{"signed sat", BitFieldOp{Kind: BitFieldIncrBy, Type: "i8", Offset: 24, Value: -10, Overflow: BitFieldSat}, int64(-128)},
+		{"set sat", BitFieldOp{Kind: BitFieldSet, Type: "i4", Offset: 32, Value: 100, Overflow: BitFieldSat}, int64(0)},
+		{"get set sat", BitFieldOp{Kind: BitFieldGet, Type: "i4", Offset: 32}, int64(7)},
+		{"set fail", BitFieldOp{Kind: BitFieldSet, Type: "i4", Offset: 32, Value: 8, Overflow: BitFieldFail}, nil},
+		{"i64", BitFieldOp{Kind: BitFieldIncrBy, Type: "i64", Offset: 40, Value: -1}, int64(-1)},
+		{"unaligned", BitFieldOp{Kind: BitFieldSet, Type: "u3", Offset: 3, Value: 5}, int64(7)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := db.BitField(key, tt.op)
+			assert.NoError(t, err)
+			assert.Equal(t, []interface{}{tt.want}, bitFieldValues(results))
+		})
+	}
+
+	_, err = db.BitField(key, BitFieldOp{Type: "u64"})
+	assert.Equal(t, ErrInvalidBitFieldType, err)
+	_, err = db.BitField(key, BitFieldOp{Type: "x8"})
+	assert.Equal(t, ErrInvalidBitFieldType, err)
+	_, err = db.BitField(key, BitFieldOp{Type: "u8", Offset: -1})
+	assert.Equal(t, ErrBitOffsetOutOfRange, err)
+
+	// reads beyond the end do not grow the string
+	results, err = db.BitField([]byte("empty"), BitFieldOp{Kind: BitFieldGet, Type: "u8", Offset: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(0)}, bitFieldValues(results))
+	_, err = db.Get([]byte("empty"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_SetBit_Pages(t *testing.T) {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_bitmap")
+	cfg := DefaultDBConfig(path)
+	cfg.MaxLogFileSize = 64 << 10
+	db, err := Open(cfg)
+	assert.NoError(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	key := []byte("dau")
+	model := make([]byte, 1<<20)
+	setModel := func(offset int64, bit int) {
+		if bit == 1 {
+			model[offset>>3] |= 0x80 >> (offset & 7)
+		} else {
+			model[offset>>3] &^= 0x80 >> (offset & 7)
+		}
+	}
+	_, err = db.SetBit(key, int64(len(model))*8-1, 1)
+	assert.NoError(t, err)
+	setModel(int64(len(model))*8-1, 1)
+
+	// a bit write of a large bitmap appends only the page it changes
+	lf := db.getActiveLogFile(valueTypeString).lf
+	offset := lf.Offset
+	_, err = db.SetBit(key, 12345, 1)
+	assert.NoError(t, err)
+	setModel(12345, 1)
+	assert.Less(t, lf.Offset-offset, int64(bitmapPageSize))
+
+	r := rand.New(rand.NewSource(45))
+	for i := 0; i < 500; i++ {
+		offset, bit := r.Int63n(int64(len(model))*8), r.Intn(2)
+		_, err := db.SetBit(key, offset, bit)
+		assert.NoError(t, err)
+		setModel(offset, bit)
+	}
+	_, err = db.BitField(key, BitFieldOp{Kind: BitFieldSet, Type: "u32", Offset: 4096*8 - 16, Value: 0xdeadbeef})
+	assert.NoError(t, err)
+	for i, b := range []byte{0xde, 0xad, 0xbe, 0xef} {
+		model[4096-2+i] = b
+	}
+
+	check := func() {
+		val, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, model, val)
+		assert.Equal(t, len(model), db.StrLen(key))
+		part, err := db.GetRange(key, 4000, 5000)
+		assert.NoError(t, err)
+		assert.Equal(t, model[4000:5001], part)
+		res, err := db.BitField(key, BitFieldOp{Kind: BitFieldGet, Type: "u32", Offset: 4096*8 - 16})
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{int64(0xdeadbeef)}, bitFieldValues(res))
+	}
+	check()
+
+	for _, fid := range db.fidsMap[valueTypeString].fids {
+		assert.NoError(t, db.Merge(valueTypeString, fid, 0.1))
+	}
+	check()
+	assert.NoError(t, db.Close())
+	db, err = Open(cfg)
+	assert.NoError(t, err)
+	check()
+
+	// the ttl is kept by the header
+	assert.NoError(t, db.Expire(key, time.Hour))
+	_, err = db.SetBit(key, 7, 1)
+	assert.NoError(t, err)
+	setModel(7, 1)
+	ttl, err := db.TTL(key)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+	check()
+
+	// a plain string drops the pages, and is converted by the next bit write
+	assert.NoError(t, db.Set(key, []byte("plain")))
+	assert.Nil(t, db.strIndex.bitmaps[string(key)])
+	_, err = db.SetBit(key, 0, 1)
+	assert.NoError(t, err)
+	val, _ := db.Get(key)
+	assert.Equal(t, []byte("\xf0lain"), val)
+	assert.NoError(t, db.Close())
+	db, err = Open(cfg)
+	assert.NoError(t, err)
+	val, _ = db.Get(key)
+	assert.Equal(t, []byte("\xf0lain"), val)
+
+	assert.NoError(t, db.Delete(key))
+	assert.Nil(t, db.strIndex.bitmaps[string(key)])
+	assert.NoError(t, db.Close())
+	db, err = Open(cfg)
+	assert.NoError(t, err)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Empty(t, db.strIndex.bitmaps)
+}
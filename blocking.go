@@ -0,0 +1,205 @@
+package lazydb
+
+import (
+	"context"
+	"time"
+
+	"lazydb/ds"
+)
+
+// The blocking pops wait until one of the given lists has an element, or the timeout or context ends.
+// Waiters are queued per key in arrival order under the list index lock, and every command that pushes
+// onto a list serves the queue of that list before releasing the lock, so the oldest waiter gets
+// the first element and no element is left behind while someone waits for it.
+
+// listWaiter is a client blocked on keys.
+type listWaiter struct {
+	keys    [][]byte
+	isLeft  bool
+	dst     []byte // the destination of BLMove, nil for the pops
+	dstLeft bool
+	result  chan *listPopResult
+}
+
+type listPopResult struct {
+	key   []byte
+	value []byte
+	err   error
+}
+
+// BLPop pops the first element of the first non-empty list of keys, waiting for one if they are all empty.
+// It returns the key of the list and the element, or nil if timeout passes. A zero timeout waits forever.
+func (db *LazyDB) BLPop(timeout time.Duration, keys ...[]byte) ([]byte, []byte, error) {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	return ignoreDeadline(db.blockingPop(ctx, keys, true, nil, false))
+}
+
+// BLPopContext is the same as BLPop, but it waits until ctx is done and returns its error.
+func (db *LazyDB) BLPopContext(ctx context.Context, keys ...[]byte) ([]byte, []byte, error) {
+	return db.blockingPop(ctx, keys, true, nil, false)
+}
+
+// BRPop pops the last element of the first non-empty list of keys, waiting for one if they are all empty.
+// It returns the key of the list and the element, or nil if timeout passes. A zero timeout waits forever.
+func (db *LazyDB) BRPop(timeout time.Duration, keys ...[]byte) ([]byte, []byte, error) {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	return ignoreDeadline(db.blockingPop(ctx, keys, false, nil, false))
+}
+
+// BRPopContext is the same as BRPop, but it waits until ctx is done and returns its error.
+func (db *LazyDB) BRPopContext(ctx context.Context, keys ...[]byte) ([]byte, []byte, error) {
+	return db.blockingPop(ctx, keys, false, nil, false)
+}
+
+// BLMove is the same as LMove, but it waits for an element if the source list is empty.
+// It returns nil if timeout passes. A zero timeout waits forever.
+func (db *LazyDB) BLMove(sourceKey, distKey []byte, sourceIsLeft, distIsLeft bool, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	_, val, err := ignoreDeadline(db.blockingPop(ctx, [][]byte{sourceKey}, sourceIsLeft, distKey, distIsLeft))
+	return val, err
+}
+
+// BLMoveContext is the same as BLMove, but it waits until ctx is done and returns its error.
+func (db *LazyDB) BLMoveContext(ctx context.Context, sourceKey, distKey []byte, sourceIsLeft, distIsLeft bool) ([]byte, error) {
+	_, val, err := db.blockingPop(ctx, [][]byte{sourceKey}, sourceIsLeft, distKey, distIsLeft)
+	return val, err
+}
+
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func ignoreDeadline(key, val []byte, err error) ([]byte, []byte, error) {
+	if err == context.DeadlineExceeded {
+		return nil, nil, nil
+	}
+	return key, val, err
+}
+
+func (db *LazyDB) blockingPop(ctx context.Context, keys [][]byte, isLeft bool, dst []byte, dstLeft bool) ([]byte, []byte, error) {
+	w := &listWaiter{keys: keys, isLeft: isLeft, dst: dst, dstLeft: dstLeft, result: make(chan *listPopResult, 1)}
+
+	db.listIndex.mu.Lock()
+	if db.IsClosed() {
+		db.listIndex.mu.Unlock()
+		return nil, nil, ErrDatabaseClosed
+	}
+	for _, key := range keys {
+		if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+			db.listIndex.mu.Unlock()
+			return nil, nil, err
+		}
+	}
+	for _, key := range keys {
+		// earlier waiters of key are served first, in case an element was added without serving them.
+		db.serveListWaiters(key)
+		if db.listIndex.trees[string(key)] != nil {
+			db.serveListWaiter(w, key)
+			db.listIndex.mu.Unlock()
+			res := <-w.result
+			return res.key, res.value, res.err
+		}
+	}
+	for _, key := range keys {
+		db.listIndex.waiters[string(key)] = append(db.listIndex.waiters[string(key)], w)
+	}
+	db.listIndex.mu.Unlock()
+
+	select {
+	case res := <-w.result:
+		return res.key, res.value, res.err
+	case <-ctx.Done():
+	}
+
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	// the waiter may have been served before the lock is taken
+	select {
+	case res := <-w.result:
+		return res.key, res.value, res.err
+	default:
+	}
+	db.removeListWaiter(w)
+	return nil, nil, ctx.Err()
+}
+
+// serveListWaiters hands the elements of the list stored at key to its waiters in arrival order.
+// It is called by every command pushing onto a list. The caller must hold the lock.
+func (db *LazyDB) serveListWaiters(key []byte) {
+	for len(db.listIndex.waiters[string(key)]) > 0 && db.listIndex.trees[string(key)] != nil {
+		w := db.listIndex.waiters[string(key)][0]
+		db.removeListWaiter(w)
+		db.serveListWaiter(w, key)
+	}
+}
+
+// serveListWaiter pops an element of the list stored at key for w, and moves it to the destination of w if any.
+// The caller must hold the lock, and w must not be queued.
+func (db *LazyDB) serveListWaiter(w *listWaiter, key []byte) {
+	val, err := db.pop(key, w.isLeft)
+	if err != nil || val == nil {
+		w.result <- &listPopResult{err: err}
+		return
+	}
+	db.notifyPop(key, w.isLeft)
+	if w.dst != nil {
+		if db.listIndex.trees[string(w.dst)] == nil {
+			db.indexCollectionKey(valueTypeList, w.dst)
+			db.listIndex.trees[string(w.dst)] = ds.NewART()
+		}
+		if err := db.push(w.dst, val, w.dstLeft); err != nil {
+			w.result <- &listPopResult{err: err}
+			return
+		}
+		if w.dstLeft {
+			db.notifyKeyspaceEvent(notifyList, "lpush", w.dst)
+		} else {
+			db.notifyKeyspaceEvent(notifyList, "rpush", w.dst)
+		}
+	}
+	w.result <- &listPopResult{key: key, value: val}
+	if w.dst != nil {
+		db.serveListWaiters(w.dst)
+	}
+}
+
+// removeListWaiter removes w from the queues of all its keys. The caller must hold the lock.
+func (db *LazyDB) removeListWaiter(w *listWaiter) {
+	for _, key := range w.keys {
+		queue := db.listIndex.waiters[string(key)]
+		for i, other := range queue {
+			if other == w {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(db.listIndex.waiters, string(key))
+		} else {
+			db.listIndex.waiters[string(key)] = queue
+		}
+	}
+}
+
+// cancelListWaiters wakes all waiters with ErrDatabaseClosed.
+func (db *LazyDB) cancelListWaiters() {
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	// a waiter on several keys is in several queues
+	waiters := make(map[*listWaiter]struct{})
+	for _, queue := range db.listIndex.waiters {
+		for _, w := range queue {
+			waiters[w] = struct{}{}
+		}
+	}
+	db.listIndex.waiters = make(map[string][]*listWaiter)
+	for w := range waiters {
+		w.result <- &listPopResult{err: ErrDatabaseClosed}
+	}
+}
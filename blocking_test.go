@@ -0,0 +1,165 @@
+package lazydb
+
+import (
+	"context"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestBlockingDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_blocking")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+type popResult struct {
+	key, val []byte
+	err      error
+}
+
+// waitBlocked waits until n clients are blocked on key.
+func waitBlocked(t *testing.T, db *LazyDB, key string, n int) {
+	assert.Eventually(t, func() bool {
+		db.listIndex.mu.RLock()
+		defer db.listIndex.mu.RUnlock()
+		return len(db.listIndex.waiters[key]) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestLazyDB_BLPop(t *testing.T) {
+	db := initTestBlockingDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// an element is already there
+	_ = db.RPush([]byte("l2"), []byte("a"), []byte("b"))
+	key, val, err := db.BLPop(time.Second, []byte("l1"), []byte("l2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("l2"), key)
+	assert.Equal(t, []byte("a"), val)
+	key, val, err = db.BRPop(time.Second, []byte("l2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("l2"), key)
+	assert.Equal(t, []byte("b"), val)
+
+	// timeout
+	start := time.Now()
+	key, val, err = db.BLPop(50*time.Millisecond, []byte("l1"))
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+	assert.Nil(t, val)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	waitBlocked(t, db, "l1", 0)
+
+	// woken by a push onto any watched key
+	done := make(chan popResult)
+	go func() {
+		key, val, err := db.BLPop(0, []byte("l1"), []byte("l3"))
+		done <- popResult{key, val, err}
+	}()
+	waitBlocked(t, db, "l3", 1)
+	_ = db.LPush([]byte("l3"), []byte("c"))
+	res := <-done
+	assert.NoError(t, res.err)
+	assert.Equal(t, []byte("l3"), res.key)
+	assert.Equal(t, []byte("c"), res.val)
+	assert.Equal(t, 0, db.LLen([]byte("l3")))
+	waitBlocked(t, db, "l1", 0)
+
+	// context
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		key, val, err := db.BRPopContext(ctx, []byte("l1"))
+		done <- popResult{key, val, err}
+	}()
+	waitBlocked(t, db, "l1", 1)
+	cancel()
+	res = <-done
+	assert.Equal(t, context.Canceled, res.err)
+	assert.Nil(t, res.val)
+}
+
+func TestLazyDB_BLPop_FIFO(t *testing.T) {
+	db := initTestBlockingDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	results := make([]chan popResult, 3)
+	for i := range results {
+		results[i] = make(chan popResult, 1)
+		go func(ch chan popResult) {
+			key, val, err := db.BLPop(0, []byte("queue"))
+			ch <- popResult{key, val, err}
+		}(results[i])
+		waitBlocked(t, db, "queue", i+1)
+	}
+
+	_ = db.RPush([]byte("queue"), []byte("j1"), []byte("j2"))
+	assert.Equal(t, []byte("j1"), (<-results[0]).val)
+	assert.Equal(t, []byte("j2"), (<-results[1]).val)
+	waitBlocked(t, db, "queue", 1)
+	_ = db.RPush([]byte("queue"), []byte("j3"))
+	assert.Equal(t, []byte("j3"), (<-results[2]).val)
+	assert.Equal(t, 0, db.LLen([]byte("queue")))
+}
+
+func TestLazyDB_BLMove(t *testing.T) {
+	db := initTestBlockingDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	done := make(chan popResult)
+	go func() {
+		val, err := db.BLMove([]byte("src"), []byte("dst"), true, false, time.Second)
+		done <- popResult{nil, val, err}
+	}()
+	// a pop waiting on the destination is served by the move
+	go func() {
+		key, val, err := db.BRPop(time.Second, []byte("dst"))
+		done <- popResult{key, val, err}
+	}()
+	waitBlocked(t, db, "src", 1)
+	waitBlocked(t, db, "dst", 1)
+
+	_ = db.RPush([]byte("src"), []byte("a"))
+	first, second := <-done, <-done
+	if first.key != nil {
+		first, second = second, first
+	}
+	assert.NoError(t, first.err)
+	assert.Equal(t, []byte("a"), first.val)
+	assert.NoError(t, second.err)
+	assert.Equal(t, []byte("dst"), second.key)
+	assert.Equal(t, []byte("a"), second.val)
+	assert.Equal(t, 0, db.LLen([]byte("src")))
+	assert.Equal(t, 0, db.LLen([]byte("dst")))
+
+	val, err := db.BLMove([]byte("src"), []byte("dst"), true, false, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+}
+
+func TestLazyDB_BLPop_Close(t *testing.T) {
+	db := initTestBlockingDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := db.BLPop(0, []byte("l1"), []byte("l2"))
+		done <- err
+	}()
+	waitBlocked(t, db, "l2", 1)
+	db.cancelListWaiters()
+	assert.Equal(t, ErrDatabaseClosed, <-done)
+}
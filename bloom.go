@@ -0,0 +1,268 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrInvalidFilter = errors.New("value is not a valid filter")
+	ErrFilterExists  = errors.New("filter already exists")
+	ErrFilterFull    = errors.New("filter is full")
+)
+
+// Bloom filters are stored as string values, they are scalable: when the last sub filter holds its capacity,
+// a new one is added with expansion times of the capacity and half of the error rate, so the compound
+// error rate stays below the one reserved. The header holds the magic "LZBF", the error rate, the expansion,
+// the non scaling flag and the number of sub filters, followed by them in little endian.
+const (
+	bfDefaultErrorRate = 0.01
+	bfDefaultCapacity  = 100
+	bfDefaultExpansion = 2
+	bfTightening       = 0.5
+	bfSeed             = 0xc6a4a7935bd1e995
+
+	// maxFilterSize is the max size of a filter in bytes.
+	maxFilterSize = 512 << 20
+)
+
+var bfMagic = []byte("LZBF")
+
+// BFReserveArgs are the arguments of BFReserve, Expansion is 2 by default.
+// A non scaling filter returns ErrFilterFull instead of adding a sub filter.
+type BFReserveArgs struct {
+	ErrorRate  float64
+	Capacity   uint64
+	Expansion  uint32
+	NonScaling bool
+}
+
+type bloomFilter struct {
+	errorRate  float64
+	expansion  uint32
+	nonScaling bool
+	subs       []*bloomSub
+}
+
+type bloomSub struct {
+	capacity uint64
+	count    uint64
+	hashes   uint32
+	bits     uint64
+	data     []byte
+}
+
+// BFReserve creates an empty Bloom filter at key, which must not exist.
+func (db *LazyDB) BFReserve(key []byte, args BFReserveArgs) error {
+	if args.ErrorRate <= 0 || args.ErrorRate >= 1 || args.Capacity == 0 {
+		return ErrInvalidParam
+	}
+	if args.Expansion == 0 {
+		args.Expansion = bfDefaultExpansion
+	}
+	bf := &bloomFilter{errorRate: args.ErrorRate, expansion: args.Expansion, nonScaling: args.NonScaling}
+	if err := bf.grow(args.Capacity); err != nil {
+		return err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, _, err := db.strValue(key)
+	if err != nil {
+		return err
+	}
+	if val != nil {
+		return ErrFilterExists
+	}
+	if err := db.setEX(key, bf.encode(), 0); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyString, "bf.reserve", key)
+	return nil
+}
+
+// BFAdd adds item to the Bloom filter at key, which is created with the default error rate 0.01
+// and capacity 100 if it does not exist. It reports whether item was not in the filter.
+func (db *LazyDB) BFAdd(key, item []byte) (bool, error) {
+	added, err := db.BFMAdd(key, item)
+	if err != nil {
+		return false, err
+	}
+	return added[0], nil
+}
+
+// BFMAdd is the same as BFAdd but adds many items at once.
+func (db *LazyDB) BFMAdd(key []byte, items ...[]byte) ([]bool, error) {
+	if len(items) == 0 {
+		return nil, ErrInvalidParam
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, expiredAt, err := db.strValue(key)
+	if err != nil {
+		return nil, err
+	}
+	var bf *bloomFilter
+	if val == nil {
+		bf = &bloomFilter{errorRate: bfDefaultErrorRate, expansion: bfDefaultExpansion}
+		if err := bf.grow(bfDefaultCapacity); err != nil {
+			return nil, err
+		}
+	} else if bf, err = decodeBloomFilter(val); err != nil {
+		return nil, err
+	}
+
+	added := make([]bool, len(items))
+	changed := val == nil
+	for i, item := range items {
+		if added[i], err = bf.add(item); err != nil {
+			return nil, err
+		}
+		changed = changed || added[i]
+	}
+	if !changed {
+		return added, nil
+	}
+	if err := db.setEX(key, bf.encode(), expiredAt); err != nil {
+		return nil, err
+	}
+	db.notifyKeyspaceEvent(notifyString, "bf.add", key)
+	return added, nil
+}
+
+// BFExists reports whether item may be in the Bloom filter at key, false positives are bounded by its error rate.
+func (db *LazyDB) BFExists(key, item []byte) (bool, error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	val, _, err := db.strValue(key)
+	if err != nil || val == nil {
+		return false, err
+	}
+	bf, err := decodeBloomFilter(val)
+	if err != nil {
+		return false, err
+	}
+	return bf.exists(bloomHash(item)), nil
+}
+
+// grow adds a sub filter of capacity with the error rate of its position.
+func (bf *bloomFilter) grow(capacity uint64) error {
+	errorRate := bf.errorRate * math.Pow(bfTightening, float64(len(bf.subs)+1))
+	bitsPerEntry := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	bits := math.Ceil(float64(capacity) * bitsPerEntry)
+	if bits > maxFilterSize*8 {
+		return ErrInvalidParam
+	}
+	size := (uint64(bits) + 7) / 8
+	bf.subs = append(bf.subs, &bloomSub{
+		capacity: capacity,
+		hashes:   uint32(math.Ceil(math.Ln2 * bitsPerEntry)),
+		bits:     size * 8,
+		data:     make([]byte, size),
+	})
+	return nil
+}
+
+func (bf *bloomFilter) add(item []byte) (bool, error) {
+	h1, h2 := bloomHash(item)
+	if bf.exists(h1, h2) {
+		return false, nil
+	}
+	last := bf.subs[len(bf.subs)-1]
+	if last.count >= last.capacity {
+		if bf.nonScaling {
+			return false, ErrFilterFull
+		}
+		if err := bf.grow(last.capacity * uint64(bf.expansion)); err != nil {
+			return false, ErrFilterFull
+		}
+		last = bf.subs[len(bf.subs)-1]
+	}
+	for i := uint64(0); i < uint64(last.hashes); i++ {
+		pos := (h1 + i*h2) % last.bits
+		last.data[pos>>3] |= 1 << (pos & 7)
+	}
+	last.count++
+	return true, nil
+}
+
+func (bf *bloomFilter) exists(h1, h2 uint64) bool {
+	for _, sub := range bf.subs {
+		found := true
+		for i := uint64(0); i < uint64(sub.hashes) && found; i++ {
+			pos := (h1 + i*h2) % sub.bits
+			found = sub.data[pos>>3]&(1<<(pos&7)) != 0
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// bloomHash returns the two hashes of item, whose combinations are the positions of its bits.
+func bloomHash(item []byte) (uint64, uint64) {
+	h1 := murmurHash64A(item, bfSeed)
+	return h1, murmurHash64A(item, h1)
+}
+
+func (bf *bloomFilter) encode() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, bfMagic...))
+	var flags uint8
+	if bf.nonScaling {
+		flags = 1
+	}
+	binary.Write(buf, binary.LittleEndian, bf.errorRate)
+	binary.Write(buf, binary.LittleEndian, bf.expansion)
+	binary.Write(buf, binary.LittleEndian, flags)
+	binary.Write(buf, binary.LittleEndian, uint32(len(bf.subs)))
+	for _, sub := range bf.subs {
+		binary.Write(buf, binary.LittleEndian, sub.capacity)
+		binary.Write(buf, binary.LittleEndian, sub.count)
+		binary.Write(buf, binary.LittleEndian, sub.hashes)
+		binary.Write(buf, binary.LittleEndian, sub.bits)
+		buf.Write(sub.data)
+	}
+	return buf.Bytes()
+}
+
+func decodeBloomFilter(val []byte) (*bloomFilter, error) {
+	if !bytes.HasPrefix(val, bfMagic) {
+		return nil, ErrInvalidFilter
+	}
+	r := bytes.NewReader(val[len(bfMagic):])
+	bf := &bloomFilter{}
+	var flags uint8
+	var n uint32
+	for _, v := range []interface{}{&bf.errorRate, &bf.expansion, &flags, &n} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, ErrInvalidFilter
+		}
+	}
+	bf.nonScaling = flags&1 != 0
+	if n == 0 {
+		return nil, ErrInvalidFilter
+	}
+	for i := uint32(0); i < n; i++ {
+		sub := &bloomSub{}
+		for _, v := range []interface{}{&sub.capacity, &sub.count, &sub.hashes, &sub.bits} {
+			if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+				return nil, ErrInvalidFilter
+			}
+		}
+		if sub.bits == 0 || sub.bits&7 != 0 || sub.bits/8 > uint64(r.Len()) {
+			return nil, ErrInvalidFilter
+		}
+		sub.data = make([]byte, sub.bits/8)
+		r.Read(sub.data)
+		bf.subs = append(bf.subs, sub)
+	}
+	if r.Len() != 0 {
+		return nil, ErrInvalidFilter
+	}
+	return bf, nil
+}
@@ -0,0 +1,117 @@
+package lazydb
+
+import (
+	"fmt"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestFilterDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_filter")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func TestLazyDB_BFAdd_BFExists(t *testing.T) {
+	db := initTestFilterDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("seen")
+	added, err := db.BFAdd(key, []byte("a"))
+	assert.NoError(t, err)
+	assert.True(t, added)
+	added, err = db.BFAdd(key, []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	results, err := db.BFMAdd(key, []byte("a"), []byte("b"), []byte("c"), []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true, false}, results)
+	for _, item := range []string{"a", "b", "c"} {
+		ok, err := db.BFExists(key, []byte(item))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, err := db.BFExists([]byte("missing"), []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_ = db.Set([]byte("str"), []byte("plain"))
+	_, err = db.BFAdd([]byte("str"), []byte("a"))
+	assert.Equal(t, ErrInvalidFilter, err)
+	_, err = db.BFExists([]byte("str"), []byte("a"))
+	assert.Equal(t, ErrInvalidFilter, err)
+	_, err = db.BFMAdd(key)
+	assert.Equal(t, ErrInvalidParam, err)
+
+	// the ttl is kept
+	assert.NoError(t, db.Expire(key, time.Hour))
+	_, _ = db.BFAdd(key, []byte("d"))
+	ttl, _ := db.TTL(key)
+	assert.True(t, ttl > 0)
+}
+
+func TestLazyDB_BFReserve(t *testing.T) {
+	db := initTestFilterDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("bf")
+	assert.NoError(t, db.BFReserve(key, BFReserveArgs{ErrorRate: 0.001, Capacity: 1000}))
+	assert.Equal(t, ErrFilterExists, db.BFReserve(key, BFReserveArgs{ErrorRate: 0.001, Capacity: 1000}))
+	assert.Equal(t, ErrInvalidParam, db.BFReserve([]byte("x"), BFReserveArgs{ErrorRate: 1, Capacity: 1000}))
+	assert.Equal(t, ErrInvalidParam, db.BFReserve([]byte("x"), BFReserveArgs{ErrorRate: 0.1}))
+	assert.Equal(t, ErrInvalidParam, db.BFReserve([]byte("x"), BFReserveArgs{ErrorRate: 0.1, Capacity: 1 << 40}))
+
+	assert.NoError(t, db.BFReserve([]byte("fixed"), BFReserveArgs{ErrorRate: 0.01, Capacity: 10, NonScaling: true}))
+	for i := 0; i < 10; i++ {
+		_, err := db.BFAdd([]byte("fixed"), []byte(fmt.Sprintf("item%d", i)))
+		assert.NoError(t, err)
+	}
+	_, err := db.BFAdd([]byte("fixed"), []byte("one more"))
+	assert.Equal(t, ErrFilterFull, err)
+}
+
+func TestLazyDB_BF_ErrorRate(t *testing.T) {
+	db := initTestFilterDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// the filter scales far beyond the reserved capacity
+	key := []byte("scaling")
+	assert.NoError(t, db.BFReserve(key, BFReserveArgs{ErrorRate: 0.01, Capacity: 1000}))
+	var items [][]byte
+	for i := 0; i < 10000; i++ {
+		items = append(items, []byte(fmt.Sprintf("member-%d", i)))
+	}
+	for i := 0; i < len(items); i += 500 {
+		_, err := db.BFMAdd(key, items[i:i+500]...)
+		assert.NoError(t, err)
+	}
+	val, _ := db.Get(key)
+	bf, err := decodeBloomFilter(val)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(bf.subs))
+
+	for _, item := range items {
+		assert.True(t, bf.exists(bloomHash(item)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.exists(bloomHash([]byte(fmt.Sprintf("other-%d", i)))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 150, falsePositives)
+}
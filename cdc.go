@@ -0,0 +1,290 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"lazydb/logfile"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrSubscriptionClosed       = errors.New("subscription is closed")
+	ErrSubscriptionDisconnected = errors.New("subscription is disconnected because it can not keep up")
+)
+
+const defaultSubscriptionBufferSize = 1024
+
+// ChangeOp is the kind of mutation described by a ChangeEvent.
+type ChangeOp uint8
+
+const (
+	// OpPut a key or a sub key is inserted or updated.
+	OpPut ChangeOp = iota + 1
+	// OpDelete a key or a sub key is deleted.
+	OpDelete
+	// OpExpire the ttl of a collection key is set, or removed if ExpiredAt is 0.
+	// The ttl of strings and json documents is carried by OpPut instead.
+	OpExpire
+)
+
+// BackpressurePolicy decides what happens when the buffer of a subscription is full.
+type BackpressurePolicy uint8
+
+const (
+	// PolicyDisconnect closes the subscription, it is the default.
+	PolicyDisconnect BackpressurePolicy = iota
+	// PolicyDrop drops the event, the number of dropped events is reported by Subscription.Dropped.
+	PolicyDrop
+	// PolicyBlock blocks the writer until the subscriber catches up.
+	// Events are published while the writer holds the lock of the index, so a subscriber with PolicyBlock
+	// must not read or write the db while it handles events, or the db deadlocks once the buffer is full.
+	PolicyBlock
+)
+
+// ChangeEvent describes a mutation that has been written to the log file and applied to the index.
+type ChangeEvent struct {
+	Type DataType
+	Key  []byte
+	// SubKey is the field of a hash, the member of a set or a sorted set,
+	// the little endian sequence of a list element, or the internal sub key of a stream or a time series,
+	// whose first byte tells what it holds, like an entry, a consumer group or a sample.
+	// It is nil for strings and json documents.
+	SubKey []byte
+	Op     ChangeOp
+	// Value is the new value, the score of a sorted set member is encoded by util.Float64ToByte.
+	Value []byte
+	// ExpiredAt is the unix time in seconds when the value expires, 0 means no expiration.
+	ExpiredAt int64
+	// TxID is the id of the transaction that committed the change, 0 if it is not written by a transaction.
+	TxID uint64
+}
+
+// ChangeFilter selects the events a subscription receives.
+type ChangeFilter struct {
+	// Types of data to receive, all types are received if it is empty.
+	Types []DataType
+	// KeyPrefix only receives events whose key starts with it.
+	KeyPrefix []byte
+	// Policy applies when the buffer is full, default PolicyDisconnect.
+	Policy BackpressurePolicy
+	// BufferSize is the capacity of the event channel, default 1024.
+	BufferSize int
+}
+
+// Subscription receives change events until it is closed.
+type Subscription struct {
+	id      uint64
+	filter  ChangeFilter
+	types   map[DataType]struct{}
+	ch      chan *ChangeEvent
+	done    chan struct{}
+	once    sync.Once
+	hub     *changeHub
+	dropped uint64
+	err     atomic.Value
+}
+
+type changeHub struct {
+	mu     sync.RWMutex
+	subs   map[uint64]*Subscription
+	nextID uint64
+	count  int32
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{subs: make(map[uint64]*Subscription)}
+}
+
+// Subscribe returns a subscription that receives every mutation matched by filter.
+// Events are delivered in the order they are applied for a single data type.
+func (db *LazyDB) Subscribe(filter ChangeFilter) *Subscription {
+	if filter.BufferSize <= 0 {
+		filter.BufferSize = defaultSubscriptionBufferSize
+	}
+	sub := &Subscription{
+		filter: filter,
+		ch:     make(chan *ChangeEvent, filter.BufferSize),
+		done:   make(chan struct{}),
+		hub:    db.changes,
+	}
+	if len(filter.Types) > 0 {
+		sub.types = make(map[DataType]struct{})
+		for _, typ := range filter.Types {
+			sub.types[typ] = struct{}{}
+		}
+	}
+	db.changes.add(sub)
+	return sub
+}
+
+// Events returns the channel of change events, it is closed when the subscription is closed.
+func (s *Subscription) Events() <-chan *ChangeEvent {
+	return s.ch
+}
+
+// Dropped returns the number of events dropped by PolicyDrop.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Err returns why the subscription was closed, nil if it is still open.
+func (s *Subscription) Err() error {
+	if err, ok := s.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Close stops the subscription and closes the event channel.
+func (s *Subscription) Close() {
+	s.closeWith(ErrSubscriptionClosed)
+	s.hub.remove(s)
+}
+
+func (s *Subscription) closeWith(err error) {
+	s.once.Do(func() {
+		s.err.Store(err)
+		close(s.done)
+	})
+}
+
+func (s *Subscription) match(ev *ChangeEvent) bool {
+	if s.types != nil {
+		if _, ok := s.types[ev.Type]; !ok {
+			return false
+		}
+	}
+	return bytes.HasPrefix(ev.Key, s.filter.KeyPrefix)
+}
+
+// send delivers ev according to the backpressure policy, returns false if the subscriber should be disconnected.
+func (s *Subscription) send(ev *ChangeEvent) bool {
+	switch s.filter.Policy {
+	case PolicyDrop:
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case PolicyBlock:
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		}
+	default:
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (h *changeHub) add(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	sub.id = h.nextID
+	h.subs[sub.id] = sub
+	atomic.AddInt32(&h.count, 1)
+}
+
+// remove unregisters sub and closes its channel.
+// Senders hold the read lock, so the channel is never closed while it is being written.
+func (h *changeHub) remove(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub.id]; !ok {
+		return
+	}
+	delete(h.subs, sub.id)
+	atomic.AddInt32(&h.count, -1)
+	close(sub.ch)
+}
+
+func (h *changeHub) active() bool {
+	return h != nil && atomic.LoadInt32(&h.count) > 0
+}
+
+func (h *changeHub) publish(ev *ChangeEvent) {
+	var slow []*Subscription
+	h.mu.RLock()
+	for _, sub := range h.subs {
+		if !sub.match(ev) {
+			continue
+		}
+		if !sub.send(ev) {
+			slow = append(slow, sub)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, sub := range slow {
+		sub.closeWith(ErrSubscriptionDisconnected)
+		h.remove(sub)
+	}
+}
+
+func (h *changeHub) close() {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	subs := make([]*Subscription, 0, len(h.subs))
+	for _, sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	h.mu.RUnlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// notifyChange publishes the entry that has been written and indexed.
+// Entries of set are expected to carry the member as value, and list meta entries are ignored.
+// The pages of bitmaps are ignored too, the bit commands publish the whole string instead.
+func (db *LazyDB) notifyChange(typ valueType, entry *logfile.LogEntry) {
+	if !db.changes.active() || entry.Stat == logfile.SListMeta ||
+		entry.Stat == logfile.SBitmap || entry.Stat == logfile.SBitmapPage {
+		return
+	}
+	ev := &ChangeEvent{
+		Type:      dataTypes[typ],
+		Op:        OpPut,
+		ExpiredAt: entry.ExpiredAt,
+		TxID:      entry.TxID,
+	}
+	if entry.Stat == logfile.SDelete {
+		ev.Op = OpDelete
+	}
+	// key meta entries are keyed by the key itself
+	if entry.Stat == logfile.SKeyMeta {
+		ev.Op, ev.Key = OpExpire, entry.Key
+		db.changes.publish(ev)
+		return
+	}
+	switch typ {
+	case valueTypeString, valueTypeJSON:
+		ev.Key, ev.Value = entry.Key, entry.Value
+	case valueTypeHash, valueTypeZSet, valueTypeStream, valueTypeTimeSeries:
+		ev.Key, ev.SubKey = decodeKey(entry.Key)
+		ev.Value = entry.Value
+	case valueTypeSet:
+		ev.Key, ev.SubKey = entry.Key, entry.Value
+	case valueTypeList:
+		var seq uint32
+		ev.Key, seq = db.decodeListKey(entry.Key)
+		ev.SubKey = make([]byte, 4)
+		binary.LittleEndian.PutUint32(ev.SubKey, seq)
+		ev.Value = entry.Value
+	}
+	if ev.Op == OpDelete {
+		ev.Value = nil
+	}
+	db.changes.publish(ev)
+}
@@ -0,0 +1,194 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveEvents(sub *Subscription, n int) []*ChangeEvent {
+	var events []*ChangeEvent
+	timeout := time.After(time.Second)
+	for len(events) < n {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+		case <-timeout:
+			return events
+		}
+	}
+	return events
+}
+
+func TestLazyDB_Subscribe(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	sub := db.Subscribe(ChangeFilter{})
+	defer sub.Close()
+
+	_ = db.Set([]byte("k1"), []byte("v1"))
+	_ = db.HSet([]byte("h1"), []byte("f1"), []byte("v1"))
+	_ = db.SAdd([]byte("s1"), []byte("m1"))
+	_ = db.ZAdd([]byte("z1"), util.Float64ToByte(1.5), []byte("m1"))
+	_ = db.RPush([]byte("l1"), []byte("v1"))
+	_ = db.Delete([]byte("k1"))
+	_ = db.SRem([]byte("s1"), []byte("m1"))
+
+	events := receiveEvents(sub, 7)
+	assert.Equal(t, 7, len(events))
+	assert.Equal(t, &ChangeEvent{Type: DataTypeString, Key: []byte("k1"), Op: OpPut, Value: []byte("v1")}, events[0])
+	assert.Equal(t, &ChangeEvent{Type: DataTypeHash, Key: []byte("h1"), SubKey: []byte("f1"), Op: OpPut, Value: []byte("v1")}, events[1])
+	assert.Equal(t, &ChangeEvent{Type: DataTypeSet, Key: []byte("s1"), SubKey: []byte("m1"), Op: OpPut}, events[2])
+	assert.Equal(t, &ChangeEvent{Type: DataTypeZSet, Key: []byte("z1"), SubKey: []byte("m1"), Op: OpPut, Value: util.Float64ToByte(1.5)}, events[3])
+	assert.Equal(t, DataTypeList, events[4].Type)
+	assert.Equal(t, []byte("l1"), events[4].Key)
+	assert.Equal(t, []byte("v1"), events[4].Value)
+	assert.Equal(t, &ChangeEvent{Type: DataTypeString, Key: []byte("k1"), Op: OpDelete}, events[5])
+	assert.Equal(t, &ChangeEvent{Type: DataTypeSet, Key: []byte("s1"), SubKey: []byte("m1"), Op: OpDelete}, events[6])
+
+	// deleting a missing key does not produce an event
+	_ = db.Delete([]byte("missing"))
+	assert.Equal(t, 0, len(receiveEventsWithin(sub, 50*time.Millisecond)))
+}
+
+func receiveEventsWithin(sub *Subscription, d time.Duration) []*ChangeEvent {
+	var events []*ChangeEvent
+	timeout := time.After(d)
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+		case <-timeout:
+			return events
+		}
+	}
+}
+
+func TestLazyDB_Subscribe_Filter(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	sub := db.Subscribe(ChangeFilter{Types: []DataType{DataTypeString}, KeyPrefix: []byte("user:")})
+	defer sub.Close()
+
+	_ = db.Set([]byte("user:1"), []byte("v1"))
+	_ = db.Set([]byte("order:1"), []byte("v1"))
+	_ = db.HSet([]byte("user:2"), []byte("f1"), []byte("v1"))
+	_ = db.SetEX([]byte("user:3"), []byte("v3"), time.Hour)
+
+	events := receiveEventsWithin(sub, 50*time.Millisecond)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, []byte("user:1"), events[0].Key)
+	assert.Equal(t, []byte("user:3"), events[1].Key)
+	assert.True(t, events[1].ExpiredAt > time.Now().Unix())
+}
+
+func TestLazyDB_Subscribe_Expire(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.HSet([]byte("h1"), []byte("f1"), []byte("v1"))
+	sub := db.Subscribe(ChangeFilter{})
+	defer sub.Close()
+
+	assert.NoError(t, db.Expire([]byte("h1"), time.Hour))
+	assert.NoError(t, db.Persist([]byte("h1")))
+	events := receiveEvents(sub, 2)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, DataTypeHash, events[0].Type)
+	assert.Equal(t, OpExpire, events[0].Op)
+	assert.Equal(t, []byte("h1"), events[0].Key)
+	assert.Nil(t, events[0].SubKey)
+	assert.True(t, events[0].ExpiredAt > time.Now().Unix())
+	assert.Equal(t, &ChangeEvent{Type: DataTypeHash, Key: []byte("h1"), Op: OpExpire}, events[1])
+}
+
+func TestLazyDB_Subscribe_Policy(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	drop := db.Subscribe(ChangeFilter{Policy: PolicyDrop, BufferSize: 2})
+	defer drop.Close()
+	// a full subscription is disconnected by default
+	disconnect := db.Subscribe(ChangeFilter{BufferSize: 2})
+
+	for i := 0; i < 5; i++ {
+		_ = db.Set(GetKey(i), GetValue32())
+	}
+	assert.Equal(t, uint64(3), drop.Dropped())
+	assert.Equal(t, 2, len(receiveEventsWithin(drop, 50*time.Millisecond)))
+
+	// the channel is closed after the buffered events are consumed
+	assert.Equal(t, 2, len(receiveEvents(disconnect, 5)))
+	assert.Equal(t, ErrSubscriptionDisconnected, disconnect.Err())
+
+	block := db.Subscribe(ChangeFilter{Policy: PolicyBlock, BufferSize: 1})
+	_ = db.Set(GetKey(1), GetValue32())
+	done := make(chan struct{})
+	go func() {
+		_ = db.Set(GetKey(2), GetValue32())
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("writer should be blocked by a full subscription")
+	case <-time.After(50 * time.Millisecond):
+	}
+	block.Close()
+	<-done
+	assert.Equal(t, ErrSubscriptionClosed, block.Err())
+}
+
+func TestTx_Subscribe(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	sub := db.Subscribe(ChangeFilter{})
+	defer sub.Close()
+
+	tx, err := db.Begin(RWTX)
+	assert.NoError(t, err)
+	txID := tx.id
+	tx.Set([]byte("k1"), []byte("v1"))
+	assert.NoError(t, tx.Commit())
+
+	events := receiveEvents(sub, 1)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, txID, events[0].TxID)
+}
+
+func TestTx_Subscribe_WriteError(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	sub := db.Subscribe(ChangeFilter{})
+	defer sub.Close()
+
+	tx, err := db.Begin(RWTX)
+	assert.NoError(t, err)
+	tx.Set([]byte("k1"), []byte("v1"))
+	// the log can not be written once the db becomes read only
+	atomic.StoreInt32(&db.readOnly, 1)
+	assert.Equal(t, ErrReadOnly, tx.Commit())
+	atomic.StoreInt32(&db.readOnly, 0)
+
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, len(receiveEventsWithin(sub, 50*time.Millisecond)))
+}
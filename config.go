@@ -10,6 +10,7 @@ const (
 	defaultMaxLogFileSize       int64          = 512 << 20
 	defaultLogFileMergeInterval time.Duration  = time.Hour * 8
 	defaultIOType               logfile.IOType = logfile.FileIO
+	defaultExpireCycleInterval  time.Duration  = time.Millisecond * 100
 )
 
 type DBConfig struct {
@@ -32,6 +33,21 @@ type DBConfig struct {
 	// The recommended ratio is 0.5, half of the file can be compacted.
 	// Default value is 0.5.
 	LogFileGCRatio float64
+
+	// NotifyKeyspaceEvents enables keyspace notifications with the flags of redis notify-keyspace-events.
+	// K: keyspace events, E: keyevent events, g: generic commands like DEL and EXPIRE,
+	// $: string, l: list, s: set, h: hash, z: sorted set, t: stream, d: json and time series,
+	// x: expired, e: evicted, A: alias of "g$lshztdxe".
+	// Default value is empty, which disables notifications.
+	NotifyKeyspaceEvents string
+
+	// ExpireCycleInterval is the interval of the background cycle that deletes expired keys by sampling,
+	// and requeues the items of queues whose deadline has passed.
+	// Default value is 100ms, a negative value disables it and expired keys are only hidden from reads.
+	ExpireCycleInterval time.Duration
+
+	// ExpireCallback is called after a key is deleted by the expiration cycle, no lock of db is held when it is called.
+	ExpireCallback func(typ DataType, key []byte)
 }
 
 func DefaultDBConfig(path string) DBConfig {
@@ -43,5 +59,6 @@ func DefaultDBConfig(path string) DBConfig {
 		IOType:               defaultIOType,
 		DiscardBufferSize:    8 << 20,
 		LogFileGCRatio:       0.5,
+		ExpireCycleInterval:  defaultExpireCycleInterval,
 	}
 }
@@ -0,0 +1,350 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Cuckoo filters are stored as string values. Every item has a fingerprint of one byte, which is kept
+// in one of its two buckets, the second bucket is the first one xor the hash of the fingerprint, so either
+// bucket can be found from the other one. When an item cannot be placed after moving others around,
+// a sub filter with expansion times of the buckets is added. The header holds the magic "LZCF",
+// the bucket size, the max iterations, the expansion, the number of items and deletes and of sub filters,
+// followed by them in little endian.
+const (
+	cfDefaultCapacity      = 1024
+	cfDefaultBucketSize    = 2
+	cfDefaultMaxIterations = 20
+	cfDefaultExpansion     = 1
+	cfMaxSubFilters        = 32
+	cfSeed                 = 0x5bd1e995
+)
+
+var cfMagic = []byte("LZCF")
+
+// CFReserveArgs are the arguments of CFReserve, BucketSize is 2, MaxIterations 20 and Expansion 1 by default.
+type CFReserveArgs struct {
+	Capacity      uint64
+	BucketSize    uint8
+	MaxIterations uint16
+	Expansion     uint16
+}
+
+type cuckooFilter struct {
+	bucketSize    uint8
+	maxIterations uint16
+	expansion     uint16
+	items         uint64
+	deletes       uint64
+	subs          []*cuckooSub
+}
+
+type cuckooSub struct {
+	numBuckets uint64
+	data       []byte
+}
+
+// CFReserve creates an empty cuckoo filter at key, which must not exist.
+func (db *LazyDB) CFReserve(key []byte, args CFReserveArgs) error {
+	if args.Capacity == 0 {
+		return ErrInvalidParam
+	}
+	cf, err := newCuckooFilter(args)
+	if err != nil {
+		return err
+	}
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, _, err := db.strValue(key)
+	if err != nil {
+		return err
+	}
+	if val != nil {
+		return ErrFilterExists
+	}
+	if err := db.setEX(key, cf.encode(), 0); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyString, "cf.reserve", key)
+	return nil
+}
+
+// CFAdd adds item to the cuckoo filter at key, which is created with capacity 1024 if it does not exist.
+// An item may be added more than once, and must be deleted as many times.
+func (db *LazyDB) CFAdd(key, item []byte) error {
+	_, err := db.cfAdd(key, item, false)
+	return err
+}
+
+// CFAddNX adds item to the cuckoo filter at key unless it may exist, and reports whether it is added.
+func (db *LazyDB) CFAddNX(key, item []byte) (bool, error) {
+	return db.cfAdd(key, item, true)
+}
+
+func (db *LazyDB) cfAdd(key, item []byte, nx bool) (bool, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, expiredAt, err := db.strValue(key)
+	if err != nil {
+		return false, err
+	}
+	var cf *cuckooFilter
+	if val == nil {
+		cf, _ = newCuckooFilter(CFReserveArgs{Capacity: cfDefaultCapacity})
+	} else if cf, err = decodeCuckooFilter(val); err != nil {
+		return false, err
+	}
+
+	fp, h := cuckooHash(item)
+	if nx && cf.count(fp, h) > 0 {
+		return false, nil
+	}
+	if err := cf.add(fp, h); err != nil {
+		return false, err
+	}
+	if err := db.setEX(key, cf.encode(), expiredAt); err != nil {
+		return false, err
+	}
+	db.notifyKeyspaceEvent(notifyString, "cf.add", key)
+	return true, nil
+}
+
+// CFExists reports whether item may be in the cuckoo filter at key.
+func (db *LazyDB) CFExists(key, item []byte) (bool, error) {
+	n, err := db.CFCount(key, item)
+	return n > 0, err
+}
+
+// CFCount returns the number of times item may have been added to the cuckoo filter at key.
+func (db *LazyDB) CFCount(key, item []byte) (int, error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	val, _, err := db.strValue(key)
+	if err != nil || val == nil {
+		return 0, err
+	}
+	cf, err := decodeCuckooFilter(val)
+	if err != nil {
+		return 0, err
+	}
+	return cf.count(cuckooHash(item)), nil
+}
+
+// CFDel deletes item from the cuckoo filter at key once, and reports whether it was found.
+func (db *LazyDB) CFDel(key, item []byte) (bool, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, expiredAt, err := db.strValue(key)
+	if err != nil || val == nil {
+		return false, err
+	}
+	cf, err := decodeCuckooFilter(val)
+	if err != nil {
+		return false, err
+	}
+	if !cf.delete(cuckooHash(item)) {
+		return false, nil
+	}
+	if err := db.setEX(key, cf.encode(), expiredAt); err != nil {
+		return false, err
+	}
+	db.notifyKeyspaceEvent(notifyString, "cf.del", key)
+	return true, nil
+}
+
+func newCuckooFilter(args CFReserveArgs) (*cuckooFilter, error) {
+	cf := &cuckooFilter{
+		bucketSize:    args.BucketSize,
+		maxIterations: args.MaxIterations,
+		expansion:     args.Expansion,
+	}
+	if cf.bucketSize == 0 {
+		cf.bucketSize = cfDefaultBucketSize
+	}
+	if cf.maxIterations == 0 {
+		cf.maxIterations = cfDefaultMaxIterations
+	}
+	if cf.expansion == 0 {
+		cf.expansion = cfDefaultExpansion
+	}
+	numBuckets := nextPowerOfTwo((args.Capacity + uint64(cf.bucketSize) - 1) / uint64(cf.bucketSize))
+	if numBuckets*uint64(cf.bucketSize) > maxFilterSize {
+		return nil, ErrInvalidParam
+	}
+	cf.subs = []*cuckooSub{{numBuckets: numBuckets, data: make([]byte, numBuckets*uint64(cf.bucketSize))}}
+	return cf, nil
+}
+
+// cuckooHash returns the fingerprint of item, which is never 0, and its hash.
+func cuckooHash(item []byte) (byte, uint64) {
+	h := murmurHash64A(item, cfSeed)
+	return byte(h%255 + 1), h
+}
+
+// altIndex returns the other bucket of the fingerprint in bucket index.
+func (sub *cuckooSub) altIndex(index uint64, fp byte) uint64 {
+	return (index ^ uint64(fp)*cfSeed) & (sub.numBuckets - 1)
+}
+
+func (cf *cuckooFilter) bucket(sub *cuckooSub, index uint64) []byte {
+	size := uint64(cf.bucketSize)
+	return sub.data[index*size : (index+1)*size]
+}
+
+func (cf *cuckooFilter) add(fp byte, h uint64) error {
+	last := cf.subs[len(cf.subs)-1]
+	if !cf.insert(last, fp, h) {
+		if len(cf.subs) >= cfMaxSubFilters {
+			return ErrFilterFull
+		}
+		numBuckets := last.numBuckets * nextPowerOfTwo(uint64(cf.expansion))
+		if numBuckets*uint64(cf.bucketSize) > maxFilterSize {
+			return ErrFilterFull
+		}
+		last = &cuckooSub{numBuckets: numBuckets, data: make([]byte, numBuckets*uint64(cf.bucketSize))}
+		cf.subs = append(cf.subs, last)
+		// an empty sub filter always has room
+		cf.insert(last, fp, h)
+	}
+	cf.items++
+	return nil
+}
+
+// insert puts the fingerprint into one of its buckets, moving others to their other bucket if both are full.
+// Nothing is moved if it fails after maxIterations.
+func (cf *cuckooFilter) insert(sub *cuckooSub, fp byte, h uint64) bool {
+	i1 := h & (sub.numBuckets - 1)
+	i2 := sub.altIndex(i1, fp)
+	for _, index := range []uint64{i1, i2} {
+		if cf.place(sub, index, fp) {
+			return true
+		}
+	}
+
+	type swap struct {
+		index uint64
+		slot  int
+	}
+	var swaps []swap
+	index, cur := i1, fp
+	for n := 0; n < int(cf.maxIterations); n++ {
+		slot := n % int(cf.bucketSize)
+		b := cf.bucket(sub, index)
+		b[slot], cur = cur, b[slot]
+		swaps = append(swaps, swap{index, slot})
+		index = sub.altIndex(index, cur)
+		if cf.place(sub, index, cur) {
+			return true
+		}
+	}
+	for i := len(swaps) - 1; i >= 0; i-- {
+		b := cf.bucket(sub, swaps[i].index)
+		b[swaps[i].slot], cur = cur, b[swaps[i].slot]
+	}
+	return false
+}
+
+// place puts the fingerprint into a free slot of the bucket, and reports whether there is one.
+func (cf *cuckooFilter) place(sub *cuckooSub, index uint64, fp byte) bool {
+	b := cf.bucket(sub, index)
+	for i := range b {
+		if b[i] == 0 {
+			b[i] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (cf *cuckooFilter) count(fp byte, h uint64) int {
+	n := 0
+	for _, sub := range cf.subs {
+		i1 := h & (sub.numBuckets - 1)
+		i2 := sub.altIndex(i1, fp)
+		n += bytes.Count(cf.bucket(sub, i1), []byte{fp})
+		if i2 != i1 {
+			n += bytes.Count(cf.bucket(sub, i2), []byte{fp})
+		}
+	}
+	return n
+}
+
+// delete clears a slot holding the fingerprint, the newest sub filters first.
+func (cf *cuckooFilter) delete(fp byte, h uint64) bool {
+	for i := len(cf.subs) - 1; i >= 0; i-- {
+		sub := cf.subs[i]
+		i1 := h & (sub.numBuckets - 1)
+		for _, index := range []uint64{i1, sub.altIndex(i1, fp)} {
+			b := cf.bucket(sub, index)
+			if j := bytes.IndexByte(b, fp); j >= 0 {
+				b[j] = 0
+				cf.items--
+				cf.deletes++
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cf *cuckooFilter) encode() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, cfMagic...))
+	binary.Write(buf, binary.LittleEndian, cf.bucketSize)
+	binary.Write(buf, binary.LittleEndian, cf.maxIterations)
+	binary.Write(buf, binary.LittleEndian, cf.expansion)
+	binary.Write(buf, binary.LittleEndian, cf.items)
+	binary.Write(buf, binary.LittleEndian, cf.deletes)
+	binary.Write(buf, binary.LittleEndian, uint32(len(cf.subs)))
+	for _, sub := range cf.subs {
+		binary.Write(buf, binary.LittleEndian, sub.numBuckets)
+		buf.Write(sub.data)
+	}
+	return buf.Bytes()
+}
+
+func decodeCuckooFilter(val []byte) (*cuckooFilter, error) {
+	if !bytes.HasPrefix(val, cfMagic) {
+		return nil, ErrInvalidFilter
+	}
+	r := bytes.NewReader(val[len(cfMagic):])
+	cf := &cuckooFilter{}
+	var n uint32
+	for _, v := range []interface{}{&cf.bucketSize, &cf.maxIterations, &cf.expansion, &cf.items, &cf.deletes, &n} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, ErrInvalidFilter
+		}
+	}
+	if n == 0 || cf.bucketSize == 0 {
+		return nil, ErrInvalidFilter
+	}
+	for i := uint32(0); i < n; i++ {
+		sub := &cuckooSub{}
+		if err := binary.Read(r, binary.LittleEndian, &sub.numBuckets); err != nil {
+			return nil, ErrInvalidFilter
+		}
+		size := sub.numBuckets * uint64(cf.bucketSize)
+		if sub.numBuckets == 0 || sub.numBuckets&(sub.numBuckets-1) != 0 || size > uint64(r.Len()) {
+			return nil, ErrInvalidFilter
+		}
+		sub.data = make([]byte, size)
+		r.Read(sub.data)
+		cf.subs = append(cf.subs, sub)
+	}
+	if r.Len() != 0 {
+		return nil, ErrInvalidFilter
+	}
+	return cf, nil
+}
+
+// nextPowerOfTwo returns the smallest power of two not less than n, and 1 for 0.
+func nextPowerOfTwo(n uint64) uint64 {
+	p := uint64(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
@@ -0,0 +1,100 @@
+package lazydb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyDB_CFAdd_CFDel(t *testing.T) {
+	db := initTestFilterDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("cf")
+	assert.NoError(t, db.CFAdd(key, []byte("a")))
+	assert.NoError(t, db.CFAdd(key, []byte("a")))
+	added, err := db.CFAddNX(key, []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, added)
+	added, err = db.CFAddNX(key, []byte("b"))
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	n, err := db.CFCount(key, []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// an item added twice must be deleted twice
+	for i := 0; i < 2; i++ {
+		deleted, err := db.CFDel(key, []byte("a"))
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	}
+	deleted, err := db.CFDel(key, []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	ok, err := db.CFExists(key, []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, _ = db.CFExists(key, []byte("b"))
+	assert.True(t, ok)
+
+	ok, err = db.CFExists([]byte("missing"), []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	deleted, err = db.CFDel([]byte("missing"), []byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+
+	_ = db.Set([]byte("str"), []byte("plain"))
+	assert.Equal(t, ErrInvalidFilter, db.CFAdd([]byte("str"), []byte("a")))
+	_, err = db.BFAdd(key, []byte("a"))
+	assert.Equal(t, ErrInvalidFilter, err)
+}
+
+func TestLazyDB_CFReserve(t *testing.T) {
+	db := initTestFilterDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("cf")
+	assert.NoError(t, db.CFReserve(key, CFReserveArgs{Capacity: 100, BucketSize: 4}))
+	assert.Equal(t, ErrFilterExists, db.CFReserve(key, CFReserveArgs{Capacity: 100}))
+	assert.Equal(t, ErrInvalidParam, db.CFReserve([]byte("x"), CFReserveArgs{}))
+
+	// the filter grows sub filters when items cannot be placed
+	items := make([][]byte, 1000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("item-%d", i))
+		assert.NoError(t, db.CFAdd(key, items[i]))
+	}
+	val, _ := db.Get(key)
+	cf, err := decodeCuckooFilter(val)
+	assert.NoError(t, err)
+	assert.True(t, len(cf.subs) > 1)
+	assert.Equal(t, uint64(1000), cf.items)
+	for _, item := range items {
+		assert.True(t, cf.count(cuckooHash(item)) > 0, string(item))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if cf.count(cuckooHash([]byte(fmt.Sprintf("other-%d", i)))) > 0 {
+			falsePositives++
+		}
+	}
+	// two buckets of 4 slots with 8 bits fingerprints are about 3% per sub filter
+	assert.True(t, float64(falsePositives) < 10000*0.03*float64(len(cf.subs)), falsePositives)
+
+	for _, item := range items {
+		deleted, err := db.CFDel(key, item)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	}
+	val, _ = db.Get(key)
+	cf, _ = decodeCuckooFilter(val)
+	assert.Equal(t, uint64(0), cf.items)
+	assert.Equal(t, uint64(1000), cf.deletes)
+}
@@ -27,10 +27,21 @@ type (
 		listIndex        *listIndex
 		setIndex         *setIndex
 		zSetIndex        *zSetIndex
+		streamIndex      *streamIndex
+		jsonIndex        *jsonIndex
+		tsIndex          *tsIndex
+		changes          *changeHub
+		pubsub           *pubSubHub
+		notifyFlags      int
 		discardsMap      map[valueType]*discard
 		fidsMap          map[valueType]*MutexFids
 		activeLogFileMap map[valueType]*MutexLogFile
 		archivedLogFile  map[valueType]*ds.ConcurrentMap[uint32] // [uint32]*MutexLogFile
+		appendNotifiers  map[valueType]*logNotifier
+		readOnly         int32
+		expireStop       chan struct{}
+		expireDone       chan struct{}
+		queueMu          sync.Mutex // serializes the operations of queues
 		mu               sync.RWMutex
 	}
 
@@ -49,27 +60,62 @@ type (
 	strIndex struct {
 		mu      *sync.RWMutex
 		idxTree *ds.AdaptiveRadixTree
+		expires map[string]int64                 // keys with ttl, sampled by the expiration cycle
+		bitmaps map[string]*ds.AdaptiveRadixTree // pages of the bitmaps, keyed by the page number
 	}
 
 	hashIndex struct {
-		mu    *sync.RWMutex
-		trees map[string]*ds.AdaptiveRadixTree
+		mu      *sync.RWMutex
+		trees   map[string]*ds.AdaptiveRadixTree
+		keys    *ds.AdaptiveRadixTree // the keys of the index in byte order, walked by scans
+		expires map[string]*Value     // key meta entries of keys with ttl
+		// fieldExpires holds the expiration time of the fields with ttl of every hash, keyed by their encoded key.
+		fieldExpires map[string]map[string]int64
 	}
 
 	listIndex struct {
-		mu    *sync.RWMutex
-		trees map[string]*ds.AdaptiveRadixTree
+		mu      *sync.RWMutex
+		trees   map[string]*ds.AdaptiveRadixTree
+		keys    *ds.AdaptiveRadixTree // the keys of the index in byte order, walked by scans
+		expires map[string]*Value
+		waiters map[string][]*listWaiter // clients blocked on empty lists, in arrival order
 	}
 
 	setIndex struct {
 		mu      *sync.RWMutex
 		murHash *util.Murmur128
 		trees   map[string]*ds.AdaptiveRadixTree
+		keys    *ds.AdaptiveRadixTree // the keys of the index in byte order, walked by scans
+		expires map[string]*Value
 	}
 
 	zSetIndex struct {
 		mu      *sync.RWMutex
 		indexes map[string]*ZSetIndex
+		keys    *ds.AdaptiveRadixTree // the keys of the index in byte order, walked by scans
+		expires map[string]*Value
+	}
+
+	streamIndex struct {
+		mu      *sync.RWMutex
+		streams map[string]*stream
+		keys    *ds.AdaptiveRadixTree // the keys of the index in byte order, walked by scans
+		expires map[string]*Value
+		added   chan struct{} // closed and replaced when entries are added, to wake blocked readers
+		closed  bool
+	}
+
+	jsonIndex struct {
+		mu      *sync.RWMutex
+		idxTree *ds.AdaptiveRadixTree
+		expires map[string]*Value
+	}
+
+	tsIndex struct {
+		mu      *sync.RWMutex
+		series  map[string]*timeSeries
+		keys    *ds.AdaptiveRadixTree // the keys of the index in byte order, walked by scans
+		expires map[string]*Value
 	}
 
 	Value struct {
@@ -95,8 +141,11 @@ const (
 	valueTypeHash
 	valueTypeSet
 	valueTypeZSet
+	valueTypeStream
+	valueTypeJSON
+	valueTypeTimeSeries
 
-	logFileTypeNum = 5
+	logFileTypeNum = 8
 
 	encodeHeaderSize = 10
 	discardFilePath  = "DISCARD"
@@ -104,24 +153,68 @@ const (
 	initialListSeq = uint32(math.MaxUint32 / 2)
 )
 
+// DataType is the public name of a value type.
+type DataType string
+
+const (
+	DataTypeNone       DataType = "none"
+	DataTypeString     DataType = "string"
+	DataTypeList       DataType = "list"
+	DataTypeHash       DataType = "hash"
+	DataTypeSet        DataType = "set"
+	DataTypeZSet       DataType = "zset"
+	DataTypeStream     DataType = "stream"
+	DataTypeJSON       DataType = "json"
+	DataTypeTimeSeries DataType = "timeseries"
+)
+
+var dataTypes = map[valueType]DataType{
+	valueTypeString:     DataTypeString,
+	valueTypeList:       DataTypeList,
+	valueTypeHash:       DataTypeHash,
+	valueTypeSet:        DataTypeSet,
+	valueTypeZSet:       DataTypeZSet,
+	valueTypeStream:     DataTypeStream,
+	valueTypeJSON:       DataTypeJSON,
+	valueTypeTimeSeries: DataTypeTimeSeries,
+}
+
 var (
 	ErrKeyNotFound     = errors.New("key not found")
 	ErrLogFileNotExist = errors.New("log file is not exist")
 	ErrOpenLogFile     = errors.New("open Log file error")
 	ErrWrongIndex      = errors.New("index is out of range")
 	ErrDatabaseClosed  = errors.New("database is closed")
+	ErrReadOnly        = errors.New("database is a read only follower")
 )
 
 func newStrIndex() *strIndex {
-	return &strIndex{idxTree: ds.NewART(), mu: new(sync.RWMutex)}
+	return &strIndex{
+		idxTree: ds.NewART(),
+		mu:      new(sync.RWMutex),
+		expires: make(map[string]int64),
+		bitmaps: make(map[string]*ds.AdaptiveRadixTree),
+	}
 }
 
 func newHashIndex() *hashIndex {
-	return &hashIndex{trees: make(map[string]*ds.AdaptiveRadixTree), mu: new(sync.RWMutex)}
+	return &hashIndex{
+		mu:           new(sync.RWMutex),
+		trees:        make(map[string]*ds.AdaptiveRadixTree),
+		keys:         ds.NewART(),
+		expires:      make(map[string]*Value),
+		fieldExpires: make(map[string]map[string]int64),
+	}
 }
 
 func newListIndex() *listIndex {
-	return &listIndex{trees: make(map[string]*ds.AdaptiveRadixTree), mu: new(sync.RWMutex)}
+	return &listIndex{
+		mu:      new(sync.RWMutex),
+		trees:   make(map[string]*ds.AdaptiveRadixTree),
+		keys:    ds.NewART(),
+		expires: make(map[string]*Value),
+		waiters: make(map[string][]*listWaiter),
+	}
 }
 
 func newSetIndex() *setIndex {
@@ -129,6 +222,8 @@ func newSetIndex() *setIndex {
 		mu:      new(sync.RWMutex),
 		murHash: util.NewMurmur128(),
 		trees:   make(map[string]*ds.AdaptiveRadixTree),
+		keys:    ds.NewART(),
+		expires: make(map[string]*Value),
 	}
 }
 
@@ -136,6 +231,35 @@ func newZSetIndex() *zSetIndex {
 	return &zSetIndex{
 		mu:      new(sync.RWMutex),
 		indexes: make(map[string]*ZSetIndex),
+		keys:    ds.NewART(),
+		expires: make(map[string]*Value),
+	}
+}
+
+func newStreamIndex() *streamIndex {
+	return &streamIndex{
+		mu:      new(sync.RWMutex),
+		streams: make(map[string]*stream),
+		keys:    ds.NewART(),
+		expires: make(map[string]*Value),
+		added:   make(chan struct{}),
+	}
+}
+
+func newJSONIndex() *jsonIndex {
+	return &jsonIndex{
+		mu:      new(sync.RWMutex),
+		idxTree: ds.NewART(),
+		expires: make(map[string]*Value),
+	}
+}
+
+func newTSIndex() *tsIndex {
+	return &tsIndex{
+		mu:      new(sync.RWMutex),
+		series:  make(map[string]*timeSeries),
+		keys:    ds.NewART(),
+		expires: make(map[string]*Value),
 	}
 }
 
@@ -148,6 +272,11 @@ func Open(cfg DBConfig) (*LazyDB, error) {
 		}
 	}
 
+	notifyFlags, err := parseNotifyFlags(cfg.NotifyKeyspaceEvents)
+	if err != nil {
+		return nil, err
+	}
+
 	db := &LazyDB{
 		cfg:              &cfg,
 		index:            ds.NewConcurrentMap(int(cfg.HashIndexShardCount)),
@@ -156,14 +285,22 @@ func Open(cfg DBConfig) (*LazyDB, error) {
 		listIndex:        newListIndex(),
 		setIndex:         newSetIndex(),
 		zSetIndex:        newZSetIndex(),
+		streamIndex:      newStreamIndex(),
+		jsonIndex:        newJSONIndex(),
+		tsIndex:          newTSIndex(),
+		changes:          newChangeHub(),
+		pubsub:           newPubSubHub(),
+		notifyFlags:      notifyFlags,
 		fidsMap:          make(map[valueType]*MutexFids),
 		activeLogFileMap: make(map[valueType]*MutexLogFile),
 		archivedLogFile:  make(map[valueType]*ds.ConcurrentMap[uint32]),
+		appendNotifiers:  make(map[valueType]*logNotifier),
 	}
 
 	for i := 0; i < logFileTypeNum; i++ {
 		db.fidsMap[valueType(i)] = &MutexFids{fids: make([]uint32, 0)}
 		db.archivedLogFile[valueType(i)] = ds.NewWithCustomShardingFunction[uint32](ds.DefaultShardCount, ds.SimpleSharding)
+		db.appendNotifiers[valueType(i)] = new(logNotifier)
 	}
 
 	if err := db.initDiscard(); err != nil {
@@ -181,6 +318,12 @@ func Open(cfg DBConfig) (*LazyDB, error) {
 		return nil, err
 	}
 
+	if err := db.recoverQueues(); err != nil {
+		return nil, err
+	}
+
+	db.startExpireCycle()
+
 	return db, nil
 }
 
@@ -204,6 +347,9 @@ func (db *LazyDB) Sync() error {
 
 // Close db
 func (db *LazyDB) Close() error {
+	db.stopExpireCycle()
+	db.cancelListWaiters()
+	db.cancelStreamReaders()
 	for _, mlf := range db.activeLogFileMap {
 		mlf.lf.Sync()
 		err := mlf.lf.Close()
@@ -225,6 +371,8 @@ func (db *LazyDB) Close() error {
 		}
 	}
 
+	db.changes.close()
+	db.pubsub.close()
 	db.index = nil
 	db.fidsMap = nil
 	db.activeLogFileMap = nil
@@ -244,6 +392,9 @@ func (db *LazyDB) mergeStr(fid uint32, offset int64, ent *logfile.LogEntry) erro
 	db.strIndex.mu.RLock()
 	defer db.strIndex.mu.RUnlock()
 
+	if ent.Stat == logfile.SBitmapPage {
+		return db.mergeBitmapPage(fid, offset, ent)
+	}
 	indexVal := db.strIndex.idxTree.Get(ent.Key)
 	if indexVal == nil {
 		return nil
@@ -254,7 +405,7 @@ func (db *LazyDB) mergeStr(fid uint32, offset int64, ent *logfile.LogEntry) erro
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeString, ent)
+		valuePos, err := db.appendLogEntry(valueTypeString, ent)
 		if err != nil {
 			return err
 		}
@@ -264,6 +415,24 @@ func (db *LazyDB) mergeStr(fid uint32, offset int64, ent *logfile.LogEntry) erro
 	return nil
 }
 
+// mergeBitmapPage rewrites a page of a bitmap if it is still in the index.
+func (db *LazyDB) mergeBitmapPage(fid uint32, offset int64, ent *logfile.LogEntry) error {
+	key, page := decodeKey(ent.Key)
+	tree := db.strIndex.bitmaps[string(key)]
+	if tree == nil {
+		return nil
+	}
+	val, _ := tree.Get(page).(*Value)
+	if val != nil && val.fid == fid && val.offset == offset {
+		valuePos, err := db.appendLogEntry(valueTypeString, ent)
+		if err != nil {
+			return err
+		}
+		db.buildBitmapPage(ent, valuePos)
+	}
+	return nil
+}
+
 func (db *LazyDB) mergeHash(fid uint32, offset int64, ent *logfile.LogEntry) error {
 	key, _ := decodeKey(ent.Key)
 	db.hashIndex.mu.RLock()
@@ -280,7 +449,7 @@ func (db *LazyDB) mergeHash(fid uint32, offset int64, ent *logfile.LogEntry) err
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeHash, ent)
+		valuePos, err := db.appendLogEntry(valueTypeHash, ent)
 		if err != nil {
 			return err
 		}
@@ -306,7 +475,7 @@ func (db *LazyDB) mergeSet(fid uint32, offset int64, ent *logfile.LogEntry) erro
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeSet, ent)
+		valuePos, err := db.appendLogEntry(valueTypeSet, ent)
 		if err != nil {
 			return err
 		}
@@ -332,7 +501,7 @@ func (db *LazyDB) mergeZSet(fid uint32, offset int64, ent *logfile.LogEntry) err
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeZSet, ent)
+		valuePos, err := db.appendLogEntry(valueTypeZSet, ent)
 		if err != nil {
 			return err
 		}
@@ -357,7 +526,7 @@ func (db *LazyDB) mergeList(fid uint32, offset int64, ent *logfile.LogEntry) err
 	// as in index. Otherwise, this entry is updated in other log.
 	if val != nil && val.fid == fid && val.offset == offset {
 		// rewrite entry
-		valuePos, err := db.writeLogEntry(valueTypeList, ent)
+		valuePos, err := db.appendLogEntry(valueTypeList, ent)
 		if err != nil {
 			return err
 		}
@@ -367,6 +536,77 @@ func (db *LazyDB) mergeList(fid uint32, offset int64, ent *logfile.LogEntry) err
 	return nil
 }
 
+func (db *LazyDB) mergeStream(fid uint32, offset int64, ent *logfile.LogEntry) error {
+	key, subKey := decodeKey(ent.Key)
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+	s := db.streamIndex.streams[util.ByteToString(key)]
+	if s == nil {
+		return nil
+	}
+
+	val, _ := s.tree.Get(subKey).(*Value)
+	// Only update rewriting entry when fid and offset is the same
+	// as in index. Otherwise, this entry is updated in other log.
+	if val != nil && val.fid == fid && val.offset == offset {
+		// rewrite entry
+		valuePos, err := db.appendLogEntry(valueTypeStream, ent)
+		if err != nil {
+			return err
+		}
+		// update index
+		s.tree.Put(subKey, &Value{fid: valuePos.fid, offset: valuePos.offset, entrySize: valuePos.entrySize})
+	}
+	return nil
+}
+
+func (db *LazyDB) mergeJSON(fid uint32, offset int64, ent *logfile.LogEntry) error {
+	db.jsonIndex.mu.Lock()
+	defer db.jsonIndex.mu.Unlock()
+	indexVal := db.jsonIndex.idxTree.Get(ent.Key)
+	if indexVal == nil {
+		return nil
+	}
+
+	val, _ := indexVal.(*Value)
+	// Only update rewriting entry when fid and offset is the same
+	// as in index. Otherwise, this entry is updated in other log.
+	if val != nil && val.fid == fid && val.offset == offset {
+		// rewrite entry
+		valuePos, err := db.appendLogEntry(valueTypeJSON, ent)
+		if err != nil {
+			return err
+		}
+		// update index
+		db.updateIndexTree(valueTypeJSON, db.jsonIndex.idxTree, ent, valuePos, false)
+	}
+	return nil
+}
+
+func (db *LazyDB) mergeTimeSeries(fid uint32, offset int64, ent *logfile.LogEntry) error {
+	key, subKey := decodeKey(ent.Key)
+	db.tsIndex.mu.Lock()
+	defer db.tsIndex.mu.Unlock()
+	ts := db.tsIndex.series[util.ByteToString(key)]
+	if ts == nil {
+		return nil
+	}
+
+	val, _ := ts.tree.Get(subKey).(*Value)
+	// Only update rewriting entry when fid and offset is the same
+	// as in index. Otherwise, this entry is updated in other log.
+	if val != nil && val.fid == fid && val.offset == offset {
+		// rewrite entry
+		valuePos, err := db.appendLogEntry(valueTypeTimeSeries, ent)
+		if err != nil {
+			return err
+		}
+		// update index
+		ts.tree.Put(subKey, &Value{fid: valuePos.fid, offset: valuePos.offset, entrySize: valuePos.entrySize})
+	}
+	return nil
+}
+
 func (db *LazyDB) Merge(typ valueType, targetFid uint32, gcRatio float64) error {
 
 	activeFile := db.getActiveLogFile(typ)
@@ -403,6 +643,13 @@ func (db *LazyDB) Merge(typ valueType, targetFid uint32, gcRatio float64) error
 			if ent.Stat == logfile.SDelete {
 				continue
 			}
+			// key meta is kept even if it is expired, or the members would outlive their ttl.
+			if ent.Stat == logfile.SKeyMeta {
+				if err := db.mergeKeyMeta(typ, archivedFile.lf.Fid, off, ent); err != nil {
+					return err
+				}
+				continue
+			}
 			ts := time.Now().Unix()
 			if ent.ExpiredAt != 0 && ent.ExpiredAt <= ts {
 				continue
@@ -419,6 +666,12 @@ func (db *LazyDB) Merge(typ valueType, targetFid uint32, gcRatio float64) error
 				mergeErr = db.mergeZSet(archivedFile.lf.Fid, off, ent)
 			case valueTypeList:
 				mergeErr = db.mergeList(archivedFile.lf.Fid, off, ent)
+			case valueTypeStream:
+				mergeErr = db.mergeStream(archivedFile.lf.Fid, off, ent)
+			case valueTypeJSON:
+				mergeErr = db.mergeJSON(archivedFile.lf.Fid, off, ent)
+			case valueTypeTimeSeries:
+				mergeErr = db.mergeTimeSeries(archivedFile.lf.Fid, off, ent)
 			}
 
 			if mergeErr != nil {
@@ -469,8 +722,36 @@ func (db *LazyDB) readLogEntry(typ valueType, fid uint32, offset int64) (*logfil
 }
 
 // writeLogEntry writes entry into active log file and returns position.
-// Return nil and error if writing fails.
+// Return nil and error if writing fails, or ErrReadOnly if db is a replication follower.
 func (db *LazyDB) writeLogEntry(typ valueType, entry *logfile.LogEntry) (*ValuePos, error) {
+	if db.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+	return db.appendLogEntry(typ, entry)
+}
+
+// writeLogEntries writes entries into active log file in one write when they fit into it, and returns their positions.
+// Return nil and error if writing fails, or ErrReadOnly if db is a replication follower.
+func (db *LazyDB) writeLogEntries(typ valueType, entries []*logfile.LogEntry) ([]*ValuePos, error) {
+	if db.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+	return db.appendLogEntries(typ, entries)
+}
+
+// appendLogEntry is the same as writeLogEntry, but it also writes when db is read only.
+// It is used by merging and replication.
+func (db *LazyDB) appendLogEntry(typ valueType, entry *logfile.LogEntry) (*ValuePos, error) {
+	valPos, err := db.appendLogEntries(typ, []*logfile.LogEntry{entry})
+	if err != nil {
+		return nil, err
+	}
+	return valPos[0], nil
+}
+
+// appendLogEntries is the same as writeLogEntries, but it also writes when db is read only.
+// Entries are buffered and written together, the buffer is flushed early only when the active log file is full.
+func (db *LazyDB) appendLogEntries(typ valueType, entries []*logfile.LogEntry) ([]*ValuePos, error) {
 	activeLogFile := db.getActiveLogFile(typ)
 	if activeLogFile == nil {
 		return nil, ErrOpenLogFile
@@ -478,50 +759,70 @@ func (db *LazyDB) writeLogEntry(typ valueType, entry *logfile.LogEntry) (*ValueP
 	activeLogFile.mu.Lock()
 	defer activeLogFile.mu.Unlock()
 
-	lf := activeLogFile.lf
-	entBuf, entSize := logfile.EncodeEntry(entry)
+	valPos := make([]*ValuePos, 0, len(entries))
+	var buf []byte
+	for _, entry := range entries {
+		entBuf, entSize := logfile.EncodeEntry(entry)
 
-	// maxsize exceeded
-	if lf.Offset+int64(entSize) > db.cfg.MaxLogFileSize {
-		if err := lf.Sync(); err != nil {
-			return nil, err
-		}
-
-		newFid := lf.Fid + 1
-		newActiveLF, err := logfile.Open(db.cfg.DBPath, newFid, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
-		if err != nil {
-			return nil, err
+		// maxsize exceeded
+		if activeLogFile.lf.Offset+int64(len(buf)+entSize) > db.cfg.MaxLogFileSize {
+			if err := activeLogFile.lf.Write(buf); err != nil {
+				return nil, err
+			}
+			buf = buf[:0]
+			if err := db.rotateLogFile(typ, activeLogFile); err != nil {
+				return nil, err
+			}
 		}
 
-		// move activeLogFile to archive
-		db.archivedLogFile[typ].Set(lf.Fid, &MutexLogFile{lf: lf})
-
-		// insert new fid
-		fids := db.fidsMap[typ]
-		fids.mu.Lock()
-		fids.fids = append(fids.fids, newFid)
-		fids.mu.Unlock()
-
-		// update discard of new file
-		db.discardsMap[typ].setTotal(newFid, uint32(db.cfg.MaxLogFileSize))
-
-		// update activeLogFile
-		activeLogFile.lf = newActiveLF
+		lf := activeLogFile.lf
+		valPos = append(valPos, &ValuePos{
+			fid:       lf.Fid,
+			offset:    lf.Offset + int64(len(buf)),
+			entrySize: entSize,
+		})
+		buf = append(buf, entBuf...)
 	}
-
-	lf = activeLogFile.lf
-	writeAt := lf.Offset
-	if err := lf.Write(entBuf); err != nil {
+	if err := activeLogFile.lf.Write(buf); err != nil {
 		return nil, err
 	}
-	valPos := &ValuePos{
-		fid:       lf.Fid,
-		offset:    writeAt,
-		entrySize: entSize,
+	if n := db.appendNotifiers[typ]; n != nil {
+		n.broadcast()
 	}
 	return valPos, nil
 }
 
+// rotateLogFile archives the active log file of typ and opens a new one.
+// The caller must hold the lock of activeLogFile.
+func (db *LazyDB) rotateLogFile(typ valueType, activeLogFile *MutexLogFile) error {
+	lf := activeLogFile.lf
+	if err := lf.Sync(); err != nil {
+		return err
+	}
+
+	newFid := lf.Fid + 1
+	newActiveLF, err := logfile.Open(db.cfg.DBPath, newFid, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
+	if err != nil {
+		return err
+	}
+
+	// move activeLogFile to archive
+	db.archivedLogFile[typ].Set(lf.Fid, &MutexLogFile{lf: lf})
+
+	// insert new fid
+	fids := db.fidsMap[typ]
+	fids.mu.Lock()
+	fids.fids = append(fids.fids, newFid)
+	fids.mu.Unlock()
+
+	// update discard of new file
+	db.discardsMap[typ].setTotal(newFid, uint32(db.cfg.MaxLogFileSize))
+
+	// update activeLogFile
+	activeLogFile.lf = newActiveLF
+	return nil
+}
+
 // buildLogFiles Recover archivedLogFile from disk.
 // Only run once when program start running.
 func (db *LazyDB) buildLogFiles() error {
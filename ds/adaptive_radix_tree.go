@@ -1,61 +1,595 @@
 package ds
 
 import (
-	art "github.com/plar/go-adaptive-radix-tree"
+	"bytes"
+	"errors"
+	"math/rand"
+	"sort"
 )
 
+var (
+	// ErrNoMoreNodes is returned by Iterator.Next once all keys are visited.
+	ErrNoMoreNodes = errors.New("there are no more nodes in the tree")
+	// ErrConcurrentModification is returned by Iterator.Next if the tree changed after the iterator was created.
+	ErrConcurrentModification = errors.New("concurrent modification has been detected")
+)
+
+// Iterator walks the keys of a tree in ascending order.
+type Iterator interface {
+	HasNext() bool
+	Next() (Node, error)
+}
+
+// Node is a key and its value returned by an Iterator.
+type Node interface {
+	Key() []byte
+	Value() interface{}
+}
+
+const (
+	// artMaxSorted is the number of children a node keeps in a sorted array before growing into a full one.
+	artMaxSorted = 48
+	// artMinFull is the number of children a full node shrinks back into a sorted array at.
+	artMinFull = 32
+)
+
+// AdaptiveRadixTree is a radix tree with path compression that keeps its keys in byte order.
+// Inner nodes hold their children in a sorted array and grow into a 256-slot array once crowded,
+// so a lookup costs O(len(key)), and a range walk seeks to its bound and only reaches the keys it returns.
 type AdaptiveRadixTree struct {
-	tree art.Tree
+	root *artNode
+	size int
+	// version changes whenever the shape of the tree does, iterators stop once it moved.
+	version int
+}
+
+type artNode struct {
+	// prefix is the compressed path between the edge leading to the node and the edges of its children.
+	prefix []byte
+	// leaf holds the key ending at the node, if any.
+	leaf *artLeaf
+	// edges and children are kept sorted by edge while the node is small.
+	edges    []byte
+	children []*artNode
+	// full is indexed by edge once the node has grown.
+	full *[256]*artNode
+	num  int
 }
 
+type artLeaf struct {
+	key   []byte
+	value interface{}
+}
+
+func (l *artLeaf) Key() []byte { return l.key }
+
+func (l *artLeaf) Value() interface{} { return l.value }
+
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: art.New(),
+		root: &artNode{},
 	}
 }
 
 func (t *AdaptiveRadixTree) Get(key []byte) interface{} {
-	value, _ := t.tree.Search(key)
-	return value
+	n, depth := t.root, 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil
+			}
+			return n.leaf.value
+		}
+		n = n.child(key[depth])
+		depth++
+	}
+	return nil
 }
 
+// Put inserts key with value, or replaces the value if key is present. A nil key is not stored.
 func (t *AdaptiveRadixTree) Put(key []byte, value interface{}) (oldVal interface{}, updated bool) {
-	return t.tree.Insert(key, value)
+	if key == nil {
+		return nil, false
+	}
+	n, depth := t.root, 0
+	for {
+		common := commonPrefixLen(n.prefix, key[depth:])
+		if common < len(n.prefix) {
+			// split the node where key leaves its prefix
+			edge, tail := n.prefix[common], *n
+			tail.prefix = n.prefix[common+1:]
+			*n = artNode{prefix: n.prefix[:common]}
+			n.setChild(edge, &tail)
+		}
+		depth += common
+		if depth == len(key) {
+			if n.leaf != nil {
+				oldVal, n.leaf.value = n.leaf.value, value
+				return oldVal, true
+			}
+			n.leaf = &artLeaf{key: key, value: value}
+			t.size++
+			t.version++
+			return nil, false
+		}
+		child := n.child(key[depth])
+		if child == nil {
+			n.setChild(key[depth], &artNode{prefix: key[depth+1:], leaf: &artLeaf{key: key, value: value}})
+			t.size++
+			t.version++
+			return nil, false
+		}
+		n = child
+		depth++
+	}
 }
 
 func (t *AdaptiveRadixTree) Delete(key []byte) (val interface{}, updated bool) {
-	return t.tree.Delete(key)
+	var parent *artNode
+	var edge byte
+	n, depth := t.root, 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil, false
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			break
+		}
+		parent, edge = n, key[depth]
+		n = n.child(key[depth])
+		depth++
+	}
+	if n == nil || n.leaf == nil {
+		return nil, false
+	}
+	val = n.leaf.value
+	n.leaf = nil
+	t.size--
+	t.version++
+
+	// keep the tree compressed, the root is never merged so that it always has an empty prefix
+	switch {
+	case n.num == 0 && parent != nil:
+		parent.removeChild(edge)
+		if parent != t.root && parent.leaf == nil && parent.num == 1 {
+			parent.mergeChild()
+		}
+	case n.num == 1 && n != t.root:
+		n.mergeChild()
+	}
+	return val, true
 }
 
 func (t *AdaptiveRadixTree) Size() int {
-	return t.tree.Size()
+	return t.size
+}
+
+// Random returns a key picked by a random walk down the tree and its value, or a nil key if the tree is empty.
+// Every key may be picked, though not all with the same probability.
+func (t *AdaptiveRadixTree) Random() ([]byte, interface{}) {
+	n := t.root
+	for {
+		choices := n.num
+		if n.leaf != nil {
+			choices++
+		}
+		if choices == 0 {
+			return nil, nil
+		}
+		i := rand.Intn(choices)
+		if n.leaf != nil {
+			if i == 0 {
+				return n.leaf.key, n.leaf.value
+			}
+			i--
+		}
+		n = n.nth(i)
+	}
+}
+
+// Iterator returns an iterator over all keys in ascending order.
+func (t *AdaptiveRadixTree) Iterator() Iterator {
+	iter := &artIterator{tree: t, version: t.version}
+	iter.stack = append(iter.stack, artFrame{node: t.root, pos: -1})
+	iter.advance()
+	return iter
 }
 
-func (t *AdaptiveRadixTree) Iterator() art.Iterator {
-	return t.tree.Iterator()
+// Ascend calls fn for the keys greater than or equal to start in ascending order until fn returns false.
+// All keys are taken into account if start is nil.
+func (t *AdaptiveRadixTree) Ascend(start []byte, fn func(key []byte, value interface{}) bool) {
+	t.ascend(start, fn)
+}
+
+// ascend is Ascend, it returns the number of nodes the walk reached.
+func (t *AdaptiveRadixTree) ascend(start []byte, fn func(key []byte, value interface{}) bool) int {
+	w := &artWalk{fn: fn}
+	w.ascend(t.root, start, 0, true)
+	return w.nodes
+}
+
+// Descend calls fn for the keys less than end in descending order until fn returns false.
+// All keys are taken into account if end is nil.
+func (t *AdaptiveRadixTree) Descend(end []byte, fn func(key []byte, value interface{}) bool) {
+	t.descend(end, fn)
+}
+
+// descend is Descend, it returns the number of nodes the walk reached.
+func (t *AdaptiveRadixTree) descend(end []byte, fn func(key []byte, value interface{}) bool) int {
+	w := &artWalk{fn: fn}
+	w.descend(t.root, end, 0, end != nil)
+	return w.nodes
 }
 
 // PrefixScan returns keys start with specific prefix
 // Count refers to the maximum number of retrieved keys. No limitation if count is smaller than 0.
 func (t *AdaptiveRadixTree) PrefixScan(prefix []byte, count int) (keys [][]byte) {
-	cb := func(node art.Node) bool {
-		if node.Kind() != art.Leaf {
-			return true
-		}
-		if count == 0 {
+	t.Ascend(prefix, func(key []byte, _ interface{}) bool {
+		if count == 0 || !bytes.HasPrefix(key, prefix) {
 			return false
 		}
-		keys = append(keys, node.Key())
+		keys = append(keys, key)
 		if count > 0 {
 			count--
 		}
 		return true
+	})
+	return
+}
+
+// ScanAfter returns at most count keys greater than after in ascending order, starting from the smallest key if after is nil.
+func (t *AdaptiveRadixTree) ScanAfter(after []byte, count int) (keys [][]byte) {
+	if count <= 0 {
+		return nil
 	}
+	t.Ascend(after, func(key []byte, _ interface{}) bool {
+		if after != nil && bytes.Equal(key, after) {
+			return true
+		}
+		keys = append(keys, key)
+		count--
+		return count > 0
+	})
+	return
+}
 
-	if len(prefix) == 0 {
-		t.tree.ForEach(cb)
-	} else {
-		t.tree.ForEachPrefix(prefix, cb)
+// ScanFrom returns at most count keys greater than or equal to start in ascending order.
+func (t *AdaptiveRadixTree) ScanFrom(start []byte, count int) (keys [][]byte) {
+	if count <= 0 {
+		return nil
 	}
+	t.Ascend(start, func(key []byte, _ interface{}) bool {
+		keys = append(keys, key)
+		count--
+		return count > 0
+	})
 	return
 }
+
+// ScanBefore returns at most count keys less than end in ascending order, they are the greatest ones.
+// All keys are taken into account if end is nil.
+func (t *AdaptiveRadixTree) ScanBefore(end []byte, count int) [][]byte {
+	if count <= 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, count)
+	t.Descend(end, func(key []byte, _ interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < count
+	})
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return keys
+}
+
+// artWalk is a range walk over the tree, nodes counts the nodes it reached.
+type artWalk struct {
+	fn    func(key []byte, value interface{}) bool
+	nodes int
+}
+
+// ascend walks the subtree of n in ascending order, skipping the keys less than start while bounded.
+// Parameter depth is the number of bytes of start matched by the path leading to n.
+func (w *artWalk) ascend(n *artNode, start []byte, depth int, bounded bool) bool {
+	w.nodes++
+	if bounded {
+		rest := start[depth:]
+		l := len(n.prefix)
+		if len(rest) < l {
+			l = len(rest)
+		}
+		c := bytes.Compare(n.prefix[:l], rest[:l])
+		if c < 0 {
+			return true
+		}
+		// start is left behind once the path goes above it, or runs out within the prefix
+		bounded = c == 0 && len(rest) > len(n.prefix)
+	}
+
+	pos := 0
+	if bounded {
+		// the key ending here is shorter than start, thus less than it
+		depth += len(n.prefix)
+		b := start[depth]
+		pos = n.seek(b)
+		if next, edge, child := n.at(pos); child != nil && edge == b {
+			if !w.ascend(child, start, depth+1, true) {
+				return false
+			}
+			pos = next
+		}
+	} else if n.leaf != nil && !w.fn(n.leaf.key, n.leaf.value) {
+		return false
+	}
+	for {
+		next, _, child := n.at(pos)
+		if child == nil {
+			return true
+		}
+		if !w.ascend(child, nil, 0, false) {
+			return false
+		}
+		pos = next
+	}
+}
+
+// descend walks the subtree of n in descending order, skipping the keys not less than end while bounded.
+// Parameter depth is the number of bytes of end matched by the path leading to n.
+func (w *artWalk) descend(n *artNode, end []byte, depth int, bounded bool) bool {
+	w.nodes++
+	if bounded {
+		rest := end[depth:]
+		l := len(n.prefix)
+		if len(rest) < l {
+			l = len(rest)
+		}
+		c := bytes.Compare(n.prefix[:l], rest[:l])
+		if c > 0 || c == 0 && len(rest) <= len(n.prefix) {
+			return true
+		}
+		// end is left behind once the path goes below it
+		bounded = c == 0
+	}
+
+	pos := n.end()
+	if bounded {
+		depth += len(n.prefix)
+		b := end[depth]
+		pos = n.seek(b)
+		if _, edge, child := n.at(pos); child != nil && edge == b {
+			if !w.descend(child, end, depth+1, true) {
+				return false
+			}
+		}
+	}
+	for {
+		prev, _, child := n.before(pos)
+		if child == nil {
+			break
+		}
+		if !w.descend(child, nil, 0, false) {
+			return false
+		}
+		pos = prev
+	}
+	// the key ending here is shorter than end if still bounded, thus less than it
+	if n.leaf != nil {
+		return w.fn(n.leaf.key, n.leaf.value)
+	}
+	return true
+}
+
+type artFrame struct {
+	node *artNode
+	// pos is the position of the next child to visit, -1 if the leaf of node is not visited yet.
+	pos int
+}
+
+type artIterator struct {
+	tree    *AdaptiveRadixTree
+	version int
+	stack   []artFrame
+	next    *artLeaf
+}
+
+func (it *artIterator) HasNext() bool {
+	return it.next != nil
+}
+
+func (it *artIterator) Next() (Node, error) {
+	if it.version != it.tree.version {
+		return nil, ErrConcurrentModification
+	}
+	if it.next == nil {
+		return nil, ErrNoMoreNodes
+	}
+	leaf := it.next
+	it.advance()
+	return leaf, nil
+}
+
+// advance moves the iterator to the next leaf in ascending order.
+func (it *artIterator) advance() {
+	it.next = nil
+	for len(it.stack) > 0 {
+		top := &it.stack[len(it.stack)-1]
+		if top.pos < 0 {
+			top.pos = 0
+			if top.node.leaf != nil {
+				it.next = top.node.leaf
+				return
+			}
+			continue
+		}
+		next, _, child := top.node.at(top.pos)
+		if child == nil {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		top.pos = next
+		it.stack = append(it.stack, artFrame{node: child, pos: -1})
+	}
+}
+
+func (n *artNode) child(b byte) *artNode {
+	if n.full != nil {
+		return n.full[b]
+	}
+	if i := n.seek(b); i < len(n.edges) && n.edges[i] == b {
+		return n.children[i]
+	}
+	return nil
+}
+
+// seek returns the position of the first child whose edge is not less than b.
+func (n *artNode) seek(b byte) int {
+	if n.full != nil {
+		return int(b)
+	}
+	return sort.Search(len(n.edges), func(i int) bool { return n.edges[i] >= b })
+}
+
+// at returns the first child at or after position pos, and the position following it.
+// The returned child is nil if there is none.
+func (n *artNode) at(pos int) (next int, edge byte, child *artNode) {
+	if n.full != nil {
+		for ; pos < len(n.full); pos++ {
+			if n.full[pos] != nil {
+				return pos + 1, byte(pos), n.full[pos]
+			}
+		}
+		return pos, 0, nil
+	}
+	if pos < len(n.children) {
+		return pos + 1, n.edges[pos], n.children[pos]
+	}
+	return pos, 0, nil
+}
+
+// nth returns the i-th child in edge order.
+func (n *artNode) nth(i int) *artNode {
+	if n.full == nil {
+		return n.children[i]
+	}
+	for _, child := range n.full {
+		if child == nil {
+			continue
+		}
+		if i == 0 {
+			return child
+		}
+		i--
+	}
+	return nil
+}
+
+// before returns the last child before position pos, and its own position.
+// The returned child is nil if there is none.
+func (n *artNode) before(pos int) (prev int, edge byte, child *artNode) {
+	if n.full != nil {
+		for pos--; pos >= 0; pos-- {
+			if n.full[pos] != nil {
+				return pos, byte(pos), n.full[pos]
+			}
+		}
+		return 0, 0, nil
+	}
+	if pos > 0 {
+		return pos - 1, n.edges[pos-1], n.children[pos-1]
+	}
+	return 0, 0, nil
+}
+
+// end returns the position following the last child.
+func (n *artNode) end() int {
+	if n.full != nil {
+		return len(n.full)
+	}
+	return len(n.children)
+}
+
+func (n *artNode) setChild(b byte, child *artNode) {
+	if n.full != nil {
+		if n.full[b] == nil {
+			n.num++
+		}
+		n.full[b] = child
+		return
+	}
+	i := n.seek(b)
+	if i < len(n.edges) && n.edges[i] == b {
+		n.children[i] = child
+		return
+	}
+	n.edges = append(n.edges, 0)
+	copy(n.edges[i+1:], n.edges[i:])
+	n.edges[i] = b
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+	n.num++
+
+	if n.num > artMaxSorted {
+		n.full = new([256]*artNode)
+		for j, edge := range n.edges {
+			n.full[edge] = n.children[j]
+		}
+		n.edges, n.children = nil, nil
+	}
+}
+
+func (n *artNode) removeChild(b byte) {
+	if n.full != nil {
+		if n.full[b] == nil {
+			return
+		}
+		n.full[b] = nil
+		n.num--
+		if n.num <= artMinFull {
+			n.edges = make([]byte, 0, artMaxSorted)
+			n.children = make([]*artNode, 0, artMaxSorted)
+			for edge, child := range n.full {
+				if child != nil {
+					n.edges = append(n.edges, byte(edge))
+					n.children = append(n.children, child)
+				}
+			}
+			n.full = nil
+		}
+		return
+	}
+	i := n.seek(b)
+	if i == len(n.edges) || n.edges[i] != b {
+		return
+	}
+	n.edges = append(n.edges[:i], n.edges[i+1:]...)
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+	n.num--
+}
+
+// mergeChild merges the only child of n into n.
+func (n *artNode) mergeChild() {
+	_, edge, child := n.at(0)
+	prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+	prefix = append(prefix, n.prefix...)
+	prefix = append(prefix, edge)
+	prefix = append(prefix, child.prefix...)
+	*n = *child
+	n.prefix = prefix
+}
+
+func commonPrefixLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -2,6 +2,8 @@ package ds
 
 import (
 	"bytes"
+	"fmt"
+	"math/rand"
 	"reflect"
 	"sort"
 	"testing"
@@ -172,3 +174,299 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	}
 	assert.Equal(t, keys, targets)
 }
+
+func TestAdaptiveRadixTree_ScanAfter(t *testing.T) {
+	art := NewART()
+	for _, key := range []string{"b", "a", "ab", "c", "abc"} {
+		art.Put([]byte(key), 1)
+	}
+
+	tests := []struct {
+		name  string
+		after []byte
+		count int
+		want  [][]byte
+	}{
+		{"from beginning", nil, 2, [][]byte{[]byte("a"), []byte("ab")}},
+		{"after existing key", []byte("ab"), 2, [][]byte{[]byte("abc"), []byte("b")}},
+		{"after missing key", []byte("abd"), 10, [][]byte{[]byte("b"), []byte("c")}},
+		{"after last key", []byte("c"), 10, nil},
+		{"zero count", nil, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, art.ScanAfter(tt.after, tt.count))
+		})
+	}
+}
+
+func TestAdaptiveRadixTree_ScanFrom_ScanBefore(t *testing.T) {
+	art := NewART()
+	for _, key := range []string{"b", "a", "ab", "c", "abc"} {
+		art.Put([]byte(key), 1)
+	}
+
+	assert.Equal(t, [][]byte{[]byte("ab"), []byte("abc")}, art.ScanFrom([]byte("ab"), 2))
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, art.ScanFrom([]byte("abd"), 5))
+	assert.Nil(t, art.ScanFrom([]byte("d"), 5))
+
+	assert.Equal(t, [][]byte{[]byte("abc"), []byte("b")}, art.ScanBefore([]byte("c"), 2))
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("ab")}, art.ScanBefore([]byte("abc"), 5))
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, art.ScanBefore(nil, 2))
+	assert.Equal(t, [][]byte{}, art.ScanBefore([]byte("a"), 2))
+}
+
+func TestAdaptiveRadixTree_Random(t *testing.T) {
+	art := NewART()
+	rnd := rand.New(rand.NewSource(1))
+	randKey := func() []byte {
+		// short keys over a wide alphabet, so that nodes share prefixes, grow and shrink
+		key := make([]byte, rnd.Intn(4))
+		for i := range key {
+			key[i] = byte(rnd.Intn(64))
+		}
+		return key
+	}
+
+	want := make(map[string]int)
+	for i := 0; i < 20000; i++ {
+		key := randKey()
+		if rnd.Intn(3) == 0 {
+			val, deleted := art.Delete(key)
+			old, ok := want[string(key)]
+			assert.Equal(t, ok, deleted)
+			if ok {
+				assert.Equal(t, old, val)
+			}
+			delete(want, string(key))
+		} else {
+			art.Put(key, i)
+			want[string(key)] = i
+		}
+	}
+
+	var keys [][]byte
+	for key, val := range want {
+		keys = append(keys, []byte(key))
+		assert.Equal(t, val, art.Get([]byte(key)))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	assert.Equal(t, len(keys), art.Size())
+
+	var walked [][]byte
+	iter := art.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		walked = append(walked, node.Key())
+	}
+	assert.Equal(t, keys, walked)
+
+	for i := 0; i < 1000; i++ {
+		after := randKey()
+		j := sort.Search(len(keys), func(j int) bool { return bytes.Compare(keys[j], after) > 0 })
+		end := j + 5
+		if end > len(keys) {
+			end = len(keys)
+		}
+		got := art.ScanAfter(after, 5)
+		if j == end {
+			assert.Nil(t, got)
+		} else {
+			assert.Equal(t, keys[j:end], got)
+		}
+	}
+}
+
+func TestAdaptiveRadixTree_ScanWindow(t *testing.T) {
+	art := NewART()
+	for i := 0; i < 100000; i++ {
+		art.Put([]byte(fmt.Sprintf("key-%06d", i)), i)
+	}
+
+	// a batch reaches the nodes on the path to its bound and the ones holding its keys, not the rest of the tree
+	var keys [][]byte
+	nodes := art.ascend([]byte("key-050000"), func(key []byte, _ interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 10
+	})
+	assert.Equal(t, []byte("key-050000"), keys[0])
+	assert.Equal(t, []byte("key-050009"), keys[9])
+	assert.Less(t, nodes, 40)
+
+	keys = nil
+	nodes = art.descend([]byte("key-050000"), func(key []byte, _ interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 10
+	})
+	assert.Equal(t, []byte("key-049999"), keys[0])
+	assert.Equal(t, []byte("key-049990"), keys[9])
+	assert.Less(t, nodes, 40)
+
+	keys = nil
+	nodes = art.descend(nil, func(key []byte, _ interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 10
+	})
+	assert.Equal(t, []byte("key-099999"), keys[0])
+	assert.Less(t, nodes, 40)
+}
+
+func TestAdaptiveRadixTree_Random_Range(t *testing.T) {
+	art := NewART()
+	rnd := rand.New(rand.NewSource(2))
+	randKey := func() []byte {
+		key := make([]byte, rnd.Intn(5))
+		for i := range key {
+			key[i] = byte('a' + rnd.Intn(4))
+		}
+		return key
+	}
+
+	set := make(map[string]struct{})
+	for i := 0; i < 2000; i++ {
+		key := randKey()
+		if rnd.Intn(4) == 0 {
+			art.Delete(key)
+			delete(set, string(key))
+		} else {
+			art.Put(key, i)
+			set[string(key)] = struct{}{}
+		}
+	}
+	var keys [][]byte
+	for key := range set {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	for i := 0; i < 500; i++ {
+		bound := randKey()
+		count := rnd.Intn(6) + 1
+
+		from := sort.Search(len(keys), func(j int) bool { return bytes.Compare(keys[j], bound) >= 0 })
+		want := keys[from:]
+		if len(want) > count {
+			want = want[:count]
+		}
+		if got := art.ScanFrom(bound, count); len(want) == 0 {
+			assert.Nil(t, got)
+		} else {
+			assert.Equal(t, want, got)
+		}
+
+		want = keys[:from]
+		if len(want) > count {
+			want = want[len(want)-count:]
+		}
+		assert.Equal(t, append([][]byte{}, want...), art.ScanBefore(bound, count))
+
+		var prefixed [][]byte
+		for _, key := range keys {
+			if bytes.HasPrefix(key, bound) {
+				prefixed = append(prefixed, key)
+			}
+		}
+		assert.Equal(t, prefixed, art.PrefixScan(bound, -1))
+	}
+}
+
+func TestAdaptiveRadixTree_Random_Key(t *testing.T) {
+	art := NewART()
+	key, _ := art.Random()
+	assert.Nil(t, key)
+
+	want := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		art.Put([]byte(key), i)
+		want[key] = true
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		key, val := art.Random()
+		assert.True(t, want[string(key)])
+		assert.Equal(t, art.Get(key), val)
+		seen[string(key)] = true
+	}
+	// every key has a chance to be picked
+	assert.Equal(t, len(want), len(seen))
+}
+
+func TestAdaptiveRadixTree_Random_Model(t *testing.T) {
+	art := NewART()
+	rnd := rand.New(rand.NewSource(3))
+	// short keys over all bytes make nodes grow into full ones and shrink back
+	randKey := func() []byte {
+		key := make([]byte, rnd.Intn(3))
+		for i := range key {
+			key[i] = byte(rnd.Intn(256))
+		}
+		return key
+	}
+
+	model := make(map[string]int)
+	for i := 0; i < 50000; i++ {
+		key := randKey()
+		old, ok := model[string(key)]
+		if rnd.Intn(3) == 0 {
+			val, deleted := art.Delete(key)
+			assert.Equal(t, ok, deleted)
+			if ok {
+				assert.Equal(t, old, val)
+			}
+			delete(model, string(key))
+		} else {
+			val, updated := art.Put(key, i)
+			assert.Equal(t, ok, updated)
+			if ok {
+				assert.Equal(t, old, val)
+			}
+			model[string(key)] = i
+		}
+		assert.Equal(t, len(model), art.Size())
+	}
+
+	var keys [][]byte
+	for key, val := range model {
+		keys = append(keys, []byte(key))
+		assert.Equal(t, val, art.Get([]byte(key)))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	var walked [][]byte
+	for iter := art.Iterator(); iter.HasNext(); {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, model[string(node.Key())], node.Value())
+		walked = append(walked, node.Key())
+	}
+	assert.Equal(t, keys, walked)
+}
+
+func TestAdaptiveRadixTree_Iterator_Modified(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("a"), 1)
+	art.Put([]byte("b"), 2)
+
+	iter := art.Iterator()
+	_, err := iter.Next()
+	assert.Nil(t, err)
+	// replacing a value keeps the shape of the tree
+	art.Put([]byte("b"), 3)
+	node, err := iter.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, node.Value())
+	_, err = iter.Next()
+	assert.Equal(t, ErrNoMoreNodes, err)
+
+	iter = art.Iterator()
+	art.Put([]byte("c"), 4)
+	_, err = iter.Next()
+	assert.Equal(t, ErrConcurrentModification, err)
+}
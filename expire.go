@@ -0,0 +1,704 @@
+package lazydb
+
+import (
+	"lazydb/ds"
+	"lazydb/logfile"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// expireSampleSize is the number of keys with ttl checked in one round.
+	expireSampleSize = 20
+	// another round starts immediately if more than 1/expireRepeatDivisor of the samples are expired.
+	expireRepeatDivisor = 4
+	// expireCycleTimeLimit limits how long a cycle may hold the index.
+	expireCycleTimeLimit = 25 * time.Millisecond
+	// expireDeleteBatch is the number of members deleted from an expired collection at a time,
+	// a larger collection is deleted over several rounds, so that one key does not hold the index for long.
+	expireDeleteBatch = 64
+)
+
+// expiredKey is a key deleted by the expiration cycle.
+type expiredKey struct {
+	typ valueType
+	key []byte
+}
+
+func (db *LazyDB) startExpireCycle() {
+	if db.cfg.ExpireCycleInterval <= 0 {
+		return
+	}
+	db.expireStop = make(chan struct{})
+	db.expireDone = make(chan struct{})
+	go func() {
+		defer close(db.expireDone)
+		ticker := time.NewTicker(db.cfg.ExpireCycleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.activeExpireCycle()
+				db.requeueExpiredItems()
+			case <-db.expireStop:
+				return
+			}
+		}
+	}()
+}
+
+func (db *LazyDB) stopExpireCycle() {
+	if db.expireStop == nil {
+		return
+	}
+	close(db.expireStop)
+	<-db.expireDone
+	db.expireStop = nil
+}
+
+// activeExpireCycle deletes expired keys like redis: it samples keys with ttl,
+// deletes the expired ones, and repeats while many of the samples are expired.
+func (db *LazyDB) activeExpireCycle() {
+	// the primary writes the tombstones, which are replicated to followers.
+	if db.isReadOnly() {
+		return
+	}
+	deadline := time.Now().Add(expireCycleTimeLimit)
+	for {
+		expired, sampled := db.expireStrSample(expireSampleSize, deadline)
+		for _, typ := range collectionTypes {
+			keys, n := db.expireKeySample(typ, expireSampleSize, deadline)
+			expired = append(expired, keys...)
+			sampled += n
+		}
+		db.fireExpired(expired)
+		fields, n := db.expireHashFieldSample(expireSampleSize, deadline)
+		sampled += n
+		if sampled == 0 || (len(expired)+fields)*expireRepeatDivisor <= sampled || time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// expireKeySample checks at most n collection keys of typ with ttl, deletes the expired ones and returns them.
+// It stops deleting once deadline has passed, the keys left are deleted by later cycles,
+// and so are the members of large collections beyond expireDeleteBatch.
+func (db *LazyDB) expireKeySample(typ valueType, n int, deadline time.Time) ([]*expiredKey, int) {
+	mu := db.indexMutex(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var sampled int
+	var keys []string
+	ts := time.Now().Unix()
+	for key, meta := range db.expiresOf(typ) {
+		if sampled >= n {
+			break
+		}
+		sampled++
+		if meta.expiredAt < ts {
+			keys = append(keys, key)
+		}
+	}
+
+	var expired []*expiredKey
+	for _, key := range keys {
+		if time.Now().After(deadline) {
+			break
+		}
+		done, err := db.dropMembers(typ, []byte(key), expireDeleteBatch)
+		if err == nil && done {
+			err = db.deleteKey(typ, []byte(key))
+		}
+		if err != nil {
+			log.Printf("delete expired key err: %v", err)
+			break
+		}
+		if done {
+			expired = append(expired, &expiredKey{typ: typ, key: []byte(key)})
+		}
+	}
+	return expired, sampled
+}
+
+// dropMembers deletes n members of the collection key of typ if it holds more than that,
+// and reports whether the key is small enough to be deleted at once by deleteKey.
+// Lists, hashes, sets, sorted sets and streams are dropped by batches, other types are always deleted at once.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) dropMembers(typ valueType, key []byte, n int) (bool, error) {
+	var idxTree *ds.AdaptiveRadixTree
+	switch typ {
+	case valueTypeList:
+		idxTree = db.listIndex.trees[string(key)]
+	case valueTypeHash:
+		idxTree = db.hashIndex.trees[string(key)]
+	case valueTypeSet:
+		idxTree = db.setIndex.trees[string(key)]
+	case valueTypeZSet:
+		if idx := db.zSetIndex.indexes[string(key)]; idx != nil {
+			idxTree = idx.tree
+		}
+	case valueTypeStream:
+		if s := db.streamIndex.streams[string(key)]; s != nil {
+			idxTree = s.tree
+		}
+	}
+	if idxTree == nil || idxTree.Size() <= n {
+		return true, nil
+	}
+
+	var members [][]byte
+	idxTree.Ascend(nil, func(k []byte, _ interface{}) bool {
+		// the list meta is reset by deleteKey
+		if typ != valueTypeList || string(k) != string(key) {
+			members = append(members, k)
+		}
+		return len(members) < n
+	})
+	switch typ {
+	case valueTypeSet:
+		for _, sum := range members {
+			if err := db.dropSetMember(idxTree, key, sum); err != nil {
+				return false, err
+			}
+		}
+	case valueTypeStream:
+		var entries []*logfile.LogEntry
+		for _, subKey := range members {
+			entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, subKey), Stat: logfile.SDelete})
+		}
+		if err := db.writeStreamEntries(entries); err != nil {
+			return false, err
+		}
+	default:
+		for _, k := range members {
+			if err := db.writeTombstone(typ, idxTree, k, &logfile.LogEntry{Key: k, Stat: logfile.SDelete}); err != nil {
+				return false, err
+			}
+			if typ == valueTypeHash {
+				db.setFieldExpire(key, k, 0)
+			}
+		}
+	}
+	return false, nil
+}
+
+// expireHashFieldSample checks at most n hash fields with ttl, deletes the expired ones until deadline has passed,
+// and returns the number of fields deleted and checked.
+func (db *LazyDB) expireHashFieldSample(n int, deadline time.Time) (int, int) {
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
+
+	var sampled int
+	expired := make(map[string][]string)
+	ts := time.Now().Unix()
+	for key, fields := range db.hashIndex.fieldExpires {
+		for hashKey, expiredAt := range fields {
+			if sampled >= n {
+				break
+			}
+			sampled++
+			if expiredAt < ts {
+				expired[key] = append(expired[key], hashKey)
+			}
+		}
+		if sampled >= n {
+			break
+		}
+	}
+
+	var count int
+	for key, hashKeys := range expired {
+		if time.Now().After(deadline) {
+			break
+		}
+		idxTree := db.hashIndex.trees[key]
+		for _, hashKey := range hashKeys {
+			entry := &logfile.LogEntry{Key: []byte(hashKey), Stat: logfile.SDelete}
+			if err := db.writeTombstone(valueTypeHash, idxTree, entry.Key, entry); err != nil {
+				log.Printf("delete expired hash field err: %v", err)
+				return count, sampled
+			}
+			db.setFieldExpire([]byte(key), entry.Key, 0)
+			count++
+		}
+		db.notifyKeyspaceEvent(notifyHash, "hexpired", []byte(key))
+		if idxTree.Size() == 0 {
+			if err := db.setKeyExpire(valueTypeHash, []byte(key), 0); err != nil {
+				log.Printf("delete expired hash field err: %v", err)
+				return count, sampled
+			}
+		}
+	}
+	return count, sampled
+}
+
+// expireStrSample checks at most n strings with ttl, deletes the expired ones until deadline has passed and returns them.
+// The random iteration order of map makes the samples random.
+func (db *LazyDB) expireStrSample(n int, deadline time.Time) ([]*expiredKey, int) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	var sampled int
+	var keys []string
+	ts := time.Now().Unix()
+	for key, expiredAt := range db.strIndex.expires {
+		if sampled >= n {
+			break
+		}
+		sampled++
+		if expiredAt < ts {
+			keys = append(keys, key)
+		}
+	}
+
+	var expired []*expiredKey
+	for _, key := range keys {
+		if time.Now().After(deadline) {
+			break
+		}
+		if err := db.deleteStr([]byte(key)); err != nil {
+			log.Printf("delete expired key err: %v", err)
+			break
+		}
+		expired = append(expired, &expiredKey{typ: valueTypeString, key: []byte(key)})
+	}
+	return expired, sampled
+}
+
+// deleteStr writes the tombstone of a string and removes it from the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) deleteStr(key []byte) error {
+	entry := &logfile.LogEntry{Key: key, Stat: logfile.SDelete}
+	pos, err := db.writeLogEntry(valueTypeString, entry)
+	if err != nil {
+		return err
+	}
+	delVal, updated := db.strIndex.idxTree.Delete(key)
+	delete(db.strIndex.expires, string(key))
+	db.dropBitmapPages(key, true)
+	if updated {
+		db.notifyChange(valueTypeString, entry)
+	}
+
+	// delete invalid entry, and also merge the delete entry
+	_, size := logfile.EncodeEntry(entry)
+	db.trySendDiscard(delVal, updated, valueTypeString)
+	db.trySendDiscard(&Value{fid: pos.fid, entrySize: size}, true, valueTypeString)
+	return nil
+}
+
+// trySendDiscard is sendDiscard for the paths run by the expiration cycle, which must not stop the db.
+// If the discard channel is full, the entry is only missing from the discard stats that pick the log files to merge.
+func (db *LazyDB) trySendDiscard(oldVal interface{}, updated bool, typ valueType) {
+	node, _ := oldVal.(*Value)
+	if !updated || node == nil || node.entrySize == 0 {
+		return
+	}
+	select {
+	case db.discardsMap[typ].valChan <- node:
+	default:
+		log.Printf("send discard fail, the discard channel of %s is full", dataTypes[typ])
+	}
+}
+
+// fireExpired publishes the "expired" keyspace events and calls ExpireCallback, without holding any lock.
+func (db *LazyDB) fireExpired(expired []*expiredKey) {
+	for _, ek := range expired {
+		db.notifyKeyspaceEvent(notifyExpired, "expired", ek.key)
+		if db.cfg.ExpireCallback != nil {
+			db.cfg.ExpireCallback(dataTypes[ek.typ], ek.key)
+		}
+	}
+}
+
+// setStrExpire records the ttl of a string key, expiredAt 0 removes it.
+// The caller must hold the lock of strIndex.
+func (db *LazyDB) setStrExpire(key []byte, expiredAt int64) {
+	if expiredAt == 0 {
+		if _, ok := db.strIndex.expires[string(key)]; ok {
+			delete(db.strIndex.expires, string(key))
+		}
+		return
+	}
+	if old, ok := db.strIndex.expires[string(key)]; !ok || old != expiredAt {
+		db.strIndex.expires[string(key)] = expiredAt
+	}
+}
+
+// collectionTypes are the value types whose keys hold a key meta entry for ttl.
+var collectionTypes = []valueType{valueTypeList, valueTypeHash, valueTypeSet, valueTypeZSet, valueTypeStream, valueTypeJSON, valueTypeTimeSeries}
+
+// Expire sets the expiration time for the given key, whatever type it holds.
+func (db *LazyDB) Expire(key []byte, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	if reservedKey(key) {
+		return ErrKeyNotFound
+	}
+	expiredAt := time.Now().Add(duration).Unix()
+	err := db.strExpire(key, expiredAt)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	found := err == nil
+	for _, typ := range collectionTypes {
+		ok, err := db.expireKey(typ, key, expiredAt)
+		if err != nil {
+			return err
+		}
+		found = found || ok
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "expire", key)
+	return nil
+}
+
+// TTL gets ttl(time to live) for the given key, 0 means the key has no expiration time.
+// If the key is held by more than one type, strings are checked first, then lists, hashes, sets, sorted sets, streams, json documents and time series.
+func (db *LazyDB) TTL(key []byte) (int64, error) {
+	if reservedKey(key) {
+		return 0, ErrKeyNotFound
+	}
+	ttl, err := db.strTTL(key)
+	if err != ErrKeyNotFound {
+		return ttl, err
+	}
+	for _, typ := range collectionTypes {
+		if ttl, ok := db.keyTTL(typ, key); ok {
+			return ttl, nil
+		}
+	}
+	return 0, ErrKeyNotFound
+}
+
+// Persist removes the expiration time for the given key, whatever type it holds.
+func (db *LazyDB) Persist(key []byte) error {
+	if reservedKey(key) {
+		return ErrKeyNotFound
+	}
+	err := db.strPersist(key)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	found := err == nil
+	for _, typ := range collectionTypes {
+		ok, err := db.expireKey(typ, key, 0)
+		if err != nil {
+			return err
+		}
+		found = found || ok
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "persist", key)
+	return nil
+}
+
+// expireKey sets the ttl of the collection key of typ, and reports whether the key exists.
+func (db *LazyDB) expireKey(typ valueType, key []byte, expiredAt int64) (bool, error) {
+	mu := db.indexMutex(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := db.expireIfNeeded(typ, key); err != nil {
+		return false, err
+	}
+	if !db.keyExists(typ, key) {
+		return false, nil
+	}
+	return true, db.setKeyExpire(typ, key, expiredAt)
+}
+
+// keyTTL returns the ttl of the collection key of typ, and reports whether the key exists.
+func (db *LazyDB) keyTTL(typ valueType, key []byte) (int64, bool) {
+	mu := db.indexMutex(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if db.keyExpired(typ, key) || !db.keyExists(typ, key) {
+		return 0, false
+	}
+	var ttl int64
+	if meta := db.expiresOf(typ)[string(key)]; meta != nil {
+		ttl = meta.expiredAt - time.Now().Unix()
+	}
+	return ttl, true
+}
+
+// keyExists reports whether the collection key of typ holds any member, expired or not.
+// The caller must hold the lock of the index.
+func (db *LazyDB) keyExists(typ valueType, key []byte) bool {
+	switch typ {
+	case valueTypeList:
+		return db.listIndex.trees[string(key)] != nil
+	case valueTypeHash:
+		idxTree := db.hashIndex.trees[string(key)]
+		return idxTree != nil && idxTree.Size() > 0
+	case valueTypeSet:
+		idxTree := db.setIndex.trees[string(key)]
+		return idxTree != nil && idxTree.Size() > 0
+	case valueTypeZSet:
+		idx := db.zSetIndex.indexes[string(key)]
+		return idx != nil && idx.tree.Size() > 0
+	case valueTypeStream:
+		return db.streamIndex.streams[string(key)] != nil
+	case valueTypeJSON:
+		return db.jsonIndex.idxTree.Get(key) != nil
+	case valueTypeTimeSeries:
+		return db.tsIndex.series[string(key)] != nil
+	}
+	return false
+}
+
+// indexMutex returns the lock of the index of typ.
+func (db *LazyDB) indexMutex(typ valueType) *sync.RWMutex {
+	switch typ {
+	case valueTypeList:
+		return db.listIndex.mu
+	case valueTypeHash:
+		return db.hashIndex.mu
+	case valueTypeSet:
+		return db.setIndex.mu
+	case valueTypeZSet:
+		return db.zSetIndex.mu
+	case valueTypeStream:
+		return db.streamIndex.mu
+	case valueTypeJSON:
+		return db.jsonIndex.mu
+	case valueTypeTimeSeries:
+		return db.tsIndex.mu
+	default:
+		return db.strIndex.mu
+	}
+}
+
+// expiresOf returns the key meta of the collection keys of typ with ttl.
+func (db *LazyDB) expiresOf(typ valueType) map[string]*Value {
+	switch typ {
+	case valueTypeList:
+		return db.listIndex.expires
+	case valueTypeHash:
+		return db.hashIndex.expires
+	case valueTypeSet:
+		return db.setIndex.expires
+	case valueTypeZSet:
+		return db.zSetIndex.expires
+	case valueTypeStream:
+		return db.streamIndex.expires
+	case valueTypeJSON:
+		return db.jsonIndex.expires
+	case valueTypeTimeSeries:
+		return db.tsIndex.expires
+	}
+	return nil
+}
+
+// keyExpired reports whether the collection key of typ has expired.
+// The caller must hold the lock of the index.
+func (db *LazyDB) keyExpired(typ valueType, key []byte) bool {
+	meta := db.expiresOf(typ)[string(key)]
+	return meta != nil && meta.expiredAt < time.Now().Unix()
+}
+
+// expireIfNeeded deletes the collection key of typ if it has expired, so that writes start from an empty key.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) expireIfNeeded(typ valueType, key []byte) error {
+	if !db.keyExpired(typ, key) {
+		return nil
+	}
+	if err := db.deleteKey(typ, key); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyExpired, "expired", key)
+	return nil
+}
+
+// setKeyExpire writes the key meta entry holding the ttl of a collection key, expiredAt 0 removes the ttl.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) setKeyExpire(typ valueType, key []byte, expiredAt int64) error {
+	expires := db.expiresOf(typ)
+	oldMeta := expires[string(key)]
+	if oldMeta == nil && expiredAt == 0 {
+		return nil
+	}
+	entry := &logfile.LogEntry{Key: key, Stat: logfile.SKeyMeta, ExpiredAt: expiredAt}
+	pos, err := db.writeLogEntry(typ, entry)
+	if err != nil {
+		return err
+	}
+	db.sendDiscard(oldMeta, true, typ)
+	db.notifyChange(typ, entry)
+	if expiredAt == 0 {
+		delete(expires, string(key))
+		// removing ttl makes the entry itself invalid, the same as a tombstone
+		db.sendDiscard(&Value{fid: pos.fid, entrySize: pos.entrySize}, true, typ)
+		return nil
+	}
+	expires[string(key)] = &Value{fid: pos.fid, offset: pos.offset, entrySize: pos.entrySize, expiredAt: expiredAt}
+	return nil
+}
+
+// buildKeyMeta applies a key meta entry to the index of typ, and returns the key meta it replaced.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) buildKeyMeta(typ valueType, entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	expires := db.expiresOf(typ)
+	oldMeta, ok := expires[string(entry.Key)]
+	if entry.ExpiredAt == 0 {
+		delete(expires, string(entry.Key))
+	} else {
+		_, size := logfile.EncodeEntry(entry)
+		expires[string(entry.Key)] = &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size, expiredAt: entry.ExpiredAt}
+	}
+	if !ok {
+		return nil
+	}
+	return oldMeta
+}
+
+// mergeKeyMeta rewrites the key meta entry if it is still the latest one of the key.
+func (db *LazyDB) mergeKeyMeta(typ valueType, fid uint32, offset int64, ent *logfile.LogEntry) error {
+	mu := db.indexMutex(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	expires := db.expiresOf(typ)
+	meta := expires[string(ent.Key)]
+	if meta == nil || meta.fid != fid || meta.offset != offset {
+		return nil
+	}
+	pos, err := db.appendLogEntry(typ, ent)
+	if err != nil {
+		return err
+	}
+	expires[string(ent.Key)] = &Value{fid: pos.fid, offset: pos.offset, entrySize: pos.entrySize, expiredAt: meta.expiredAt}
+	return nil
+}
+
+// deleteKey removes the key of typ with all its members and its ttl.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) deleteKey(typ valueType, key []byte) error {
+	switch typ {
+	case valueTypeString:
+		return db.deleteStr(key)
+	case valueTypeList:
+		if idxTree := db.listIndex.trees[string(key)]; idxTree != nil {
+			for _, k := range treeKeys(idxTree) {
+				// the list meta is reset below
+				if string(k) == string(key) {
+					continue
+				}
+				if err := db.writeTombstone(typ, idxTree, k, &logfile.LogEntry{Key: k, Stat: logfile.SDelete}); err != nil {
+					return err
+				}
+			}
+			if err := db.saveLMeta(idxTree, key, initialListSeq, initialListSeq+1); err != nil {
+				return err
+			}
+			db.unindexCollectionKey(valueTypeList, key)
+			delete(db.listIndex.trees, string(key))
+		}
+	case valueTypeHash:
+		if idxTree := db.hashIndex.trees[string(key)]; idxTree != nil {
+			for _, k := range treeKeys(idxTree) {
+				if err := db.writeTombstone(typ, idxTree, k, &logfile.LogEntry{Key: k, Stat: logfile.SDelete}); err != nil {
+					return err
+				}
+			}
+			db.unindexCollectionKey(valueTypeHash, key)
+			delete(db.hashIndex.trees, string(key))
+			delete(db.hashIndex.fieldExpires, string(key))
+		}
+	case valueTypeSet:
+		if idxTree := db.setIndex.trees[string(key)]; idxTree != nil {
+			for _, sum := range treeKeys(idxTree) {
+				if err := db.dropSetMember(idxTree, key, sum); err != nil {
+					return err
+				}
+			}
+			db.unindexCollectionKey(valueTypeSet, key)
+			delete(db.setIndex.trees, string(key))
+		}
+	case valueTypeZSet:
+		if idx := db.zSetIndex.indexes[string(key)]; idx != nil {
+			for _, k := range treeKeys(idx.tree) {
+				if err := db.writeTombstone(typ, idx.tree, k, &logfile.LogEntry{Key: k, Stat: logfile.SDelete}); err != nil {
+					return err
+				}
+			}
+			db.unindexCollectionKey(valueTypeZSet, key)
+			delete(db.zSetIndex.indexes, string(key))
+		}
+	case valueTypeStream:
+		if s := db.streamIndex.streams[string(key)]; s != nil {
+			var entries []*logfile.LogEntry
+			for _, subKey := range treeKeys(s.tree) {
+				entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, subKey), Stat: logfile.SDelete})
+			}
+			// the stream is removed from the index with its last sub key
+			if err := db.writeStreamEntries(entries); err != nil {
+				return err
+			}
+		}
+	case valueTypeJSON:
+		if db.jsonIndex.idxTree.Get(key) != nil {
+			if err := db.writeTombstone(typ, db.jsonIndex.idxTree, key, &logfile.LogEntry{Key: key, Stat: logfile.SDelete}); err != nil {
+				return err
+			}
+		}
+	case valueTypeTimeSeries:
+		if err := db.deleteTimeSeries(key); err != nil {
+			return err
+		}
+	}
+	return db.setKeyExpire(typ, key, 0)
+}
+
+// dropSetMember writes the delete entry of the member of the set stored at key whose hash is sum,
+// removes it from idxTree and sends both to discard.
+func (db *LazyDB) dropSetMember(idxTree *ds.AdaptiveRadixTree, key, sum []byte) error {
+	member, _ := db.getValue(idxTree, sum, valueTypeSet)
+	entry := &logfile.LogEntry{Key: key, Value: sum, Stat: logfile.SDelete}
+	pos, err := db.writeLogEntry(valueTypeSet, entry)
+	if err != nil {
+		return err
+	}
+	val, updated := idxTree.Delete(sum)
+	db.notifyChange(valueTypeSet, &logfile.LogEntry{Key: key, Value: member, Stat: logfile.SDelete})
+	db.sendDiscard(val, updated, valueTypeSet)
+	db.sendDiscard(&Value{fid: pos.fid, entrySize: pos.entrySize}, true, valueTypeSet)
+	return nil
+}
+
+// writeTombstone writes the delete entry of idxKey, removes it from idxTree and sends both to discard.
+func (db *LazyDB) writeTombstone(typ valueType, idxTree *ds.AdaptiveRadixTree, idxKey []byte, entry *logfile.LogEntry) error {
+	pos, err := db.writeLogEntry(typ, entry)
+	if err != nil {
+		return err
+	}
+	val, updated := idxTree.Delete(idxKey)
+	if updated {
+		db.notifyChange(typ, entry)
+	}
+	db.sendDiscard(val, updated, typ)
+	db.sendDiscard(&Value{fid: pos.fid, entrySize: pos.entrySize}, true, typ)
+	return nil
+}
+
+func treeKeys(idxTree *ds.AdaptiveRadixTree) [][]byte {
+	var keys [][]byte
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil || node == nil {
+			break
+		}
+		keys = append(keys, node.Key())
+	}
+	return keys
+}
@@ -0,0 +1,291 @@
+package lazydb
+
+import (
+	"lazydb/logfile"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestExpireDB(cfg func(*DBConfig)) *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_expire")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	c := DefaultDBConfig(path)
+	c.ExpireCycleInterval = 10 * time.Millisecond
+	if cfg != nil {
+		cfg(&c)
+	}
+	db, _ := Open(c)
+	return db
+}
+
+func TestLazyDB_ActiveExpire(t *testing.T) {
+	var mu sync.Mutex
+	expired := make(map[string]DataType)
+	db := initTestExpireDB(func(cfg *DBConfig) {
+		cfg.NotifyKeyspaceEvents = "Ex"
+		cfg.ExpireCallback = func(typ DataType, key []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			expired[string(key)] = typ
+		}
+	})
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	events := db.SubscribeChannels([]byte("__keyevent@0__:expired"))
+	defer events.Close()
+
+	for i := 0; i < 50; i++ {
+		_ = db.SetEX(GetKey(i), GetValue32(), -time.Second)
+	}
+	for i := 50; i < 60; i++ {
+		_ = db.Set(GetKey(i), GetValue32())
+	}
+	_ = db.SetEX([]byte("alive"), GetValue32(), time.Hour)
+
+	assert.True(t, waitFor(func() bool { return db.Count() == 11 }))
+	mu.Lock()
+	assert.Equal(t, 50, len(expired))
+	assert.Equal(t, DataTypeString, expired[string(GetKey(0))])
+	mu.Unlock()
+	assert.Equal(t, 50, len(receiveMessages(events, 50*time.Millisecond)))
+
+	db.strIndex.mu.RLock()
+	assert.Equal(t, 1, len(db.strIndex.expires))
+	db.strIndex.mu.RUnlock()
+
+	// persisted keys are no longer sampled
+	assert.NoError(t, db.Persist([]byte("alive")))
+	db.strIndex.mu.RLock()
+	assert.Equal(t, 0, len(db.strIndex.expires))
+	db.strIndex.mu.RUnlock()
+}
+
+func TestLazyDB_ActiveExpire_Disabled(t *testing.T) {
+	db := initTestExpireDB(func(cfg *DBConfig) {
+		cfg.ExpireCycleInterval = -1
+	})
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.SetEX([]byte("k1"), GetValue32(), -time.Second)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, db.Count())
+	_, err := db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the key is tombstoned by the next expiration cycle
+	activeLF := db.getActiveLogFile(valueTypeString).lf
+	offset := activeLF.Offset
+	db.activeExpireCycle()
+	assert.Equal(t, 0, db.Count())
+	ent, _, err := activeLF.ReadLogEntry(offset)
+	assert.NoError(t, err)
+	assert.Equal(t, logfile.SDelete, ent.Stat)
+	assert.Equal(t, []byte("k1"), ent.Key)
+}
+
+func TestLazyDB_ExpireCollections(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    valueType
+		create func(db *LazyDB, key []byte) error
+		exists func(db *LazyDB, key []byte) bool
+	}{
+		{"list", valueTypeList,
+			func(db *LazyDB, key []byte) error { return db.RPush(key, []byte("a"), []byte("b")) },
+			func(db *LazyDB, key []byte) bool { return db.LLen(key) > 0 }},
+		{"hash", valueTypeHash,
+			func(db *LazyDB, key []byte) error { return db.HSet(key, []byte("f"), []byte("v")) },
+			func(db *LazyDB, key []byte) bool { return db.HLen(key) > 0 }},
+		{"set", valueTypeSet,
+			func(db *LazyDB, key []byte) error { return db.SAdd(key, []byte("m1"), []byte("m2")) },
+			func(db *LazyDB, key []byte) bool { return db.SIsMember(key, []byte("m1")) }},
+		{"zset", valueTypeZSet,
+			func(db *LazyDB, key []byte) error { return db.ZAdd(key, util.Float64ToByte(1), []byte("m1")) },
+			func(db *LazyDB, key []byte) bool { return db.ZCard(key) > 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := initTestExpireDB(func(cfg *DBConfig) {
+				cfg.ExpireCycleInterval = -1
+			})
+			defer destroyDB(db)
+			assert.NotNil(t, db)
+			key := []byte("key")
+
+			assert.Equal(t, ErrKeyNotFound, db.Expire(key, time.Hour))
+			assert.NoError(t, tt.create(db, key))
+			ttl, err := db.TTL(key)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), ttl)
+
+			assert.NoError(t, db.Expire(key, time.Hour))
+			ttl, err = db.TTL(key)
+			assert.NoError(t, err)
+			assert.True(t, ttl > 3500)
+			assert.NoError(t, db.Persist(key))
+			ttl, err = db.TTL(key)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), ttl)
+
+			// expired keys are invisible to reads, and writes start from an empty key
+			mu := db.indexMutex(tt.typ)
+			mu.Lock()
+			assert.NoError(t, db.setKeyExpire(tt.typ, key, time.Now().Unix()-1))
+			mu.Unlock()
+			assert.False(t, tt.exists(db, key))
+			_, err = db.TTL(key)
+			assert.Equal(t, ErrKeyNotFound, err)
+
+			assert.NoError(t, tt.create(db, key))
+			assert.True(t, tt.exists(db, key))
+			ttl, err = db.TTL(key)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), ttl)
+		})
+	}
+}
+
+func TestLazyDB_ExpireCollections_Rebuild(t *testing.T) {
+	db := initTestExpireDB(nil)
+	assert.NotNil(t, db)
+	_ = db.HSet([]byte("h1"), []byte("f"), []byte("v"))
+	_ = db.HSet([]byte("h2"), []byte("f"), []byte("v"))
+	_ = db.RPush([]byte("l1"), []byte("a"))
+	assert.NoError(t, db.Expire([]byte("h1"), time.Hour))
+	assert.NoError(t, db.Expire([]byte("h2"), time.Hour))
+	assert.NoError(t, db.Persist([]byte("h2")))
+	assert.NoError(t, db.Expire([]byte("l1"), time.Hour))
+	// the ttl is removed with the last element
+	_, _ = db.LPop([]byte("l1"))
+	assert.NoError(t, db.Close())
+
+	db = initTestExpireDB(nil)
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	ttl, err := db.TTL([]byte("h1"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 3500)
+	ttl, err = db.TTL([]byte("h2"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ttl)
+	assert.Equal(t, 1, len(db.hashIndex.expires))
+	assert.Equal(t, 0, len(db.listIndex.expires))
+
+	// merge rewrites only the latest key meta
+	meta := db.hashIndex.expires["h1"]
+	ent, _, err := db.getActiveLogFile(valueTypeHash).lf.ReadLogEntry(meta.offset)
+	assert.NoError(t, err)
+	assert.Equal(t, logfile.SKeyMeta, ent.Stat)
+	assert.NoError(t, db.mergeKeyMeta(valueTypeHash, meta.fid, meta.offset+1, ent))
+	assert.Equal(t, meta, db.hashIndex.expires["h1"])
+	assert.NoError(t, db.mergeKeyMeta(valueTypeHash, meta.fid, meta.offset, ent))
+	assert.True(t, db.hashIndex.expires["h1"].offset > meta.offset)
+	assert.Equal(t, meta.expiredAt, db.hashIndex.expires["h1"].expiredAt)
+}
+
+func TestLazyDB_ActiveExpireCollections(t *testing.T) {
+	var mu sync.Mutex
+	var expired []DataType
+	db := initTestExpireDB(func(cfg *DBConfig) {
+		cfg.ExpireCallback = func(typ DataType, key []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			expired = append(expired, typ)
+		}
+	})
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.HSet([]byte("h1"), []byte("f"), []byte("v"))
+	_ = db.ZAdd([]byte("z1"), util.Float64ToByte(1), []byte("m1"))
+	for _, typ := range []valueType{valueTypeHash, valueTypeZSet} {
+		idxMu := db.indexMutex(typ)
+		idxMu.Lock()
+		key := []byte("h1")
+		if typ == valueTypeZSet {
+			key = []byte("z1")
+		}
+		assert.NoError(t, db.setKeyExpire(typ, key, time.Now().Unix()-1))
+		idxMu.Unlock()
+	}
+
+	assert.True(t, waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(expired) == 2
+	}))
+	db.hashIndex.mu.RLock()
+	assert.Equal(t, 0, len(db.hashIndex.expires))
+	assert.Nil(t, db.hashIndex.trees["h1"])
+	db.hashIndex.mu.RUnlock()
+	db.zSetIndex.mu.RLock()
+	assert.Nil(t, db.zSetIndex.indexes["z1"])
+	db.zSetIndex.mu.RUnlock()
+}
+
+func TestLazyDB_ActiveExpire_LargeCollections(t *testing.T) {
+	var mu sync.Mutex
+	var expired []DataType
+	db := initTestExpireDB(func(cfg *DBConfig) {
+		cfg.ExpireCycleInterval = -1
+		cfg.ExpireCallback = func(typ DataType, key []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			expired = append(expired, typ)
+		}
+	})
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 3*expireDeleteBatch; i++ {
+		_ = db.HSet([]byte("h1"), GetKey(i), []byte("v"))
+		_ = db.SAdd([]byte("s1"), GetKey(i))
+		_ = db.RPush([]byte("l1"), GetKey(i))
+	}
+	for _, typ := range []valueType{valueTypeHash, valueTypeSet, valueTypeList} {
+		key := map[valueType]string{valueTypeHash: "h1", valueTypeSet: "s1", valueTypeList: "l1"}[typ]
+		idxMu := db.indexMutex(typ)
+		idxMu.Lock()
+		assert.NoError(t, db.setKeyExpire(typ, []byte(key), time.Now().Unix()-1))
+		idxMu.Unlock()
+	}
+
+	// a cycle deletes a batch of members of each key, which stay hidden until they are gone
+	db.activeExpireCycle()
+	db.hashIndex.mu.RLock()
+	assert.Equal(t, 2*expireDeleteBatch, db.hashIndex.trees["h1"].Size())
+	db.hashIndex.mu.RUnlock()
+	db.setIndex.mu.RLock()
+	assert.Equal(t, 2*expireDeleteBatch, db.setIndex.trees["s1"].Size())
+	db.setIndex.mu.RUnlock()
+	assert.Equal(t, 0, db.HLen([]byte("h1")))
+	assert.Equal(t, 0, db.Exists([]byte("l1")))
+	mu.Lock()
+	assert.Equal(t, 0, len(expired))
+	mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		db.activeExpireCycle()
+	}
+	mu.Lock()
+	assert.Equal(t, 3, len(expired))
+	mu.Unlock()
+	db.hashIndex.mu.RLock()
+	assert.Nil(t, db.hashIndex.trees["h1"])
+	assert.Equal(t, 0, len(db.hashIndex.expires))
+	db.hashIndex.mu.RUnlock()
+	db.listIndex.mu.RLock()
+	assert.Nil(t, db.listIndex.trees["l1"])
+	db.listIndex.mu.RUnlock()
+}
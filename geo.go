@@ -0,0 +1,414 @@
+package lazydb
+
+import (
+	"errors"
+	"lazydb/util"
+	"math"
+	"sort"
+)
+
+var (
+	ErrInvalidCoordinate = errors.New("invalid longitude or latitude")
+	ErrInvalidGeoUnit    = errors.New("unsupported unit provided, please use m, km, ft, mi")
+)
+
+const (
+	geoStep        = 26 // 52 bits of geohash, which fits in the mantissa of a float64 score
+	geoLongMin     = -180.0
+	geoLongMax     = 180.0
+	geoLatMin      = -85.05112878
+	geoLatMax      = 85.05112878
+	geoEarthRadius = 6372797.560856 // in meters, the same as redis
+	geoMercatorMax = 20037726.37
+	geoAlphabet    = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+var geoUnits = map[string]float64{
+	"":   1,
+	"m":  1,
+	"km": 1000,
+	"ft": 0.3048,
+	"mi": 1609.34,
+}
+
+// GeoLocation is a named point, and also a result of GeoSearch.
+// Dist and GeoHash are only set in search results when asked for.
+type GeoLocation struct {
+	Name      []byte
+	Longitude float64
+	Latitude  float64
+	Dist      float64
+	GeoHash   int64
+}
+
+// GeoPos is the position of a member.
+type GeoPos struct {
+	Longitude float64
+	Latitude  float64
+}
+
+// GeoSort is the order of GeoSearch results.
+type GeoSort int
+
+const (
+	GeoSortNone GeoSort = iota
+	GeoSortAsc
+	GeoSortDesc
+)
+
+// GeoSearchArgs are the arguments of GeoSearch.
+// The center is Member if it is set, or Longitude and Latitude otherwise.
+// The area is a circle if Radius is set, or a box of Width and Height otherwise, all of them in Unit.
+type GeoSearchArgs struct {
+	Member    []byte
+	Longitude float64
+	Latitude  float64
+	Radius    float64
+	Width     float64
+	Height    float64
+	Unit      string
+	Sort      GeoSort
+	Count     int
+	Any       bool
+	WithCoord bool
+	WithDist  bool
+	WithHash  bool
+}
+
+// GeoAdd adds the locations to the sorted set stored at key, with their geohash as the score.
+// It returns the number of members newly added.
+func (db *LazyDB) GeoAdd(key []byte, locations ...*GeoLocation) (int, error) {
+	args := make([][]byte, 0, len(locations)*2)
+	for _, loc := range locations {
+		if !geoValid(loc.Longitude, loc.Latitude) {
+			return 0, ErrInvalidCoordinate
+		}
+		score := float64(geoEncode(loc.Longitude, loc.Latitude))
+		args = append(args, util.Float64ToByte(score), loc.Name)
+	}
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
+	added := make(map[string]struct{})
+	if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx != nil {
+		for _, loc := range locations {
+			if idx.tree.Get(encodeKey(key, loc.Name)) == nil {
+				added[string(loc.Name)] = struct{}{}
+			}
+		}
+	} else {
+		for _, loc := range locations {
+			added[string(loc.Name)] = struct{}{}
+		}
+	}
+	if err := db.zAdd(key, args...); err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyZSet, "zadd", key)
+	return len(added), nil
+}
+
+// GeoPos returns the positions of members, with nil for the members that do not exist.
+func (db *LazyDB) GeoPos(key []byte, members ...[]byte) ([]*GeoPos, error) {
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	positions := make([]*GeoPos, len(members))
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return positions, nil
+	}
+	for i, member := range members {
+		if long, lat, ok := db.geoMemberPos(idx, key, member); ok {
+			positions[i] = &GeoPos{Longitude: long, Latitude: lat}
+		}
+	}
+	return positions, nil
+}
+
+// GeoDist returns the distance between two members in unit, which is meters if empty.
+func (db *LazyDB) GeoDist(key, member1, member2 []byte, unit string) (float64, error) {
+	conversion, ok := geoUnits[unit]
+	if !ok {
+		return 0, ErrInvalidGeoUnit
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return 0, ErrZSetKeyNotExist
+	}
+	long1, lat1, ok1 := db.geoMemberPos(idx, key, member1)
+	long2, lat2, ok2 := db.geoMemberPos(idx, key, member2)
+	if !ok1 || !ok2 {
+		return 0, ErrZSetMemberNotExist
+	}
+	return geoDistance(long1, lat1, long2, lat2) / conversion, nil
+}
+
+// GeoHash returns the standard 11 characters geohash strings of members,
+// with empty strings for the members that do not exist.
+func (db *LazyDB) GeoHash(key []byte, members ...[]byte) ([]string, error) {
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	hashes := make([]string, len(members))
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return hashes, nil
+	}
+	for i, member := range members {
+		long, lat, ok := db.geoMemberPos(idx, key, member)
+		if !ok {
+			continue
+		}
+		// the standard geohash uses the full latitude range instead of the mercator one
+		bits := geoEncodeRange(long, lat, -90, 90)
+		buf := make([]byte, 11)
+		for j := range buf {
+			pos := 0
+			if j < 10 {
+				pos = int(bits>>(52-(j+1)*5)) & 0x1f
+			}
+			buf[j] = geoAlphabet[pos]
+		}
+		hashes[i] = string(buf)
+	}
+	return hashes, nil
+}
+
+// GeoSearch returns the members in the circle or the box of args.
+func (db *LazyDB) GeoSearch(key []byte, args GeoSearchArgs) ([]*GeoLocation, error) {
+	conversion, ok := geoUnits[args.Unit]
+	if !ok {
+		return nil, ErrInvalidGeoUnit
+	}
+	byRadius, byBox := args.Radius > 0, args.Width > 0 && args.Height > 0
+	if byRadius == byBox || args.Count < 0 || args.Any && args.Count == 0 {
+		return nil, ErrInvalidParam
+	}
+	if args.Member == nil && !geoValid(args.Longitude, args.Latitude) {
+		return nil, ErrInvalidCoordinate
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return nil, nil
+	}
+	long, lat := args.Longitude, args.Latitude
+	if args.Member != nil {
+		if long, lat, ok = db.geoMemberPos(idx, key, args.Member); !ok {
+			return nil, ErrZSetMemberNotExist
+		}
+	}
+
+	// the distance to a member in meters, and whether it is in the area
+	radius, width, height := args.Radius*conversion, args.Width*conversion, args.Height*conversion
+	within := func(mLong, mLat float64) (float64, bool) {
+		if byRadius {
+			dist := geoDistance(long, lat, mLong, mLat)
+			return dist, dist <= radius
+		}
+		if geoEarthRadius*math.Abs(geoRad(mLat)-geoRad(lat)) > height/2 ||
+			geoDistance(long, mLat, mLong, mLat) > width/2 {
+			return 0, false
+		}
+		return geoDistance(long, lat, mLong, mLat), true
+	}
+	if !byRadius {
+		radius = math.Sqrt(width*width+height*height) / 2
+	}
+
+	var results []*GeoLocation
+	limit := 0
+	if args.Any {
+		limit = args.Count
+	}
+	for _, cell := range geoCells(long, lat, radius) {
+		first, last := zScoreRange(idx, ScoreBound{Value: cell[0]}, ScoreBound{Value: cell[1], Exclusive: true})
+		members, scores := zCollect(idx, first, last, false, 0, 0)
+		for i, member := range members {
+			mLong, mLat := geoDecode(uint64(scores[i]))
+			dist, ok := within(mLong, mLat)
+			if !ok {
+				continue
+			}
+			loc := &GeoLocation{Name: member, Dist: dist / conversion}
+			if args.WithCoord {
+				loc.Longitude, loc.Latitude = mLong, mLat
+			}
+			if args.WithHash {
+				loc.GeoHash = int64(scores[i])
+			}
+			results = append(results, loc)
+			if limit > 0 && len(results) == limit {
+				break
+			}
+		}
+		if limit > 0 && len(results) == limit {
+			break
+		}
+	}
+
+	order := args.Sort
+	if order == GeoSortNone && args.Count > 0 && !args.Any {
+		order = GeoSortAsc
+	}
+	if order != GeoSortNone {
+		sort.SliceStable(results, func(i, j int) bool {
+			if order == GeoSortDesc {
+				return results[i].Dist > results[j].Dist
+			}
+			return results[i].Dist < results[j].Dist
+		})
+	}
+	if args.Count > 0 && len(results) > args.Count {
+		results = results[:args.Count]
+	}
+	if !args.WithDist {
+		for _, loc := range results {
+			loc.Dist = 0
+		}
+	}
+	return results, nil
+}
+
+// geoMemberPos returns the position of member decoded from its score, the caller must hold the lock.
+func (db *LazyDB) geoMemberPos(idx *ZSetIndex, key, member []byte) (float64, float64, bool) {
+	val, err := db.getValue(idx.tree, encodeKey(key, member), valueTypeZSet)
+	if err != nil {
+		return 0, 0, false
+	}
+	long, lat := geoDecode(uint64(util.ByteToFloat64(val)))
+	return long, lat, true
+}
+
+func geoValid(long, lat float64) bool {
+	return long >= geoLongMin && long <= geoLongMax && lat >= geoLatMin && lat <= geoLatMax
+}
+
+// geoEncode returns the 52 bits geohash of a point, with the latitude bits in the even positions.
+func geoEncode(long, lat float64) uint64 {
+	return geoEncodeRange(long, lat, geoLatMin, geoLatMax)
+}
+
+func geoEncodeRange(long, lat, latMin, latMax float64) uint64 {
+	latCell := uint64((lat - latMin) / (latMax - latMin) * (1 << geoStep))
+	longCell := uint64((long - geoLongMin) / (geoLongMax - geoLongMin) * (1 << geoStep))
+	// the max values fall out of the last cell
+	latCell = uint64(util.Min(int(latCell), 1<<geoStep-1))
+	longCell = uint64(util.Min(int(longCell), 1<<geoStep-1))
+	return geoInterleave(latCell, longCell)
+}
+
+// geoDecode returns the center of the cell of a 52 bits geohash.
+func geoDecode(bits uint64) (float64, float64) {
+	latCell, longCell := geoDeinterleave(bits)
+	long := geoLongMin + (float64(longCell)+0.5)/(1<<geoStep)*(geoLongMax-geoLongMin)
+	lat := geoLatMin + (float64(latCell)+0.5)/(1<<geoStep)*(geoLatMax-geoLatMin)
+	return math.Max(geoLongMin, math.Min(geoLongMax, long)), math.Max(geoLatMin, math.Min(geoLatMax, lat))
+}
+
+func geoInterleave(x, y uint64) uint64 {
+	var bits uint64
+	for i := 0; i < geoStep; i++ {
+		bits |= (x>>i&1)<<(2*i) | (y>>i&1)<<(2*i+1)
+	}
+	return bits
+}
+
+func geoDeinterleave(bits uint64) (x, y uint64) {
+	for i := 0; i < geoStep; i++ {
+		x |= (bits >> (2 * i) & 1) << i
+		y |= (bits >> (2*i + 1) & 1) << i
+	}
+	return x, y
+}
+
+// geoCells returns the score ranges of the cell containing the point and its neighbours,
+// in a precision where they cover every point within radius meters.
+func geoCells(long, lat, radius float64) [][2]float64 {
+	step := geoStepsByRadius(radius, lat)
+	latDelta := geoDeg(radius / geoEarthRadius)
+	longDelta := geoDeg(radius / geoEarthRadius / math.Cos(geoRad(math.Min(math.Abs(lat)+latDelta, 89.9))))
+	var latCell, longCell uint64
+	for ; ; step-- {
+		bits := geoEncode(long, lat) >> (2 * (geoStep - step))
+		latCell, longCell = geoDeinterleave(bits)
+		cellHeight := (geoLatMax - geoLatMin) / float64(uint64(1)<<step)
+		cellWidth := (geoLongMax - geoLongMin) / float64(uint64(1)<<step)
+		south := geoLatMin + (float64(latCell)-1)*cellHeight
+		north := geoLatMin + (float64(latCell)+2)*cellHeight
+		west := geoLongMin + (float64(longCell)-1)*cellWidth
+		east := geoLongMin + (float64(longCell)+2)*cellWidth
+		if step == 1 || south <= lat-latDelta && north >= lat+latDelta && west <= long-longDelta && east >= long+longDelta {
+			break
+		}
+	}
+
+	size := uint64(1) << step
+	shift := 2 * (geoStep - step)
+	seen := make(map[uint64]struct{})
+	var cells [][2]float64
+	for dLat := -1; dLat <= 1; dLat++ {
+		nLat := int64(latCell) + int64(dLat)
+		if nLat < 0 || nLat >= int64(size) {
+			continue
+		}
+		for dLong := -1; dLong <= 1; dLong++ {
+			nLong := (int64(longCell) + int64(dLong) + int64(size)) % int64(size)
+			bits := geoInterleave(uint64(nLat), uint64(nLong))
+			if _, ok := seen[bits]; ok {
+				continue
+			}
+			seen[bits] = struct{}{}
+			cells = append(cells, [2]float64{float64(bits << shift), float64((bits + 1) << shift)})
+		}
+	}
+	return cells
+}
+
+// geoStepsByRadius estimates the precision of cells a bit larger than radius meters.
+func geoStepsByRadius(radius, lat float64) int {
+	if radius == 0 {
+		return geoStep
+	}
+	step := 1
+	for radius < geoMercatorMax {
+		radius *= 2
+		step++
+	}
+	step -= 2
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return util.Max(1, util.Min(step, geoStep))
+}
+
+// geoDistance returns the haversine distance between two points in meters.
+func geoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, lat2r := geoRad(lat1), geoRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin(geoRad(long2-long1) / 2)
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+func geoRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func geoDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
@@ -0,0 +1,197 @@
+package lazydb
+
+import (
+	"fmt"
+	"lazydb/util"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestGeoDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_geo")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func geoNames(locations []*GeoLocation) []string {
+	names := make([]string, len(locations))
+	for i, loc := range locations {
+		names[i] = string(loc.Name)
+	}
+	return names
+}
+
+func addSicily(t *testing.T, db *LazyDB) {
+	n, err := db.GeoAdd([]byte("Sicily"),
+		&GeoLocation{Name: []byte("Palermo"), Longitude: 13.361389, Latitude: 38.115556},
+		&GeoLocation{Name: []byte("Catania"), Longitude: 15.087269, Latitude: 37.502669},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestLazyDB_GeoAdd_GeoPos(t *testing.T) {
+	db := initTestGeoDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	addSicily(t, db)
+	n, err := db.GeoAdd([]byte("Sicily"),
+		&GeoLocation{Name: []byte("Palermo"), Longitude: 13.361389, Latitude: 38.115556},
+		&GeoLocation{Name: []byte("Agrigento"), Longitude: 13.583333, Latitude: 37.316667},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 3, db.ZCard([]byte("Sicily")))
+
+	// the score is the 52 bits geohash like redis
+	score, err := db.ZScore([]byte("Sicily"), []byte("Palermo"))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3479099956230698), score)
+
+	positions, err := db.GeoPos([]byte("Sicily"), []byte("Palermo"), []byte("missing"))
+	assert.NoError(t, err)
+	assert.Len(t, positions, 2)
+	assert.InDelta(t, 13.36138933897018433, positions[0].Longitude, 1e-9)
+	assert.InDelta(t, 38.11555639549629859, positions[0].Latitude, 1e-9)
+	assert.Nil(t, positions[1])
+
+	_, err = db.GeoAdd([]byte("Sicily"), &GeoLocation{Name: []byte("pole"), Longitude: 0, Latitude: 89})
+	assert.Equal(t, ErrInvalidCoordinate, err)
+	_, err = db.GeoAdd([]byte("Sicily"), &GeoLocation{Name: []byte("far"), Longitude: 181, Latitude: 0})
+	assert.Equal(t, ErrInvalidCoordinate, err)
+}
+
+func TestLazyDB_GeoDist_GeoHash(t *testing.T) {
+	db := initTestGeoDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	addSicily(t, db)
+	tests := []struct {
+		unit string
+		want float64
+	}{
+		{"", 166274.1516},
+		{"km", 166.2742},
+		{"mi", 103.3182},
+		{"ft", 545518.8700},
+	}
+	for _, tt := range tests {
+		dist, err := db.GeoDist([]byte("Sicily"), []byte("Palermo"), []byte("Catania"), tt.unit)
+		assert.NoError(t, err)
+		assert.InDelta(t, tt.want, dist, 1e-4)
+	}
+	_, err := db.GeoDist([]byte("Sicily"), []byte("Palermo"), []byte("missing"), "km")
+	assert.Equal(t, ErrZSetMemberNotExist, err)
+	_, err = db.GeoDist([]byte("Sicily"), []byte("Palermo"), []byte("Catania"), "yd")
+	assert.Equal(t, ErrInvalidGeoUnit, err)
+
+	hashes, err := db.GeoHash([]byte("Sicily"), []byte("Palermo"), []byte("Catania"), []byte("missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sqc8b49rny0", "sqdtr74hyu0", ""}, hashes)
+}
+
+func TestLazyDB_GeoSearch(t *testing.T) {
+	db := initTestGeoDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	addSicily(t, db)
+	_, _ = db.GeoAdd([]byte("Sicily"),
+		&GeoLocation{Name: []byte("edge1"), Longitude: 12.758489, Latitude: 38.788135},
+		&GeoLocation{Name: []byte("edge2"), Longitude: 17.241510, Latitude: 38.788135},
+	)
+
+	results, err := db.GeoSearch([]byte("Sicily"), GeoSearchArgs{
+		Longitude: 15, Latitude: 37, Radius: 200, Unit: "km", Sort: GeoSortAsc, WithDist: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Catania", "Palermo"}, geoNames(results))
+	assert.InDelta(t, 56.4413, results[0].Dist, 1e-4)
+	assert.InDelta(t, 190.4424, results[1].Dist, 1e-4)
+	assert.Zero(t, results[0].Longitude)
+
+	results, err = db.GeoSearch([]byte("Sicily"), GeoSearchArgs{
+		Longitude: 15, Latitude: 37, Width: 400, Height: 400, Unit: "km", Sort: GeoSortDesc, WithCoord: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"edge1", "edge2", "Palermo", "Catania"}, geoNames(results))
+	assert.InDelta(t, 12.758489, results[0].Longitude, 1e-5)
+	assert.Zero(t, results[0].Dist)
+
+	// COUNT sorts by distance unless ANY is set
+	results, err = db.GeoSearch([]byte("Sicily"), GeoSearchArgs{
+		Member: []byte("Palermo"), Radius: 500, Unit: "km", Count: 2, WithHash: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Palermo", "edge1"}, geoNames(results))
+	assert.Equal(t, int64(3479099956230698), results[0].GeoHash)
+	results, err = db.GeoSearch([]byte("Sicily"), GeoSearchArgs{
+		Member: []byte("Palermo"), Radius: 500, Unit: "km", Count: 3, Any: true,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+
+	results, err = db.GeoSearch([]byte("missing"), GeoSearchArgs{Radius: 1})
+	assert.NoError(t, err)
+	assert.Nil(t, results)
+	_, err = db.GeoSearch([]byte("Sicily"), GeoSearchArgs{Member: []byte("missing"), Radius: 1})
+	assert.Equal(t, ErrZSetMemberNotExist, err)
+	_, err = db.GeoSearch([]byte("Sicily"), GeoSearchArgs{Radius: 1, Width: 1, Height: 1})
+	assert.Equal(t, ErrInvalidParam, err)
+	_, err = db.GeoSearch([]byte("Sicily"), GeoSearchArgs{Radius: 1, Any: true})
+	assert.Equal(t, ErrInvalidParam, err)
+}
+
+func TestLazyDB_GeoSearch_Random(t *testing.T) {
+	db := initTestGeoDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// the neighbouring cells must find the same members as a full scan
+	r := rand.New(rand.NewSource(1))
+	key := []byte("points")
+	var points []*GeoLocation
+	for i := 0; i < 2000; i++ {
+		loc := &GeoLocation{
+			Name:      []byte(fmt.Sprintf("p%d", i)),
+			Longitude: r.Float64()*360 - 180,
+			Latitude:  r.Float64()*170 - 85,
+		}
+		points = append(points, loc)
+	}
+	_, err := db.GeoAdd(key, points...)
+	assert.NoError(t, err)
+	positions, _ := db.GeoPos(key, []byte("p0"), []byte("p1"), []byte("p2"))
+
+	for _, radius := range []float64{100, 1000, 5000} {
+		for _, pos := range positions {
+			var want []string
+			for _, p := range points {
+				long, lat := geoDecode(geoEncode(p.Longitude, p.Latitude))
+				if geoDistance(pos.Longitude, pos.Latitude, long, lat) <= radius*1000 {
+					want = append(want, string(p.Name))
+				}
+			}
+			results, err := db.GeoSearch(key, GeoSearchArgs{
+				Longitude: pos.Longitude, Latitude: pos.Latitude, Radius: radius, Unit: "km",
+			})
+			assert.NoError(t, err)
+			got := geoNames(results)
+			sort.Strings(want)
+			sort.Strings(got)
+			assert.Equal(t, want, got, "radius %v", radius)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"lazydb/logfile"
 	"lazydb/util"
 	"log"
+	"time"
 )
 
 var (
@@ -24,9 +25,13 @@ func (db *LazyDB) HSet(key []byte, args ...[]byte) error {
 	}
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeHash, key); err != nil {
+		return err
+	}
 
 	strKey := util.ByteToString(key)
 	if db.hashIndex.trees[strKey] == nil {
+		db.indexCollectionKey(valueTypeHash, key)
 		db.hashIndex.trees[strKey] = ds.NewART()
 	}
 
@@ -43,7 +48,10 @@ func (db *LazyDB) HSet(key []byte, args ...[]byte) error {
 		if err != nil {
 			return err
 		}
+		db.setFieldExpire(key, hashKey, 0)
+		db.notifyChange(valueTypeHash, entry)
 	}
+	db.notifyKeyspaceEvent(notifyHash, "hset", key)
 	return nil
 }
 
@@ -52,7 +60,7 @@ func (db *LazyDB) HGet(key, field []byte) ([]byte, error) {
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
 
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	idxTree := db.getHashTree(key)
 	if idxTree == nil {
 		return nil, nil
 	}
@@ -69,12 +77,16 @@ func (db *LazyDB) HGet(key, field []byte) ([]byte, error) {
 func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeHash, key); err != nil {
+		return 0, err
+	}
 
 	idxTree := db.hashIndex.trees[util.ByteToString(key)]
 	if idxTree == nil {
 		return 0, nil
 	}
 	var count int
+	ts := time.Now().Unix()
 	for _, field := range fields {
 		hashKey := encodeKey(key, field)
 		entry := &logfile.LogEntry{Key: hashKey, Stat: logfile.SDelete}
@@ -83,8 +95,13 @@ func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
 			return count, err
 		}
 		val, updated := idxTree.Delete(hashKey)
+		db.setFieldExpire(key, hashKey, 0)
 		if updated {
-			count++
+			// a field whose ttl has passed is removed, but it is not counted as deleted
+			if !hashFieldExpired(val, ts) {
+				count++
+			}
+			db.notifyChange(valueTypeHash, entry)
 		}
 		// delete invalid entry
 		db.sendDiscard(val, updated, valueTypeHash)
@@ -97,6 +114,17 @@ func (db *LazyDB) HDel(key []byte, fields ...[]byte) (int, error) {
 			log.Fatal("send discard fail")
 		}
 	}
+	if count > 0 {
+		db.notifyKeyspaceEvent(notifyHash, "hdel", key)
+	}
+	if idxTree.Size() == 0 {
+		if err := db.setKeyExpire(valueTypeHash, key, 0); err != nil {
+			return count, err
+		}
+		if count > 0 {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		}
+	}
 	return count, nil
 }
 
@@ -106,7 +134,7 @@ func (db *LazyDB) HExists(key []byte, field []byte) (bool, error) {
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
 
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	idxTree := db.getHashTree(key)
 	if idxTree == nil {
 		return false, nil
 	}
@@ -127,7 +155,7 @@ func (db *LazyDB) HGetAll(key []byte) ([][]byte, error) {
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
 
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	idxTree := db.getHashTree(key)
 	if idxTree == nil {
 		return [][]byte{}, nil
 	}
@@ -157,17 +185,21 @@ func (db *LazyDB) HKeys(key []byte) ([][]byte, error) {
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
 
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	idxTree := db.getHashTree(key)
 	if idxTree == nil {
 		return [][]byte{}, nil
 	}
 	fields := make([][]byte, 0)
+	ts := time.Now().Unix()
 	iter := idxTree.Iterator()
 	for iter.HasNext() {
 		node, err := iter.Next()
 		if err != nil {
 			return nil, err
 		}
+		if hashFieldExpired(node.Value(), ts) {
+			continue
+		}
 		_, field := decodeKey(node.Key())
 		fields = append(fields, field)
 	}
@@ -179,7 +211,7 @@ func (db *LazyDB) HVals(key []byte) ([][]byte, error) {
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
 
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	idxTree := db.getHashTree(key)
 	if idxTree == nil {
 		return [][]byte{}, nil
 	}
@@ -207,9 +239,13 @@ func (db *LazyDB) HVals(key []byte) ([][]byte, error) {
 func (db *LazyDB) HSetNX(key, field, value []byte) error {
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeHash, key); err != nil {
+		return err
+	}
 
 	strKey := util.ByteToString(key)
 	if db.hashIndex.trees[strKey] == nil {
+		db.indexCollectionKey(valueTypeHash, key)
 		db.hashIndex.trees[strKey] = ds.NewART()
 	}
 	idxTree := db.hashIndex.trees[strKey]
@@ -233,6 +269,9 @@ func (db *LazyDB) HSetNX(key, field, value []byte) error {
 	if err != nil {
 		return err
 	}
+	db.setFieldExpire(key, hashKey, 0)
+	db.notifyChange(valueTypeHash, entry)
+	db.notifyKeyspaceEvent(notifyHash, "hset", key)
 	return nil
 }
 
@@ -243,8 +282,8 @@ func (db *LazyDB) HMGet(key []byte, fields ...[]byte) ([][]byte, error) {
 	defer db.hashIndex.mu.RUnlock()
 
 	vals := make([][]byte, 0)
-	idxTree, ok := db.hashIndex.trees[util.ByteToString(key)]
-	if !ok {
+	idxTree := db.getHashTree(key)
+	if idxTree == nil {
 		return vals, nil
 	}
 
@@ -265,9 +304,164 @@ func (db *LazyDB) HMGet(key []byte, fields ...[]byte) ([][]byte, error) {
 func (db *LazyDB) HLen(key []byte) int {
 	db.hashIndex.mu.RLock()
 	defer db.hashIndex.mu.RUnlock()
-	idxTree, ok := db.hashIndex.trees[util.ByteToString(key)]
-	if !ok {
+	idxTree := db.getHashTree(key)
+	if idxTree == nil {
 		return 0
 	}
-	return idxTree.Size()
+	return db.hashLen(key, idxTree)
+}
+
+// HSetEX sets field in the hash stored at key to value, and the field expires after duration.
+func (db *LazyDB) HSetEX(key, field, value []byte, duration time.Duration) error {
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeHash, key); err != nil {
+		return err
+	}
+
+	strKey := util.ByteToString(key)
+	if db.hashIndex.trees[strKey] == nil {
+		db.indexCollectionKey(valueTypeHash, key)
+		db.hashIndex.trees[strKey] = ds.NewART()
+	}
+	if err := db.hSetField(db.hashIndex.trees[strKey], key, field, value, time.Now().Add(duration).Unix()); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyHash, "hset", key)
+	return nil
+}
+
+// HExpire sets the expiration time of the given fields in the hash stored at key.
+// It returns the number of fields updated, fields that do not exist are ignored.
+func (db *LazyDB) HExpire(key []byte, duration time.Duration, fields ...[]byte) (int, error) {
+	if duration <= 0 {
+		return 0, nil
+	}
+	count, err := db.hUpdateFieldExpire(key, time.Now().Add(duration).Unix(), fields...)
+	if count > 0 {
+		db.notifyKeyspaceEvent(notifyHash, "hexpire", key)
+	}
+	return count, err
+}
+
+// HPersist removes the expiration time of the given fields in the hash stored at key.
+// It returns the number of fields updated, fields that do not exist are ignored.
+func (db *LazyDB) HPersist(key []byte, fields ...[]byte) (int, error) {
+	count, err := db.hUpdateFieldExpire(key, 0, fields...)
+	if count > 0 {
+		db.notifyKeyspaceEvent(notifyHash, "hpersist", key)
+	}
+	return count, err
+}
+
+// HTTL returns the ttl(time to live) of field in the hash stored at key, 0 means the field has no expiration time.
+func (db *LazyDB) HTTL(key, field []byte) (int64, error) {
+	db.hashIndex.mu.RLock()
+	defer db.hashIndex.mu.RUnlock()
+
+	idxTree := db.getHashTree(key)
+	if idxTree == nil {
+		return 0, ErrKeyNotFound
+	}
+	ts := time.Now().Unix()
+	rawValue := idxTree.Get(encodeKey(key, field))
+	if rawValue == nil || hashFieldExpired(rawValue, ts) {
+		return 0, ErrKeyNotFound
+	}
+	var ttl int64
+	if val, _ := rawValue.(*Value); val != nil && val.expiredAt != 0 {
+		ttl = val.expiredAt - ts
+	}
+	return ttl, nil
+}
+
+// hUpdateFieldExpire rewrites the given fields with expiredAt, and returns the number of fields updated.
+func (db *LazyDB) hUpdateFieldExpire(key []byte, expiredAt int64, fields ...[]byte) (int, error) {
+	db.hashIndex.mu.Lock()
+	defer db.hashIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeHash, key); err != nil {
+		return 0, err
+	}
+
+	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if idxTree == nil {
+		return 0, nil
+	}
+	var count int
+	for _, field := range fields {
+		val, err := db.getValue(idxTree, encodeKey(key, field), valueTypeHash)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := db.hSetField(idxTree, key, field, val, expiredAt); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// hSetField writes a field of the hash stored at key with its expiration time.
+func (db *LazyDB) hSetField(idxTree *ds.AdaptiveRadixTree, key, field, value []byte, expiredAt int64) error {
+	entry := &logfile.LogEntry{Key: encodeKey(key, field), Value: value, ExpiredAt: expiredAt}
+	valPos, err := db.writeLogEntry(valueTypeHash, entry)
+	if err != nil {
+		return err
+	}
+	if err = db.updateIndexTree(valueTypeHash, idxTree, entry, valPos, true); err != nil {
+		return err
+	}
+	db.setFieldExpire(key, entry.Key, expiredAt)
+	db.notifyChange(valueTypeHash, entry)
+	return nil
+}
+
+// setFieldExpire records the expiration time of the hash field keyed by hashKey, 0 means it has no ttl.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) setFieldExpire(key, hashKey []byte, expiredAt int64) {
+	fields := db.hashIndex.fieldExpires[string(key)]
+	if expiredAt == 0 {
+		if fields != nil {
+			delete(fields, string(hashKey))
+			if len(fields) == 0 {
+				delete(db.hashIndex.fieldExpires, string(key))
+			}
+		}
+		return
+	}
+	if fields == nil {
+		fields = make(map[string]int64)
+		db.hashIndex.fieldExpires[string(key)] = fields
+	}
+	fields[string(hashKey)] = expiredAt
+}
+
+// hashLen returns the number of fields of the hash stored at key that have not expired,
+// only the fields with ttl are checked. The caller must hold the lock of the index.
+func (db *LazyDB) hashLen(key []byte, idxTree *ds.AdaptiveRadixTree) int {
+	count := idxTree.Size()
+	ts := time.Now().Unix()
+	for _, expiredAt := range db.hashIndex.fieldExpires[util.ByteToString(key)] {
+		if expiredAt < ts {
+			count--
+		}
+	}
+	return count
+}
+
+// hashFieldExpired reports whether the index value of a hash field has expired.
+func hashFieldExpired(rawValue interface{}, ts int64) bool {
+	val, _ := rawValue.(*Value)
+	return val != nil && val.expiredAt != 0 && val.expiredAt < ts
+}
+
+// getHashTree returns the index of the hash stored at key, or nil if it does not exist or has expired.
+func (db *LazyDB) getHashTree(key []byte) *ds.AdaptiveRadixTree {
+	if db.keyExpired(valueTypeHash, key) {
+		return nil
+	}
+	return db.hashIndex.trees[util.ByteToString(key)]
 }
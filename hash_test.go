@@ -1,11 +1,13 @@
 package lazydb
 
 import (
+	"fmt"
 	"lazydb/util"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -595,3 +597,117 @@ func TestLazyDB_HLen(t *testing.T) {
 		assert.Equal(t, 0, got)
 	})
 }
+
+func TestLazyDB_HExpire(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("flags")
+	_ = db.HSet(key, []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2"))
+	assert.NoError(t, db.HSetEX(key, []byte("f3"), []byte("v3"), time.Hour))
+	assert.NoError(t, db.HSetEX(key, []byte("f4"), []byte("v4"), -time.Second))
+
+	count, err := db.HExpire(key, time.Hour, []byte("f1"), []byte("missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = db.HExpire(key, -time.Second, []byte("f2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	tests := []struct {
+		field   string
+		wantTTL bool
+		wantErr error
+	}{
+		{"f1", true, nil},
+		{"f2", false, nil},
+		{"f3", true, nil},
+		{"f4", false, ErrKeyNotFound},
+		{"missing", false, ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			ttl, err := db.HTTL(key, []byte(tt.field))
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantTTL, ttl > 3500)
+		})
+	}
+
+	// expired fields are hidden from reads
+	assert.Equal(t, 3, db.HLen(key))
+	keys, err := db.HKeys(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(keys))
+	all, err := db.HGetAll(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(all))
+	exists, err := db.HExists(key, []byte("f4"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	count, err = db.HPersist(key, []byte("f1"), []byte("f4"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	ttl, err := db.HTTL(key, []byte("f1"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ttl)
+	val, err := db.HGet(key, []byte("f1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// overwriting a field removes its ttl
+	_ = db.HSet(key, []byte("f3"), []byte("v3"))
+	ttl, err = db.HTTL(key, []byte("f3"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ttl)
+
+	// deleting a field that has already expired does not count it
+	count, err = db.HDel(key, []byte("f4"), []byte("f3"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = db.HDel(key, []byte("f4"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestLazyDB_HashFieldExpire_Reclaim(t *testing.T) {
+	db := initTestExpireDB(nil)
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	key := []byte("sessions")
+	_ = db.HSet(key, []byte("keep"), []byte("v"))
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, db.HSetEX(key, []byte(fmt.Sprintf("s%d", i)), []byte("v"), time.Hour))
+	}
+	assert.Equal(t, 51, db.HLen(key))
+
+	// expire the fields in the index, the expiration cycle deletes them
+	db.hashIndex.mu.Lock()
+	for hashKey := range db.hashIndex.fieldExpires[string(key)] {
+		db.hashIndex.fieldExpires[string(key)][hashKey] = time.Now().Unix() - 1
+	}
+	db.hashIndex.mu.Unlock()
+	assert.Equal(t, 1, db.HLen(key))
+	assert.True(t, waitFor(func() bool {
+		db.hashIndex.mu.RLock()
+		defer db.hashIndex.mu.RUnlock()
+		return db.hashIndex.trees[string(key)].Size() == 1
+	}))
+	db.hashIndex.mu.RLock()
+	assert.Equal(t, 0, len(db.hashIndex.fieldExpires))
+	db.hashIndex.mu.RUnlock()
+
+	// the fields with ttl are tracked again when the index is rebuilt
+	assert.NoError(t, db.HSetEX(key, []byte("s0"), []byte("v"), time.Hour))
+	_, _ = db.HPersist(key, []byte("keep"))
+	db.Close()
+	var err error
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	db.hashIndex.mu.RLock()
+	assert.Equal(t, 1, len(db.hashIndex.fieldExpires[string(key)]))
+	db.hashIndex.mu.RUnlock()
+	assert.Equal(t, 2, db.HLen(key))
+}
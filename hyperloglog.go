@@ -0,0 +1,393 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrInvalidHLL = errors.New("value is not a valid HyperLogLog string")
+)
+
+// HyperLogLogs are stored as string values in the format of redis, so they can be exchanged with it.
+// The 16 bytes header holds the magic "HYLL", the encoding, three unused bytes and the cached cardinality
+// in little endian, whose most significant bit is set when the cache is invalid.
+// The dense encoding packs 16384 registers of 6 bits, the least significant bits first.
+// The sparse encoding is a sequence of opcodes: ZERO 00xxxxxx and XZERO 01xxxxxx yyyyyyyy are runs of
+// 1-64 and 1-16384 zero registers, and VAL 1vvvvvxx is a run of 1-4 registers holding 1-32.
+const (
+	hllP              = 14
+	hllQ              = 64 - hllP
+	hllRegisters      = 1 << hllP
+	hllBits           = 6
+	hllRegisterMax    = 1<<hllBits - 1
+	hllHeaderSize     = 16
+	hllDenseSize      = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllEncodingDense  = 0
+	hllEncodingSparse = 1
+
+	// hllSparseMaxBytes is the size above which the sparse encoding is converted to the dense one,
+	// the same as the default hll-sparse-max-bytes of redis.
+	hllSparseMaxBytes = 3000
+	hllSparseValMax   = 32
+	hllSparseZeroMax  = 64
+	hllSparseRunMax   = 4
+
+	hllAlphaInf = 0.721347520444481703680
+	hllSeed     = 0xadc83b19
+)
+
+var hllMagic = []byte("HYLL")
+
+// PFAdd adds the elements to the HyperLogLog stored at key, which is created if it does not exist.
+// It reports whether the estimated cardinality may have changed, or the HyperLogLog was created.
+func (db *LazyDB) PFAdd(key []byte, elements ...[]byte) (bool, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, expiredAt, err := db.strValue(key)
+	if err != nil {
+		return false, err
+	}
+	regs, dense, err := hllDecode(val)
+	if err != nil {
+		return false, err
+	}
+	changed := val == nil
+	for _, element := range elements {
+		index, count := hllPatLen(element)
+		if count > regs[index] {
+			regs[index] = count
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	var card *uint64
+	if len(elements) == 0 {
+		var zero uint64
+		card = &zero
+	}
+	if err := db.setEX(key, hllEncode(regs, dense, card), expiredAt); err != nil {
+		return false, err
+	}
+	db.notifyKeyspaceEvent(notifyString, "pfadd", key)
+	return true, nil
+}
+
+// PFCount returns the estimated cardinality of the HyperLogLog stored at key,
+// or of the union of the HyperLogLogs stored at keys. Missing keys are considered as empty.
+// The cardinality of a single key is cached in its header.
+func (db *LazyDB) PFCount(keys ...[]byte) (int64, error) {
+	if len(keys) == 0 {
+		return 0, ErrInvalidParam
+	}
+	if len(keys) == 1 {
+		return db.pfCountKey(keys[0])
+	}
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	regs, _, err := db.hllUnion(keys)
+	if err != nil {
+		return 0, err
+	}
+	return int64(hllCount(regs)), nil
+}
+
+// pfCountKey returns the cached cardinality of the HyperLogLog stored at key, or estimates it and caches it.
+func (db *LazyDB) pfCountKey(key []byte) (int64, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	val, expiredAt, err := db.strValue(key)
+	if err != nil || val == nil {
+		return 0, err
+	}
+	regs, _, err := hllDecode(val)
+	if err != nil {
+		return 0, err
+	}
+	if val[15]&0x80 == 0 {
+		return int64(binary.LittleEndian.Uint64(val[8:hllHeaderSize])), nil
+	}
+	card := hllCount(regs)
+	// a follower cannot write, the cardinality is cached by the primary.
+	if !db.isReadOnly() {
+		cached := make([]byte, len(val))
+		copy(cached, val)
+		binary.LittleEndian.PutUint64(cached[8:hllHeaderSize], card)
+		if err := db.setEX(key, cached, expiredAt); err != nil {
+			return 0, err
+		}
+	}
+	return int64(card), nil
+}
+
+// PFMerge merges the HyperLogLogs stored at keys into the one stored at destination, which is created if it does not exist.
+// Missing keys are considered as empty, and the ttl of destination is kept.
+func (db *LazyDB) PFMerge(destination []byte, keys ...[]byte) error {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	_, expiredAt, err := db.strValue(destination)
+	if err != nil {
+		return err
+	}
+	regs, dense, err := db.hllUnion(append([][]byte{destination}, keys...))
+	if err != nil {
+		return err
+	}
+	if err := db.setEX(destination, hllEncode(regs, dense, nil), expiredAt); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyString, "pfadd", destination)
+	return nil
+}
+
+// hllUnion returns the maximum of the registers of the HyperLogLogs stored at keys,
+// and reports whether any of them is dense. The caller must hold the lock of strIndex.
+func (db *LazyDB) hllUnion(keys [][]byte) ([]uint8, bool, error) {
+	regs := make([]uint8, hllRegisters)
+	var anyDense bool
+	for _, key := range keys {
+		val, _, err := db.strValue(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if val == nil {
+			continue
+		}
+		other, dense, err := hllDecode(val)
+		if err != nil {
+			return nil, false, err
+		}
+		anyDense = anyDense || dense
+		for i, reg := range other {
+			if reg > regs[i] {
+				regs[i] = reg
+			}
+		}
+	}
+	return regs, anyDense, nil
+}
+
+// hllDecode returns the registers of a HyperLogLog, and reports whether it is dense.
+// A nil value is an empty sparse HyperLogLog.
+func hllDecode(val []byte) ([]uint8, bool, error) {
+	regs := make([]uint8, hllRegisters)
+	if val == nil {
+		return regs, false, nil
+	}
+	if len(val) < hllHeaderSize || !bytes.Equal(val[:4], hllMagic) {
+		return nil, false, ErrInvalidHLL
+	}
+	switch val[4] {
+	case hllEncodingDense:
+		if len(val) != hllDenseSize {
+			return nil, false, ErrInvalidHLL
+		}
+		p := val[hllHeaderSize:]
+		for i := range regs {
+			regs[i] = hllDenseGet(p, i)
+		}
+		return regs, true, nil
+	case hllEncodingSparse:
+		p, index := val[hllHeaderSize:], 0
+		for len(p) > 0 {
+			var run int
+			switch op := p[0]; {
+			case op&0xc0 == 0x00:
+				run, p = int(op&0x3f)+1, p[1:]
+			case op&0xc0 == 0x40:
+				if len(p) < 2 {
+					return nil, false, ErrInvalidHLL
+				}
+				run, p = (int(op&0x3f)<<8|int(p[1]))+1, p[2:]
+			default:
+				run = int(op&0x3) + 1
+				if index+run > hllRegisters {
+					return nil, false, ErrInvalidHLL
+				}
+				for i := index; i < index+run; i++ {
+					regs[i] = (op>>2)&0x1f + 1
+				}
+				p = p[1:]
+			}
+			if index += run; index > hllRegisters {
+				return nil, false, ErrInvalidHLL
+			}
+		}
+		if index != hllRegisters {
+			return nil, false, ErrInvalidHLL
+		}
+		return regs, false, nil
+	}
+	return nil, false, ErrInvalidHLL
+}
+
+// hllEncode encodes the registers with the sparse encoding if dense is false and they fit into it,
+// or with the dense one. The cardinality is cached if card is not nil.
+func hllEncode(regs []uint8, dense bool, card *uint64) []byte {
+	header := make([]byte, hllHeaderSize)
+	copy(header, hllMagic)
+	if card != nil {
+		binary.LittleEndian.PutUint64(header[8:], *card)
+	} else {
+		header[15] |= 0x80
+	}
+	if !dense {
+		if buf := hllEncodeSparse(header, regs); buf != nil {
+			return buf
+		}
+	}
+	buf := make([]byte, hllDenseSize)
+	copy(buf, header)
+	buf[4] = hllEncodingDense
+	for i, reg := range regs {
+		hllDenseSet(buf[hllHeaderSize:], i, reg)
+	}
+	return buf
+}
+
+// hllEncodeSparse returns the sparse encoding of the registers, or nil if they do not fit into it.
+func hllEncodeSparse(header []byte, regs []uint8) []byte {
+	buf := append([]byte{}, header...)
+	buf[4] = hllEncodingSparse
+	for index := 0; index < hllRegisters; {
+		reg, run := regs[index], 1
+		for index+run < hllRegisters && regs[index+run] == reg {
+			run++
+		}
+		index += run
+		switch {
+		case reg == 0 && run > hllSparseZeroMax:
+			buf = append(buf, 0x40|byte((run-1)>>8), byte(run-1))
+		case reg == 0:
+			buf = append(buf, byte(run-1))
+		case reg > hllSparseValMax:
+			return nil
+		default:
+			for ; run > 0; run -= hllSparseRunMax {
+				n := run
+				if n > hllSparseRunMax {
+					n = hllSparseRunMax
+				}
+				buf = append(buf, 0x80|(reg-1)<<2|byte(n-1))
+			}
+		}
+		if len(buf) > hllSparseMaxBytes {
+			return nil
+		}
+	}
+	return buf
+}
+
+func hllDenseGet(p []byte, index int) uint8 {
+	b, fb := index*hllBits/8, uint(index*hllBits&7)
+	v := uint(p[b]) >> fb
+	if b+1 < len(p) {
+		v |= uint(p[b+1]) << (8 - fb)
+	}
+	return uint8(v & hllRegisterMax)
+}
+
+func hllDenseSet(p []byte, index int, reg uint8) {
+	b, fb := index*hllBits/8, uint(index*hllBits&7)
+	v := uint(reg)
+	p[b] &^= byte(hllRegisterMax << fb)
+	p[b] |= byte(v << fb)
+	if b+1 < len(p) {
+		p[b+1] &^= byte(hllRegisterMax >> (8 - fb))
+		p[b+1] |= byte(v >> (8 - fb))
+	}
+}
+
+// hllPatLen returns the register of element, and the length of the pattern 000..1 of its hash, like redis.
+func hllPatLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, hllSeed)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	// the bit hllQ stops the count, so it is at most hllQ+1
+	hash |= 1 << hllQ
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+// hllCount estimates the cardinality with the improved estimator of Otmar Ertl used by redis.
+func hllCount(regs []uint8) uint64 {
+	var histogram [hllQ + 2]int
+	for _, reg := range regs {
+		histogram[reg]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64 bits MurmurHash2 of Austin Appleby used by redis, reading the input in little endian.
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m, r = 0xc6a4a7935bd1e995, 47
+	h := seed ^ uint64(len(data))*m
+	for ; len(data) >= 8; data = data[8:] {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
@@ -0,0 +1,162 @@
+package lazydb
+
+import (
+	"fmt"
+	"lazydb/util"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestHLLDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_hll")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func TestLazyDB_PFAdd_PFCount(t *testing.T) {
+	db := initTestHLLDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	// an empty HyperLogLog is encoded like redis
+	ok, err := db.PFAdd([]byte("empty"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	val, _ := db.Get([]byte("empty"))
+	assert.Equal(t, append([]byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), 0x7f, 0xff), val)
+	ok, _ = db.PFAdd([]byte("empty"))
+	assert.False(t, ok)
+
+	key := []byte("hll")
+	ok, err = db.PFAdd(key, []byte("a"), []byte("b"), []byte("c"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = db.PFAdd(key, []byte("a"), []byte("b"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	count, err := db.PFCount(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	// the cardinality is cached in the header
+	val, _ = db.Get(key)
+	assert.Equal(t, byte(3), val[8])
+	assert.Equal(t, byte(0), val[15]&0x80)
+	_, _ = db.PFAdd(key, []byte("d"))
+	val, _ = db.Get(key)
+	assert.Equal(t, byte(0x80), val[15]&0x80)
+
+	count, err = db.PFCount([]byte("missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+	_, err = db.PFCount()
+	assert.Equal(t, ErrInvalidParam, err)
+
+	_ = db.Set([]byte("str"), []byte("not a hll"))
+	_, err = db.PFAdd([]byte("str"), []byte("a"))
+	assert.Equal(t, ErrInvalidHLL, err)
+	_, err = db.PFCount([]byte("str"))
+	assert.Equal(t, ErrInvalidHLL, err)
+
+	// the ttl is kept
+	assert.NoError(t, db.Expire(key, time.Hour))
+	_, _ = db.PFAdd(key, []byte("e"))
+	ttl, _ := db.TTL(key)
+	assert.True(t, ttl > 0)
+}
+
+func TestLazyDB_PFCount_Error(t *testing.T) {
+	db := initTestHLLDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("visitors")
+	for _, n := range []int{1000, 10000, 100000} {
+		batch := make([][]byte, 0, 1000)
+		for i := 0; i < n; i++ {
+			batch = append(batch, []byte(fmt.Sprintf("%d-visitor-%d", n, i)))
+			if len(batch) == cap(batch) {
+				_, err := db.PFAdd(key, batch...)
+				assert.NoError(t, err)
+				batch = batch[:0]
+			}
+		}
+		_, _ = db.PFAdd(key, batch...)
+
+		count, err := db.PFCount(key)
+		assert.NoError(t, err)
+		// the standard error is 0.81%, 3 times of it is far enough
+		assert.True(t, math.Abs(float64(count-int64(n)))/float64(n) < 0.0243, "n %d count %d", n, count)
+		err = db.Delete(key)
+		assert.NoError(t, err)
+	}
+}
+
+func TestLazyDB_PFMerge(t *testing.T) {
+	db := initTestHLLDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 3000; i++ {
+		_, _ = db.PFAdd([]byte("a"), []byte(fmt.Sprintf("e%d", i)))
+		_, _ = db.PFAdd([]byte("b"), []byte(fmt.Sprintf("e%d", i+2000)))
+	}
+	union, err := db.PFCount([]byte("a"), []byte("b"), []byte("missing"))
+	assert.NoError(t, err)
+	assert.True(t, math.Abs(float64(union-5000)) < 5000*0.0243, union)
+
+	_, _ = db.PFAdd([]byte("dst"), []byte("e100000"))
+	assert.NoError(t, db.PFMerge([]byte("dst"), []byte("a"), []byte("b")))
+	count, err := db.PFCount([]byte("dst"))
+	assert.NoError(t, err)
+	// the destination is merged too
+	assert.True(t, count > union)
+
+	assert.NoError(t, db.PFMerge([]byte("new"), []byte("a")))
+	merged, _ := db.PFCount([]byte("new"))
+	single, _ := db.PFCount([]byte("a"))
+	assert.Equal(t, single, merged)
+}
+
+func TestHLL_Encoding(t *testing.T) {
+	regs := make([]uint8, hllRegisters)
+	regs[0], regs[1], regs[2], regs[100], regs[hllRegisters-1] = 3, 3, 32, 1, 7
+
+	// sparse: VAL(3)x2, VAL(32), XZERO(97), VAL(1), XZERO(16282), VAL(7)
+	sparse := hllEncode(regs, false, nil)
+	assert.Equal(t, byte(hllEncodingSparse), sparse[4])
+	assert.Equal(t, []byte{0x89, 0xfc, 0x40, 0x60, 0x80, 0x7f, 0x99, 0x98}, sparse[hllHeaderSize:])
+	decoded, dense, err := hllDecode(sparse)
+	assert.NoError(t, err)
+	assert.False(t, dense)
+	assert.Equal(t, regs, decoded)
+
+	// values greater than 32 need the dense encoding
+	regs[5] = 40
+	buf := hllEncode(regs, false, nil)
+	assert.Equal(t, hllDenseSize, len(buf))
+	decoded, dense, err = hllDecode(buf)
+	assert.NoError(t, err)
+	assert.True(t, dense)
+	assert.Equal(t, regs, decoded)
+
+	for _, bad := range [][]byte{
+		[]byte("HYLL"),
+		append([]byte("HYLX\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), 0x7f, 0xff),
+		append([]byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), 0x7f, 0xfe),
+		append([]byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), 0x7f, 0xff, 0x00),
+		[]byte("HYLL\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+	} {
+		_, _, err := hllDecode(bad)
+		assert.Equal(t, ErrInvalidHLL, err)
+	}
+}
@@ -1,6 +1,8 @@
 package lazydb
 
 import (
+	"encoding/binary"
+	"github.com/gansidui/skiplist"
 	"io"
 	"lazydb/ds"
 	"lazydb/logfile"
@@ -12,44 +14,197 @@ import (
 	"time"
 )
 
-func (db *LazyDB) buildStrIndex(entry *logfile.LogEntry, vPos *ValuePos) {
+// buildStrIndex applies a string entry to the index, and returns the index value it replaced.
+func (db *LazyDB) buildStrIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	if entry.Stat == logfile.SBitmapPage {
+		return db.buildBitmapPage(entry, vPos)
+	}
+	if entry.Stat != logfile.SBitmap {
+		db.dropBitmapPages(entry.Key, false)
+	}
 	if entry.Stat == logfile.SDelete {
-		db.strIndex.idxTree.Delete(entry.Key)
-		return
+		oldVal, _ := db.strIndex.idxTree.Delete(entry.Key)
+		db.setStrExpire(entry.Key, 0)
+		return oldVal
 	}
 	_, size := logfile.EncodeEntry(entry)
-	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
-
-	// TODO: set expire time
+	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size, expiredAt: entry.ExpiredAt}
+	oldVal, _ := db.strIndex.idxTree.Put(entry.Key, idxNode)
+	db.setStrExpire(entry.Key, entry.ExpiredAt)
+	return oldVal
+}
 
-	db.strIndex.idxTree.Put(entry.Key, idxNode)
+// buildBitmapPage applies a page entry of a bitmap, and returns the index value it replaced.
+// An empty page entry removes the page.
+func (db *LazyDB) buildBitmapPage(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	key, page := decodeKey(entry.Key)
+	tree := db.strIndex.bitmaps[string(key)]
+	if len(entry.Value) == 0 {
+		if tree == nil {
+			return nil
+		}
+		oldVal, _ := tree.Delete(page)
+		if tree.Size() == 0 {
+			delete(db.strIndex.bitmaps, string(key))
+		}
+		return oldVal
+	}
+	if tree == nil {
+		tree = ds.NewART()
+		db.strIndex.bitmaps[string(key)] = tree
+	}
+	_, size := logfile.EncodeEntry(entry)
+	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
+	oldVal, _ := tree.Put(page, idxNode)
+	return oldVal
 }
 
-func (db *LazyDB) buildHashIndex(entry *logfile.LogEntry, vPos *ValuePos) {
-	key, _ := decodeKey(entry.Key)
+func (db *LazyDB) buildHashIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
 	db.hashIndex.mu.Lock()
 	defer db.hashIndex.mu.Unlock()
-	idxTree := db.hashIndex.trees[util.ByteToString(key)]
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeHash, entry, vPos)
+	}
+	key, _ := decodeKey(entry.Key)
+	idxTree := db.hashIndex.trees[string(key)]
+	if idxTree == nil {
+		idxTree = ds.NewART()
+		db.indexCollectionKey(valueTypeHash, key)
+		db.hashIndex.trees[string(key)] = idxTree
+	}
+	if entry.Stat == logfile.SDelete {
+		oldVal, _ := idxTree.Delete(entry.Key)
+		db.setFieldExpire(key, entry.Key, 0)
+		return oldVal
+	}
+
+	_, size := logfile.EncodeEntry(entry)
+	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size, expiredAt: entry.ExpiredAt}
+	oldVal, _ := idxTree.Put(entry.Key, idxNode)
+	db.setFieldExpire(key, entry.Key, entry.ExpiredAt)
+	return oldVal
+}
+
+// buildListIndex applies a list entry, list meta and key meta entries are keyed by the raw key
+// and elements are keyed by the encoded list key.
+func (db *LazyDB) buildListIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	key := entry.Key
+	if entry.Stat != logfile.SListMeta && entry.Stat != logfile.SKeyMeta {
+		key, _ = db.decodeListKey(entry.Key)
+	}
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeList, entry, vPos)
+	}
+	idxTree := db.listIndex.trees[string(key)]
+	if idxTree == nil {
+		idxTree = ds.NewART()
+		db.indexCollectionKey(valueTypeList, key)
+		db.listIndex.trees[string(key)] = idxTree
+	}
 	if entry.Stat == logfile.SDelete {
-		idxTree.Delete(entry.Key)
-		return
+		oldVal, _ := idxTree.Delete(entry.Key)
+		return oldVal
 	}
 
+	_, size := logfile.EncodeEntry(entry)
+	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size, expiredAt: entry.ExpiredAt}
+	oldVal, _ := idxTree.Put(entry.Key, idxNode)
+	// an empty list is removed from the index, the same as popping the last element.
+	if entry.Stat == logfile.SListMeta && len(entry.Value) == 8 &&
+		binary.LittleEndian.Uint32(entry.Value[4:8])-binary.LittleEndian.Uint32(entry.Value[:4]) == 1 {
+		db.unindexCollectionKey(valueTypeList, key)
+		delete(db.listIndex.trees, string(key))
+	}
+	return oldVal
+}
+
+// buildSetIndex applies a set entry, members are indexed by their murmur hash.
+// Added entries hold the member as value, while deleted entries hold the hash.
+func (db *LazyDB) buildSetIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeSet, entry, vPos)
+	}
+	idxTree := db.setIndex.trees[string(entry.Key)]
+	if idxTree == nil {
+		idxTree = ds.NewART()
+		db.indexCollectionKey(valueTypeSet, entry.Key)
+		db.setIndex.trees[string(entry.Key)] = idxTree
+	}
+	if entry.Stat == logfile.SDelete {
+		oldVal, _ := idxTree.Delete(entry.Value)
+		return oldVal
+	}
+
+	if err := db.setIndex.murHash.Write(entry.Value); err != nil {
+		return nil
+	}
+	sum := db.setIndex.murHash.EncodeSum128()
+	db.setIndex.murHash.Reset()
+
 	_, size := logfile.EncodeEntry(entry)
 	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
+	oldVal, _ := idxTree.Put(sum, idxNode)
+	return oldVal
+}
 
-	// TODO: set expire time
+// buildZSetIndex applies a sorted set entry to both the radix tree and the skip list.
+func (db *LazyDB) buildZSetIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeZSet, entry, vPos)
+	}
+	key, member := decodeKey(entry.Key)
+	idx := db.zSetIndex.indexes[string(key)]
+	if idx == nil {
+		idx = &ZSetIndex{tree: ds.NewART(), skl: skiplist.New()}
+		db.indexCollectionKey(valueTypeZSet, key)
+		db.zSetIndex.indexes[string(key)] = idx
+	}
+	if idx.tree.Get(entry.Key) != nil {
+		if oldScore, err := db.getValue(idx.tree, entry.Key, valueTypeZSet); err == nil {
+			idx.deleteNode(util.ByteToFloat64(oldScore), member)
+		}
+	}
+	if entry.Stat == logfile.SDelete {
+		oldVal, _ := idx.tree.Delete(entry.Key)
+		return oldVal
+	}
 
-	idxTree.Put(entry.Key, idxNode)
+	_, size := logfile.EncodeEntry(entry)
+	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
+	oldVal, _ := idx.tree.Put(entry.Key, idxNode)
+	idx.insertNode(util.ByteToFloat64(entry.Value), member)
+	return oldVal
 }
 
-func (db *LazyDB) buildIndexByVType(typ valueType, entry *logfile.LogEntry, vPos *ValuePos) {
+// buildIndexByVType applies entry to the index of typ, and returns the index value it replaced.
+func (db *LazyDB) buildIndexByVType(typ valueType, entry *logfile.LogEntry, vPos *ValuePos) interface{} {
 	switch typ {
 	case valueTypeString:
-		db.buildStrIndex(entry, vPos)
+		return db.buildStrIndex(entry, vPos)
 	case valueTypeHash:
-		db.buildHashIndex(entry, vPos)
+		return db.buildHashIndex(entry, vPos)
+	case valueTypeList:
+		return db.buildListIndex(entry, vPos)
+	case valueTypeSet:
+		return db.buildSetIndex(entry, vPos)
+	case valueTypeZSet:
+		return db.buildZSetIndex(entry, vPos)
+	case valueTypeStream:
+		return db.buildStreamIndex(entry, vPos)
+	case valueTypeJSON:
+		return db.buildJSONIndex(entry, vPos)
+	case valueTypeTimeSeries:
+		return db.buildTSIndex(entry, vPos)
 	}
+	return nil
 }
 
 func (db *LazyDB) buildIndexFromLogFiles() error {
@@ -133,6 +288,9 @@ func (db *LazyDB) getValue(idxTree *ds.AdaptiveRadixTree, key []byte, typ valueT
 	if ent.Stat == logfile.SDelete || (ent.ExpiredAt != 0 && ent.ExpiredAt < ts) {
 		return nil, ErrKeyNotFound
 	}
+	if typ == valueTypeString && ent.Stat == logfile.SBitmap {
+		return db.bitmapValue(key, ent)
+	}
 
 	return ent.Value, nil
 }
@@ -151,6 +309,12 @@ func (db *LazyDB) updateIndexTree(typ valueType, idxTree *ds.AdaptiveRadixTree,
 	}
 
 	oldVal, updated := idxTree.Put(entry.Key, idxNode)
+	if typ == valueTypeString {
+		db.setStrExpire(entry.Key, entry.ExpiredAt)
+		if entry.Stat != logfile.SBitmap {
+			db.dropBitmapPages(entry.Key, sendDiscard)
+		}
+	}
 
 	if sendDiscard {
 		if err := db.sendDiscard(oldVal, updated, typ); err != nil {
@@ -0,0 +1,230 @@
+package lazydb
+
+import (
+	"bytes"
+	"lazydb/logfile"
+	"time"
+)
+
+// defaultIteratorBatchSize is the number of keys loaded by an Iterator at a time.
+const defaultIteratorBatchSize = 100
+
+// IteratorOptions are the options of an Iterator.
+type IteratorOptions struct {
+	// Start is the first key of the range, inclusive. The range is unbounded below if it is nil.
+	Start []byte
+	// End is the last key of the range, exclusive. The range is unbounded above if it is nil.
+	End []byte
+	// Reverse makes Next go from the greatest key to the smallest one.
+	Reverse bool
+	// KeysOnly makes Value always return nil, so values are never read.
+	KeysOnly bool
+	// BatchSize is the number of keys loaded from the index at a time, defaultIteratorBatchSize if not positive.
+	BatchSize int
+}
+
+// Iterator walks the string keys in order.
+// Keys are loaded from the index in batches, so the read lock is not held between calls,
+// and values are read from the log files only when Value is called.
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	db    *LazyDB
+	opts  IteratorOptions
+	batch []*iterEntry
+	// pos is the position of the current entry in batch, which is sorted in ascending key order.
+	pos int
+}
+
+type iterEntry struct {
+	key []byte
+	val *Value
+}
+
+// NewIterator returns an Iterator over the string keys, positioned at the first key.
+func (db *LazyDB) NewIterator(opts IteratorOptions) *Iterator {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultIteratorBatchSize
+	}
+	it := &Iterator{db: db, opts: opts}
+	it.Rewind()
+	return it
+}
+
+// Rewind positions the iterator at the first key, which is the greatest one in reverse mode.
+func (it *Iterator) Rewind() {
+	if it.opts.Reverse {
+		it.loadBefore(it.opts.End)
+		return
+	}
+	it.loadFrom(it.opts.Start)
+}
+
+// Seek positions the iterator at the first key greater than or equal to key,
+// or at the last key less than or equal to key in reverse mode.
+func (it *Iterator) Seek(key []byte) {
+	if it.opts.Reverse {
+		// the keys less than key+"\x00" are the ones less than or equal to key.
+		end := append(append([]byte{}, key...), 0)
+		if it.opts.End != nil && bytes.Compare(end, it.opts.End) > 0 {
+			end = it.opts.End
+		}
+		it.loadBefore(end)
+		return
+	}
+	if it.opts.Start != nil && bytes.Compare(key, it.opts.Start) < 0 {
+		key = it.opts.Start
+	}
+	it.loadFrom(key)
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.batch)
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() {
+	if it.opts.Reverse {
+		it.down()
+	} else {
+		it.up()
+	}
+}
+
+// Prev moves the iterator to the previous key.
+func (it *Iterator) Prev() {
+	if it.opts.Reverse {
+		it.up()
+	} else {
+		it.down()
+	}
+}
+
+// Key returns the current key, it must not be modified.
+func (it *Iterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.batch[it.pos].key
+}
+
+// Value reads the value of the current key. It returns nil in KeysOnly mode.
+// If the key has been deleted or overwritten since it was loaded, the value it held when loaded is returned,
+// unless the log file holding it has been merged.
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.Valid() || it.opts.KeysOnly {
+		return nil, nil
+	}
+	ent := it.batch[it.pos]
+	logEntry, err := it.db.readLogEntry(valueTypeString, ent.val.fid, ent.val.offset)
+	if err != nil {
+		// the log file may have been merged, read the latest value instead.
+		return it.db.Get(ent.key)
+	}
+	// the pages of a bitmap are assembled by Get
+	if logEntry.Stat == logfile.SBitmap {
+		return it.db.Get(ent.key)
+	}
+	return logEntry.Value, nil
+}
+
+// Close releases the loaded keys, the iterator is invalid afterwards.
+func (it *Iterator) Close() {
+	it.batch, it.pos = nil, 0
+}
+
+// up moves to the next greater key, loading the following batch if needed.
+func (it *Iterator) up() {
+	if !it.Valid() {
+		return
+	}
+	if it.pos+1 < len(it.batch) {
+		it.pos++
+		return
+	}
+	// the keys greater than last are the ones greater than or equal to last+"\x00".
+	last := it.batch[it.pos].key
+	it.loadFrom(append(append([]byte{}, last...), 0))
+}
+
+// down moves to the next smaller key, loading the preceding batch if needed.
+func (it *Iterator) down() {
+	if !it.Valid() {
+		return
+	}
+	if it.pos > 0 {
+		it.pos--
+		return
+	}
+	it.loadBefore(it.batch[0].key)
+}
+
+// loadFrom loads the batch of keys greater than or equal to start, and positions at the first one.
+func (it *Iterator) loadFrom(start []byte) {
+	if start == nil {
+		start = []byte{}
+	}
+	for {
+		keys, more := it.scan(true, start)
+		it.pos = 0
+		if len(it.batch) > 0 || !more {
+			return
+		}
+		// every key of the batch has expired, go on with the following one.
+		start = append(append([]byte{}, keys[len(keys)-1]...), 0)
+	}
+}
+
+// loadBefore loads the batch of keys less than end, and positions at the last one.
+// All keys are taken into account if end is nil.
+func (it *Iterator) loadBefore(end []byte) {
+	for {
+		keys, more := it.scan(false, end)
+		it.pos = len(it.batch) - 1
+		if len(it.batch) > 0 || !more {
+			return
+		}
+		end = keys[0]
+	}
+}
+
+// scan loads a batch of keys within the range of the iterator, forward from bound if forward is true,
+// or backward from bound. Expired keys are dropped from the batch but returned in keys,
+// and it reports whether there may be more keys in the same direction.
+func (it *Iterator) scan(forward bool, bound []byte) (keys [][]byte, more bool) {
+	db := it.db
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+
+	size := it.opts.BatchSize
+	if forward {
+		keys = db.strIndex.idxTree.ScanFrom(bound, size)
+		more = len(keys) == size
+		for i, key := range keys {
+			if it.opts.End != nil && bytes.Compare(key, it.opts.End) >= 0 {
+				keys, more = keys[:i], false
+				break
+			}
+		}
+	} else {
+		keys = db.strIndex.idxTree.ScanBefore(bound, size)
+		more = len(keys) == size
+		for i := len(keys) - 1; i >= 0; i-- {
+			if it.opts.Start != nil && bytes.Compare(keys[i], it.opts.Start) < 0 {
+				keys, more = keys[i+1:], false
+				break
+			}
+		}
+	}
+
+	ts := time.Now().Unix()
+	it.batch = make([]*iterEntry, 0, len(keys))
+	for _, key := range keys {
+		val, _ := db.strIndex.idxTree.Get(key).(*Value)
+		if val == nil || (val.expiredAt != 0 && val.expiredAt < ts) {
+			continue
+		}
+		it.batch = append(it.batch, &iterEntry{key: key, val: val})
+	}
+	return keys, more
+}
@@ -0,0 +1,111 @@
+package lazydb
+
+import (
+	"fmt"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestIteratorDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_iterator")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func iterKeys(it *Iterator) []string {
+	keys := make([]string, 0)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func TestLazyDB_Iterator(t *testing.T) {
+	db := initTestIteratorDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		_ = db.Set([]byte(fmt.Sprintf("event:%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	_ = db.Set([]byte("a"), []byte("a"))
+	_ = db.Set([]byte("z"), []byte("z"))
+	_ = db.SetEX([]byte("event:05"), []byte("expired"), -time.Second)
+
+	tests := []struct {
+		name string
+		opts IteratorOptions
+		want []string
+	}{
+		{"all", IteratorOptions{BatchSize: 3},
+			[]string{"a", "event:00", "event:01", "event:02", "event:03", "event:04", "event:06", "event:07", "event:08", "event:09", "z"}},
+		{"bounds", IteratorOptions{Start: []byte("event:02"), End: []byte("event:07"), BatchSize: 2},
+			[]string{"event:02", "event:03", "event:04", "event:06"}},
+		{"reverse", IteratorOptions{Start: []byte("event:"), End: []byte("event:;"), Reverse: true, BatchSize: 4},
+			[]string{"event:09", "event:08", "event:07", "event:06", "event:04", "event:03", "event:02", "event:01", "event:00"}},
+		{"empty range", IteratorOptions{Start: []byte("b"), End: []byte("c")}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := db.NewIterator(tt.opts)
+			defer it.Close()
+			assert.Equal(t, tt.want, iterKeys(it))
+		})
+	}
+}
+
+func TestLazyDB_Iterator_Seek(t *testing.T) {
+	db := initTestIteratorDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"k1", "k3", "k5", "k7"} {
+		_ = db.Set([]byte(key), []byte("v"+key))
+	}
+
+	it := db.NewIterator(IteratorOptions{BatchSize: 2})
+	it.Seek([]byte("k4"))
+	assert.Equal(t, "k5", string(it.Key()))
+	val, err := it.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "vk5", string(val))
+	it.Prev()
+	assert.Equal(t, "k3", string(it.Key()))
+	it.Prev()
+	assert.Equal(t, "k1", string(it.Key()))
+	it.Prev()
+	assert.False(t, it.Valid())
+	it.Seek([]byte("k8"))
+	assert.False(t, it.Valid())
+	it.Rewind()
+	assert.Equal(t, "k1", string(it.Key()))
+
+	rit := db.NewIterator(IteratorOptions{Reverse: true, KeysOnly: true})
+	rit.Seek([]byte("k5"))
+	assert.Equal(t, "k5", string(rit.Key()))
+	val, err = rit.Value()
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	rit.Next()
+	assert.Equal(t, "k3", string(rit.Key()))
+	rit.Prev()
+	rit.Prev()
+	assert.Equal(t, "k7", string(rit.Key()))
+
+	// values are read lazily from the position loaded with the key
+	it.Seek([]byte("k7"))
+	_ = db.Set([]byte("k7"), []byte("new"))
+	val, err = it.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "vk7", string(val))
+}
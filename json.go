@@ -0,0 +1,674 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"lazydb/logfile"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidJSON        = errors.New("invalid json value")
+	ErrInvalidJSONPath    = errors.New("invalid json path")
+	ErrJSONPathNotFound   = errors.New("json path does not exist")
+	ErrJSONNewNotRoot     = errors.New("new json documents must be created at the root")
+	ErrJSONNumberOverflow = errors.New("json number overflow")
+)
+
+// A json document is decoded into nil, bool, json.Number, string, *jsonArray and *jsonObject values,
+// which keep the order of object keys and can be updated in place.
+type (
+	jsonObject struct {
+		keys   []string
+		values map[string]interface{}
+	}
+
+	jsonArray struct {
+		items []interface{}
+	}
+
+	// jsonDoc holds the root value, so that the root can be replaced like any other value.
+	jsonDoc struct {
+		root interface{}
+	}
+
+	// jsonRef refers to a value by its parent, which is nil for the root.
+	jsonRef struct {
+		parent interface{}
+		name   string
+		index  int
+	}
+
+	// jsonSegment is a step of a json path, it selects a member by name or an array element by index,
+	// or every child if wildcard is set. If recursive is set, it selects them from all descendants.
+	jsonSegment struct {
+		recursive bool
+		wildcard  bool
+		isIndex   bool
+		name      string
+		index     int
+	}
+)
+
+// JSONSet sets the json value at path in the document stored at key.
+// A new document must be set at the root "$". If path does not exist, its last segment may name
+// a new member of existing objects, otherwise ErrJSONPathNotFound is returned.
+//
+// Paths are a subset of JSONPath: the root "$", members ".name" and "['name']", elements "[1]" and "[-1]",
+// wildcards ".*" and "[*]", and the recursive descent "..name", "..*" and "..[0]".
+func (db *LazyDB) JSONSet(key []byte, path string, value []byte) error {
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(value) {
+		return ErrInvalidJSON
+	}
+	db.jsonIndex.mu.Lock()
+	defer db.jsonIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeJSON, key); err != nil {
+		return err
+	}
+
+	doc, err := db.getJSON(key)
+	if err == ErrKeyNotFound {
+		if len(segs) != 0 {
+			return ErrJSONNewNotRoot
+		}
+		doc, err = &jsonDoc{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	refs := doc.find(segs)
+	if len(refs) == 0 {
+		last := segs[len(segs)-1]
+		if last.recursive || last.wildcard || last.isIndex {
+			return ErrJSONPathNotFound
+		}
+		for _, ref := range doc.find(segs[:len(segs)-1]) {
+			if obj, ok := doc.get(ref).(*jsonObject); ok {
+				refs = append(refs, jsonRef{parent: obj, name: last.name})
+			}
+		}
+		if len(refs) == 0 {
+			return ErrJSONPathNotFound
+		}
+	}
+	for _, ref := range refs {
+		// every match gets its own copy
+		v, _ := decodeJSON(value)
+		doc.set(ref, v)
+	}
+	if err := db.writeJSON(key, encodeJSON(doc.root)); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "json.set", key)
+	return nil
+}
+
+// JSONGet returns the document stored at key if no path is given, a json array of the values at path
+// if one is given, or a json object of the arrays keyed by path if more than one is given.
+func (db *LazyDB) JSONGet(key []byte, paths ...string) ([]byte, error) {
+	segs := make([][]jsonSegment, len(paths))
+	for i, path := range paths {
+		var err error
+		if segs[i], err = parseJSONPath(path); err != nil {
+			return nil, err
+		}
+	}
+	db.jsonIndex.mu.RLock()
+	defer db.jsonIndex.mu.RUnlock()
+
+	doc, err := db.getJSON(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return encodeJSON(doc.root), nil
+	}
+	values := func(segs []jsonSegment) *jsonArray {
+		arr := &jsonArray{}
+		for _, ref := range doc.find(segs) {
+			arr.items = append(arr.items, doc.get(ref))
+		}
+		return arr
+	}
+	if len(paths) == 1 {
+		return encodeJSON(values(segs[0])), nil
+	}
+	obj := newJSONObject()
+	for i, path := range paths {
+		obj.set(path, values(segs[i]))
+	}
+	return encodeJSON(obj), nil
+}
+
+// JSONDel deletes the values at path in the document stored at key, and returns the number of them.
+// Deleting the root deletes the key.
+func (db *LazyDB) JSONDel(key []byte, path string) (int, error) {
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+	db.jsonIndex.mu.Lock()
+	defer db.jsonIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeJSON, key); err != nil {
+		return 0, err
+	}
+
+	doc, err := db.getJSON(key)
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(segs) == 0 {
+		if err := db.deleteKey(valueTypeJSON, key); err != nil {
+			return 0, err
+		}
+		db.notifyKeyspaceEvent(notifyModule, "json.del", key)
+		return 1, nil
+	}
+	refs := doc.find(segs)
+	if len(refs) == 0 {
+		return 0, nil
+	}
+	// elements are removed from the back, so the indexes of the others still hold
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].index > refs[j].index
+	})
+	for _, ref := range refs {
+		doc.delete(ref)
+	}
+	if err := db.writeJSON(key, encodeJSON(doc.root)); err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "json.del", key)
+	return len(refs), nil
+}
+
+// JSONNumIncrBy increments the numbers at path in the document stored at key,
+// and returns the new values, with nil for the values that are not numbers.
+// Integers stay integers if incr is an integer too.
+func (db *LazyDB) JSONNumIncrBy(key []byte, path string, incr float64) ([]*float64, error) {
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	db.jsonIndex.mu.Lock()
+	defer db.jsonIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeJSON, key); err != nil {
+		return nil, err
+	}
+
+	doc, err := db.getJSON(key)
+	if err != nil {
+		return nil, err
+	}
+	refs := doc.find(segs)
+	results := make([]*float64, len(refs))
+	updated := make([]json.Number, len(refs))
+	for i, ref := range refs {
+		num, ok := doc.get(ref).(json.Number)
+		if !ok {
+			continue
+		}
+		sum, f, err := jsonAddNumber(num, incr)
+		if err != nil {
+			return nil, err
+		}
+		updated[i], results[i] = sum, &f
+	}
+	// nothing is changed if any of them overflows
+	changed := false
+	for i, ref := range refs {
+		if results[i] != nil {
+			doc.set(ref, updated[i])
+			changed = true
+		}
+	}
+	if !changed {
+		return results, nil
+	}
+	if err := db.writeJSON(key, encodeJSON(doc.root)); err != nil {
+		return nil, err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "json.numincrby", key)
+	return results, nil
+}
+
+// JSONArrAppend appends the json values to the arrays at path in the document stored at key,
+// and returns the new lengths of them, with nil for the values that are not arrays.
+func (db *LazyDB) JSONArrAppend(key []byte, path string, values ...[]byte) ([]*int64, error) {
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrInvalidParam
+	}
+	for _, value := range values {
+		if !json.Valid(value) {
+			return nil, ErrInvalidJSON
+		}
+	}
+	db.jsonIndex.mu.Lock()
+	defer db.jsonIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeJSON, key); err != nil {
+		return nil, err
+	}
+
+	doc, err := db.getJSON(key)
+	if err != nil {
+		return nil, err
+	}
+	refs := doc.find(segs)
+	lengths := make([]*int64, len(refs))
+	changed := false
+	for i, ref := range refs {
+		arr, ok := doc.get(ref).(*jsonArray)
+		if !ok {
+			continue
+		}
+		for _, value := range values {
+			v, _ := decodeJSON(value)
+			arr.items = append(arr.items, v)
+		}
+		n := int64(len(arr.items))
+		lengths[i] = &n
+		changed = true
+	}
+	if !changed {
+		return lengths, nil
+	}
+	if err := db.writeJSON(key, encodeJSON(doc.root)); err != nil {
+		return nil, err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "json.arrappend", key)
+	return lengths, nil
+}
+
+// JSONObjKeys returns the keys of the objects at path in the document stored at key,
+// with nil for the values that are not objects.
+func (db *LazyDB) JSONObjKeys(key []byte, path string) ([][]string, error) {
+	segs, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	db.jsonIndex.mu.RLock()
+	defer db.jsonIndex.mu.RUnlock()
+
+	doc, err := db.getJSON(key)
+	if err != nil {
+		return nil, err
+	}
+	refs := doc.find(segs)
+	keys := make([][]string, len(refs))
+	for i, ref := range refs {
+		if obj, ok := doc.get(ref).(*jsonObject); ok {
+			keys[i] = append([]string{}, obj.keys...)
+		}
+	}
+	return keys, nil
+}
+
+func (db *LazyDB) buildJSONIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	db.jsonIndex.mu.Lock()
+	defer db.jsonIndex.mu.Unlock()
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeJSON, entry, vPos)
+	}
+	if entry.Stat == logfile.SDelete {
+		oldVal, _ := db.jsonIndex.idxTree.Delete(entry.Key)
+		return oldVal
+	}
+	_, size := logfile.EncodeEntry(entry)
+	idxNode := &Value{fid: vPos.fid, offset: vPos.offset, entrySize: size}
+	oldVal, _ := db.jsonIndex.idxTree.Put(entry.Key, idxNode)
+	return oldVal
+}
+
+// getJSON returns the decoded document stored at key, the caller must hold the lock.
+func (db *LazyDB) getJSON(key []byte) (*jsonDoc, error) {
+	if db.keyExpired(valueTypeJSON, key) {
+		return nil, ErrKeyNotFound
+	}
+	val, err := db.getValue(db.jsonIndex.idxTree, key, valueTypeJSON)
+	if err != nil {
+		return nil, err
+	}
+	root, err := decodeJSON(val)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonDoc{root: root}, nil
+}
+
+// writeJSON writes the encoded document of key, the caller must hold the write lock.
+func (db *LazyDB) writeJSON(key, val []byte) error {
+	entry := &logfile.LogEntry{Key: key, Value: val}
+	pos, err := db.writeLogEntry(valueTypeJSON, entry)
+	if err != nil {
+		return err
+	}
+	if err := db.updateIndexTree(valueTypeJSON, db.jsonIndex.idxTree, entry, pos, true); err != nil {
+		return err
+	}
+	db.notifyChange(valueTypeJSON, entry)
+	return nil
+}
+
+// jsonAddNumber returns num plus incr as a json number and as a float.
+func jsonAddNumber(num json.Number, incr float64) (json.Number, float64, error) {
+	if i, err := num.Int64(); err == nil && incr == math.Trunc(incr) && math.Abs(incr) < math.MaxInt64 {
+		d := int64(incr)
+		sum := i + d
+		if d > 0 && sum < i || d < 0 && sum > i {
+			return "", 0, ErrJSONNumberOverflow
+		}
+		return json.Number(strconv.FormatInt(sum, 10)), float64(sum), nil
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return "", 0, ErrInvalidJSON
+	}
+	sum := f + incr
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", 0, ErrJSONNumberOverflow
+	}
+	buf, _ := json.Marshal(sum)
+	return json.Number(buf), sum, nil
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: make(map[string]interface{})}
+}
+
+func (o *jsonObject) set(name string, v interface{}) {
+	if _, ok := o.values[name]; !ok {
+		o.keys = append(o.keys, name)
+	}
+	o.values[name] = v
+}
+
+func (o *jsonObject) delete(name string) {
+	if _, ok := o.values[name]; !ok {
+		return
+	}
+	delete(o.values, name)
+	for i, k := range o.keys {
+		if k == name {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (d *jsonDoc) get(ref jsonRef) interface{} {
+	switch p := ref.parent.(type) {
+	case *jsonObject:
+		return p.values[ref.name]
+	case *jsonArray:
+		return p.items[ref.index]
+	}
+	return d.root
+}
+
+func (d *jsonDoc) set(ref jsonRef, v interface{}) {
+	switch p := ref.parent.(type) {
+	case *jsonObject:
+		p.set(ref.name, v)
+	case *jsonArray:
+		p.items[ref.index] = v
+	default:
+		d.root = v
+	}
+}
+
+func (d *jsonDoc) delete(ref jsonRef) {
+	switch p := ref.parent.(type) {
+	case *jsonObject:
+		p.delete(ref.name)
+	case *jsonArray:
+		p.items = append(p.items[:ref.index], p.items[ref.index+1:]...)
+	}
+}
+
+// find returns the references of the values selected by the path segments, in document order.
+func (d *jsonDoc) find(segs []jsonSegment) []jsonRef {
+	refs := []jsonRef{{}}
+	for _, seg := range segs {
+		var next []jsonRef
+		for _, ref := range refs {
+			nodes := []jsonRef{ref}
+			if seg.recursive {
+				nodes = d.descendants(ref, nil)
+			}
+			for _, node := range nodes {
+				next = append(next, d.children(node, seg)...)
+			}
+		}
+		refs = next
+	}
+	return refs
+}
+
+// children returns the children of the value at ref selected by seg.
+func (d *jsonDoc) children(ref jsonRef, seg jsonSegment) []jsonRef {
+	var refs []jsonRef
+	switch v := d.get(ref).(type) {
+	case *jsonObject:
+		if seg.wildcard {
+			for _, name := range v.keys {
+				refs = append(refs, jsonRef{parent: v, name: name})
+			}
+		} else if _, ok := v.values[seg.name]; ok && !seg.isIndex {
+			refs = append(refs, jsonRef{parent: v, name: seg.name})
+		}
+	case *jsonArray:
+		if seg.wildcard {
+			for i := range v.items {
+				refs = append(refs, jsonRef{parent: v, index: i})
+			}
+		} else if seg.isIndex {
+			i := seg.index
+			if i < 0 {
+				i += len(v.items)
+			}
+			if i >= 0 && i < len(v.items) {
+				refs = append(refs, jsonRef{parent: v, index: i})
+			}
+		}
+	}
+	return refs
+}
+
+// descendants appends ref and all the values under it to refs, parents before their children.
+func (d *jsonDoc) descendants(ref jsonRef, refs []jsonRef) []jsonRef {
+	refs = append(refs, ref)
+	for _, child := range d.children(ref, jsonSegment{wildcard: true}) {
+		refs = d.descendants(child, refs)
+	}
+	return refs
+}
+
+// parseJSONPath parses path into segments, the root "$" has none.
+func parseJSONPath(path string) ([]jsonSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, ErrInvalidJSONPath
+	}
+	var segs []jsonSegment
+	for i := 1; i < len(path); {
+		var seg jsonSegment
+		switch path[i] {
+		case '.':
+			i++
+			if i < len(path) && path[i] == '.' {
+				seg.recursive = true
+				i++
+			}
+			if i >= len(path) {
+				return nil, ErrInvalidJSONPath
+			}
+			if path[i] == '[' && seg.recursive {
+				break
+			}
+			if path[i] == '*' {
+				seg.wildcard = true
+				i++
+				segs = append(segs, seg)
+				continue
+			}
+			j := i
+			for j < len(path) && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			if j == i {
+				return nil, ErrInvalidJSONPath
+			}
+			seg.name = path[i:j]
+			i = j
+			segs = append(segs, seg)
+			continue
+		case '[':
+		default:
+			return nil, ErrInvalidJSONPath
+		}
+
+		// a bracket segment: [*], [1], ['name'] or ["name"]
+		end := strings.IndexByte(path[i:], ']')
+		if q := path[i+1:]; len(q) > 0 && (q[0] == '\'' || q[0] == '"') {
+			closing := strings.IndexByte(q[1:], q[0])
+			if closing < 0 || len(q) < closing+3 || q[closing+2] != ']' {
+				return nil, ErrInvalidJSONPath
+			}
+			seg.name = q[1 : closing+1]
+			end = closing + 3
+		} else if end < 0 {
+			return nil, ErrInvalidJSONPath
+		} else if inner := path[i+1 : i+end]; inner == "*" {
+			seg.wildcard = true
+		} else {
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, ErrInvalidJSONPath
+			}
+			seg.isIndex, seg.index = true, index
+		}
+		i += end + 1
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// decodeJSON decodes a json text, keeping the order of object keys and the text of numbers.
+func decodeJSON(data []byte) (interface{}, error) {
+	if !json.Valid(data) {
+		return nil, ErrInvalidJSON
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, ErrInvalidJSON
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ErrInvalidJSON
+	}
+	return v, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := newJSONObject()
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(tok.(string), v)
+		}
+		_, err = dec.Token()
+		return obj, err
+	case '[':
+		arr := &jsonArray{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr.items = append(arr.items, v)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+	return nil, ErrInvalidJSON
+}
+
+// encodeJSON encodes a decoded json value into compact json text.
+func encodeJSON(v interface{}) []byte {
+	var buf bytes.Buffer
+	encodeJSONValue(&buf, v)
+	return buf.Bytes()
+}
+
+func encodeJSONValue(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		buf.WriteString(v.String())
+	case string:
+		writeJSONString(buf, v)
+	case *jsonArray:
+		buf.WriteByte('[')
+		for i, item := range v.items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encodeJSONValue(buf, item)
+		}
+		buf.WriteByte(']')
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, name := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, name)
+			buf.WriteByte(':')
+			encodeJSONValue(buf, v.values[name])
+		}
+		buf.WriteByte('}')
+	}
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	// Encode ends the value with a newline
+	buf.Truncate(buf.Len() - 1)
+}
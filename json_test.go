@@ -0,0 +1,246 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestJSONDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_json")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+const testStore = `{"name": "corner shop", "open": true, "rating": 4,
+	"address": {"city": "Lyon", "zip": "69001"},
+	"items": [{"sku": "a1", "price": 2.5, "tags": ["food"]}, {"sku": "b2", "price": 10, "tags": []}],
+	"owner": null}`
+
+func TestLazyDB_JSONSet_JSONGet(t *testing.T) {
+	db := initTestJSONDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("store:1")
+	assert.Equal(t, ErrJSONNewNotRoot, db.JSONSet(key, "$.name", []byte(`"x"`)))
+	assert.NoError(t, db.JSONSet(key, "$", []byte(testStore)))
+
+	// the document is stored compact, in the order of its keys
+	doc, err := db.JSONGet(key)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"corner shop","open":true,"rating":4,"address":{"city":"Lyon","zip":"69001"},`+
+		`"items":[{"sku":"a1","price":2.5,"tags":["food"]},{"sku":"b2","price":10,"tags":[]}],"owner":null}`, string(doc))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"$", `[` + string(doc) + `]`},
+		{"$.name", `["corner shop"]`},
+		{"$['address'][\"city\"]", `["Lyon"]`},
+		{"$.items[0].sku", `["a1"]`},
+		{"$.items[-1].sku", `["b2"]`},
+		{"$.items[*].price", `[2.5,10]`},
+		{"$.address.*", `["Lyon","69001"]`},
+		{"$..sku", `["a1","b2"]`},
+		{"$..tags[0]", `["food"]`},
+		{"$.items[5]", `[]`},
+		{"$.missing", `[]`},
+		{"$.owner", `[null]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			val, err := db.JSONGet(key, tt.path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(val))
+		})
+	}
+	val, err := db.JSONGet(key, "$.name", "$.rating")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"$.name":["corner shop"],"$.rating":[4]}`, string(val))
+
+	// existing values are replaced, and a missing last member is added to objects
+	assert.NoError(t, db.JSONSet(key, "$.items[*].price", []byte(`1`)))
+	assert.NoError(t, db.JSONSet(key, "$.address.country", []byte(`"FR"`)))
+	assert.NoError(t, db.JSONSet(key, "$.items[*].stock", []byte(`{"n": 3}`)))
+	val, _ = db.JSONGet(key, "$.items[*].price", "$.address", "$..stock")
+	assert.Equal(t, `{"$.items[*].price":[1,1],"$.address":[{"city":"Lyon","zip":"69001","country":"FR"}],"$..stock":[{"n":3},{"n":3}]}`, string(val))
+	assert.Equal(t, ErrJSONPathNotFound, db.JSONSet(key, "$.nothing.here", []byte(`1`)))
+	assert.Equal(t, ErrJSONPathNotFound, db.JSONSet(key, "$.items[9]", []byte(`1`)))
+
+	assert.Equal(t, ErrInvalidJSON, db.JSONSet(key, "$", []byte(`{"a":`)))
+	for _, path := range []string{"", "name", "$.", "$..", "$[", "$[x]", "$['a", "$.a[1"} {
+		_, err := db.JSONGet(key, path)
+		assert.Equal(t, ErrInvalidJSONPath, err, path)
+	}
+	_, err = db.JSONGet([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, DataTypeJSON, db.Type(key))
+}
+
+func TestLazyDB_JSONDel(t *testing.T) {
+	db := initTestJSONDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("store:1")
+	assert.NoError(t, db.JSONSet(key, "$", []byte(testStore)))
+	n, err := db.JSONDel(key, "$.items[*].tags")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = db.JSONDel(key, "$.items[*]")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = db.JSONDel(key, "$.missing")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	val, _ := db.JSONGet(key, "$.items")
+	assert.Equal(t, `[[]]`, string(val))
+
+	n, err = db.JSONDel(key, "$")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = db.JSONGet(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	n, err = db.JSONDel(key, "$")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLazyDB_JSONNumIncrBy(t *testing.T) {
+	db := initTestJSONDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("store:1")
+	assert.NoError(t, db.JSONSet(key, "$", []byte(testStore)))
+	results, err := db.JSONNumIncrBy(key, "$..price", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, 4.5, *results[0])
+	assert.Equal(t, float64(12), *results[1])
+	results, err = db.JSONNumIncrBy(key, "$.rating", 0.5)
+	assert.NoError(t, err)
+	assert.Equal(t, 4.5, *results[0])
+	results, err = db.JSONNumIncrBy(key, "$.name", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []*float64{nil}, results)
+
+	val, _ := db.JSONGet(key, "$..price", "$.rating")
+	assert.Equal(t, `{"$..price":[4.5,12],"$.rating":[4.5]}`, string(val))
+
+	assert.NoError(t, db.JSONSet(key, "$.big", []byte(`9223372036854775807`)))
+	_, err = db.JSONNumIncrBy(key, "$.big", 1)
+	assert.Equal(t, ErrJSONNumberOverflow, err)
+	_, err = db.JSONNumIncrBy([]byte("missing"), "$", 1)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_JSONArrAppend_JSONObjKeys(t *testing.T) {
+	db := initTestJSONDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("store:1")
+	assert.NoError(t, db.JSONSet(key, "$", []byte(testStore)))
+	lengths, err := db.JSONArrAppend(key, "$..tags", []byte(`"new"`), []byte(`{"x": [1]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), *lengths[0])
+	assert.Equal(t, int64(2), *lengths[1])
+	lengths, err = db.JSONArrAppend(key, "$.name", []byte(`1`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*int64{nil}, lengths)
+	val, _ := db.JSONGet(key, "$.items[1].tags")
+	assert.Equal(t, `[["new",{"x":[1]}]]`, string(val))
+	_, err = db.JSONArrAppend(key, "$.items", []byte(`nope`))
+	assert.Equal(t, ErrInvalidJSON, err)
+	_, err = db.JSONArrAppend(key, "$.items")
+	assert.Equal(t, ErrInvalidParam, err)
+
+	keys, err := db.JSONObjKeys(key, "$")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"name", "open", "rating", "address", "items", "owner"}}, keys)
+	keys, err = db.JSONObjKeys(key, "$.items[*]")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"sku", "price", "tags"}, {"sku", "price", "tags"}}, keys)
+	keys, _ = db.JSONObjKeys(key, "$.name")
+	assert.Equal(t, [][]string{nil}, keys)
+}
+
+func TestLazyDB_JSON_Reopen(t *testing.T) {
+	db := initTestJSONDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	key := []byte("store:1")
+	assert.NoError(t, db.JSONSet(key, "$", []byte(testStore)))
+	assert.NoError(t, db.JSONSet(key, "$.name", []byte(`"<new> & shiny"`)))
+	assert.NoError(t, db.JSONSet([]byte("tmp"), "$", []byte(`[1, 2]`)))
+	assert.NoError(t, db.Expire(key, time.Hour))
+	_, _ = db.JSONDel([]byte("tmp"), "$")
+
+	db.Close()
+	var err error
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+
+	val, err := db.JSONGet(key, "$.name")
+	assert.NoError(t, err)
+	assert.Equal(t, `["<new> & shiny"]`, string(val))
+	ttl, err := db.TTL(key)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+	_, err = db.JSONGet([]byte("tmp"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the whole key works with the keyspace commands
+	copied, err := db.Copy(key, []byte("store:2"), false)
+	assert.NoError(t, err)
+	assert.True(t, copied)
+	val, _ = db.JSONGet([]byte("store:2"), "$.address.city")
+	assert.Equal(t, `["Lyon"]`, string(val))
+	n, err := db.Del(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = db.JSONGet(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestLazyDB_JSON_Merge(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_json"))
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.NoError(t, err)
+	defer destroyDB(db)
+
+	key := []byte("counter")
+	assert.NoError(t, db.JSONSet(key, "$", []byte(`{"n": 0, "pad": "0123456789"}`)))
+	for i := 0; i < 100; i++ {
+		_, err := db.JSONNumIncrBy(key, "$.n", 1)
+		assert.NoError(t, err)
+	}
+
+	fids := append([]uint32{}, db.fidsMap[valueTypeJSON].fids...)
+	assert.True(t, len(fids) > 1)
+	// discards are counted in the background
+	time.Sleep(100 * time.Millisecond)
+	for _, fid := range fids {
+		assert.NoError(t, db.Merge(valueTypeJSON, fid, 0.1))
+	}
+	assert.True(t, db.archivedLogFile[valueTypeJSON].Size()+1 < len(fids))
+
+	val, err := db.JSONGet(key)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"n":100,"pad":"0123456789"}`, string(val))
+}
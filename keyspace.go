@@ -0,0 +1,546 @@
+package lazydb
+
+import (
+	"bytes"
+	"errors"
+	"lazydb/ds"
+	"lazydb/util"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var (
+	ErrSameKey     = errors.New("source and destination keys are the same")
+	ErrReservedKey = errors.New("key is reserved")
+)
+
+// Every data type has its own index, so the same key may be held by more than one type.
+// The commands below work on the key in all of them, and when only one type can be reported,
+// strings come first, then lists, hashes, sets, sorted sets, streams, json documents and time series.
+// The keys db keeps its own data in, like the ones of queues, are reserved: these commands treat them as missing.
+
+// reservedKey reports whether key is one of the keys db keeps its own data in.
+func reservedKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(queueKeyPrefix)) || string(key) == queueRegistryKey
+}
+
+// Exists returns the number of the given keys that exist, a key given twice is counted twice.
+func (db *LazyDB) Exists(keys ...[]byte) int {
+	var count int
+	for _, key := range keys {
+		if db.Type(key) != DataTypeNone {
+			count++
+		}
+	}
+	return count
+}
+
+// Type returns the type of the value stored at key, or DataTypeNone if the key does not exist.
+func (db *LazyDB) Type(key []byte) DataType {
+	if reservedKey(key) {
+		return DataTypeNone
+	}
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		mu := db.indexMutex(typ)
+		mu.RLock()
+		alive := db.keyAlive(typ, key)
+		mu.RUnlock()
+		if alive {
+			return dataTypes[typ]
+		}
+	}
+	return DataTypeNone
+}
+
+// Del removes the given keys of any type and returns the number of keys removed.
+// The keys are removed in all types at once, so no command sees them half removed.
+func (db *LazyDB) Del(keys ...[]byte) (int, error) {
+	unlock := db.lockIndexes()
+	defer unlock()
+
+	var count int
+	for _, key := range keys {
+		if reservedKey(key) {
+			continue
+		}
+		var deleted bool
+		for typ := valueType(0); typ < logFileTypeNum; typ++ {
+			alive, err := db.removeKey(typ, key)
+			if err != nil {
+				return count, err
+			}
+			deleted = deleted || alive
+		}
+		if deleted {
+			count++
+			db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		}
+	}
+	return count, nil
+}
+
+// Rename renames key to newKey, the value stored at newKey is overwritten.
+func (db *LazyDB) Rename(key, newKey []byte) error {
+	_, err := db.rename(key, newKey, false)
+	return err
+}
+
+// RenameNX renames key to newKey if newKey does not exist, and reports whether key is renamed.
+// It returns ErrKeyNotFound if key does not exist.
+func (db *LazyDB) RenameNX(key, newKey []byte) (bool, error) {
+	return db.rename(key, newKey, true)
+}
+
+// rename renames key to newKey, unless nx is true and newKey exists, and reports whether key is renamed.
+// The key is moved in all types at once, so no command sees it at both names or at neither.
+func (db *LazyDB) rename(key, newKey []byte, nx bool) (bool, error) {
+	if reservedKey(key) || reservedKey(newKey) {
+		return false, ErrReservedKey
+	}
+	unlock := db.lockIndexes()
+	defer unlock()
+
+	if !db.keyAliveInAny(key) {
+		return false, ErrKeyNotFound
+	}
+	if nx && db.keyAliveInAny(newKey) {
+		return false, nil
+	}
+	if bytes.Equal(key, newKey) {
+		return true, nil
+	}
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		if err := db.moveKey(typ, key, newKey, true); err != nil {
+			return false, err
+		}
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "rename_from", key)
+	db.notifyKeyspaceEvent(notifyGeneric, "rename_to", newKey)
+	return true, nil
+}
+
+// Copy copies the value stored at source to destination, including its ttl, and reports whether it is copied.
+// If destination exists, nothing is copied unless replace is true.
+func (db *LazyDB) Copy(source, destination []byte, replace bool) (bool, error) {
+	if bytes.Equal(source, destination) {
+		return false, ErrSameKey
+	}
+	if reservedKey(source) || reservedKey(destination) {
+		return false, ErrReservedKey
+	}
+	unlock := db.lockIndexes()
+	defer unlock()
+
+	if !db.keyAliveInAny(source) {
+		return false, nil
+	}
+	if !replace && db.keyAliveInAny(destination) {
+		return false, nil
+	}
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		if err := db.moveKey(typ, source, destination, false); err != nil {
+			return false, err
+		}
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "copy_to", destination)
+	return true, nil
+}
+
+// Keys returns all keys matching the glob-style pattern, sorted and without duplicates.
+func (db *LazyDB) Keys(pattern []byte) ([][]byte, error) {
+	matched := make(map[string]struct{})
+	match := func(key []byte) {
+		if !reservedKey(key) && util.GlobMatch(pattern, key) {
+			matched[string(key)] = struct{}{}
+		}
+	}
+
+	db.strIndex.mu.RLock()
+	ts := time.Now().Unix()
+	iter := db.strIndex.idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			db.strIndex.mu.RUnlock()
+			return nil, err
+		}
+		if val, _ := node.Value().(*Value); val != nil && (val.expiredAt == 0 || val.expiredAt >= ts) {
+			match(node.Key())
+		}
+	}
+	db.strIndex.mu.RUnlock()
+
+	for _, typ := range collectionTypes {
+		mu := db.indexMutex(typ)
+		mu.RLock()
+		for _, key := range db.collectionKeys(typ) {
+			if db.keyAlive(typ, []byte(key)) {
+				match([]byte(key))
+			}
+		}
+		mu.RUnlock()
+	}
+
+	keys := make([][]byte, 0, len(matched))
+	for key := range matched {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// randomKeyTries is the number of keys RandomKey samples before giving up when they have all expired.
+const randomKeyTries = 100
+
+// RandomKey returns a random key of the whole keyspace, or nil if the db is empty.
+// Keys are sampled, so the keyspace is never walked, and not every key is returned with the same probability.
+func (db *LazyDB) RandomKey() ([]byte, error) {
+	for i := 0; i < randomKeyTries; i++ {
+		key, empty := db.sampleKey()
+		if empty {
+			return nil, nil
+		}
+		if key != nil {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// sampleKey picks a type with a probability proportional to its number of keys, then one of its keys at random.
+// It returns a nil key if the key picked has expired, and reports whether the keyspace is empty.
+func (db *LazyDB) sampleKey() ([]byte, bool) {
+	var sizes [logFileTypeNum]int
+	var total int
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		mu := db.indexMutex(typ)
+		mu.RLock()
+		sizes[typ] = db.indexSize(typ)
+		mu.RUnlock()
+		total += sizes[typ]
+	}
+	if total == 0 {
+		return nil, true
+	}
+	n, typ := rand.Intn(total), valueType(0)
+	for ; typ < logFileTypeNum-1 && n >= sizes[typ]; typ++ {
+		n -= sizes[typ]
+	}
+
+	mu := db.indexMutex(typ)
+	mu.RLock()
+	defer mu.RUnlock()
+	var key []byte
+	switch typ {
+	case valueTypeString:
+		key, _ = db.strIndex.idxTree.Random()
+	case valueTypeJSON:
+		key, _ = db.jsonIndex.idxTree.Random()
+	default:
+		// maps are walked from a random position
+		db.forEachCollectionKey(typ, func(k string) bool {
+			key = []byte(k)
+			return false
+		})
+	}
+	if key == nil || reservedKey(key) || !db.keyAlive(typ, key) {
+		return nil, false
+	}
+	return key, false
+}
+
+// removeKey deletes the key of typ if it is in the index, and reports whether it was alive.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) removeKey(typ valueType, key []byte) (bool, error) {
+	alive := db.keyAlive(typ, key)
+	if !db.keyPresent(typ, key) {
+		return false, nil
+	}
+	return alive, db.deleteKey(typ, key)
+}
+
+// moveKey copies the key of typ from src to dst, the value of typ stored at dst is removed first.
+// src is removed after the copy if remove is true. The caller must hold the write lock of the index.
+func (db *LazyDB) moveKey(typ valueType, src, dst []byte, remove bool) error {
+	if db.keyPresent(typ, dst) {
+		if err := db.deleteKey(typ, dst); err != nil {
+			return err
+		}
+	}
+	if !db.keyAlive(typ, src) {
+		return nil
+	}
+	if err := db.copyKey(typ, src, dst); err != nil {
+		return err
+	}
+	if remove {
+		if err := db.deleteKey(typ, src); err != nil {
+			return err
+		}
+	}
+	if typ == valueTypeList {
+		db.serveListWaiters(dst)
+	}
+	return nil
+}
+
+// copyKey writes all members and the ttl of the key of typ from src to dst.
+// The caller must hold the write lock of the index, and dst must not exist.
+func (db *LazyDB) copyKey(typ valueType, src, dst []byte) error {
+	switch typ {
+	case valueTypeString:
+		value, err := db.getValue(db.strIndex.idxTree, src, valueTypeString)
+		if err != nil {
+			return err
+		}
+		idxNode, _ := db.strIndex.idxTree.Get(src).(*Value)
+		return db.setEX(dst, value, idxNode.expiredAt)
+	case valueTypeList:
+		idxTree := db.listIndex.trees[string(src)]
+		headSeq, tailSeq, err := db.lMeta(idxTree, src)
+		if err != nil {
+			return err
+		}
+		db.indexCollectionKey(valueTypeList, dst)
+		db.listIndex.trees[string(dst)] = ds.NewART()
+		for seq := headSeq + 1; seq < tailSeq; seq++ {
+			val, err := db.getValue(idxTree, db.encodeListKey(src, seq), valueTypeList)
+			if err != nil {
+				return err
+			}
+			if err = db.push(dst, val, false); err != nil {
+				return err
+			}
+		}
+	case valueTypeHash:
+		idxTree := db.hashIndex.trees[string(src)]
+		dstTree := ds.NewART()
+		db.indexCollectionKey(valueTypeHash, dst)
+		db.hashIndex.trees[string(dst)] = dstTree
+		for _, hashKey := range treeKeys(idxTree) {
+			val, err := db.getValue(idxTree, hashKey, valueTypeHash)
+			if err == ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			idxNode, _ := idxTree.Get(hashKey).(*Value)
+			_, field := decodeKey(hashKey)
+			if err = db.hSetField(dstTree, dst, field, val, idxNode.expiredAt); err != nil {
+				return err
+			}
+		}
+	case valueTypeSet:
+		members, err := db.sMembers(src)
+		if err != nil {
+			return err
+		}
+		if _, err = db.sAdd(dst, members...); err != nil {
+			return err
+		}
+	case valueTypeZSet:
+		idx := db.zSetIndex.indexes[string(src)]
+		args := make([][]byte, 0, idx.skl.Len()*2)
+		for e := idx.skl.Front(); e != nil; e = e.Next() {
+			node := e.Value.(*Node)
+			args = append(args, util.Float64ToByte(node.score), []byte(node.member))
+		}
+		if err := db.zAdd(dst, args...); err != nil {
+			return err
+		}
+	case valueTypeStream:
+		if err := db.copyStream(src, dst); err != nil {
+			return err
+		}
+	case valueTypeJSON:
+		val, err := db.getValue(db.jsonIndex.idxTree, src, valueTypeJSON)
+		if err != nil {
+			return err
+		}
+		if err := db.writeJSON(dst, val); err != nil {
+			return err
+		}
+	case valueTypeTimeSeries:
+		if err := db.copyTimeSeries(src, dst); err != nil {
+			return err
+		}
+	}
+	if meta := db.expiresOf(typ)[string(src)]; meta != nil {
+		return db.setKeyExpire(typ, dst, meta.expiredAt)
+	}
+	return nil
+}
+
+// keyAlive reports whether the key of typ exists and has not expired.
+// The caller must hold the lock of the index.
+func (db *LazyDB) keyAlive(typ valueType, key []byte) bool {
+	ts := time.Now().Unix()
+	switch typ {
+	case valueTypeString:
+		idxNode, _ := db.strIndex.idxTree.Get(key).(*Value)
+		return idxNode != nil && (idxNode.expiredAt == 0 || idxNode.expiredAt >= ts)
+	case valueTypeHash:
+		// a hash whose fields have all expired is empty
+		idxTree := db.getHashTree(key)
+		return idxTree != nil && db.hashLen(key, idxTree) > 0
+	default:
+		return !db.keyExpired(typ, key) && db.keyExists(typ, key)
+	}
+}
+
+// keyAliveInAny reports whether key exists in any type. The caller must hold the locks of all indexes.
+func (db *LazyDB) keyAliveInAny(key []byte) bool {
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		if db.keyAlive(typ, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockIndexes takes the write locks of all indexes in type order and returns the function releasing them.
+// Commands working on a key in every type hold them all, so that they are atomic to the ones working on one type.
+func (db *LazyDB) lockIndexes() func() {
+	for typ := valueType(0); typ < logFileTypeNum; typ++ {
+		db.indexMutex(typ).Lock()
+	}
+	return func() {
+		for typ := logFileTypeNum - 1; typ >= 0; typ-- {
+			db.indexMutex(valueType(typ)).Unlock()
+		}
+	}
+}
+
+// keyPresent reports whether the key of typ is in the index, expired or not.
+// The caller must hold the lock of the index.
+func (db *LazyDB) keyPresent(typ valueType, key []byte) bool {
+	if typ == valueTypeString {
+		return db.strIndex.idxTree.Get(key) != nil
+	}
+	_, ok := db.expiresOf(typ)[string(key)]
+	return ok || db.keyExists(typ, key)
+}
+
+// indexSize returns the number of keys in the index of typ, expired or not.
+// The caller must hold the lock of the index.
+func (db *LazyDB) indexSize(typ valueType) int {
+	switch typ {
+	case valueTypeString:
+		return db.strIndex.idxTree.Size()
+	case valueTypeList:
+		return len(db.listIndex.trees)
+	case valueTypeHash:
+		return len(db.hashIndex.trees)
+	case valueTypeSet:
+		return len(db.setIndex.trees)
+	case valueTypeZSet:
+		return len(db.zSetIndex.indexes)
+	case valueTypeStream:
+		return len(db.streamIndex.streams)
+	case valueTypeJSON:
+		return db.jsonIndex.idxTree.Size()
+	case valueTypeTimeSeries:
+		return len(db.tsIndex.series)
+	}
+	return 0
+}
+
+// collectionKeys returns the keys in the index of typ.
+// The caller must hold the lock of the index.
+func (db *LazyDB) collectionKeys(typ valueType) []string {
+	var keys []string
+	db.forEachCollectionKey(typ, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// orderedKeys returns the keys in the index of typ in byte order.
+// The caller must hold the lock of the index.
+func (db *LazyDB) orderedKeys(typ valueType) *ds.AdaptiveRadixTree {
+	switch typ {
+	case valueTypeString:
+		return db.strIndex.idxTree
+	case valueTypeList:
+		return db.listIndex.keys
+	case valueTypeHash:
+		return db.hashIndex.keys
+	case valueTypeSet:
+		return db.setIndex.keys
+	case valueTypeZSet:
+		return db.zSetIndex.keys
+	case valueTypeStream:
+		return db.streamIndex.keys
+	case valueTypeJSON:
+		return db.jsonIndex.idxTree
+	case valueTypeTimeSeries:
+		return db.tsIndex.keys
+	}
+	return nil
+}
+
+// indexCollectionKey adds key to the ordered keys of typ, it is called along with adding key to the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) indexCollectionKey(typ valueType, key []byte) {
+	k := make([]byte, len(key))
+	copy(k, key)
+	db.orderedKeys(typ).Put(k, struct{}{})
+}
+
+// unindexCollectionKey removes key from the ordered keys of typ, it is called along with removing key from the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) unindexCollectionKey(typ valueType, key []byte) {
+	db.orderedKeys(typ).Delete(key)
+}
+
+// forEachCollectionKey calls fn for every key in the index of typ, in no particular order, until fn returns false.
+// The caller must hold the lock of the index.
+func (db *LazyDB) forEachCollectionKey(typ valueType, fn func(key string) bool) {
+	switch typ {
+	case valueTypeList:
+		for key := range db.listIndex.trees {
+			if !fn(key) {
+				return
+			}
+		}
+	case valueTypeHash:
+		for key := range db.hashIndex.trees {
+			if !fn(key) {
+				return
+			}
+		}
+	case valueTypeSet:
+		for key := range db.setIndex.trees {
+			if !fn(key) {
+				return
+			}
+		}
+	case valueTypeZSet:
+		for key := range db.zSetIndex.indexes {
+			if !fn(key) {
+				return
+			}
+		}
+	case valueTypeStream:
+		for key := range db.streamIndex.streams {
+			if !fn(key) {
+				return
+			}
+		}
+	case valueTypeJSON:
+		db.jsonIndex.idxTree.Ascend(nil, func(key []byte, _ interface{}) bool {
+			return fn(string(key))
+		})
+	case valueTypeTimeSeries:
+		for key := range db.tsIndex.series {
+			if !fn(key) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestKeyspaceDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_keyspace")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func fillKeyspace(db *LazyDB) {
+	_ = db.Set([]byte("str"), []byte("v"))
+	_ = db.RPush([]byte("list"), []byte("a"), []byte("b"))
+	_ = db.HSet([]byte("hash"), []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2"))
+	_ = db.SAdd([]byte("set"), []byte("m1"), []byte("m2"))
+	_ = db.ZAdd([]byte("zset"), util.Float64ToByte(2), []byte("m2"), util.Float64ToByte(1), []byte("m1"))
+	_ = db.SetEX([]byte("str-expired"), []byte("v"), -time.Second)
+}
+
+func TestLazyDB_Type(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	fillKeyspace(db)
+
+	tests := []struct {
+		key  string
+		want DataType
+	}{
+		{"str", DataTypeString},
+		{"list", DataTypeList},
+		{"hash", DataTypeHash},
+		{"set", DataTypeSet},
+		{"zset", DataTypeZSet},
+		{"str-expired", DataTypeNone},
+		{"missing", DataTypeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.want, db.Type([]byte(tt.key)))
+		})
+	}
+	assert.Equal(t, 3, db.Exists([]byte("str"), []byte("str"), []byte("zset"), []byte("missing")))
+}
+
+func TestLazyDB_Del(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+	fillKeyspace(db)
+	// the same key held by two types
+	_ = db.SAdd([]byte("str"), []byte("m1"))
+
+	count, err := db.Del([]byte("str"), []byte("list"), []byte("hash"), []byte("set"), []byte("zset"),
+		[]byte("str-expired"), []byte("missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	keys, err := db.Keys([]byte("*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(keys))
+	assert.Equal(t, 0, db.LLen([]byte("list")))
+	assert.Equal(t, 0, db.HLen([]byte("hash")))
+	assert.Equal(t, 0, db.ZCard([]byte("zset")))
+	assert.False(t, db.SIsMember([]byte("str"), []byte("m1")))
+
+	// deleted keys are still deleted after the index is rebuilt
+	path := db.cfg.DBPath
+	assert.NoError(t, db.Close())
+	db, _ = Open(DefaultDBConfig(path))
+	keys, err = db.Keys([]byte("*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(keys))
+}
+
+func TestLazyDB_Rename(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	fillKeyspace(db)
+	assert.NoError(t, db.Expire([]byte("hash"), time.Hour))
+
+	assert.NoError(t, db.Rename([]byte("hash"), []byte("hash2")))
+	assert.Equal(t, DataTypeNone, db.Type([]byte("hash")))
+	all, err := db.HGetAll([]byte("hash2"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")}, all)
+	ttl, err := db.TTL([]byte("hash2"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 3500)
+
+	// the destination is overwritten whatever type it holds
+	assert.NoError(t, db.Rename([]byte("list"), []byte("str")))
+	assert.Equal(t, DataTypeList, db.Type([]byte("str")))
+	_, err = db.Get([]byte("str"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	list, err := db.LRange([]byte("str"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, list)
+
+	assert.Equal(t, ErrKeyNotFound, db.Rename([]byte("missing"), []byte("k")))
+	assert.NoError(t, db.Rename([]byte("zset"), []byte("zset")))
+
+	ok, err := db.RenameNX([]byte("zset"), []byte("set"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = db.RenameNX([]byte("zset"), []byte("zset2"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{[]byte("m1"), []byte("m2")}, db.ZRange([]byte("zset2"), 0, -1))
+}
+
+func TestLazyDB_Copy(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	fillKeyspace(db)
+
+	ok, err := db.Copy([]byte("set"), []byte("set2"), false)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	members, err := db.SMembers([]byte("set2"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("m1"), []byte("m2")}, members)
+	assert.True(t, db.SIsMember([]byte("set"), []byte("m1")))
+
+	ok, err = db.Copy([]byte("str"), []byte("set2"), false)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = db.Copy([]byte("str"), []byte("set2"), true)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, DataTypeString, db.Type([]byte("set2")))
+	assert.False(t, db.SIsMember([]byte("set2"), []byte("m1")))
+
+	ok, err = db.Copy([]byte("missing"), []byte("k"), false)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, err = db.Copy([]byte("str"), []byte("str"), true)
+	assert.Equal(t, ErrSameKey, err)
+}
+
+func TestLazyDB_Keys(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key, err := db.RandomKey()
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	fillKeyspace(db)
+	_ = db.SAdd([]byte("str"), []byte("m1"))
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*", []string{"hash", "list", "set", "str", "zset"}},
+		{"s*", []string{"set", "str"}},
+		{"?set", []string{"zset"}},
+		{"none*", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			keys, err := db.Keys([]byte(tt.pattern))
+			assert.NoError(t, err)
+			got := make([]string, 0)
+			for _, k := range keys {
+				got = append(got, string(k))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	key, err = db.RandomKey()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, db.Exists(key))
+}
+
+func TestLazyDB_Rename_Concurrent(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.Set([]byte("k1"), []byte("v"))
+	_ = db.HSet([]byte("k1"), []byte("f"), []byte("v"))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = db.Rename([]byte("k1"), []byte("k2"))
+			_ = db.Rename([]byte("k2"), []byte("k1"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			// the key is moved in all types at once, so a copy never catches it half moved
+			if ok, err := db.Copy([]byte("k2"), []byte("copy"), true); ok {
+				assert.NoError(t, err)
+				assert.Equal(t, DataTypeString, db.Type([]byte("copy")))
+				assert.Equal(t, 1, db.HLen([]byte("copy")))
+			}
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 1, db.Exists([]byte("k1")))
+	assert.Equal(t, 0, db.Exists([]byte("k2")))
+	val, err := db.Get([]byte("k1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), val)
+	assert.Equal(t, 1, db.HLen([]byte("k1")))
+}
+
+func TestLazyDB_Del_Concurrent(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.Set([]byte("src"), []byte("v"))
+	_ = db.HSet([]byte("src"), []byte("f"), []byte("v"))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, _ = db.Copy([]byte("src"), []byte("k1"), true)
+			_, _ = db.Del([]byte("k1"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			// the key is removed in all types at once, so a copy never catches it half removed
+			if ok, err := db.Copy([]byte("k1"), []byte("copy"), true); ok {
+				assert.NoError(t, err)
+				assert.Equal(t, DataTypeString, db.Type([]byte("copy")))
+				assert.Equal(t, 1, db.HLen([]byte("copy")))
+			}
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 0, db.Exists([]byte("k1")))
+}
+
+func TestLazyDB_RandomKey(t *testing.T) {
+	db := initTestKeyspaceDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	fillKeyspace(db)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		key, err := db.RandomKey()
+		assert.NoError(t, err)
+		assert.NotEqual(t, "str-expired", string(key))
+		seen[string(key)] = true
+	}
+	assert.Equal(t, map[string]bool{"str": true, "list": true, "hash": true, "set": true, "zset": true}, seen)
+
+	_, _ = db.Del([]byte("str"), []byte("list"), []byte("hash"), []byte("set"), []byte("zset"))
+	key, err := db.RandomKey()
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+}
@@ -1,20 +1,36 @@
 package lazydb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"lazydb/ds"
 	"lazydb/logfile"
+	"lazydb/util"
 	"log"
 )
 
+// LPosOptions are the options of LPos, which are the same as RANK, COUNT and MAXLEN of redis.
+type LPosOptions struct {
+	// Rank is the rank of the first match to return, 1 if zero. A negative rank searches from the tail.
+	Rank int
+	// Count is the number of matches to return, 1 if zero. All matches are returned if it is negative.
+	Count int
+	// MaxLen limits the number of compared elements if it is positive.
+	MaxLen int
+}
+
 func (db *LazyDB) LPush(key []byte, args ...[]byte) (err error) {
 	if len(args) == 0 {
 		return nil
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return err
+	}
 
 	if (db.listIndex.trees[string(key)]) == nil {
+		db.indexCollectionKey(valueTypeList, key)
 		db.listIndex.trees[string(key)] = ds.NewART()
 	}
 	for _, arg := range args {
@@ -22,6 +38,8 @@ func (db *LazyDB) LPush(key []byte, args ...[]byte) (err error) {
 			return err
 		}
 	}
+	db.notifyKeyspaceEvent(notifyList, "lpush", key)
+	db.serveListWaiters(key)
 	return nil
 }
 
@@ -31,6 +49,9 @@ func (db *LazyDB) LPushX(key []byte, args ...[]byte) (err error) {
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return err
+	}
 
 	if (db.listIndex.trees[string(key)]) == nil {
 		return ErrKeyNotFound
@@ -40,13 +61,21 @@ func (db *LazyDB) LPushX(key []byte, args ...[]byte) (err error) {
 			return err
 		}
 	}
+	db.notifyKeyspaceEvent(notifyList, "lpush", key)
+	db.serveListWaiters(key)
 	return nil
 }
 
 func (db *LazyDB) LPop(key []byte) (value []byte, err error) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err = db.expireIfNeeded(valueTypeList, key); err != nil {
+		return nil, err
+	}
 	value, err = db.pop(key, true)
+	if value != nil {
+		db.notifyPop(key, true)
+	}
 	return value, err
 }
 
@@ -56,8 +85,12 @@ func (db *LazyDB) RPush(key []byte, args ...[]byte) (err error) {
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return err
+	}
 
 	if (db.listIndex.trees[string(key)]) == nil {
+		db.indexCollectionKey(valueTypeList, key)
 		db.listIndex.trees[string(key)] = ds.NewART()
 	}
 	for _, arg := range args {
@@ -65,6 +98,8 @@ func (db *LazyDB) RPush(key []byte, args ...[]byte) (err error) {
 			return err
 		}
 	}
+	db.notifyKeyspaceEvent(notifyList, "rpush", key)
+	db.serveListWaiters(key)
 	return nil
 }
 
@@ -74,6 +109,9 @@ func (db *LazyDB) RPushX(key []byte, args ...[]byte) (err error) {
 	}
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return err
+	}
 
 	if (db.listIndex.trees[string(key)]) == nil {
 		return ErrKeyNotFound
@@ -83,19 +121,30 @@ func (db *LazyDB) RPushX(key []byte, args ...[]byte) (err error) {
 			return err
 		}
 	}
+	db.notifyKeyspaceEvent(notifyList, "rpush", key)
+	db.serveListWaiters(key)
 	return nil
 }
 
 func (db *LazyDB) RPop(key []byte) (value []byte, err error) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err = db.expireIfNeeded(valueTypeList, key); err != nil {
+		return nil, err
+	}
 	value, err = db.pop(key, false)
+	if value != nil {
+		db.notifyPop(key, false)
+	}
 	return value, err
 }
 
 func (db *LazyDB) LSet(key []byte, index int, value []byte) (err error) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return err
+	}
 	if (db.listIndex.trees[string(key)]) == nil {
 		return ErrKeyNotFound
 	}
@@ -114,17 +163,21 @@ func (db *LazyDB) LSet(key []byte, index int, value []byte) (err error) {
 	if err != nil {
 		return err
 	}
-	err = db.updateIndexTree(valueTypeList, idxTree, entry, pos, true)
-	return err
+	if err = db.updateIndexTree(valueTypeList, idxTree, entry, pos, true); err != nil {
+		return err
+	}
+	db.notifyChange(valueTypeList, entry)
+	db.notifyKeyspaceEvent(notifyList, "lset", key)
+	return nil
 }
 
 func (db *LazyDB) LIndex(key []byte, index int) (value []byte, err error) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
-	if (db.listIndex.trees[string(key)]) == nil {
+	idxTree := db.getListTree(key)
+	if idxTree == nil {
 		return nil, ErrKeyNotFound
 	}
-	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
 		return nil, err
@@ -144,10 +197,10 @@ func (db *LazyDB) LIndex(key []byte, index int) (value []byte, err error) {
 func (db *LazyDB) LLen(key []byte) (len int) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
-	if (db.listIndex.trees[string(key)]) == nil {
+	idxTree := db.getListTree(key)
+	if idxTree == nil {
 		return 0
 	}
-	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
 		return 0
@@ -159,10 +212,10 @@ func (db *LazyDB) LLen(key []byte) (len int) {
 func (db *LazyDB) LRange(key []byte, start int, stop int) (value [][]byte, err error) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
-	if (db.listIndex.trees[string(key)]) == nil {
+	idxTree := db.getListTree(key)
+	if idxTree == nil {
 		return nil, ErrKeyNotFound
 	}
-	idxTree := db.listIndex.trees[string(key)]
 	headSeq, tailSeq, err := db.lMeta(idxTree, key)
 	if err != nil {
 		return nil, err
@@ -198,6 +251,11 @@ func (db *LazyDB) LRange(key []byte, start int, stop int) (value [][]byte, err e
 func (db *LazyDB) LMove(sourceKey []byte, distKey []byte, sourceIsLeft bool, distIsLeft bool) (val []byte, err error) {
 	db.listIndex.mu.Lock()
 	defer db.listIndex.mu.Unlock()
+	for _, key := range [][]byte{sourceKey, distKey} {
+		if err = db.expireIfNeeded(valueTypeList, key); err != nil {
+			return nil, err
+		}
+	}
 	val, err = db.pop(sourceKey, sourceIsLeft)
 	if err != nil {
 		return nil, err
@@ -205,16 +263,405 @@ func (db *LazyDB) LMove(sourceKey []byte, distKey []byte, sourceIsLeft bool, dis
 	if val == nil {
 		return nil, nil
 	}
+	db.notifyPop(sourceKey, sourceIsLeft)
 	if db.listIndex.trees[string(distKey)] == nil {
+		db.indexCollectionKey(valueTypeList, distKey)
 		db.listIndex.trees[string(distKey)] = ds.NewART()
 	}
 	err = db.push(distKey, val, distIsLeft)
 	if err != nil {
 		return nil, err
 	}
+	if distIsLeft {
+		db.notifyKeyspaceEvent(notifyList, "lpush", distKey)
+	} else {
+		db.notifyKeyspaceEvent(notifyList, "rpush", distKey)
+	}
+	db.serveListWaiters(distKey)
 	return val, err
 }
 
+// LInsert inserts value before or after the first element equal to pivot in the list stored at key,
+// and returns the length of the list, or -1 if pivot is not found. It returns 0 if key does not exist.
+// The elements between value and the nearest end of the list are renumbered.
+func (db *LazyDB) LInsert(key []byte, before bool, pivot, value []byte) (int, error) {
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return 0, err
+	}
+
+	idxTree := db.listIndex.trees[string(key)]
+	if idxTree == nil {
+		return 0, nil
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return 0, err
+	}
+	// the elements are read up to pivot only
+	length := int(tailSeq - headSeq - 1)
+	var values [][]byte
+	at := -1
+	for i := 0; i < length && at < 0; i++ {
+		val, err := db.getValue(idxTree, db.encodeListKey(key, headSeq+1+uint32(i)), valueTypeList)
+		if err != nil {
+			return 0, err
+		}
+		values = append(values, val)
+		if bytes.Equal(val, pivot) {
+			at = i
+		}
+	}
+	if at < 0 {
+		return -1, nil
+	}
+	if !before {
+		at++
+	}
+
+	if at < length/2 {
+		// the elements before value move one step towards the head
+		newValues := make([][]byte, 0, at+1)
+		newValues = append(newValues, values[:at]...)
+		newValues = append(newValues, value)
+		err = db.lRewrite(idxTree, key, headSeq, values[:at], headSeq-1, newValues, headSeq-1, tailSeq)
+	} else {
+		// the elements after value move one step towards the tail
+		from := headSeq + uint32(at)
+		var rest [][]byte
+		if rest, err = db.lValues(idxTree, key, headSeq+uint32(len(values)), tailSeq); err != nil {
+			return 0, err
+		}
+		values = append(values[at:], rest...)
+		newValues := make([][]byte, 0, len(values)+1)
+		newValues = append(newValues, value)
+		newValues = append(newValues, values...)
+		err = db.lRewrite(idxTree, key, from, values, from, newValues, headSeq, tailSeq+1)
+	}
+	if err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyList, "linsert", key)
+	return length + 1, nil
+}
+
+// LRem removes the first count elements equal to value from the list stored at key, and returns the number of
+// removed elements. If count is negative, elements are removed from the tail, and if it is 0, all of them are removed.
+// The elements are read from the end the removal starts from until count of them are found, and the ones between
+// the removed elements and the nearest end of the list are renumbered.
+func (db *LazyDB) LRem(key []byte, count int, value []byte) (int, error) {
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return 0, err
+	}
+
+	idxTree := db.listIndex.trees[string(key)]
+	if idxTree == nil {
+		return 0, nil
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// values holds the elements read, which are the ones from index lo on
+	length := int(tailSeq - headSeq - 1)
+	var values [][]byte
+	lo := length
+	removed := make(map[int]struct{})
+	first, last := length, -1
+	for i := 0; i < length && (count == 0 || len(removed) < count || len(removed) < -count); i++ {
+		j := i
+		if count < 0 {
+			j = length - 1 - i
+		}
+		val, err := db.getValue(idxTree, db.encodeListKey(key, headSeq+1+uint32(j)), valueTypeList)
+		if err != nil {
+			return 0, err
+		}
+		if count < 0 {
+			values = append([][]byte{val}, values...)
+			lo = j
+		} else {
+			values = append(values, val)
+			lo = 0
+		}
+		if bytes.Equal(val, value) {
+			removed[j] = struct{}{}
+			first, last = util.Min(first, j), util.Max(last, j)
+		}
+	}
+	n := len(removed)
+	if n == 0 {
+		return 0, nil
+	}
+
+	// the elements between the removed ones and the nearest end move towards the other end
+	var from, newFrom, newHead, newTail uint32
+	if last+1 <= length-first {
+		if lo > 0 {
+			more, err := db.lValues(idxTree, key, headSeq, headSeq+uint32(lo)+1)
+			if err != nil {
+				return 0, err
+			}
+			values, lo = append(more, values...), 0
+		}
+		values = values[:last+1]
+		from, newFrom = headSeq, headSeq+uint32(n)
+		newHead, newTail = headSeq+uint32(n), tailSeq
+	} else {
+		if hi := lo + len(values); hi < length {
+			more, err := db.lValues(idxTree, key, headSeq+uint32(hi), tailSeq)
+			if err != nil {
+				return 0, err
+			}
+			values = append(values, more...)
+		}
+		values, lo = values[first-lo:], first
+		from, newFrom = headSeq+uint32(first), headSeq+uint32(first)
+		newHead, newTail = headSeq, tailSeq-uint32(n)
+	}
+	newValues := make([][]byte, 0, len(values)-n)
+	for i, val := range values {
+		if _, ok := removed[lo+i]; !ok {
+			newValues = append(newValues, val)
+		}
+	}
+	if n == length {
+		newHead, newTail = initialListSeq, initialListSeq+1
+	}
+	if err := db.lRewrite(idxTree, key, from, values, newFrom, newValues, newHead, newTail); err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyList, "lrem", key)
+	if db.listIndex.trees[string(key)] == nil {
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return n, nil
+}
+
+// LTrim trims the list stored at key to the elements between start and stop, which are both inclusive
+// and count from the tail if negative. The list is removed if no element is in the range.
+func (db *LazyDB) LTrim(key []byte, start, stop int) error {
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+		return err
+	}
+
+	idxTree := db.listIndex.trees[string(key)]
+	if idxTree == nil {
+		return nil
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return err
+	}
+	length := int(tailSeq - headSeq - 1)
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = util.Max(start, 0)
+	stop = util.Min(stop, length-1)
+	if start == 0 && stop == length-1 {
+		return nil
+	}
+
+	// the kept elements stay where they are, so only the trimmed ones are written
+	var entries []*logfile.LogEntry
+	for i := 0; i < length; i++ {
+		if i < start || i > stop {
+			entries = append(entries, &logfile.LogEntry{Key: db.encodeListKey(key, headSeq+1+uint32(i)), Stat: logfile.SDelete})
+		}
+	}
+	newHead, newTail := initialListSeq, initialListSeq+1
+	if start <= stop {
+		newHead, newTail = headSeq+uint32(start), headSeq+uint32(stop)+2
+	}
+	if err := db.lApply(idxTree, key, entries, newHead, newTail); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyList, "ltrim", key)
+	if db.listIndex.trees[string(key)] == nil {
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return nil
+}
+
+// LPos returns the indexes of the elements equal to element in the list stored at key.
+func (db *LazyDB) LPos(key, element []byte, opts LPosOptions) ([]int, error) {
+	db.listIndex.mu.RLock()
+	defer db.listIndex.mu.RUnlock()
+
+	idxTree := db.getListTree(key)
+	if idxTree == nil {
+		return nil, nil
+	}
+	headSeq, tailSeq, err := db.lMeta(idxTree, key)
+	if err != nil {
+		return nil, err
+	}
+	rank, count := opts.Rank, opts.Count
+	if rank == 0 {
+		rank = 1
+	}
+	if count == 0 {
+		count = 1
+	}
+	length := int(tailSeq - headSeq - 1)
+	compared := length
+	if opts.MaxLen > 0 {
+		compared = util.Min(compared, opts.MaxLen)
+	}
+
+	var indexes []int
+	for i := 0; i < compared && (count < 0 || len(indexes) < count); i++ {
+		index := i
+		if rank < 0 {
+			index = length - 1 - i
+		}
+		val, err := db.getValue(idxTree, db.encodeListKey(key, headSeq+1+uint32(index)), valueTypeList)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(val, element) {
+			continue
+		}
+		// skip the matches before the requested rank
+		if rank > 1 {
+			rank--
+			continue
+		}
+		if rank < -1 {
+			rank++
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// LMPop pops up to count elements from the first non-empty list of keys, from the head if isLeft is true.
+// It returns the key of the list and the popped elements, or nil if all lists are empty.
+func (db *LazyDB) LMPop(count int, isLeft bool, keys ...[]byte) ([]byte, [][]byte, error) {
+	db.listIndex.mu.Lock()
+	defer db.listIndex.mu.Unlock()
+
+	for _, key := range keys {
+		if err := db.expireIfNeeded(valueTypeList, key); err != nil {
+			return nil, nil, err
+		}
+		if db.listIndex.trees[string(key)] == nil {
+			continue
+		}
+		var values [][]byte
+		for len(values) < util.Max(count, 1) {
+			val, err := db.pop(key, isLeft)
+			if err != nil {
+				return nil, nil, err
+			}
+			if val == nil {
+				break
+			}
+			values = append(values, val)
+		}
+		if len(values) > 0 {
+			db.notifyPop(key, isLeft)
+			return key, values, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// lValues returns the elements of the list stored at key between seq from and seq to, which are both exclusive.
+func (db *LazyDB) lValues(idxTree *ds.AdaptiveRadixTree, key []byte, from, to uint32) ([][]byte, error) {
+	values := make([][]byte, 0, to-from-1)
+	for seq := from + 1; seq < to; seq++ {
+		val, err := db.getValue(idxTree, db.encodeListKey(key, seq), valueTypeList)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+	}
+	return values, nil
+}
+
+// lRewrite replaces the elements of the list stored at key placed after seq from, which are values,
+// with newValues placed after seq newFrom, and saves headSeq and tailSeq as the new meta of the list.
+// Only the sequences whose element changes are written, and the ones left out of newValues are removed.
+func (db *LazyDB) lRewrite(idxTree *ds.AdaptiveRadixTree, key []byte, from uint32, values [][]byte,
+	newFrom uint32, newValues [][]byte, headSeq, tailSeq uint32) error {
+	to := from + uint32(len(values)) + 1
+	newTo := newFrom + uint32(len(newValues)) + 1
+
+	var entries []*logfile.LogEntry
+	for i, val := range newValues {
+		seq := newFrom + 1 + uint32(i)
+		if seq > from && seq < to && bytes.Equal(values[seq-from-1], val) {
+			continue
+		}
+		entries = append(entries, &logfile.LogEntry{Key: db.encodeListKey(key, seq), Value: val})
+	}
+	for seq := from + 1; seq < to; seq++ {
+		if seq <= newFrom || seq >= newTo {
+			entries = append(entries, &logfile.LogEntry{Key: db.encodeListKey(key, seq), Stat: logfile.SDelete})
+		}
+	}
+	return db.lApply(idxTree, key, entries, headSeq, tailSeq)
+}
+
+// lApply writes entries of the list stored at key followed by its new meta in one batch, and updates the index.
+// The list is removed from the index if it becomes empty, the same as popping its last element.
+func (db *LazyDB) lApply(idxTree *ds.AdaptiveRadixTree, key []byte, entries []*logfile.LogEntry, headSeq, tailSeq uint32) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[:4], headSeq)
+	binary.LittleEndian.PutUint32(buf[4:8], tailSeq)
+	entries = append(entries, &logfile.LogEntry{Key: key, Value: buf, Stat: logfile.SListMeta})
+	valPos, err := db.writeLogEntries(valueTypeList, entries)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if entry.Stat == logfile.SDelete {
+			val, updated := idxTree.Delete(entry.Key)
+			db.sendDiscard(val, updated, valueTypeList)
+			db.sendDiscard(&Value{fid: valPos[i].fid, entrySize: valPos[i].entrySize}, true, valueTypeList)
+			db.notifyChange(valueTypeList, entry)
+			continue
+		}
+		if err := db.updateIndexTree(valueTypeList, idxTree, entry, valPos[i], true); err != nil {
+			return err
+		}
+		if entry.Stat != logfile.SListMeta {
+			db.notifyChange(valueTypeList, entry)
+		}
+	}
+	if tailSeq-headSeq-1 == 0 {
+		db.unindexCollectionKey(valueTypeList, key)
+		delete(db.listIndex.trees, string(key))
+		return db.setKeyExpire(valueTypeList, key, 0)
+	}
+	return nil
+}
+
+// notifyPop publishes the keyspace events of popping from key, and "del" if the list becomes empty.
+func (db *LazyDB) notifyPop(key []byte, isLeft bool) {
+	if isLeft {
+		db.notifyKeyspaceEvent(notifyList, "lpop", key)
+	} else {
+		db.notifyKeyspaceEvent(notifyList, "rpop", key)
+	}
+	if db.listIndex.trees[string(key)] == nil {
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+}
+
 func (db *LazyDB) pop(key []byte, isLeft bool) (value []byte, err error) {
 	if (db.listIndex.trees[string(key)]) == nil {
 		return nil, nil
@@ -243,6 +690,7 @@ func (db *LazyDB) pop(key []byte, isLeft bool) (value []byte, err error) {
 	}
 
 	delVal, updated := idxTree.Delete(encodeKey)
+	db.notifyChange(valueTypeList, entry)
 
 	if isLeft {
 		headSeq++
@@ -271,7 +719,11 @@ func (db *LazyDB) pop(key []byte, isLeft bool) (value []byte, err error) {
 			tailSeq = initialListSeq + 1
 			_ = db.saveLMeta(idxTree, key, headSeq, tailSeq)
 		}
+		db.unindexCollectionKey(valueTypeList, key)
 		delete(db.listIndex.trees, string(key))
+		if err = db.setKeyExpire(valueTypeList, key, 0); err != nil {
+			return nil, err
+		}
 	}
 	return value, nil
 }
@@ -296,6 +748,7 @@ func (db *LazyDB) push(key []byte, arg []byte, isLeft bool) (err error) {
 	if err != nil {
 		return err
 	}
+	db.notifyChange(valueTypeList, entry)
 	if isLeft {
 		headSeq--
 	} else {
@@ -354,3 +807,11 @@ func (db *LazyDB) lSequence(headSeq uint32, tailSeq uint32, index int) (seq uint
 	}
 	return seq, nil
 }
+
+// getListTree returns the index of the list stored at key, or nil if it does not exist or has expired.
+func (db *LazyDB) getListTree(key []byte) *ds.AdaptiveRadixTree {
+	if db.keyExpired(valueTypeList, key) {
+		return nil
+	}
+	return db.listIndex.trees[string(key)]
+}
@@ -2,6 +2,8 @@ package lazydb
 
 import (
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -453,3 +455,261 @@ func TestLazyDB_LMove(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, v, []byte("d"))
 }
+
+func listOf(db *LazyDB, key string) string {
+	values, _ := db.LRange([]byte(key), 0, -1)
+	var elems []string
+	for _, val := range values {
+		elems = append(elems, string(val))
+	}
+	return strings.Join(elems, ",")
+}
+
+func rpushString(db *LazyDB, key string, elems string) {
+	for _, elem := range strings.Split(elems, ",") {
+		_ = db.RPush([]byte(key), []byte(elem))
+	}
+}
+
+func TestLazyDB_LInsert(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	rpushString(db, "l1", "a,b,c,d,e")
+	tests := []struct {
+		name     string
+		before   bool
+		pivot    string
+		expected int
+		list     string
+	}{
+		{"before head", true, "a", 6, "x,a,b,c,d,e"},
+		{"after head", false, "a", 7, "x,a,x,b,c,d,e"},
+		{"before tail", true, "e", 8, "x,a,x,b,c,d,x,e"},
+		{"after tail", false, "e", 9, "x,a,x,b,c,d,x,e,x"},
+		{"first pivot", false, "x", 10, "x,x,a,x,b,c,d,x,e,x"},
+		{"missing pivot", true, "z", -1, "x,x,a,x,b,c,d,x,e,x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := db.LInsert([]byte("l1"), tt.before, []byte(tt.pivot), []byte("x"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, n)
+			assert.Equal(t, tt.list, listOf(db, "l1"))
+		})
+	}
+
+	n, err := db.LInsert([]byte("missing"), true, []byte("a"), []byte("x"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLazyDB_LRem(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	tests := []struct {
+		name     string
+		count    int
+		expected int
+		list     string
+	}{
+		{"from head", 2, 2, "b,c,a,b,a"},
+		{"from tail", -2, 2, "a,b,a,c,b"},
+		{"all", 0, 4, "b,c,b"},
+		{"more than present", 10, 4, "b,c,b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rpushString(db, "l1", "a,b,a,c,a,b,a")
+			n, err := db.LRem([]byte("l1"), tt.count, []byte("a"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, n)
+			assert.Equal(t, tt.list, listOf(db, "l1"))
+			assert.Equal(t, strings.Count(tt.list, ",")+1, db.LLen([]byte("l1")))
+			_ = db.LTrim([]byte("l1"), 1, 0)
+		})
+	}
+
+	rpushString(db, "l2", "a,a")
+	n, err := db.LRem([]byte("l2"), 0, []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, db.LLen([]byte("l2")))
+	assert.Equal(t, DataTypeNone, db.Type([]byte("l2")))
+}
+
+func TestLazyDB_LInsert_LRem_Model(t *testing.T) {
+	db := initTestDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	// small alphabet, so that elements repeat and matches land anywhere in the list
+	rnd := rand.New(rand.NewSource(1))
+	elem := func() string { return string(rune('a' + rnd.Intn(4))) }
+	var model []string
+	for i := 0; i < 20; i++ {
+		model = append(model, elem())
+	}
+	rpushString(db, "l1", strings.Join(model, ","))
+
+	for i := 0; i < 300; i++ {
+		if rnd.Intn(2) == 0 {
+			before, pivot, value := rnd.Intn(2) == 0, elem(), elem()
+			n, err := db.LInsert([]byte("l1"), before, []byte(pivot), []byte(value))
+			assert.NoError(t, err)
+			at := -1
+			for j, v := range model {
+				if v == pivot {
+					at = j
+					break
+				}
+			}
+			if at < 0 {
+				assert.Equal(t, -1, n)
+				continue
+			}
+			if !before {
+				at++
+			}
+			model = append(model[:at], append([]string{value}, model[at:]...)...)
+			assert.Equal(t, len(model), n)
+		} else {
+			count, value := rnd.Intn(5)-2, elem()
+			n, err := db.LRem([]byte("l1"), count, []byte(value))
+			assert.NoError(t, err)
+			var kept []string
+			var removed int
+			for j := range model {
+				k := j
+				if count < 0 {
+					k = len(model) - 1 - j
+				}
+				if model[k] == value && (count == 0 || removed < count || removed < -count) {
+					removed++
+					model[k] = ""
+				}
+			}
+			for _, v := range model {
+				if v != "" {
+					kept = append(kept, v)
+				}
+			}
+			model = kept
+			assert.Equal(t, removed, n)
+		}
+		if len(model) == 0 {
+			model = []string{elem()}
+			rpushString(db, "l1", model[0])
+		}
+		assert.Equal(t, strings.Join(model, ","), listOf(db, "l1"))
+	}
+
+	var err error
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(model, ","), listOf(db, "l1"))
+}
+
+func TestLazyDB_LTrim(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	tests := []struct {
+		name        string
+		start, stop int
+		list        string
+	}{
+		{"middle", 1, 3, "b,c,d"},
+		{"negative", -2, -1, "d,e"},
+		{"out of range stop", 2, 10, "c,d,e"},
+		{"all", 0, -1, "a,b,c,d,e"},
+		{"empty", 3, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rpushString(db, "l1", "a,b,c,d,e")
+			assert.NoError(t, db.LTrim([]byte("l1"), tt.start, tt.stop))
+			assert.Equal(t, tt.list, listOf(db, "l1"))
+			_ = db.LTrim([]byte("l1"), 1, 0)
+			assert.Equal(t, 0, db.LLen([]byte("l1")))
+		})
+	}
+}
+
+func TestLazyDB_LPos(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	rpushString(db, "l1", "a,b,c,a,b,c,a")
+	tests := []struct {
+		name     string
+		opts     LPosOptions
+		expected []int
+	}{
+		{"first", LPosOptions{}, []int{0}},
+		{"rank", LPosOptions{Rank: 2}, []int{3}},
+		{"negative rank", LPosOptions{Rank: -2}, []int{3}},
+		{"count", LPosOptions{Count: 2}, []int{0, 3}},
+		{"all", LPosOptions{Count: -1}, []int{0, 3, 6}},
+		{"all from tail", LPosOptions{Rank: -1, Count: -1}, []int{6, 3, 0}},
+		{"maxlen", LPosOptions{Count: -1, MaxLen: 4}, []int{0, 3}},
+		{"rank out of range", LPosOptions{Rank: 4}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indexes, err := db.LPos([]byte("l1"), []byte("a"), tt.opts)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, indexes)
+		})
+	}
+}
+
+func TestLazyDB_LMPop(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	rpushString(db, "l2", "a,b,c")
+	key, values, err := db.LMPop(2, true, []byte("l1"), []byte("l2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("l2"), key)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, values)
+
+	key, values, err = db.LMPop(5, false, []byte("l1"), []byte("l2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("l2"), key)
+	assert.Equal(t, [][]byte{[]byte("c")}, values)
+
+	key, values, err = db.LMPop(1, true, []byte("l1"), []byte("l2"))
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+	assert.Nil(t, values)
+}
+
+func TestLazyDB_List_Rebuild(t *testing.T) {
+	db := initTestDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	rpushString(db, "l1", "a,b,c,d,e,f")
+	_, _ = db.LInsert([]byte("l1"), true, []byte("b"), []byte("x"))
+	_, _ = db.LInsert([]byte("l1"), false, []byte("e"), []byte("y"))
+	_, _ = db.LRem([]byte("l1"), 1, []byte("c"))
+	assert.NoError(t, db.LTrim([]byte("l1"), 1, -2))
+	assert.Equal(t, "x,b,d,e,y", listOf(db, "l1"))
+
+	var err error
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "x,b,d,e,y", listOf(db, "l1"))
+	assert.NoError(t, db.LPush([]byte("l1"), []byte("h")))
+	assert.NoError(t, db.RPush([]byte("l1"), []byte("t")))
+	assert.Equal(t, "h,x,b,d,e,y,t", listOf(db, "l1"))
+}
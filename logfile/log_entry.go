@@ -13,6 +13,12 @@ const (
 	SDelete Status = iota + 1
 	// SListMeta represents entry is list meta.
 	SListMeta
+	// SKeyMeta represents entry holds the expiration of a collection key, 0 means no expiration.
+	SKeyMeta
+	// SBitmap represents entry is the header of a string stored in pages by the bit commands, it holds the length.
+	SBitmap
+	// SBitmapPage represents entry is a page of a bitmap, an empty page has been cleared.
+	SBitmapPage
 )
 
 // TxStatus of LogEntry
@@ -77,6 +83,21 @@ func EncodeEntry(le *LogEntry) ([]byte, int) {
 	return newBuf, size
 }
 
+// DecodeEntry decodes a LogEntry from the binary form produced by EncodeEntry.
+// It returns ErrInvalidCrc if the buffer is truncated or corrupted.
+func DecodeEntry(buf []byte) (*LogEntry, error) {
+	le, size := decodeHeader(buf)
+	if le == nil || size+int(le.kSize)+int(le.vSize) != len(buf) {
+		return nil, ErrInvalidCrc
+	}
+	le.Key = buf[size : size+int(le.kSize)]
+	le.Value = buf[size+int(le.kSize):]
+	if crc := getEntryCrc(buf[:size], le); crc != le.crc {
+		return nil, ErrInvalidCrc
+	}
+	return le, nil
+}
+
 // decodeHeader decodes header from a bytes array to LogEntry struct, returns LogEntry and offset.
 func decodeHeader(buf []byte) (*LogEntry, int) {
 	if len(buf) <= 4 {
@@ -112,3 +112,25 @@ func Test_getEntryCrc(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeEntry(t *testing.T) {
+	entry := &LogEntry{ExpiredAt: 1676969769, TxID: 42, TxStat: TxCommited, Key: []byte("key"), Value: []byte("value")}
+	buf, _ := EncodeEntry(entry)
+
+	got, err := DecodeEntry(buf)
+	if err != nil {
+		t.Fatalf("DecodeEntry() err = %v", err)
+	}
+	if got.ExpiredAt != entry.ExpiredAt || got.TxID != entry.TxID || got.TxStat != entry.TxStat ||
+		!reflect.DeepEqual(got.Key, entry.Key) || !reflect.DeepEqual(got.Value, entry.Value) {
+		t.Errorf("DecodeEntry() got = %+v, want %+v", got, entry)
+	}
+
+	if _, err := DecodeEntry(buf[:len(buf)-1]); err != ErrInvalidCrc {
+		t.Errorf("DecodeEntry() truncated err = %v, want %v", err, ErrInvalidCrc)
+	}
+	buf[len(buf)-1] ^= 0xFF
+	if _, err := DecodeEntry(buf); err != ErrInvalidCrc {
+		t.Errorf("DecodeEntry() corrupted err = %v, want %v", err, ErrInvalidCrc)
+	}
+}
@@ -54,23 +54,32 @@ const (
 	Hash
 	Set
 	ZSet
+	Stream
+	JSON
+	TimeSeries
 )
 
 var (
 	//  convert string in filename to FType
 	FileTypesMap = map[string]FType{
-		"strs": Strs,
-		"list": List,
-		"hash": Hash,
-		"set":  Set,
-		"zset": ZSet,
+		"strs":   Strs,
+		"list":   List,
+		"hash":   Hash,
+		"set":    Set,
+		"zset":   ZSet,
+		"stream": Stream,
+		"json":   JSON,
+		"ts":     TimeSeries,
 	}
 	FileNamesMap = map[FType]string{
-		Strs: "log.strs.",
-		List: "log.list.",
-		Hash: "log.hash.",
-		Set:  "log.set.",
-		ZSet: "log.zset.",
+		Strs:       "log.strs.",
+		List:       "log.list.",
+		Hash:       "log.hash.",
+		Set:        "log.set.",
+		ZSet:       "log.zset.",
+		Stream:     "log.stream.",
+		JSON:       "log.json.",
+		TimeSeries: "log.ts.",
 	}
 )
 
@@ -0,0 +1,319 @@
+package lazydb
+
+import (
+	"errors"
+	"lazydb/util"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrPubSubClosed          = errors.New("pubsub is closed")
+	ErrInvalidNotifyKeyspace = errors.New("invalid keyspace notification flags")
+)
+
+const defaultPubSubBufferSize = 1024
+
+// classes of keyspace notifications, see DBConfig.NotifyKeyspaceEvents.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyStream               // t
+	notifyModule               // d, json and time series
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyAll      = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyStream | notifyModule | notifyExpired | notifyEvicted
+)
+
+// Message is a message received by a PubSub.
+type Message struct {
+	Channel []byte
+	// Pattern is the matched pattern if the message is received by pattern subscription, otherwise nil.
+	Pattern []byte
+	Payload []byte
+}
+
+// PubSub receives the messages published to its channels and patterns.
+// Like redis, a slow subscriber never blocks publishers, messages are dropped when its buffer is full.
+type PubSub struct {
+	hub      *pubSubHub
+	ch       chan *Message
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	closed   bool
+	dropped  uint64
+}
+
+type pubSubHub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*PubSub]struct{}
+	patterns map[string]map[*PubSub]struct{}
+	count    int32
+}
+
+func newPubSubHub() *pubSubHub {
+	return &pubSubHub{
+		channels: make(map[string]map[*PubSub]struct{}),
+		patterns: make(map[string]map[*PubSub]struct{}),
+	}
+}
+
+// SubscribeChannels returns a PubSub subscribed to the given channels.
+func (db *LazyDB) SubscribeChannels(channels ...[]byte) *PubSub {
+	ps := db.newPubSub()
+	_ = ps.Subscribe(channels...)
+	return ps
+}
+
+// PSubscribe returns a PubSub subscribed to the given glob-style patterns.
+func (db *LazyDB) PSubscribe(patterns ...[]byte) *PubSub {
+	ps := db.newPubSub()
+	_ = ps.PSubscribe(patterns...)
+	return ps
+}
+
+func (db *LazyDB) newPubSub() *PubSub {
+	return &PubSub{
+		hub:      db.pubsub,
+		ch:       make(chan *Message, defaultPubSubBufferSize),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// Publish posts msg to channel and returns the number of subscribers that received it.
+func (db *LazyDB) Publish(channel, msg []byte) int {
+	return db.pubsub.publish(channel, msg)
+}
+
+// Messages returns the channel of messages, it is closed when the PubSub is closed.
+func (ps *PubSub) Messages() <-chan *Message {
+	return ps.ch
+}
+
+// Dropped returns the number of messages dropped because the buffer was full.
+func (ps *PubSub) Dropped() uint64 {
+	return atomic.LoadUint64(&ps.dropped)
+}
+
+// Subscribe adds channels to the subscription.
+func (ps *PubSub) Subscribe(channels ...[]byte) error {
+	return ps.hub.update(ps, channels, false, true)
+}
+
+// PSubscribe adds patterns to the subscription.
+func (ps *PubSub) PSubscribe(patterns ...[]byte) error {
+	return ps.hub.update(ps, patterns, true, true)
+}
+
+// Unsubscribe removes channels from the subscription, all channels are removed if none is given.
+func (ps *PubSub) Unsubscribe(channels ...[]byte) error {
+	return ps.hub.update(ps, channels, false, false)
+}
+
+// PUnsubscribe removes patterns from the subscription, all patterns are removed if none is given.
+func (ps *PubSub) PUnsubscribe(patterns ...[]byte) error {
+	return ps.hub.update(ps, patterns, true, false)
+}
+
+// Channels returns the number of subscribed channels and patterns.
+func (ps *PubSub) Channels() int {
+	ps.hub.mu.RLock()
+	defer ps.hub.mu.RUnlock()
+	return len(ps.channels) + len(ps.patterns)
+}
+
+// Close unsubscribes everything and closes the message channel.
+func (ps *PubSub) Close() {
+	h := ps.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ps.closed {
+		return
+	}
+	h.unsubscribeAll(ps, false)
+	h.unsubscribeAll(ps, true)
+	ps.closed = true
+	close(ps.ch)
+}
+
+func (h *pubSubHub) update(ps *PubSub, names [][]byte, pattern, subscribe bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ps.closed {
+		return ErrPubSubClosed
+	}
+	if !subscribe && len(names) == 0 {
+		h.unsubscribeAll(ps, pattern)
+		return nil
+	}
+
+	subs, own := h.channels, ps.channels
+	if pattern {
+		subs, own = h.patterns, ps.patterns
+	}
+	for _, name := range names {
+		s := string(name)
+		_, ok := own[s]
+		switch {
+		case subscribe && !ok:
+			if subs[s] == nil {
+				subs[s] = make(map[*PubSub]struct{})
+			}
+			subs[s][ps] = struct{}{}
+			own[s] = struct{}{}
+			atomic.AddInt32(&h.count, 1)
+		case !subscribe && ok:
+			h.unsubscribe(ps, s, pattern)
+		}
+	}
+	return nil
+}
+
+func (h *pubSubHub) unsubscribeAll(ps *PubSub, pattern bool) {
+	own := ps.channels
+	if pattern {
+		own = ps.patterns
+	}
+	for s := range own {
+		h.unsubscribe(ps, s, pattern)
+	}
+}
+
+func (h *pubSubHub) unsubscribe(ps *PubSub, name string, pattern bool) {
+	subs, own := h.channels, ps.channels
+	if pattern {
+		subs, own = h.patterns, ps.patterns
+	}
+	delete(own, name)
+	delete(subs[name], ps)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+	atomic.AddInt32(&h.count, -1)
+}
+
+func (h *pubSubHub) active() bool {
+	return h != nil && atomic.LoadInt32(&h.count) > 0
+}
+
+func (h *pubSubHub) publish(channel, payload []byte) int {
+	if !h.active() {
+		return 0
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var receivers int
+	for ps := range h.channels[string(channel)] {
+		ps.send(&Message{Channel: channel, Payload: payload})
+		receivers++
+	}
+	for pattern, subs := range h.patterns {
+		if !util.GlobMatch([]byte(pattern), channel) {
+			continue
+		}
+		for ps := range subs {
+			ps.send(&Message{Channel: channel, Pattern: []byte(pattern), Payload: payload})
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// send is called with the read lock of hub, so the channel is never closed while it is being written.
+func (ps *PubSub) send(msg *Message) {
+	select {
+	case ps.ch <- msg:
+	default:
+		atomic.AddUint64(&ps.dropped, 1)
+	}
+}
+
+func (h *pubSubHub) close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	subs := make(map[*PubSub]struct{})
+	for _, m := range h.channels {
+		for ps := range m {
+			subs[ps] = struct{}{}
+		}
+	}
+	for _, m := range h.patterns {
+		for ps := range m {
+			subs[ps] = struct{}{}
+		}
+	}
+	h.mu.Unlock()
+	for ps := range subs {
+		ps.Close()
+	}
+}
+
+// parseNotifyFlags parses the flags of DBConfig.NotifyKeyspaceEvents.
+func parseNotifyFlags(flags string) (int, error) {
+	var classes int
+	for _, c := range flags {
+		switch c {
+		case 'A':
+			classes |= notifyAll
+		case 'K':
+			classes |= notifyKeyspace
+		case 'E':
+			classes |= notifyKeyevent
+		case 'g':
+			classes |= notifyGeneric
+		case '$':
+			classes |= notifyString
+		case 'l':
+			classes |= notifyList
+		case 's':
+			classes |= notifySet
+		case 'h':
+			classes |= notifyHash
+		case 'z':
+			classes |= notifyZSet
+		case 't':
+			classes |= notifyStream
+		case 'd':
+			classes |= notifyModule
+		case 'x':
+			classes |= notifyExpired
+		case 'e':
+			classes |= notifyEvicted
+		default:
+			return 0, ErrInvalidNotifyKeyspace
+		}
+	}
+	// nothing is published without K or E
+	if classes&(notifyKeyspace|notifyKeyevent) == 0 {
+		return 0, nil
+	}
+	return classes, nil
+}
+
+// notifyKeyspaceEvent publishes event of key to the keyspace and keyevent channels like redis,
+// which are "__keyspace@0__:<key>" with event as payload and "__keyevent@0__:<event>" with key as payload.
+func (db *LazyDB) notifyKeyspaceEvent(class int, event string, key []byte) {
+	if db.notifyFlags&class == 0 || !db.pubsub.active() {
+		return
+	}
+	const dbIndex = 0
+	if db.notifyFlags&notifyKeyspace != 0 {
+		channel := append([]byte("__keyspace@"+strconv.Itoa(dbIndex)+"__:"), key...)
+		db.pubsub.publish(channel, []byte(event))
+	}
+	if db.notifyFlags&notifyKeyevent != 0 {
+		channel := []byte("__keyevent@" + strconv.Itoa(dbIndex) + "__:" + event)
+		db.pubsub.publish(channel, key)
+	}
+}
@@ -0,0 +1,184 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestPubSubDB(notify string) *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_pubsub")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	cfg.NotifyKeyspaceEvents = notify
+	db, _ := Open(cfg)
+	return db
+}
+
+func receiveMessages(ps *PubSub, d time.Duration) []*Message {
+	var msgs []*Message
+	timeout := time.After(d)
+	for {
+		select {
+		case msg, ok := <-ps.Messages():
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		case <-timeout:
+			return msgs
+		}
+	}
+}
+
+func TestLazyDB_Publish(t *testing.T) {
+	db := initTestPubSubDB("")
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	ps := db.SubscribeChannels([]byte("news"), []byte("sport"))
+	defer ps.Close()
+	pps := db.PSubscribe([]byte("new?"), []byte("n*"))
+	defer pps.Close()
+
+	assert.Equal(t, 3, db.Publish([]byte("news"), []byte("hello")))
+	assert.Equal(t, 1, db.Publish([]byte("sport"), []byte("goal")))
+	assert.Equal(t, 0, db.Publish([]byte("weather"), []byte("rain")))
+
+	msgs := receiveMessages(ps, 50*time.Millisecond)
+	assert.Equal(t, []*Message{
+		{Channel: []byte("news"), Payload: []byte("hello")},
+		{Channel: []byte("sport"), Payload: []byte("goal")},
+	}, msgs)
+	msgs = receiveMessages(pps, 50*time.Millisecond)
+	assert.Equal(t, 2, len(msgs))
+	for _, msg := range msgs {
+		assert.Equal(t, []byte("hello"), msg.Payload)
+		assert.NotNil(t, msg.Pattern)
+	}
+
+	assert.NoError(t, ps.Unsubscribe([]byte("news")))
+	assert.Equal(t, 1, ps.Channels())
+	assert.Equal(t, 2, db.Publish([]byte("news"), []byte("hello")))
+	assert.NoError(t, pps.PUnsubscribe())
+	assert.Equal(t, 0, db.Publish([]byte("news"), []byte("hello")))
+
+	ps.Close()
+	_, ok := <-ps.Messages()
+	assert.False(t, ok)
+	assert.Equal(t, ErrPubSubClosed, ps.Subscribe([]byte("news")))
+}
+
+func TestLazyDB_Publish_Dropped(t *testing.T) {
+	db := initTestPubSubDB("")
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	ps := db.SubscribeChannels([]byte("ch"))
+	defer ps.Close()
+	for i := 0; i < defaultPubSubBufferSize+10; i++ {
+		db.Publish([]byte("ch"), GetValue32())
+	}
+	assert.Equal(t, uint64(10), ps.Dropped())
+}
+
+func TestLazyDB_KeyspaceEvents(t *testing.T) {
+	db := initTestPubSubDB("KEA")
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	keyspace := db.PSubscribe([]byte("__keyspace@0__:*"))
+	defer keyspace.Close()
+	keyevent := db.PSubscribe([]byte("__keyevent@0__:*"))
+	defer keyevent.Close()
+
+	_ = db.Set([]byte("k1"), []byte("v1"))
+	_ = db.Expire([]byte("k1"), time.Hour)
+	_ = db.Delete([]byte("k1"))
+	_ = db.Delete([]byte("missing"))
+	_ = db.RPush([]byte("l1"), []byte("a"))
+	_, _ = db.LPop([]byte("l1"))
+	_ = db.HSet([]byte("h1"), []byte("f1"), []byte("v1"))
+	_ = db.SAdd([]byte("s1"), []byte("m1"))
+	_ = db.SRem([]byte("s1"), []byte("missing"))
+	_ = db.ZAdd([]byte("z1"), util.Float64ToByte(1), []byte("m1"))
+	_, _ = db.ZIncrBy([]byte("z1"), 1, []byte("m1"))
+
+	var events []string
+	for _, msg := range receiveMessages(keyspace, 50*time.Millisecond) {
+		events = append(events, string(msg.Channel)+" "+string(msg.Payload))
+	}
+	assert.Equal(t, []string{
+		"__keyspace@0__:k1 set",
+		"__keyspace@0__:k1 expire",
+		"__keyspace@0__:k1 del",
+		"__keyspace@0__:l1 rpush",
+		"__keyspace@0__:l1 lpop",
+		"__keyspace@0__:l1 del",
+		"__keyspace@0__:h1 hset",
+		"__keyspace@0__:s1 sadd",
+		"__keyspace@0__:z1 zadd",
+		"__keyspace@0__:z1 zincr",
+	}, events)
+
+	msgs := receiveMessages(keyevent, 50*time.Millisecond)
+	assert.Equal(t, 10, len(msgs))
+	assert.Equal(t, "__keyevent@0__:set", string(msgs[0].Channel))
+	assert.Equal(t, "k1", string(msgs[0].Payload))
+}
+
+func TestLazyDB_KeyspaceEvents_Flags(t *testing.T) {
+	db := initTestPubSubDB("Kl")
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	ps := db.PSubscribe([]byte("__key*"))
+	defer ps.Close()
+
+	_ = db.Set([]byte("k1"), []byte("v1"))
+	_ = db.LPush([]byte("l1"), []byte("a"))
+	msgs := receiveMessages(ps, 50*time.Millisecond)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, "__keyspace@0__:l1", string(msgs[0].Channel))
+	assert.Equal(t, "lpush", string(msgs[0].Payload))
+
+	_, err := parseNotifyFlags("KX")
+	assert.Equal(t, ErrInvalidNotifyKeyspace, err)
+	flags, err := parseNotifyFlags("A")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, flags)
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"user:*:name", "user:1:name", true},
+		{"user:*:name", "user:1:age", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"_"+tt.str, func(t *testing.T) {
+			assert.Equal(t, tt.want, util.GlobMatch([]byte(tt.pattern), []byte(tt.str)))
+		})
+	}
+}
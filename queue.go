@@ -0,0 +1,362 @@
+package lazydb
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"lazydb/util"
+)
+
+// A Queue is a reliable queue built on lists, sorted sets and hashes, so it is persisted like any other key.
+// Producers push item ids onto the ready list and the payloads are kept in a hash.
+// A dequeued id is moved to the processing list, which only holds it until its visibility deadline is added
+// to a sorted set keyed by id. The id stays in flight there until it is acknowledged, or requeued by Nack
+// or when its deadline passes, so settling an item does not depend on the number of items in flight.
+// Items are delivered at least once: an item whose worker crashed is delivered again.
+//
+// All keys of a queue start with queueKeyPrefix, and the names of the queues are kept in the set queueRegistryKey,
+// so the expiration cycle can requeue the expired items of every queue. These keys are reserved,
+// the commands working on the whole keyspace neither return nor change them.
+
+const (
+	queueKeyPrefix   = "__queue__:"
+	queueRegistryKey = "__queues__"
+
+	queueStatEnqueued    = "enqueued"
+	queueStatAcked       = "acked"
+	queueStatNacked      = "nacked"
+	queueStatRedelivered = "redelivered"
+	queueStatSeq         = "seq"
+)
+
+// Queue is a reliable queue named name, see LazyDB.Queue.
+type Queue struct {
+	db   *LazyDB
+	name []byte
+}
+
+// QueueItem is an item delivered by a Queue.
+type QueueItem struct {
+	ID      []byte
+	Payload []byte
+	// Deadline is the time the item is requeued at unless it is acknowledged before.
+	Deadline time.Time
+}
+
+// QueueStats are the statistics of a Queue.
+type QueueStats struct {
+	Ready       int // number of items waiting to be dequeued
+	InFlight    int // number of dequeued items not acknowledged yet
+	Enqueued    int64
+	Acked       int64
+	Nacked      int64
+	Redelivered int64 // number of items requeued because their deadline passed
+}
+
+// Queue returns the reliable queue named name. The queue is created by the first Enqueue.
+func (db *LazyDB) Queue(name []byte) *Queue {
+	return &Queue{db: db, name: name}
+}
+
+func (q *Queue) key(part string) []byte {
+	return []byte(queueKeyPrefix + string(q.name) + ":" + part)
+}
+
+// Enqueue appends an item holding payload to the queue and returns its id.
+func (q *Queue) Enqueue(payload []byte) ([]byte, error) {
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+
+	if !q.db.SIsMember([]byte(queueRegistryKey), q.name) {
+		if err := q.db.SAdd([]byte(queueRegistryKey), q.name); err != nil {
+			return nil, err
+		}
+	}
+	seq, err := q.incrStat(queueStatSeq)
+	if err != nil {
+		return nil, err
+	}
+	id := []byte(strconv.FormatInt(seq, 10))
+	// the payload is written first, so a dequeued id always has one
+	if err := q.db.HSet(q.key("items"), id, payload); err != nil {
+		return nil, err
+	}
+	if err := q.db.LPush(q.key("ready"), id); err != nil {
+		return nil, err
+	}
+	if _, err := q.incrStat(queueStatEnqueued); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Dequeue moves the oldest ready item to the processing list and returns it, or nil if no item is ready.
+// The item is requeued if it is not acknowledged within visibility.
+func (q *Queue) Dequeue(visibility time.Duration) (*QueueItem, error) {
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+
+	id, err := q.db.LMove(q.key("ready"), q.key("processing"), false, true)
+	if err != nil || id == nil {
+		return nil, err
+	}
+	return q.deliver(id, visibility)
+}
+
+// DequeueContext is the same as Dequeue, but it waits for an item until ctx is done and returns its error.
+func (q *Queue) DequeueContext(ctx context.Context, visibility time.Duration) (*QueueItem, error) {
+	id, err := q.db.BLMoveContext(ctx, q.key("ready"), q.key("processing"), false, true)
+	if err != nil {
+		return nil, err
+	}
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+	return q.deliver(id, visibility)
+}
+
+// deliver sets the deadline of id, which has just been moved to the processing list, then takes it out of the list.
+// An id left in the list without deadline is only requeued when db is opened, so it is not requeued before the deadline is set.
+func (q *Queue) deliver(id []byte, visibility time.Duration) (*QueueItem, error) {
+	deadline := time.Now().Add(visibility)
+	if err := q.db.ZAdd(q.key("deadlines"), util.Float64ToByte(float64(deadline.UnixMilli())), id); err != nil {
+		return nil, err
+	}
+	// the list holds the ids being delivered only, they are pushed to its head and mostly still there
+	if _, err := q.db.LRem(q.key("processing"), 1, id); err != nil {
+		return nil, err
+	}
+	payload, err := q.db.HGet(q.key("items"), id)
+	if err != nil {
+		return nil, err
+	}
+	return &QueueItem{ID: id, Payload: payload, Deadline: deadline}, nil
+}
+
+// Ack removes the in flight item id from the queue, and reports whether it was in flight.
+// An item requeued because its deadline passed is not in flight anymore.
+func (q *Queue) Ack(id []byte) (bool, error) {
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+
+	ok, err := q.settle(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := q.db.HDel(q.key("items"), id); err != nil {
+		return false, err
+	}
+	if _, err := q.incrStat(queueStatAcked); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Nack puts the in flight item id back to the queue, where it is the next one to dequeue,
+// and reports whether it was in flight.
+func (q *Queue) Nack(id []byte) (bool, error) {
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+
+	ok, err := q.requeue(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := q.incrStat(queueStatNacked); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RequeueExpired puts back the in flight items whose deadline has passed, and returns their number.
+// It is run by the expiration cycle for every queue.
+func (q *Queue) RequeueExpired() (int, error) {
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+	return q.requeueExpired()
+}
+
+func (q *Queue) requeueExpired() (int, error) {
+	now := ScoreBound{Value: float64(time.Now().UnixMilli())}
+	ids := q.db.ZRangeByScore(q.key("deadlines"), ScoreBound{Value: math.Inf(-1)}, now, 0, 0)
+	var n int
+	for _, id := range ids {
+		ok, err := q.requeue(id)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		n++
+		if _, err := q.incrStat(queueStatRedelivered); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Stats returns the statistics of the queue.
+func (q *Queue) Stats() (*QueueStats, error) {
+	q.db.queueMu.Lock()
+	defer q.db.queueMu.Unlock()
+
+	stats := &QueueStats{
+		Ready:    q.db.LLen(q.key("ready")),
+		InFlight: q.db.ZCard(q.key("deadlines")) + q.db.LLen(q.key("processing")),
+	}
+	for field, stat := range map[string]*int64{
+		queueStatEnqueued:    &stats.Enqueued,
+		queueStatAcked:       &stats.Acked,
+		queueStatNacked:      &stats.Nacked,
+		queueStatRedelivered: &stats.Redelivered,
+	} {
+		val, err := q.stat(field)
+		if err != nil {
+			return nil, err
+		}
+		*stat = val
+	}
+	return stats, nil
+}
+
+// settle removes the deadline of id, and reports whether it was in flight.
+func (q *Queue) settle(id []byte) (bool, error) {
+	n, err := q.db.ZRem(q.key("deadlines"), id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// requeue moves the in flight item id back to the consuming end of the ready list.
+// The id is pushed before its deadline is removed, so an item is never left without both if db stops in between.
+func (q *Queue) requeue(id []byte) (bool, error) {
+	if _, err := q.db.ZScore(q.key("deadlines"), id); err != nil {
+		return false, nil
+	}
+	if err := q.db.RPush(q.key("ready"), id); err != nil {
+		return false, err
+	}
+	return q.settle(id)
+}
+
+func (q *Queue) stat(field string) (int64, error) {
+	val, err := q.db.HGet(q.key("stats"), []byte(field))
+	if err != nil || val == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+func (q *Queue) incrStat(field string) (int64, error) {
+	val, err := q.stat(field)
+	if err != nil {
+		return 0, err
+	}
+	val++
+	return val, q.db.HSet(q.key("stats"), []byte(field), []byte(strconv.FormatInt(val, 10)))
+}
+
+// queues returns the queues that have been created.
+func (db *LazyDB) queues() ([]*Queue, error) {
+	names, err := db.SMembers([]byte(queueRegistryKey))
+	if err != nil {
+		return nil, err
+	}
+	queues := make([]*Queue, 0, len(names))
+	for _, name := range names {
+		queues = append(queues, db.Queue(name))
+	}
+	return queues, nil
+}
+
+// requeueExpiredItems requeues the expired in flight items of all queues.
+func (db *LazyDB) requeueExpiredItems() {
+	if db.isReadOnly() {
+		return
+	}
+	queues, err := db.queues()
+	if err != nil {
+		log.Printf("list queues err: %v", err)
+		return
+	}
+	for _, q := range queues {
+		if _, err := q.RequeueExpired(); err != nil {
+			log.Printf("requeue expired items of queue %s err: %v", q.name, err)
+		}
+	}
+}
+
+// recoverQueues empties the processing lists, which hold items when db stops while they are delivered.
+// The items without deadline are requeued, the others are already in flight.
+// It also finishes the other operations db stopped in: a requeued item still in flight is settled,
+// and a payload neither ready nor in flight, left by an Enqueue or an Ack, is removed.
+func (db *LazyDB) recoverQueues() error {
+	if db.isReadOnly() {
+		return nil
+	}
+	queues, err := db.queues()
+	if err != nil {
+		return err
+	}
+	db.queueMu.Lock()
+	defer db.queueMu.Unlock()
+	for _, q := range queues {
+		ids, err := q.db.LRange(q.key("processing"), 0, -1)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		for _, id := range ids {
+			if _, err := q.db.LRem(q.key("processing"), 1, id); err != nil {
+				return err
+			}
+			if _, err := q.db.ZScore(q.key("deadlines"), id); err == nil {
+				continue
+			}
+			if err := q.db.RPush(q.key("ready"), id); err != nil {
+				return err
+			}
+		}
+		if err := q.removeOrphans(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphans settles the ready items that are still in flight, and removes the payloads of the items that are neither.
+// The caller must hold queueMu, and the processing list must be empty.
+func (q *Queue) removeOrphans() error {
+	ready, err := q.db.LRange(q.key("ready"), 0, -1)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	live := make(map[string]bool, len(ready))
+	for _, id := range ready {
+		live[string(id)] = true
+	}
+	for _, id := range q.db.ZRange(q.key("deadlines"), 0, -1) {
+		if live[string(id)] {
+			if _, err := q.settle(id); err != nil {
+				return err
+			}
+		}
+		live[string(id)] = true
+	}
+	ids, err := q.db.HKeys(q.key("items"))
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	for _, id := range ids {
+		if live[string(id)] {
+			continue
+		}
+		if _, err := q.db.HDel(q.key("items"), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
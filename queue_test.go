@@ -0,0 +1,263 @@
+package lazydb
+
+import (
+	"context"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestQueueDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_queue")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	cfg.ExpireCycleInterval = -1
+	db, _ := Open(cfg)
+	return db
+}
+
+func TestQueue(t *testing.T) {
+	db := initTestQueueDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	q := db.Queue([]byte("jobs"))
+	item, err := q.Dequeue(time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, item)
+
+	id1, err := q.Enqueue([]byte("job1"))
+	assert.NoError(t, err)
+	id2, err := q.Enqueue([]byte("job2"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	item, err = q.Dequeue(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, id1, item.ID)
+	assert.Equal(t, []byte("job1"), item.Payload)
+
+	stats, err := q.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, &QueueStats{Ready: 1, InFlight: 1, Enqueued: 2}, stats)
+
+	ok, err := q.Nack(id1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = q.Nack(id1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// a nacked item is dequeued again first
+	item, err = q.Dequeue(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, id1, item.ID)
+	ok, err = q.Ack(id1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = q.Ack(id1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	item, err = q.Dequeue(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, id2, item.ID)
+	assert.Equal(t, []byte("job2"), item.Payload)
+
+	stats, err = q.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, &QueueStats{Ready: 0, InFlight: 1, Enqueued: 2, Acked: 1, Nacked: 1}, stats)
+}
+
+func TestQueue_RequeueExpired(t *testing.T) {
+	db := initTestQueueDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	q := db.Queue([]byte("jobs"))
+	id, _ := q.Enqueue([]byte("job"))
+	item, err := q.Dequeue(-time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, id, item.ID)
+	_, _ = q.Enqueue([]byte("other"))
+	other, _ := q.Dequeue(time.Hour)
+
+	n, err := q.RequeueExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// the worker of the expired item is too late to acknowledge it
+	ok, err := q.Ack(id)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	item, err = q.Dequeue(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, id, item.ID)
+	assert.Equal(t, []byte("job"), item.Payload)
+
+	ok, err = q.Ack(other.ID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	stats, err := q.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, &QueueStats{Ready: 0, InFlight: 1, Enqueued: 2, Acked: 1, Redelivered: 1}, stats)
+}
+
+func TestQueue_DequeueContext(t *testing.T) {
+	db := initTestQueueDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	q := db.Queue([]byte("jobs"))
+	done := make(chan *QueueItem)
+	go func() {
+		item, err := q.DequeueContext(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		done <- item
+	}()
+	waitBlocked(t, db, string(q.key("ready")), 1)
+	id, _ := q.Enqueue([]byte("job"))
+	item := <-done
+	assert.Equal(t, id, item.ID)
+	assert.Equal(t, []byte("job"), item.Payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	item, err := q.DequeueContext(ctx, time.Minute)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, item)
+}
+
+func TestQueue_Recover(t *testing.T) {
+	db := initTestQueueDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	q := db.Queue([]byte("jobs"))
+	id1, _ := q.Enqueue([]byte("job1"))
+	id2, _ := q.Enqueue([]byte("job2"))
+	_, _ = q.Enqueue([]byte("job3"))
+	_, _ = q.Dequeue(time.Hour)
+	// stopped between moving the item and setting its deadline
+	_, _ = db.LMove(q.key("ready"), q.key("processing"), false, true)
+
+	var err error
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	q = db.Queue([]byte("jobs"))
+
+	stats, err := q.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, &QueueStats{Ready: 2, InFlight: 1, Enqueued: 3}, stats)
+	item, err := q.Dequeue(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, id2, item.ID)
+	ok, err := q.Ack(id1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestQueue_Recover_Interrupted(t *testing.T) {
+	db := initTestQueueDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	q := db.Queue([]byte("jobs"))
+	_, _ = q.Enqueue([]byte("job1"))
+	_, _ = q.Enqueue([]byte("job2"))
+	_, _ = q.Enqueue([]byte("job3"))
+	acked, _ := q.Dequeue(time.Hour)
+	requeued, _ := q.Dequeue(time.Hour)
+	// stopped after writing the payload of an Enqueue
+	_ = db.HSet(q.key("items"), []byte("99"), []byte("job99"))
+	// stopped after settling an Ack
+	_, _ = db.ZRem(q.key("deadlines"), acked.ID)
+	// stopped after pushing back a requeued item
+	_ = db.RPush(q.key("ready"), requeued.ID)
+
+	var err error
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	q = db.Queue([]byte("jobs"))
+
+	stats, err := q.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Ready)
+	assert.Equal(t, 0, stats.InFlight)
+	ids, err := db.HKeys(q.key("items"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ids))
+
+	item, err := q.Dequeue(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, requeued.ID, item.ID)
+	assert.Equal(t, []byte("job2"), item.Payload)
+}
+
+func TestQueue_ExpireCycle(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_queue"))
+	cfg.ExpireCycleInterval = 10 * time.Millisecond
+	db, err := Open(cfg)
+	assert.NoError(t, err)
+	defer destroyDB(db)
+
+	q := db.Queue([]byte("jobs"))
+	id, _ := q.Enqueue([]byte("job"))
+	_, _ = q.Dequeue(20 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		stats, _ := q.Stats()
+		return stats.Ready == 1 && stats.Redelivered == 1
+	}, time.Second, 10*time.Millisecond)
+	item, _ := q.Dequeue(time.Minute)
+	assert.Equal(t, id, item.ID)
+}
+
+func TestQueue_ReservedKeys(t *testing.T) {
+	db := initTestQueueDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	q := db.Queue([]byte("jobs"))
+	id, _ := q.Enqueue([]byte("job"))
+	_ = db.Set([]byte("user-key"), []byte("v"))
+
+	keys, err := db.Keys([]byte("*"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-key")}, keys)
+	keys, _, err = db.ScanKeys(nil, nil, 100, DataTypeNone)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-key")}, keys)
+	for i := 0; i < 10; i++ {
+		key, err := db.RandomKey()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("user-key"), key)
+	}
+
+	for _, key := range [][]byte{q.key("ready"), q.key("items"), []byte(queueRegistryKey)} {
+		assert.Equal(t, 0, db.Exists(key))
+		n, err := db.Del(key)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.Equal(t, ErrReservedKey, db.Rename(key, []byte("stolen")))
+		assert.Equal(t, ErrReservedKey, db.Rename([]byte("user-key"), key))
+		_, err = db.Copy([]byte("user-key"), key, true)
+		assert.Equal(t, ErrReservedKey, err)
+		assert.Equal(t, ErrKeyNotFound, db.Expire(key, time.Second))
+	}
+
+	item, err := q.Dequeue(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, id, item.ID)
+	assert.Equal(t, []byte("job"), item.Payload)
+}
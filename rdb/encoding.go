@@ -0,0 +1,347 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+const (
+	zipEnd       = 0xFF
+	zipBigPrevLn = 0xFE
+
+	zipStr06B = 0x00
+	zipStr14B = 0x40
+	zipStr32B = 0x80
+	zipInt16B = 0xC0
+	zipInt32B = 0xD0
+	zipInt64B = 0xE0
+	zipInt24B = 0xF0
+	zipInt8B  = 0xFE
+
+	lpEOF = 0xFF
+)
+
+// decodeZiplist returns all entries of a ziplist as strings.
+// +---------+--------+-------+-------+-----+-------+-------+
+// | zlbytes | zltail | zllen | entry | ... | entry | zlend |
+// +---------+--------+-------+-------+-----+-------+-------+
+func decodeZiplist(buf []byte) ([][]byte, error) {
+	if len(buf) < 11 {
+		return nil, ErrInvalidEncoding
+	}
+	pos := 10
+	var values [][]byte
+	for {
+		if pos >= len(buf) {
+			return nil, ErrInvalidEncoding
+		}
+		if buf[pos] == zipEnd {
+			return values, nil
+		}
+		// skip prevlen
+		if buf[pos] == zipBigPrevLn {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(buf) {
+			return nil, ErrInvalidEncoding
+		}
+		value, n, err := decodeZiplistEntry(buf[pos:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		pos += n
+	}
+}
+
+func decodeZiplistEntry(buf []byte) ([]byte, int, error) {
+	header := buf[0]
+	var length, pos int
+	switch header >> 6 {
+	case zipStr06B >> 6:
+		length, pos = int(header&0x3F), 1
+	case zipStr14B >> 6:
+		if len(buf) < 2 {
+			return nil, 0, ErrInvalidEncoding
+		}
+		length, pos = int(header&0x3F)<<8|int(buf[1]), 2
+	case zipStr32B >> 6:
+		if len(buf) < 5 {
+			return nil, 0, ErrInvalidEncoding
+		}
+		length, pos = int(binary.BigEndian.Uint32(buf[1:5])), 5
+	default:
+		return decodeZiplistInt(buf)
+	}
+	if pos+length > len(buf) {
+		return nil, 0, ErrInvalidEncoding
+	}
+	return buf[pos : pos+length], pos + length, nil
+}
+
+func decodeZiplistInt(buf []byte) ([]byte, int, error) {
+	header := buf[0]
+	var v int64
+	var size int
+	switch {
+	case header == zipInt16B:
+		size = 2
+	case header == zipInt32B:
+		size = 4
+	case header == zipInt64B:
+		size = 8
+	case header == zipInt24B:
+		size = 3
+	case header == zipInt8B:
+		size = 1
+	case header >= 0xF1 && header <= 0xFD:
+		// 4 bit immediate integer between 0 and 12
+		return []byte(strconv.Itoa(int(header&0x0F) - 1)), 1, nil
+	default:
+		return nil, 0, ErrInvalidEncoding
+	}
+	if len(buf) < 1+size {
+		return nil, 0, ErrInvalidEncoding
+	}
+	data := buf[1 : 1+size]
+	switch size {
+	case 1:
+		v = int64(int8(data[0]))
+	case 2:
+		v = int64(int16(binary.LittleEndian.Uint16(data)))
+	case 3:
+		v = int64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24) >> 8)
+	case 4:
+		v = int64(int32(binary.LittleEndian.Uint32(data)))
+	case 8:
+		v = int64(binary.LittleEndian.Uint64(data))
+	}
+	return []byte(strconv.FormatInt(v, 10)), 1 + size, nil
+}
+
+// decodeListpack returns all entries of a listpack as strings.
+// +-------------+--------------+-------+-----+-------+--------+
+// | total bytes | num elements | entry | ... | entry | lp-end |
+// +-------------+--------------+-------+-----+-------+--------+
+func decodeListpack(buf []byte) ([][]byte, error) {
+	if len(buf) < 7 {
+		return nil, ErrInvalidEncoding
+	}
+	pos := 6
+	var values [][]byte
+	for {
+		if pos >= len(buf) {
+			return nil, ErrInvalidEncoding
+		}
+		if buf[pos] == lpEOF {
+			return values, nil
+		}
+		value, n, err := decodeListpackEntry(buf[pos:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		pos += n + listpackBacklenSize(n)
+	}
+}
+
+func decodeListpackEntry(buf []byte) ([]byte, int, error) {
+	header := buf[0]
+	var length, pos int
+	var v int64
+	switch {
+	case header&0x80 == 0:
+		// 7 bit unsigned integer
+		return []byte(strconv.Itoa(int(header & 0x7F))), 1, nil
+	case header&0xC0 == 0x80:
+		// 6 bit string length
+		length, pos = int(header&0x3F), 1
+	case header&0xE0 == 0xC0:
+		// 13 bit signed integer
+		if len(buf) < 2 {
+			return nil, 0, ErrInvalidEncoding
+		}
+		u := uint64(header&0x1F)<<8 | uint64(buf[1])
+		v = int64(u)
+		if u >= 1<<12 {
+			v = int64(u) - 1<<13
+		}
+		return []byte(strconv.FormatInt(v, 10)), 2, nil
+	case header&0xF0 == 0xE0:
+		// 12 bit string length
+		if len(buf) < 2 {
+			return nil, 0, ErrInvalidEncoding
+		}
+		length, pos = int(header&0x0F)<<8|int(buf[1]), 2
+	case header == 0xF0:
+		// 32 bit string length
+		if len(buf) < 5 {
+			return nil, 0, ErrInvalidEncoding
+		}
+		length, pos = int(binary.LittleEndian.Uint32(buf[1:5])), 5
+	case header >= 0xF1 && header <= 0xF4:
+		size := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[header]
+		if len(buf) < 1+size {
+			return nil, 0, ErrInvalidEncoding
+		}
+		var u uint64
+		for i := size - 1; i >= 0; i-- {
+			u = u<<8 | uint64(buf[1+i])
+		}
+		// sign extension
+		shift := 64 - uint(size)*8
+		v = int64(u<<shift) >> shift
+		return []byte(strconv.FormatInt(v, 10)), 1 + size, nil
+	default:
+		return nil, 0, ErrInvalidEncoding
+	}
+	if pos+length > len(buf) {
+		return nil, 0, ErrInvalidEncoding
+	}
+	return buf[pos : pos+length], pos + length, nil
+}
+
+// listpackBacklenSize returns how many bytes the backlen of an entry with size n occupies.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// decodeIntset returns all integers of an intset as strings.
+// +----------+--------+----------+-----+----------+
+// | encoding | length | integer  | ... | integer  |
+// +----------+--------+----------+-----+----------+
+func decodeIntset(buf []byte) ([][]byte, error) {
+	if len(buf) < 8 {
+		return nil, ErrInvalidEncoding
+	}
+	size := int(binary.LittleEndian.Uint32(buf[:4]))
+	length := int(binary.LittleEndian.Uint32(buf[4:8]))
+	if size != 2 && size != 4 && size != 8 || len(buf) < 8+size*length {
+		return nil, ErrInvalidEncoding
+	}
+	values := make([][]byte, 0, capHint(uint64(length)))
+	for i := 0; i < length; i++ {
+		data := buf[8+i*size : 8+(i+1)*size]
+		var v int64
+		switch size {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(data))
+		}
+		values = append(values, []byte(strconv.FormatInt(v, 10)))
+	}
+	return values, nil
+}
+
+// decodeZipmap returns field-value pairs of a zipmap, it is used by very old rdb versions.
+// +-------+-----+-------+-----+------+-------+-----+-----+-----+
+// | zmlen | len | field | len | free | value | ... | ... | end |
+// +-------+-----+-------+-----+------+-------+-----+-----+-----+
+func decodeZipmap(buf []byte) ([][]byte, error) {
+	if len(buf) < 2 {
+		return nil, ErrInvalidEncoding
+	}
+	pos := 1
+	readLen := func() (int, bool) {
+		if pos >= len(buf) {
+			return 0, false
+		}
+		b := buf[pos]
+		if b < 254 {
+			pos++
+			return int(b), true
+		}
+		if b == 254 && pos+5 <= len(buf) {
+			l := int(binary.LittleEndian.Uint32(buf[pos+1 : pos+5]))
+			pos += 5
+			return l, true
+		}
+		return 0, false
+	}
+	var values [][]byte
+	for {
+		if pos >= len(buf) {
+			return nil, ErrInvalidEncoding
+		}
+		if buf[pos] == zipEnd {
+			return values, nil
+		}
+		l, ok := readLen()
+		if !ok || pos+l > len(buf) {
+			return nil, ErrInvalidEncoding
+		}
+		field := buf[pos : pos+l]
+		pos += l
+		l, ok = readLen()
+		if !ok || pos+1+l > len(buf) {
+			return nil, ErrInvalidEncoding
+		}
+		free := int(buf[pos])
+		pos++
+		value := buf[pos : pos+l]
+		pos += l + free
+		values = append(values, field, value)
+	}
+}
+
+// lzfDecompress decompresses data compressed by liblzf, rawLen is the length of original data.
+func lzfDecompress(in []byte, rawLen int) ([]byte, error) {
+	if rawLen < 0 {
+		return nil, ErrInvalidEncoding
+	}
+	out := make([]byte, 0, capHint(uint64(rawLen)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, ErrInvalidEncoding
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, ErrInvalidEncoding
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrInvalidEncoding
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, ErrInvalidEncoding
+		}
+		// copy byte by byte since the ranges may overlap
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != rawLen {
+		return nil, ErrInvalidEncoding
+	}
+	return out, nil
+}
@@ -0,0 +1,819 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+var (
+	// ErrInvalidHeader the file does not start with the REDIS magic string.
+	ErrInvalidHeader = errors.New("rdb: invalid header")
+
+	// ErrUnsupportedVersion rdb version is newer than the parser understands.
+	ErrUnsupportedVersion = errors.New("rdb: unsupported version")
+
+	// ErrUnsupportedEncoding value is stored in an encoding that can not be decoded or skipped.
+	ErrUnsupportedEncoding = errors.New("rdb: unsupported encoding")
+
+	// ErrInvalidEncoding value bytes are corrupted.
+	ErrInvalidEncoding = errors.New("rdb: invalid encoding")
+)
+
+// ObjectType represents the logical type of a redis value.
+type ObjectType uint8
+
+const (
+	TypeString ObjectType = iota
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+	// TypeStream and TypeModule are recognized and skipped, their Value is always nil.
+	TypeStream
+	TypeModule
+)
+
+var typeNames = map[ObjectType]string{
+	TypeString: "string",
+	TypeList:   "list",
+	TypeSet:    "set",
+	TypeZSet:   "zset",
+	TypeHash:   "hash",
+	TypeStream: "stream",
+	TypeModule: "module",
+}
+
+func (t ObjectType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// value encodings, refer to rdb.h in redis.
+const (
+	encString          = 0
+	encList            = 1
+	encSet             = 2
+	encZSet            = 3
+	encHash            = 4
+	encZSet2           = 5
+	encModule          = 6
+	encModule2         = 7
+	encHashZipmap      = 9
+	encListZiplist     = 10
+	encSetIntset       = 11
+	encZSetZiplist     = 12
+	encHashZiplist     = 13
+	encListQuicklist   = 14
+	encStreamListpacks = 15
+	encHashListpack    = 16
+	encZSetListpack    = 17
+	encListQuicklist2  = 18
+	encStreamListpack2 = 19
+	encSetListpack     = 20
+	encStreamListpack3 = 21
+	// hashes with field ttl, the pre-release formats of redis 7.4 do not start with the minimum ttl.
+	encHashMetadataPreGA   = 22
+	encHashListpackExPreGA = 23
+	encHashMetadata        = 24
+	encHashListpackEx      = 25
+)
+
+// special opcodes.
+const (
+	opSlotInfo       = 0xF4
+	opFunction2      = 0xF5
+	opFunctionPreGA  = 0xF6
+	opModuleAux      = 0xF7
+	opIdle           = 0xF8
+	opFreq           = 0xF9
+	opAux            = 0xFA
+	opResizeDB       = 0xFB
+	opExpireTimeMs   = 0xFC
+	opExpireTime     = 0xFD
+	opSelectDB       = 0xFE
+	opEOF            = 0xFF
+	maxSupportedVer  = 12
+	quicklistPlain   = 1
+	quicklistPacked  = 2
+	moduleOpcodeEOF  = 0
+	moduleOpcodeSInt = 1
+	moduleOpcodeUInt = 2
+	moduleOpcodeFlt  = 3
+	moduleOpcodeDbl  = 4
+	moduleOpcodeStr  = 5
+)
+
+// maxPrealloc bounds the capacity preallocated from a length read from the file, which may be corrupt,
+// larger values grow as they are read.
+const maxPrealloc = 1024
+
+// length encodings.
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	lenEnc   = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// ZMember is a member of a sorted set.
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+// Object is a key-value pair read from the rdb file.
+type Object struct {
+	DB int
+	// ExpireAt is the absolute expiration time in unix milliseconds, 0 means no expiration.
+	ExpireAt int64
+	Key      []byte
+	Type     ObjectType
+	// Value holds []byte for strings, [][]byte for lists and sets,
+	// [][]byte with field-value pairs for hashes, []ZMember for sorted sets.
+	// It is nil for the skipped types.
+	Value interface{}
+	// FieldExpireAt holds the absolute expiration time in unix milliseconds of every field of a hash with field ttl,
+	// in the order of Value, 0 means no expiration. It is nil for the other objects.
+	FieldExpireAt []int64
+}
+
+// Parser reads objects from a rdb file one by one.
+type Parser struct {
+	r       *bufio.Reader
+	version int
+	db      int
+	read    int64
+	started bool
+	done    bool
+}
+
+// NewParser returns a parser that reads rdb data from r.
+func NewParser(r io.Reader) *Parser {
+	return &Parser{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// Version returns the rdb version, it is only valid after the first call of Next.
+func (p *Parser) Version() int {
+	return p.version
+}
+
+// BytesRead returns the number of bytes consumed so far.
+func (p *Parser) BytesRead() int64 {
+	return p.read
+}
+
+// Next returns the next object in the file.
+// It returns io.EOF when the end of file opcode is reached.
+func (p *Parser) Next() (*Object, error) {
+	if p.done {
+		return nil, io.EOF
+	}
+	if !p.started {
+		if err := p.readHeader(); err != nil {
+			return nil, err
+		}
+		p.started = true
+	}
+
+	var expireAt int64
+	for {
+		op, err := p.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opEOF:
+			p.done = true
+			// the checksum is only present since version 5, a missing one is tolerated.
+			if p.version >= 5 {
+				_, _ = p.readFull(8)
+			}
+			return nil, io.EOF
+		case opSelectDB:
+			db, _, err := p.readLength()
+			if err != nil {
+				return nil, err
+			}
+			p.db = int(db)
+		case opResizeDB:
+			if _, _, err := p.readLength(); err != nil {
+				return nil, err
+			}
+			if _, _, err := p.readLength(); err != nil {
+				return nil, err
+			}
+		case opAux:
+			if _, err := p.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := p.readString(); err != nil {
+				return nil, err
+			}
+		case opExpireTime:
+			buf, err := p.readFull(4)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case opExpireTimeMs:
+			buf, err := p.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+		case opFreq:
+			if _, err := p.readByte(); err != nil {
+				return nil, err
+			}
+		case opIdle:
+			if _, _, err := p.readLength(); err != nil {
+				return nil, err
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, _, err := p.readLength(); err != nil {
+					return nil, err
+				}
+			}
+		case opFunction2:
+			if _, err := p.readString(); err != nil {
+				return nil, err
+			}
+		case opFunctionPreGA:
+			// redis refuses to load the function libraries of its release candidates as well.
+			return nil, fmt.Errorf("%w: pre-release function library", ErrUnsupportedEncoding)
+		case opModuleAux:
+			// module id, when opcode and when
+			for i := 0; i < 3; i++ {
+				if _, _, err := p.readLength(); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.skipModuleOpcodes(); err != nil {
+				return nil, err
+			}
+		default:
+			key, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			obj := &Object{DB: p.db, ExpireAt: expireAt, Key: key}
+			if err := p.readObject(op, obj); err != nil {
+				return nil, fmt.Errorf("%w, key: %q", err, key)
+			}
+			return obj, nil
+		}
+	}
+}
+
+func (p *Parser) readHeader() error {
+	buf, err := p.readFull(9)
+	if err != nil {
+		return err
+	}
+	if string(buf[:5]) != "REDIS" {
+		return ErrInvalidHeader
+	}
+	version, err := strconv.Atoi(string(buf[5:]))
+	if err != nil {
+		return ErrInvalidHeader
+	}
+	if version < 1 || version > maxSupportedVer {
+		return ErrUnsupportedVersion
+	}
+	p.version = version
+	return nil
+}
+
+func (p *Parser) readObject(enc byte, obj *Object) error {
+	var err error
+	switch enc {
+	case encString:
+		obj.Type = TypeString
+		obj.Value, err = p.readString()
+	case encList, encSet:
+		obj.Type = TypeList
+		if enc == encSet {
+			obj.Type = TypeSet
+		}
+		obj.Value, err = p.readStrings(1)
+	case encHash:
+		obj.Type = TypeHash
+		obj.Value, err = p.readStrings(2)
+	case encZSet, encZSet2:
+		obj.Type = TypeZSet
+		obj.Value, err = p.readZSet(enc == encZSet2)
+	case encHashZipmap:
+		obj.Type = TypeHash
+		obj.Value, err = p.readEncoded(decodeZipmap)
+	case encListZiplist:
+		obj.Type = TypeList
+		obj.Value, err = p.readEncoded(decodeZiplist)
+	case encSetIntset:
+		obj.Type = TypeSet
+		obj.Value, err = p.readEncoded(decodeIntset)
+	case encSetListpack:
+		obj.Type = TypeSet
+		obj.Value, err = p.readEncoded(decodeListpack)
+	case encHashZiplist:
+		obj.Type = TypeHash
+		obj.Value, err = p.readEncoded(decodeZiplist)
+	case encHashListpack:
+		obj.Type = TypeHash
+		obj.Value, err = p.readEncoded(decodeListpack)
+	case encHashMetadata, encHashMetadataPreGA:
+		obj.Type = TypeHash
+		obj.Value, obj.FieldExpireAt, err = p.readHashMetadata(enc == encHashMetadataPreGA)
+	case encHashListpackEx, encHashListpackExPreGA:
+		obj.Type = TypeHash
+		obj.Value, obj.FieldExpireAt, err = p.readHashListpackEx(enc == encHashListpackExPreGA)
+	case encZSetZiplist, encZSetListpack:
+		obj.Type = TypeZSet
+		decode := decodeZiplist
+		if enc == encZSetListpack {
+			decode = decodeListpack
+		}
+		var pairs [][]byte
+		if pairs, err = p.readEncoded(decode); err == nil {
+			obj.Value, err = pairsToZMembers(pairs)
+		}
+	case encListQuicklist, encListQuicklist2:
+		obj.Type = TypeList
+		obj.Value, err = p.readQuicklist(enc == encListQuicklist2)
+	case encStreamListpacks, encStreamListpack2, encStreamListpack3:
+		obj.Type = TypeStream
+		err = p.skipStream(enc)
+	case encModule2:
+		obj.Type = TypeModule
+		if _, _, err = p.readLength(); err == nil {
+			err = p.skipModuleOpcodes()
+		}
+	case encModule:
+		// module values without opcodes can only be parsed by the module itself.
+		obj.Type = TypeModule
+		err = ErrUnsupportedEncoding
+	default:
+		err = fmt.Errorf("%w: type %d", ErrUnsupportedEncoding, enc)
+	}
+	return err
+}
+
+// readStrings reads a length prefixed sequence of strings, n is the number of strings per element.
+func (p *Parser) readStrings(n int) ([][]byte, error) {
+	length, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length > math.MaxUint32 {
+		return nil, ErrInvalidEncoding
+	}
+	count := length * uint64(n)
+	values := make([][]byte, 0, capHint(count))
+	for i := uint64(0); i < count; i++ {
+		s, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// readHashMetadata reads a hash with field ttl, where every field is preceded by its ttl.
+// Refer to rdbLoadObject in redis, the ttl is absolute before GA and relative to the minimum ttl of the hash since.
+func (p *Parser) readHashMetadata(preGA bool) ([][]byte, []int64, error) {
+	var minExpire int64
+	if !preGA {
+		buf, err := p.readFull(8)
+		if err != nil {
+			return nil, nil, err
+		}
+		minExpire = int64(binary.LittleEndian.Uint64(buf))
+	}
+	length, _, err := p.readLength()
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > math.MaxUint32 {
+		return nil, nil, ErrInvalidEncoding
+	}
+	values := make([][]byte, 0, capHint(length*2))
+	expires := make([]int64, 0, capHint(length))
+	for i := uint64(0); i < length; i++ {
+		var expireAt int64
+		if preGA {
+			buf, err := p.readFull(8)
+			if err != nil {
+				return nil, nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+		} else {
+			ttl, _, err := p.readLength()
+			if err != nil {
+				return nil, nil, err
+			}
+			if ttl != 0 {
+				expireAt = int64(ttl) + minExpire - 1
+			}
+		}
+		field, err := p.readString()
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := p.readString()
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, field, value)
+		expires = append(expires, expireAt)
+	}
+	return values, expires, nil
+}
+
+// readHashListpackEx reads a hash with field ttl held by a listpack of field, value and ttl triples.
+func (p *Parser) readHashListpackEx(preGA bool) ([][]byte, []int64, error) {
+	if !preGA {
+		// the minimum ttl of the hash, every field carries its own one
+		if _, err := p.readFull(8); err != nil {
+			return nil, nil, err
+		}
+	}
+	triples, err := p.readEncoded(decodeListpack)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(triples)%3 != 0 {
+		return nil, nil, ErrInvalidEncoding
+	}
+	values := make([][]byte, 0, len(triples)/3*2)
+	expires := make([]int64, 0, len(triples)/3)
+	for i := 0; i < len(triples); i += 3 {
+		expireAt, err := strconv.ParseInt(string(triples[i+2]), 10, 64)
+		if err != nil {
+			return nil, nil, ErrInvalidEncoding
+		}
+		values = append(values, triples[i], triples[i+1])
+		expires = append(expires, expireAt)
+	}
+	return values, expires, nil
+}
+
+func (p *Parser) readZSet(binaryScore bool) ([]ZMember, error) {
+	length, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ZMember, 0, capHint(length))
+	for i := uint64(0); i < length; i++ {
+		member, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScore {
+			buf, err := p.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else if score, err = p.readStringDouble(); err != nil {
+			return nil, err
+		}
+		members = append(members, ZMember{Member: member, Score: score})
+	}
+	return members, nil
+}
+
+func (p *Parser) readStringDouble() (float64, error) {
+	l, err := p.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch l {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := p.readFull(int(l))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+func (p *Parser) readEncoded(decode func([]byte) ([][]byte, error)) ([][]byte, error) {
+	buf, err := p.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode(buf)
+}
+
+func (p *Parser) readQuicklist(v2 bool) ([][]byte, error) {
+	length, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var values [][]byte
+	for i := uint64(0); i < length; i++ {
+		container := uint64(quicklistPacked)
+		if v2 {
+			if container, _, err = p.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		buf, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		if container == quicklistPlain {
+			values = append(values, buf)
+			continue
+		}
+		decode := decodeZiplist
+		if v2 {
+			decode = decodeListpack
+		}
+		elements, err := decode(buf)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, elements...)
+	}
+	return values, nil
+}
+
+// skipStream consumes a stream value, refer to rdbLoadObject in redis.
+func (p *Parser) skipStream(enc byte) error {
+	skipLengths := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, _, err := p.readLength(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	listpacks, _, err := p.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < listpacks; i++ {
+		if _, err := p.readString(); err != nil {
+			return err
+		}
+		if _, err := p.readString(); err != nil {
+			return err
+		}
+	}
+	// length, last id
+	if err := skipLengths(3); err != nil {
+		return err
+	}
+	if enc >= encStreamListpack2 {
+		// first id, max deleted id, entries added
+		if err := skipLengths(5); err != nil {
+			return err
+		}
+	}
+	groups, _, err := p.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if _, err := p.readString(); err != nil {
+			return err
+		}
+		if err := skipLengths(2); err != nil {
+			return err
+		}
+		if enc >= encStreamListpack2 {
+			if err := skipLengths(1); err != nil {
+				return err
+			}
+		}
+		pending, _, err := p.readLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pending; j++ {
+			// raw id and delivery time
+			if _, err := p.readFull(16 + 8); err != nil {
+				return err
+			}
+			if err := skipLengths(1); err != nil {
+				return err
+			}
+		}
+		consumers, _, err := p.readLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if _, err := p.readString(); err != nil {
+				return err
+			}
+			seen := 8
+			if enc >= encStreamListpack3 {
+				seen += 8
+			}
+			if _, err := p.readFull(seen); err != nil {
+				return err
+			}
+			pending, _, err := p.readLength()
+			if err != nil {
+				return err
+			}
+			if _, err := p.readFull(int(pending) * 16); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Parser) skipModuleOpcodes() error {
+	for {
+		op, _, err := p.readLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case moduleOpcodeEOF:
+			return nil
+		case moduleOpcodeSInt, moduleOpcodeUInt:
+			_, _, err = p.readLength()
+		case moduleOpcodeFlt:
+			_, err = p.readFull(4)
+		case moduleOpcodeDbl:
+			_, err = p.readFull(8)
+		case moduleOpcodeStr:
+			_, err = p.readString()
+		default:
+			err = ErrUnsupportedEncoding
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLength reads a length-encoded integer.
+// If the length is a special encoding, the encoding type is returned and isEncoded is true.
+func (p *Parser) readLength() (length uint64, isEncoded bool, err error) {
+	b, err := p.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3F), false, nil
+	case len14Bit:
+		next, err := p.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case lenEnc:
+		return uint64(b & 0x3F), true, nil
+	}
+	switch b {
+	case len32Bit:
+		buf, err := p.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf, err := p.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, ErrInvalidEncoding
+}
+
+func (p *Parser) readString() ([]byte, error) {
+	length, isEncoded, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !isEncoded {
+		return p.readFull(int(length))
+	}
+	switch length {
+	case encInt8:
+		b, err := p.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int8(b)), 10)), nil
+	case encInt16:
+		buf, err := p.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10)), nil
+	case encInt32:
+		buf, err := p.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10)), nil
+	case encLZF:
+		compressed, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		raw, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		buf, err := p.readFull(int(compressed))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(buf, int(raw))
+	}
+	return nil, ErrInvalidEncoding
+}
+
+func (p *Parser) readByte() (byte, error) {
+	b, err := p.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	p.read++
+	return b, nil
+}
+
+func (p *Parser) readFull(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrInvalidEncoding
+	}
+	// a large buffer is grown while reading, so a corrupt length fails before it is allocated.
+	if n > maxPrealloc*maxPrealloc {
+		var buf bytes.Buffer
+		read, err := io.CopyN(&buf, p.r, int64(n))
+		p.read += read
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(p.r, buf); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	p.read += int64(n)
+	return buf, nil
+}
+
+// capHint returns the capacity to preallocate for length elements.
+func capHint(length uint64) int {
+	if length > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(length)
+}
+
+func pairsToZMembers(pairs [][]byte) ([]ZMember, error) {
+	if len(pairs)&1 == 1 {
+		return nil, ErrInvalidEncoding
+	}
+	members := make([]ZMember, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(string(pairs[i+1]), 64)
+		if err != nil {
+			return nil, ErrInvalidEncoding
+		}
+		members = append(members, ZMember{Member: pairs[i], Score: score})
+	}
+	return members, nil
+}
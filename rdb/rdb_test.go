@@ -0,0 +1,329 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// builder writes rdb data for tests.
+type builder struct {
+	bytes.Buffer
+}
+
+func newBuilder(version int) *builder {
+	b := &builder{}
+	b.WriteString(fmt.Sprintf("REDIS%04d", version))
+	return b
+}
+
+func (b *builder) length(n uint64) *builder {
+	switch {
+	case n < 1<<6:
+		b.WriteByte(byte(n))
+	case n < 1<<14:
+		b.WriteByte(byte(n>>8) | 0x40)
+		b.WriteByte(byte(n))
+	default:
+		b.WriteByte(len32Bit)
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		b.Write(buf)
+	}
+	return b
+}
+
+func (b *builder) str(s string) *builder {
+	b.length(uint64(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+func (b *builder) raw(p ...byte) *builder {
+	b.Write(p)
+	return b
+}
+
+func (b *builder) eof() []byte {
+	b.WriteByte(opEOF)
+	b.Write(make([]byte, 8))
+	return b.Bytes()
+}
+
+func ziplist(entries ...[]byte) string {
+	var body bytes.Buffer
+	for _, e := range entries {
+		body.WriteByte(0) // prevlen is not checked by the parser
+		body.Write(e)
+	}
+	buf := make([]byte, 10)
+	binary.LittleEndian.PutUint16(buf[8:], uint16(len(entries)))
+	return string(buf) + body.String() + string([]byte{zipEnd})
+}
+
+func zipStr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func listpack(entries ...[]byte) string {
+	var body bytes.Buffer
+	for _, e := range entries {
+		body.Write(e)
+		body.WriteByte(byte(len(e)))
+	}
+	buf := make([]byte, 6)
+	binary.LittleEndian.PutUint16(buf[4:], uint16(len(entries)))
+	return string(buf) + body.String() + string([]byte{lpEOF})
+}
+
+func lpStr(s string) []byte {
+	return append([]byte{0x80 | byte(len(s))}, s...)
+}
+
+func parseAll(t *testing.T, data []byte) []*Object {
+	p := NewParser(bytes.NewReader(data))
+	var objs []*Object
+	for {
+		obj, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		if err != nil {
+			return objs
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+func strs(s ...string) [][]byte {
+	values := make([][]byte, len(s))
+	for i, v := range s {
+		values[i] = []byte(v)
+	}
+	return values
+}
+
+func TestParser_Header(t *testing.T) {
+	_, err := NewParser(bytes.NewReader([]byte("RESIS0009"))).Next()
+	assert.Equal(t, ErrInvalidHeader, err)
+
+	_, err = NewParser(bytes.NewReader([]byte("REDIS0099"))).Next()
+	assert.Equal(t, ErrUnsupportedVersion, err)
+
+	data := newBuilder(9).raw(opAux).str("redis-ver").str("7.0.0").eof()
+	objs := parseAll(t, data)
+	assert.Equal(t, 0, len(objs))
+}
+
+func TestParser_String(t *testing.T) {
+	expireMs := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expireMs, 1700000000123)
+	expireSec := make([]byte, 4)
+	binary.LittleEndian.PutUint32(expireSec, 1700000000)
+
+	b := newBuilder(9)
+	b.raw(opSelectDB).length(2).raw(opResizeDB).length(5).length(1)
+	b.raw(encString).str("plain").str("value")
+	b.raw(opExpireTimeMs).raw(expireMs...).raw(encString).str("expire-ms").str("v")
+	b.raw(opExpireTime).raw(expireSec...).raw(encString).str("expire-sec").str("v")
+	b.raw(encString).str("int8").raw(0xC0, 0xFB)
+	b.raw(encString).str("int16").raw(0xC1, 0x39, 0x30)
+	b.raw(encString).str("int32").raw(0xC2, 0x87, 0xD6, 0x12, 0x00)
+	b.raw(encString).str("lzf").raw(0xC3).length(5).length(10).raw(0x00, 'a', 0xE0, 0x00, 0x00)
+	b.raw(opFreq, 3).raw(encString).str("lzf2").raw(0xC3).length(6).length(6).raw(0x02, 'a', 'b', 'c', 0x20, 0x02)
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 8, len(objs))
+	want := map[string]string{
+		"plain": "value", "expire-ms": "v", "expire-sec": "v", "int8": "-5",
+		"int16": "12345", "int32": "1234567", "lzf": "aaaaaaaaaa", "lzf2": "abcabc",
+	}
+	for _, obj := range objs {
+		assert.Equal(t, TypeString, obj.Type)
+		assert.Equal(t, 2, obj.DB)
+		assert.Equal(t, want[string(obj.Key)], string(obj.Value.([]byte)), string(obj.Key))
+	}
+	assert.Equal(t, int64(0), objs[0].ExpireAt)
+	assert.Equal(t, int64(1700000000123), objs[1].ExpireAt)
+	assert.Equal(t, int64(1700000000000), objs[2].ExpireAt)
+	assert.Equal(t, int64(0), objs[3].ExpireAt)
+}
+
+func TestParser_List(t *testing.T) {
+	b := newBuilder(11)
+	b.raw(encList).str("l1").length(2).str("a").str("b")
+	b.raw(encListZiplist).str("l2").str(ziplist(zipStr("a"), []byte{0xF2}, []byte{0xFE, 0x9C}, []byte{0xC0, 0x39, 0x30}))
+	b.raw(encListQuicklist).str("l3").length(2).str(ziplist(zipStr("a"))).str(ziplist(zipStr("b"), []byte{0xF0, 0x00, 0x00, 0x80}))
+	b.raw(encListQuicklist2).str("l4").length(2).
+		length(quicklistPacked).str(listpack(lpStr("a"), []byte{0x05}, []byte{0xDF, 0xFF})).
+		length(quicklistPlain).str("big")
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 4, len(objs))
+	assert.Equal(t, strs("a", "b"), objs[0].Value)
+	assert.Equal(t, strs("a", "1", "-100", "12345"), objs[1].Value)
+	assert.Equal(t, strs("a", "b", "-8388608"), objs[2].Value)
+	assert.Equal(t, strs("a", "5", "-1", "big"), objs[3].Value)
+	for _, obj := range objs {
+		assert.Equal(t, TypeList, obj.Type)
+	}
+}
+
+func TestParser_Set(t *testing.T) {
+	intset := make([]byte, 8+2*3)
+	binary.LittleEndian.PutUint32(intset[:4], 2)
+	binary.LittleEndian.PutUint32(intset[4:8], 3)
+	for i, v := range []int16{-3, 7, 300} {
+		binary.LittleEndian.PutUint16(intset[8+2*i:], uint16(v))
+	}
+
+	b := newBuilder(11)
+	b.raw(encSet).str("s1").length(2).str("a").str("b")
+	b.raw(encSetIntset).str("s2").str(string(intset))
+	b.raw(encSetListpack).str("s3").str(listpack(lpStr("x"), []byte{0xF1, 0x00, 0x80}))
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 3, len(objs))
+	assert.Equal(t, strs("a", "b"), objs[0].Value)
+	assert.Equal(t, strs("-3", "7", "300"), objs[1].Value)
+	assert.Equal(t, strs("x", "-32768"), objs[2].Value)
+	for _, obj := range objs {
+		assert.Equal(t, TypeSet, obj.Type)
+	}
+}
+
+func TestParser_Hash(t *testing.T) {
+	zipmap := []byte{2, 2, 'f', '1', 2, 1, 'v', '1', 'x', 2, 'f', '2', 0, 0, zipEnd}
+
+	b := newBuilder(11)
+	b.raw(encHash).str("h1").length(1).str("f").str("v")
+	b.raw(encHashZipmap).str("h2").str(string(zipmap))
+	b.raw(encHashZiplist).str("h3").str(ziplist(zipStr("f"), zipStr("v")))
+	b.raw(encHashListpack).str("h4").str(listpack(lpStr("f"), []byte{0x01}))
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 4, len(objs))
+	assert.Equal(t, strs("f", "v"), objs[0].Value)
+	assert.Equal(t, strs("f1", "v1", "f2", ""), objs[1].Value)
+	assert.Equal(t, strs("f", "v"), objs[2].Value)
+	assert.Equal(t, strs("f", "1"), objs[3].Value)
+	for _, obj := range objs {
+		assert.Equal(t, TypeHash, obj.Type)
+	}
+}
+
+func TestParser_HashFieldTTL(t *testing.T) {
+	ms := func(v int64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(v))
+		return buf
+	}
+	lpInt := func(v int64) []byte {
+		return append([]byte{0xF4}, ms(v)...)
+	}
+	const at = int64(1700000000000)
+
+	b := newBuilder(12)
+	b.raw(encHashMetadataPreGA).str("h1").length(2).raw(ms(at)...).str("f1").str("v1").raw(ms(0)...).str("f2").str("v2")
+	b.raw(encHashListpackExPreGA).str("h2").str(listpack(lpStr("f1"), lpStr("v1"), lpInt(at), lpStr("f2"), lpStr("v2"), []byte{0}))
+	// the ttl of a field is relative to the minimum ttl of the hash since GA
+	b.raw(encHashMetadata).str("h3").raw(ms(at)...).length(2).length(1).str("f1").str("v1").length(0).str("f2").str("v2")
+	b.raw(encHashListpackEx).str("h4").raw(ms(at)...).str(listpack(lpStr("f1"), lpStr("v1"), lpInt(at), lpStr("f2"), lpStr("v2"), []byte{0}))
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 4, len(objs))
+	for _, obj := range objs {
+		assert.Equal(t, TypeHash, obj.Type)
+		assert.Equal(t, strs("f1", "v1", "f2", "v2"), obj.Value)
+		assert.Equal(t, []int64{at, 0}, obj.FieldExpireAt)
+	}
+
+	_, err := NewParser(bytes.NewReader(newBuilder(12).raw(encHashListpackExPreGA).str("h").str(listpack(lpStr("f"))).eof())).Next()
+	assert.ErrorIs(t, err, ErrInvalidEncoding)
+}
+
+func TestParser_ZSet(t *testing.T) {
+	score := make([]byte, 8)
+	binary.LittleEndian.PutUint64(score, math.Float64bits(2.5))
+
+	b := newBuilder(11)
+	b.raw(encZSet).str("z1").length(3).str("a").str("1.5").str("b").raw(254).str("c").raw(255)
+	b.raw(encZSet2).str("z2").length(1).str("a").raw(score...)
+	b.raw(encZSetZiplist).str("z3").str(ziplist(zipStr("a"), []byte{0xF4}))
+	b.raw(encZSetListpack).str("z4").str(listpack(lpStr("a"), lpStr("0.5")))
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 4, len(objs))
+	assert.Equal(t, []ZMember{
+		{Member: []byte("a"), Score: 1.5},
+		{Member: []byte("b"), Score: math.Inf(1)},
+		{Member: []byte("c"), Score: math.Inf(-1)},
+	}, objs[0].Value)
+	assert.Equal(t, []ZMember{{Member: []byte("a"), Score: 2.5}}, objs[1].Value)
+	assert.Equal(t, []ZMember{{Member: []byte("a"), Score: 3}}, objs[2].Value)
+	assert.Equal(t, []ZMember{{Member: []byte("a"), Score: 0.5}}, objs[3].Value)
+	for _, obj := range objs {
+		assert.Equal(t, TypeZSet, obj.Type)
+	}
+}
+
+func TestParser_SkipUnsupported(t *testing.T) {
+	b := newBuilder(11)
+	// a stream with one listpack, no consumer groups
+	b.raw(encStreamListpack2).str("stream").length(1).str("node").str(listpack(lpStr("x"))).
+		length(1).length(1).length(0).
+		length(1).length(0).length(0).length(0).length(1).
+		length(1).str("group").length(1).length(0).length(1).
+		length(1).raw(make([]byte, 16+8)...).length(1).
+		length(1).str("consumer").raw(make([]byte, 8)...).length(1).raw(make([]byte, 16)...)
+	// a module value with opcodes
+	b.raw(encModule2).str("module").length(42).length(moduleOpcodeUInt).length(7).length(moduleOpcodeStr).str("s").length(moduleOpcodeEOF)
+	b.raw(encString).str("after").str("v")
+
+	objs := parseAll(t, b.eof())
+	assert.Equal(t, 3, len(objs))
+	assert.Equal(t, TypeStream, objs[0].Type)
+	assert.Nil(t, objs[0].Value)
+	assert.Equal(t, TypeModule, objs[1].Type)
+	assert.Nil(t, objs[1].Value)
+	assert.Equal(t, "after", string(objs[2].Key))
+	assert.Equal(t, []byte("v"), objs[2].Value)
+
+	_, err := NewParser(bytes.NewReader(newBuilder(9).raw(encModule).str("m").length(1).eof())).Next()
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+
+	// function libraries are skipped, except those of the release candidates that redis does not load either
+	objs = parseAll(t, newBuilder(10).raw(opFunction2).str("#!lua name=lib").raw(encString).str("k").str("v").eof())
+	assert.Equal(t, 1, len(objs))
+	_, err = NewParser(bytes.NewReader(newBuilder(10).raw(opFunctionPreGA).str("lib").eof())).Next()
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func TestLzfDecompress(t *testing.T) {
+	_, err := lzfDecompress([]byte{0x20, 0x05}, 3)
+	assert.Equal(t, ErrInvalidEncoding, err)
+
+	out, err := lzfDecompress([]byte{0x01, 'a', 'b', 0x40, 0x01}, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "ababab", string(out))
+}
+
+func TestParser_CorruptLength(t *testing.T) {
+	// lengths are not trusted before the data is read
+	for _, data := range [][]byte{
+		newBuilder(9).raw(encList).str("l").length(math.MaxUint32).str("a").eof(),
+		newBuilder(9).raw(encZSet2).str("z").length(math.MaxUint32).str("a").eof(),
+		newBuilder(9).raw(encString).str("s").length(math.MaxUint32).raw('a').eof(),
+		newBuilder(9).raw(encString).str("lzf").raw(0xC3).length(2).length(math.MaxUint32).raw(0x00, 'a').eof(),
+	} {
+		_, err := NewParser(bytes.NewReader(data)).Next()
+		assert.Error(t, err)
+	}
+}
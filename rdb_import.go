@@ -0,0 +1,209 @@
+package lazydb
+
+import (
+	"io"
+	"lazydb/rdb"
+	"lazydb/util"
+	"time"
+)
+
+const defaultImportProgressInterval = 10000
+
+// RDBImportOptions controls how a redis rdb file is loaded.
+type RDBImportOptions struct {
+	// DB selects the redis database to import, a negative number imports all databases into LazyDB.
+	DB int
+	// Progress is called every ProgressInterval keys and once more when the import is finished.
+	Progress func(p RDBImportProgress)
+	// ProgressInterval is the number of keys between two Progress calls, default 10000.
+	ProgressInterval int
+}
+
+// RDBImportProgress describes how far an import has gone.
+type RDBImportProgress struct {
+	BytesRead int64
+	Keys      int
+}
+
+// RDBSkippedKey is a key that was not imported and the reason why.
+type RDBSkippedKey struct {
+	DB     int
+	Key    []byte
+	Type   string
+	Reason string
+}
+
+// RDBImportReport summarizes an import.
+type RDBImportReport struct {
+	Version   int
+	BytesRead int64
+	// Loaded is the number of imported keys per type name.
+	Loaded map[string]int
+	// Expired is the number of keys that had already expired, they are not imported.
+	Expired int
+	Skipped []RDBSkippedKey
+}
+
+// ImportRDB loads a redis rdb dump into db.
+// Strings are written with Set or SetEX, lists with RPush, sets with SAdd, hashes with HSet and sorted sets with ZAdd.
+// An imported key replaces the key of the same type, so importing a dump twice gives the same data,
+// while the other types holding the key are kept. Clients blocked on an imported list are served.
+// Expiration is kept for every type, and for the fields of hashes.
+// Streams and module values are skipped and listed in the report.
+func (db *LazyDB) ImportRDB(r io.Reader, opts RDBImportOptions) (*RDBImportReport, error) {
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = defaultImportProgressInterval
+	}
+	parser := rdb.NewParser(r)
+	report := &RDBImportReport{Loaded: make(map[string]int)}
+
+	var keys int
+	progress := func() {
+		if opts.Progress != nil {
+			opts.Progress(RDBImportProgress{BytesRead: parser.BytesRead(), Keys: keys})
+		}
+	}
+	for {
+		obj, err := parser.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Version, report.BytesRead = parser.Version(), parser.BytesRead()
+			return report, err
+		}
+		keys++
+		if keys%opts.ProgressInterval == 0 {
+			progress()
+		}
+		if opts.DB >= 0 && obj.DB != opts.DB {
+			continue
+		}
+		if obj.Value == nil {
+			report.Skipped = append(report.Skipped, RDBSkippedKey{
+				DB: obj.DB, Key: obj.Key, Type: obj.Type.String(), Reason: "unsupported type",
+			})
+			continue
+		}
+
+		var ttl time.Duration
+		if obj.ExpireAt != 0 {
+			ttl = time.Until(time.UnixMilli(obj.ExpireAt))
+			// expiration is stored in seconds, keys expiring within a second are treated as expired.
+			if ttl < time.Second {
+				report.Expired++
+				continue
+			}
+		}
+		if obj.FieldExpireAt != nil && !dropExpiredRDBFields(obj) {
+			report.Expired++
+			continue
+		}
+		if err := db.importRDBObject(obj, ttl); err != nil {
+			report.Version, report.BytesRead = parser.Version(), parser.BytesRead()
+			return report, err
+		}
+		report.Loaded[obj.Type.String()]++
+	}
+	report.Version, report.BytesRead = parser.Version(), parser.BytesRead()
+	progress()
+	return report, nil
+}
+
+func (db *LazyDB) importRDBObject(obj *rdb.Object, ttl time.Duration) error {
+	if typ, ok := rdbValueTypes[obj.Type]; ok {
+		if err := db.clearRDBKey(typ, obj.Key); err != nil {
+			return err
+		}
+	}
+	switch obj.Type {
+	case rdb.TypeString:
+		if ttl > 0 {
+			return db.SetEX(obj.Key, obj.Value.([]byte), ttl)
+		}
+		return db.Set(obj.Key, obj.Value.([]byte))
+	case rdb.TypeList:
+		if err := db.RPush(obj.Key, obj.Value.([][]byte)...); err != nil {
+			return err
+		}
+		return db.importRDBExpire(valueTypeList, obj.Key, ttl)
+	case rdb.TypeSet:
+		if err := db.SAdd(obj.Key, obj.Value.([][]byte)...); err != nil {
+			return err
+		}
+		return db.importRDBExpire(valueTypeSet, obj.Key, ttl)
+	case rdb.TypeHash:
+		pairs := obj.Value.([][]byte)
+		var fields [][]byte
+		for i := 0; i < len(pairs); i += 2 {
+			if obj.FieldExpireAt == nil || obj.FieldExpireAt[i/2] == 0 {
+				fields = append(fields, pairs[i], pairs[i+1])
+				continue
+			}
+			if err := db.HSetEX(obj.Key, pairs[i], pairs[i+1], time.Until(time.UnixMilli(obj.FieldExpireAt[i/2]))); err != nil {
+				return err
+			}
+		}
+		if len(fields) > 0 {
+			if err := db.HSet(obj.Key, fields...); err != nil {
+				return err
+			}
+		}
+		return db.importRDBExpire(valueTypeHash, obj.Key, ttl)
+	case rdb.TypeZSet:
+		members := obj.Value.([]rdb.ZMember)
+		args := make([][]byte, 0, len(members)*2)
+		for _, m := range members {
+			args = append(args, util.Float64ToByte(m.Score), m.Member)
+		}
+		if err := db.ZAdd(obj.Key, args...); err != nil {
+			return err
+		}
+		return db.importRDBExpire(valueTypeZSet, obj.Key, ttl)
+	}
+	return nil
+}
+
+// rdbValueTypes maps the rdb collection types to the value types holding them, strings are replaced by Set itself.
+var rdbValueTypes = map[rdb.ObjectType]valueType{
+	rdb.TypeList: valueTypeList,
+	rdb.TypeSet:  valueTypeSet,
+	rdb.TypeHash: valueTypeHash,
+	rdb.TypeZSet: valueTypeZSet,
+}
+
+// clearRDBKey removes the key of typ before it is imported, so that the imported value is not merged into it.
+func (db *LazyDB) clearRDBKey(typ valueType, key []byte) error {
+	mu := db.indexMutex(typ)
+	mu.Lock()
+	defer mu.Unlock()
+	_, err := db.removeKey(typ, key)
+	return err
+}
+
+// importRDBExpire keeps the expiration of an imported collection key,
+// only the key of typ is expired even if other types hold the same key.
+func (db *LazyDB) importRDBExpire(typ valueType, key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := db.expireKey(typ, key, time.Now().Add(ttl).Unix())
+	return err
+}
+
+// dropExpiredRDBFields removes the fields of a hash that expire within a second, like expired keys,
+// and reports whether any field is left.
+func dropExpiredRDBFields(obj *rdb.Object) bool {
+	pairs := obj.Value.([][]byte)
+	var kept [][]byte
+	var expires []int64
+	for i, expireAt := range obj.FieldExpireAt {
+		if expireAt != 0 && time.Until(time.UnixMilli(expireAt)) < time.Second {
+			continue
+		}
+		kept = append(kept, pairs[2*i], pairs[2*i+1])
+		expires = append(expires, expireAt)
+	}
+	obj.Value, obj.FieldExpireAt = kept, expires
+	return len(kept) > 0
+}
@@ -0,0 +1,268 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"lazydb/util"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestImportDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_import")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func rdbString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func TestLazyDB_ImportRDB(t *testing.T) {
+	db := initTestImportDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	var buf bytes.Buffer
+	buf.WriteString("REDIS0011")
+	buf.Write([]byte{0xFE, 0})
+	// string
+	buf.WriteByte(0)
+	buf.Write(rdbString("str"))
+	buf.Write(rdbString("value"))
+	// string with ttl
+	expireAt := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expireAt, uint64(time.Now().Add(time.Hour).UnixMilli()))
+	buf.WriteByte(0xFC)
+	buf.Write(expireAt)
+	buf.WriteByte(0)
+	buf.Write(rdbString("str-ttl"))
+	buf.Write(rdbString("value"))
+	// expired string
+	binary.LittleEndian.PutUint64(expireAt, uint64(time.Now().Add(-time.Hour).UnixMilli()))
+	buf.WriteByte(0xFC)
+	buf.Write(expireAt)
+	buf.WriteByte(0)
+	buf.Write(rdbString("str-expired"))
+	buf.Write(rdbString("value"))
+	// list
+	buf.Write([]byte{1})
+	buf.Write(rdbString("list"))
+	buf.WriteByte(2)
+	buf.Write(rdbString("a"))
+	buf.Write(rdbString("b"))
+	// set
+	buf.Write([]byte{2})
+	buf.Write(rdbString("set"))
+	buf.WriteByte(2)
+	buf.Write(rdbString("m1"))
+	buf.Write(rdbString("m2"))
+	// hash
+	buf.Write([]byte{4})
+	buf.Write(rdbString("hash"))
+	buf.WriteByte(1)
+	buf.Write(rdbString("f"))
+	buf.Write(rdbString("v"))
+	// hash with ttl
+	binary.LittleEndian.PutUint64(expireAt, uint64(time.Now().Add(time.Hour).UnixMilli()))
+	buf.WriteByte(0xFC)
+	buf.Write(expireAt)
+	buf.Write([]byte{4})
+	buf.Write(rdbString("hash-ttl"))
+	buf.WriteByte(1)
+	buf.Write(rdbString("f"))
+	buf.Write(rdbString("v"))
+	// zset
+	buf.Write([]byte{5})
+	buf.Write(rdbString("zset"))
+	buf.WriteByte(2)
+	score := make([]byte, 8)
+	buf.Write(rdbString("m1"))
+	binary.LittleEndian.PutUint64(score, math.Float64bits(1.5))
+	buf.Write(score)
+	buf.Write(rdbString("m2"))
+	binary.LittleEndian.PutUint64(score, math.Float64bits(0.5))
+	buf.Write(score)
+	// module value is skipped
+	buf.Write([]byte{7})
+	buf.Write(rdbString("module"))
+	buf.Write([]byte{1, 0})
+	// key in another database
+	buf.Write([]byte{0xFE, 1, 0})
+	buf.Write(rdbString("db1"))
+	buf.Write(rdbString("value"))
+	buf.WriteByte(0xFF)
+	buf.Write(make([]byte, 8))
+
+	var progressCalls int
+	report, err := db.ImportRDB(bytes.NewReader(buf.Bytes()), RDBImportOptions{
+		DB:       0,
+		Progress: func(p RDBImportProgress) { progressCalls++ },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 11, report.Version)
+	assert.Equal(t, int64(buf.Len()), report.BytesRead)
+	assert.Equal(t, map[string]int{"string": 2, "list": 1, "set": 1, "hash": 2, "zset": 1}, report.Loaded)
+	assert.Equal(t, 1, report.Expired)
+	assert.Equal(t, 1, len(report.Skipped))
+	assert.Equal(t, "module", string(report.Skipped[0].Key))
+	assert.Equal(t, 1, progressCalls)
+
+	val, err := db.Get([]byte("str"))
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(val))
+	ttl, err := db.TTL([]byte("str-ttl"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 3500)
+	_, err = db.Get([]byte("str-expired"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("db1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	list, err := db.LRange([]byte("list"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, list)
+	assert.True(t, db.SIsMember([]byte("set"), []byte("m2")))
+	field, err := db.HGet([]byte("hash"), []byte("f"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v", string(field))
+	ttl, err = db.TTL([]byte("hash-ttl"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 3500)
+	ttl, err = db.TTL([]byte("hash"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ttl)
+	assert.Equal(t, [][]byte{[]byte("m2"), []byte("m1")}, db.ZRange([]byte("zset"), 0, -1))
+}
+
+func TestLazyDB_ImportRDB_Invalid(t *testing.T) {
+	db := initTestImportDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	data := append([]byte("REDIS0009"), 0)
+	data = append(data, rdbString("truncated")...)
+	report, err := db.ImportRDB(bytes.NewReader(data), RDBImportOptions{DB: -1})
+	assert.Error(t, err)
+	assert.NotNil(t, report)
+}
+
+func TestLazyDB_ImportRDB_HashFieldTTL(t *testing.T) {
+	db := initTestImportDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	ms := func(at time.Time) []byte {
+		buf := make([]byte, 8)
+		if !at.IsZero() {
+			binary.LittleEndian.PutUint64(buf, uint64(at.UnixMilli()))
+		}
+		return buf
+	}
+	var buf bytes.Buffer
+	buf.WriteString("REDIS0012")
+	buf.Write([]byte{0xFE, 0})
+	// hash with an expired field, a field with ttl and a field without
+	buf.WriteByte(22)
+	buf.Write(rdbString("hash"))
+	buf.WriteByte(3)
+	buf.Write(ms(time.Now().Add(-time.Hour)))
+	buf.Write(rdbString("expired"))
+	buf.Write(rdbString("v"))
+	buf.Write(ms(time.Now().Add(time.Hour)))
+	buf.Write(rdbString("ttl"))
+	buf.Write(rdbString("v"))
+	buf.Write(ms(time.Time{}))
+	buf.Write(rdbString("persistent"))
+	buf.Write(rdbString("v"))
+	// hash whose fields have all expired
+	buf.WriteByte(22)
+	buf.Write(rdbString("hash-expired"))
+	buf.WriteByte(1)
+	buf.Write(ms(time.Now().Add(-time.Hour)))
+	buf.Write(rdbString("f"))
+	buf.Write(rdbString("v"))
+	buf.WriteByte(0xFF)
+	buf.Write(make([]byte, 8))
+
+	report, err := db.ImportRDB(bytes.NewReader(buf.Bytes()), RDBImportOptions{DB: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"hash": 1}, report.Loaded)
+	assert.Equal(t, 1, report.Expired)
+
+	assert.Equal(t, 2, db.HLen([]byte("hash")))
+	val, err := db.HGet([]byte("hash"), []byte("expired"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	ttl, err := db.HTTL([]byte("hash"), []byte("ttl"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 3500)
+	ttl, err = db.HTTL([]byte("hash"), []byte("persistent"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ttl)
+	assert.Equal(t, 0, db.Exists([]byte("hash-expired")))
+}
+
+func TestLazyDB_ImportRDB_Replace(t *testing.T) {
+	db := initTestImportDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	var buf bytes.Buffer
+	buf.WriteString("REDIS0011")
+	buf.Write([]byte{0xFE, 0})
+	buf.Write([]byte{1})
+	buf.Write(rdbString("list"))
+	buf.WriteByte(2)
+	buf.Write(rdbString("a"))
+	buf.Write(rdbString("b"))
+	buf.Write([]byte{4})
+	buf.Write(rdbString("hash"))
+	buf.WriteByte(1)
+	buf.Write(rdbString("f"))
+	buf.Write(rdbString("v"))
+	buf.WriteByte(0xFF)
+	buf.Write(make([]byte, 8))
+
+	_ = db.HSet([]byte("hash"), []byte("old"), []byte("v"))
+	_ = db.Set([]byte("hash"), []byte("str"))
+
+	// a client blocked on an imported list is served
+	popped := make(chan []byte, 1)
+	go func() {
+		_, val, _ := db.BLPop(time.Second, []byte("list"))
+		popped <- val
+	}()
+	assert.True(t, waitFor(func() bool {
+		db.listIndex.mu.RLock()
+		defer db.listIndex.mu.RUnlock()
+		return len(db.listIndex.waiters["list"]) == 1
+	}))
+	_, err := db.ImportRDB(bytes.NewReader(buf.Bytes()), RDBImportOptions{DB: -1})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), <-popped)
+
+	// importing again replaces the keys of the same type instead of merging into them
+	_, err = db.ImportRDB(bytes.NewReader(buf.Bytes()), RDBImportOptions{DB: -1})
+	assert.NoError(t, err)
+	list, err := db.LRange([]byte("list"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, list)
+	assert.Equal(t, 1, db.HLen([]byte("hash")))
+	val, err := db.HGet([]byte("hash"), []byte("old"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	val, err = db.Get([]byte("hash"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("str"), val)
+}
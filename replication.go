@@ -0,0 +1,733 @@
+package lazydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"lazydb/ds"
+	"lazydb/logfile"
+	"lazydb/util"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replMagic           = "LZRP"
+	replVersion         = 1
+	replFrameHeaderSize = 18
+	replPositionsFile   = "REPLICATION"
+
+	replHeartbeatInterval = time.Second
+	replSaveInterval      = time.Second
+	replDialTimeout       = 5 * time.Second
+	replMinRetryInterval  = 100 * time.Millisecond
+	replMaxRetryInterval  = 5 * time.Second
+)
+
+// frame kinds sent from primary to follower.
+// +--------+--------+--------+-------------+----------------+-----------+
+// |  kind  |  type  |  fid   |   offset    | payload length |  payload  |
+// +--------+--------+--------+-------------+----------------+-----------+
+// 0--------1--------2--------6------------14---------------18
+const (
+	// frameEntry carries a raw log entry that is located at fid and offset.
+	frameEntry byte = iota + 1
+	// framePosition moves the follower to the beginning of the next log file.
+	framePosition
+	// frameResync asks the follower to drop all data of the type and replay from fid and offset.
+	frameResync
+	// frameHeartbeat keeps the connection alive.
+	frameHeartbeat
+)
+
+var (
+	ErrReplicationHandshake = errors.New("invalid replication handshake")
+	ErrReplicationFrame     = errors.New("invalid replication frame")
+)
+
+// ReplicationPosition is the position of the next entry to replicate in the log files of one type.
+type ReplicationPosition struct {
+	Fid    uint32
+	Offset int64
+}
+
+// logNotifier wakes up the goroutines waiting for new entries of a log file type.
+type logNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (n *logNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *logNotifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+func (db *LazyDB) isReadOnly() bool {
+	return atomic.LoadInt32(&db.readOnly) == 1
+}
+
+// ReplicationServer streams the log files of a primary to its followers.
+type ReplicationServer struct {
+	db     *LazyDB
+	ln     net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// StartReplicationServer listens on addr and serves followers until the server is closed.
+func (db *LazyDB) StartReplicationServer(addr string) (*ReplicationServer, error) {
+	// open all active log files in advance, so that streaming does not race with creating them.
+	for i := 0; i < logFileTypeNum; i++ {
+		if db.getActiveLogFile(valueType(i)) == nil {
+			return nil, ErrOpenLogFile
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &ReplicationServer{
+		db:     db,
+		ln:     ln,
+		conns:  make(map[net.Conn]struct{}),
+		closed: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the listening address.
+func (s *ReplicationServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops accepting followers and disconnects the connected ones.
+func (s *ReplicationServer) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	err := s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *ReplicationServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			log.Printf("accept follower err: %v", err)
+			time.Sleep(replMinRetryInterval)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *ReplicationServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		_ = conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	positions, err := readReplHandshake(conn)
+	if err != nil {
+		log.Printf("replication handshake err: %v", err)
+		return
+	}
+
+	w := &frameWriter{w: conn}
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(done) })
+	}
+
+	streams := new(sync.WaitGroup)
+	for i := 0; i < logFileTypeNum; i++ {
+		streams.Add(1)
+		go func(typ valueType) {
+			defer streams.Done()
+			if err := s.stream(typ, positions[typ], w, done); err != nil {
+				stop()
+			}
+		}(valueType(i))
+	}
+	// the follower sends nothing after handshake, reading only detects disconnection.
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		stop()
+	}()
+
+	ticker := time.NewTicker(replHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.write(frameHeartbeat, 0, ReplicationPosition{}, nil); err != nil {
+				stop()
+			}
+			continue
+		case <-done:
+		case <-s.closed:
+			stop()
+		}
+		break
+	}
+	_ = conn.Close()
+	streams.Wait()
+}
+
+// stream sends the entries of typ from pos until done is closed.
+func (s *ReplicationServer) stream(typ valueType, pos ReplicationPosition, w *frameWriter, done chan struct{}) error {
+	db := s.db
+	notifier := db.appendNotifiers[typ]
+	resync := func() error {
+		pos = ReplicationPosition{Fid: db.nextLogFid(typ, 0)}
+		return w.write(frameResync, typ, pos, nil)
+	}
+	waitAppend := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	if pos.Fid == 0 || db.replicationLogFile(typ, pos.Fid) == nil {
+		if err := resync(); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		// get the channel before reading, so that no append is missed.
+		appended := notifier.wait()
+		lf := db.replicationLogFile(typ, pos.Fid)
+		if lf == nil {
+			if pos.Fid != 0 {
+				// the log file was removed by merge
+				if err := resync(); err != nil {
+					return err
+				}
+				continue
+			}
+			if next := db.nextLogFid(typ, 0); next != 0 {
+				pos = ReplicationPosition{Fid: next}
+				if err := w.write(framePosition, typ, pos, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if !waitAppend(appended) {
+				return nil
+			}
+			continue
+		}
+
+		active := db.isActiveLogFile(typ, lf)
+		if active && pos.Offset >= atomic.LoadInt64(&lf.Offset) {
+			if !waitAppend(appended) {
+				return nil
+			}
+			continue
+		}
+		lf.Mu.RLock()
+		ent, size, err := lf.ReadLogEntry(pos.Offset)
+		lf.Mu.RUnlock()
+		if err == io.EOF || err == logfile.ErrLogEndOfFile {
+			if active {
+				if !waitAppend(appended) {
+					return nil
+				}
+				continue
+			}
+			next := db.nextLogFid(typ, pos.Fid)
+			if next == 0 {
+				if !waitAppend(appended) {
+					return nil
+				}
+				continue
+			}
+			pos = ReplicationPosition{Fid: next}
+			if err := w.write(framePosition, typ, pos, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if db.replicationLogFile(typ, pos.Fid) == nil {
+				continue
+			}
+			return err
+		}
+		buf, _ := logfile.EncodeEntry(ent)
+		if err := w.write(frameEntry, typ, pos, buf); err != nil {
+			return err
+		}
+		pos.Offset += int64(size)
+	}
+}
+
+// replicationLogFile returns the log file of fid, either active or archived, nil if it does not exist.
+func (db *LazyDB) replicationLogFile(typ valueType, fid uint32) *logfile.LogFile {
+	if fid == 0 {
+		return nil
+	}
+	if mlf, ok := db.activeLogFileMap[typ]; ok {
+		mlf.mu.RLock()
+		lf := mlf.lf
+		mlf.mu.RUnlock()
+		if lf != nil && lf.Fid == fid {
+			return lf
+		}
+	}
+	if mlf := db.getArchivedLogFile(typ, fid); mlf != nil {
+		return mlf.lf
+	}
+	return nil
+}
+
+func (db *LazyDB) isActiveLogFile(typ valueType, lf *logfile.LogFile) bool {
+	mlf, ok := db.activeLogFileMap[typ]
+	if !ok {
+		return false
+	}
+	mlf.mu.RLock()
+	defer mlf.mu.RUnlock()
+	return mlf.lf == lf
+}
+
+// nextLogFid returns the smallest existing fid which is bigger than fid, 0 if there is none.
+func (db *LazyDB) nextLogFid(typ valueType, fid uint32) uint32 {
+	mutexFids := db.fidsMap[typ]
+	mutexFids.mu.RLock()
+	fids := make([]uint32, len(mutexFids.fids))
+	copy(fids, mutexFids.fids)
+	mutexFids.mu.RUnlock()
+
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	for _, f := range fids {
+		if f > fid && db.replicationLogFile(typ, f) != nil {
+			return f
+		}
+	}
+	return 0
+}
+
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *frameWriter) write(kind byte, typ valueType, pos ReplicationPosition, payload []byte) error {
+	buf := make([]byte, replFrameHeaderSize+len(payload))
+	buf[0] = kind
+	buf[1] = byte(typ)
+	binary.LittleEndian.PutUint32(buf[2:6], pos.Fid)
+	binary.LittleEndian.PutUint64(buf[6:14], uint64(pos.Offset))
+	binary.LittleEndian.PutUint32(buf[14:18], uint32(len(payload)))
+	copy(buf[replFrameHeaderSize:], payload)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	_, err := fw.w.Write(buf)
+	return err
+}
+
+// handshake sent from follower to primary.
+// +-------+---------+-------+--------+-------+----------+-----+
+// | magic | version | count |  type  |  fid  |  offset  | ... |
+// +-------+---------+-------+--------+-------+----------+-----+
+// 0-------4---------5-------6--------7------11---------19
+func writeReplHandshake(w io.Writer, positions map[valueType]ReplicationPosition) error {
+	buf := make([]byte, 0, 6+13*len(positions))
+	buf = append(buf, replMagic...)
+	buf = append(buf, replVersion, byte(len(positions)))
+	for typ, pos := range positions {
+		item := make([]byte, 13)
+		item[0] = byte(typ)
+		binary.LittleEndian.PutUint32(item[1:5], pos.Fid)
+		binary.LittleEndian.PutUint64(item[5:13], uint64(pos.Offset))
+		buf = append(buf, item...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readReplHandshake(r io.Reader) (map[valueType]ReplicationPosition, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != replMagic || header[4] != replVersion {
+		return nil, ErrReplicationHandshake
+	}
+	body := make([]byte, 13*int(header[5]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	positions := make(map[valueType]ReplicationPosition)
+	for i := 0; i < len(body); i += 13 {
+		positions[valueType(body[i])] = ReplicationPosition{
+			Fid:    binary.LittleEndian.Uint32(body[i+1 : i+5]),
+			Offset: int64(binary.LittleEndian.Uint64(body[i+5 : i+13])),
+		}
+	}
+	return positions, nil
+}
+
+// Follower replicates the log files of a primary into a read only db.
+type Follower struct {
+	db        *LazyDB
+	addr      string
+	mu        sync.Mutex
+	conn      net.Conn
+	positions map[valueType]ReplicationPosition
+	lastSave  time.Time
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+// StartFollower makes db a read only follower of the primary listening on addr.
+// Replication resumes from the positions saved by the previous follower of db,
+// and the follower keeps reconnecting until it is closed.
+func (db *LazyDB) StartFollower(addr string) (*Follower, error) {
+	if !atomic.CompareAndSwapInt32(&db.readOnly, 0, 1) {
+		return nil, ErrReadOnly
+	}
+	positions, err := db.loadReplicationPositions()
+	if err != nil {
+		atomic.StoreInt32(&db.readOnly, 0)
+		return nil, err
+	}
+	// open all active log files in advance, so that applying entries does not modify the map.
+	for i := 0; i < logFileTypeNum; i++ {
+		if db.getActiveLogFile(valueType(i)) == nil {
+			atomic.StoreInt32(&db.readOnly, 0)
+			return nil, ErrOpenLogFile
+		}
+	}
+	f := &Follower{
+		db:        db,
+		addr:      addr,
+		positions: positions,
+		lastSave:  time.Now(),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+// Positions returns the replication position of each data type.
+func (f *Follower) Positions() map[DataType]ReplicationPosition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	positions := make(map[DataType]ReplicationPosition)
+	for typ, pos := range f.positions {
+		positions[dataTypes[typ]] = pos
+	}
+	return positions
+}
+
+// Close stops replication and saves the positions, db becomes writable again.
+func (f *Follower) Close() error {
+	select {
+	case <-f.closed:
+		return nil
+	default:
+	}
+	close(f.closed)
+	f.mu.Lock()
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	f.mu.Unlock()
+	<-f.done
+
+	err := f.savePositions()
+	atomic.StoreInt32(&f.db.readOnly, 0)
+	return err
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	retry := replMinRetryInterval
+	for {
+		err := f.replicate()
+		select {
+		case <-f.closed:
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("replication from %s err: %v", f.addr, err)
+		}
+		select {
+		case <-f.closed:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > replMaxRetryInterval {
+			retry = replMaxRetryInterval
+		}
+	}
+}
+
+func (f *Follower) replicate() error {
+	conn, err := net.DialTimeout("tcp", f.addr, replDialTimeout)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+		f.mu.Unlock()
+		return conn.Close()
+	default:
+	}
+	f.conn = conn
+	positions := make(map[valueType]ReplicationPosition)
+	for typ, pos := range f.positions {
+		positions[typ] = pos
+	}
+	f.mu.Unlock()
+	defer conn.Close()
+
+	if err := writeReplHandshake(conn, positions); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	header := make([]byte, replFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		kind, typ := header[0], valueType(header[1])
+		pos := ReplicationPosition{
+			Fid:    binary.LittleEndian.Uint32(header[2:6]),
+			Offset: int64(binary.LittleEndian.Uint64(header[6:14])),
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[14:18]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if kind != frameHeartbeat && int(typ) >= logFileTypeNum {
+			return ErrReplicationFrame
+		}
+
+		switch kind {
+		case frameEntry:
+			if err := f.apply(typ, payload); err != nil {
+				return err
+			}
+			pos.Offset += int64(len(payload))
+		case framePosition:
+		case frameResync:
+			if err := f.db.resetType(typ); err != nil {
+				return err
+			}
+		case frameHeartbeat:
+		default:
+			return ErrReplicationFrame
+		}
+
+		f.mu.Lock()
+		if kind != frameHeartbeat {
+			f.positions[typ] = pos
+		}
+		save := kind == frameHeartbeat || time.Since(f.lastSave) > replSaveInterval
+		f.mu.Unlock()
+		if save {
+			if err := f.savePositions(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply writes a replicated entry into the local log files and updates the index.
+func (f *Follower) apply(typ valueType, buf []byte) error {
+	db := f.db
+	entry, err := logfile.DecodeEntry(buf)
+	if err != nil {
+		return err
+	}
+	vPos, err := db.appendLogEntry(typ, entry)
+	if err != nil {
+		return err
+	}
+	oldVal := db.buildIndexByVType(typ, entry, vPos)
+	_ = db.sendDiscard(oldVal, true, typ)
+	if entry.Stat == logfile.SDelete || (entry.Stat == logfile.SKeyMeta && entry.ExpiredAt == 0) {
+		_ = db.sendDiscard(&Value{fid: vPos.fid, entrySize: vPos.entrySize}, true, typ)
+	}
+	return nil
+}
+
+func (f *Follower) savePositions() error {
+	f.mu.Lock()
+	buf := make([]byte, 12*logFileTypeNum)
+	for i := 0; i < logFileTypeNum; i++ {
+		pos := f.positions[valueType(i)]
+		binary.LittleEndian.PutUint32(buf[i*12:], pos.Fid)
+		binary.LittleEndian.PutUint64(buf[i*12+4:], uint64(pos.Offset))
+	}
+	f.lastSave = time.Now()
+	f.mu.Unlock()
+
+	name := filepath.Join(f.db.cfg.DBPath, replPositionsFile)
+	if err := os.WriteFile(name+".tmp", buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// loadReplicationPositions reads the positions saved by savePositions.
+// +-------+----------+-------+----------+-----+
+// |  fid  |  offset  |  fid  |  offset  | ... |
+// +-------+----------+-------+----------+-----+
+// 0-------4---------12------16---------24
+func (db *LazyDB) loadReplicationPositions() (map[valueType]ReplicationPosition, error) {
+	positions := make(map[valueType]ReplicationPosition)
+	name := filepath.Join(db.cfg.DBPath, replPositionsFile)
+	if !util.PathExist(name) {
+		return positions, nil
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < logFileTypeNum && (i+1)*12 <= len(buf); i++ {
+		positions[valueType(i)] = ReplicationPosition{
+			Fid:    binary.LittleEndian.Uint32(buf[i*12:]),
+			Offset: int64(binary.LittleEndian.Uint64(buf[i*12+4:])),
+		}
+	}
+	return positions, nil
+}
+
+// resetType removes all data of typ, including the index and log files.
+func (db *LazyDB) resetType(typ valueType) error {
+	mu := db.indexMutex(typ)
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch typ {
+	case valueTypeString:
+		db.strIndex.idxTree = ds.NewART()
+		db.strIndex.expires = make(map[string]int64)
+		db.strIndex.bitmaps = make(map[string]*ds.AdaptiveRadixTree)
+	case valueTypeList:
+		db.listIndex.trees = make(map[string]*ds.AdaptiveRadixTree)
+		db.listIndex.keys = ds.NewART()
+		db.listIndex.expires = make(map[string]*Value)
+	case valueTypeHash:
+		db.hashIndex.trees = make(map[string]*ds.AdaptiveRadixTree)
+		db.hashIndex.keys = ds.NewART()
+		db.hashIndex.expires = make(map[string]*Value)
+		db.hashIndex.fieldExpires = make(map[string]map[string]int64)
+	case valueTypeSet:
+		db.setIndex.trees = make(map[string]*ds.AdaptiveRadixTree)
+		db.setIndex.keys = ds.NewART()
+		db.setIndex.expires = make(map[string]*Value)
+	case valueTypeZSet:
+		db.zSetIndex.indexes = make(map[string]*ZSetIndex)
+		db.zSetIndex.keys = ds.NewART()
+		db.zSetIndex.expires = make(map[string]*Value)
+	case valueTypeStream:
+		db.streamIndex.streams = make(map[string]*stream)
+		db.streamIndex.keys = ds.NewART()
+		db.streamIndex.expires = make(map[string]*Value)
+	case valueTypeJSON:
+		db.jsonIndex.idxTree = ds.NewART()
+		db.jsonIndex.expires = make(map[string]*Value)
+	case valueTypeTimeSeries:
+		db.tsIndex.series = make(map[string]*timeSeries)
+		db.tsIndex.keys = ds.NewART()
+		db.tsIndex.expires = make(map[string]*Value)
+	}
+
+	active := db.getActiveLogFile(typ)
+	if active == nil {
+		return ErrOpenLogFile
+	}
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	mutexFids := db.fidsMap[typ]
+	mutexFids.mu.Lock()
+	defer mutexFids.mu.Unlock()
+
+	archived := db.archivedLogFile[typ]
+	for _, fid := range mutexFids.fids {
+		shard := archived.GetShardByWriting(fid)
+		if v, ok := shard.Get(fid); ok {
+			_ = v.(*MutexLogFile).lf.Delete()
+			shard.Remove(fid)
+		}
+		shard.Unlock()
+		db.discardsMap[typ].clear(fid)
+	}
+	if err := active.lf.Delete(); err != nil {
+		return err
+	}
+	lf, err := logfile.Open(db.cfg.DBPath, 1, db.cfg.MaxLogFileSize, logfile.FType(typ), db.cfg.IOType)
+	if err != nil {
+		return err
+	}
+	active.lf = lf
+	mutexFids.fids = []uint32{lf.Fid}
+	db.discardsMap[typ].setTotal(lf.Fid, uint32(db.cfg.MaxLogFileSize))
+	return nil
+}
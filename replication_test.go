@@ -0,0 +1,155 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestReplicationDB(name string) *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, name)
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestLazyDB_Replication(t *testing.T) {
+	primary := initTestReplicationDB("test_primary")
+	defer destroyDB(primary)
+	follower := initTestReplicationDB("test_follower")
+	defer destroyDB(follower)
+	assert.NotNil(t, primary)
+	assert.NotNil(t, follower)
+
+	_ = primary.Set([]byte("k1"), []byte("v1"))
+	_ = primary.Set([]byte("k2"), []byte("v2"))
+	_ = primary.Delete([]byte("k2"))
+	_ = primary.HSet([]byte("h1"), []byte("f1"), []byte("v1"))
+	_ = primary.SAdd([]byte("s1"), []byte("m1"), []byte("m2"))
+	_ = primary.SRem([]byte("s1"), []byte("m2"))
+	_ = primary.ZAdd([]byte("z1"), util.Float64ToByte(2), []byte("m1"))
+	_ = primary.ZAdd([]byte("z1"), util.Float64ToByte(1), []byte("m2"))
+	_ = primary.RPush([]byte("l1"), []byte("a"), []byte("b"))
+	// local data of the follower is dropped by the first sync
+	_ = follower.Set([]byte("local"), []byte("v"))
+
+	server, err := primary.StartReplicationServer("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+	f, err := follower.StartFollower(server.Addr().String())
+	assert.NoError(t, err)
+
+	assert.True(t, waitFor(func() bool { return follower.LLen([]byte("l1")) == 2 }))
+	val, err := follower.Get([]byte("k1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	_, err = follower.Get([]byte("k2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = follower.Get([]byte("local"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	field, err := follower.HGet([]byte("h1"), []byte("f1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), field)
+	assert.True(t, follower.SIsMember([]byte("s1"), []byte("m1")))
+	assert.False(t, follower.SIsMember([]byte("s1"), []byte("m2")))
+	assert.Equal(t, [][]byte{[]byte("m2"), []byte("m1")}, follower.ZRange([]byte("z1"), 0, -1))
+
+	// writes are rejected while following
+	assert.Equal(t, ErrReadOnly, follower.Set([]byte("k3"), []byte("v3")))
+	_, err = follower.Begin(RWTX)
+	assert.Equal(t, ErrReadOnly, err)
+
+	// new writes are streamed
+	_ = primary.Set([]byte("k3"), []byte("v3"))
+	_, _ = primary.LPop([]byte("l1"))
+	assert.True(t, waitFor(func() bool {
+		val, err := follower.Get([]byte("k3"))
+		return err == nil && string(val) == "v3"
+	}))
+	assert.True(t, waitFor(func() bool { return follower.LLen([]byte("l1")) == 1 }))
+
+	assert.NoError(t, f.Close())
+	assert.True(t, f.Positions()[DataTypeString].Fid > 0)
+	assert.NoError(t, follower.Set([]byte("k4"), []byte("v4")))
+}
+
+func TestLazyDB_Replication_Resume(t *testing.T) {
+	primary := initTestReplicationDB("test_primary")
+	defer destroyDB(primary)
+	follower := initTestReplicationDB("test_follower")
+	defer destroyDB(follower)
+	assert.NotNil(t, primary)
+	assert.NotNil(t, follower)
+
+	server, err := primary.StartReplicationServer("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	_ = primary.RPush([]byte("l1"), []byte("a"))
+	f, err := follower.StartFollower(server.Addr().String())
+	assert.NoError(t, err)
+	assert.True(t, waitFor(func() bool { return follower.LLen([]byte("l1")) == 1 }))
+	assert.NoError(t, f.Close())
+	pos := f.Positions()[DataTypeList]
+
+	_ = primary.RPush([]byte("l1"), []byte("b"))
+	f, err = follower.StartFollower(server.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, pos, f.Positions()[DataTypeList])
+	assert.True(t, waitFor(func() bool { return follower.LLen([]byte("l1")) == 2 }))
+	list, err := follower.LRange([]byte("l1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, list)
+	assert.NoError(t, f.Close())
+}
+
+func TestLazyDB_Replication_Reconnect(t *testing.T) {
+	primary := initTestReplicationDB("test_primary")
+	defer destroyDB(primary)
+	follower := initTestReplicationDB("test_follower")
+	defer destroyDB(follower)
+	assert.NotNil(t, primary)
+	assert.NotNil(t, follower)
+
+	server, err := primary.StartReplicationServer("127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := server.Addr().String()
+	f, err := follower.StartFollower(addr)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	_ = primary.Set([]byte("k1"), []byte("v1"))
+	assert.True(t, waitFor(func() bool {
+		_, err := follower.Get([]byte("k1"))
+		return err == nil
+	}))
+
+	assert.NoError(t, server.Close())
+	_ = primary.Set([]byte("k2"), []byte("v2"))
+	server, err = primary.StartReplicationServer(addr)
+	assert.NoError(t, err)
+	defer server.Close()
+	assert.True(t, waitFor(func() bool {
+		_, err := follower.Get([]byte("k2"))
+		return err == nil
+	}))
+}
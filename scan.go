@@ -0,0 +1,168 @@
+package lazydb
+
+import (
+	"errors"
+	"lazydb/util"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid scan cursor")
+)
+
+// defaultScanCount is the number of entries examined by one scan call if count is not positive.
+const defaultScanCount = 10
+
+// The scan commands walk the indexes in key order and return an opaque cursor that holds the last examined key.
+// Pass the cursor to the next call to resume the walk, a nil cursor starts a new one and is returned when it ends.
+// Elements present during the whole walk are returned, while elements added or removed meanwhile may or may not be.
+// Every call holds the lock of the index only for the entries it examines.
+// Parameter count limits the number of examined entries, so a call may return less entries than count, or none.
+// Parameter match is a glob-style pattern, nil matches everything.
+
+// ScanKeys iterates the keys of the whole keyspace, or only the keys of typ if it is not DataTypeNone or empty.
+// A key held by more than one type is returned once for each type.
+func (db *LazyDB) ScanKeys(cursor, match []byte, count int, typ DataType) ([][]byte, []byte, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	vType, after := valueTypeString, []byte(nil)
+	if len(cursor) > 0 {
+		if int(cursor[0]) >= logFileTypeNum {
+			return nil, nil, ErrInvalidCursor
+		}
+		vType, after = valueType(cursor[0]), cursor[1:]
+	}
+
+	var keys [][]byte
+	for ; vType < logFileTypeNum; vType, after = vType+1, nil {
+		if typ != "" && typ != DataTypeNone && dataTypes[vType] != typ {
+			continue
+		}
+		mu := db.indexMutex(vType)
+		mu.RLock()
+		examined := db.orderedKeys(vType).ScanAfter(after, count)
+		for _, key := range examined {
+			if !reservedKey(key) && db.keyAlive(vType, key) && (match == nil || util.GlobMatch(match, key)) {
+				keys = append(keys, key)
+			}
+		}
+		mu.RUnlock()
+
+		if len(examined) == count {
+			last := examined[len(examined)-1]
+			next := make([]byte, len(last)+1)
+			next[0] = byte(vType)
+			copy(next[1:], last)
+			return keys, next, nil
+		}
+		count -= len(examined)
+	}
+	return keys, nil, nil
+}
+
+// HScan iterates the fields of the hash stored at key.
+// The returned values will be a mixed data of fields and values, like [field1, value1, field2, value2, etc...].
+func (db *LazyDB) HScan(key, cursor, match []byte, count int) ([][]byte, []byte, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	db.hashIndex.mu.RLock()
+	defer db.hashIndex.mu.RUnlock()
+
+	idxTree := db.getHashTree(key)
+	if idxTree == nil {
+		return nil, nil, nil
+	}
+	examined := idxTree.ScanAfter(cursor, count)
+	var values [][]byte
+	for _, hashKey := range examined {
+		_, field := decodeKey(hashKey)
+		if match != nil && !util.GlobMatch(match, field) {
+			continue
+		}
+		val, err := db.getValue(idxTree, hashKey, valueTypeHash)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, field, val)
+	}
+	return values, scanNext(examined, count), nil
+}
+
+// SScan iterates the members of the set stored at key.
+func (db *LazyDB) SScan(key, cursor, match []byte, count int) ([][]byte, []byte, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	idxTree := db.getSetTree(key)
+	if idxTree == nil {
+		return nil, nil, nil
+	}
+	// members are indexed by their hash, so they come in no particular order.
+	examined := idxTree.ScanAfter(cursor, count)
+	var members [][]byte
+	for _, sum := range examined {
+		member, err := db.getValue(idxTree, sum, valueTypeSet)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if match == nil || util.GlobMatch(match, member) {
+			members = append(members, member)
+		}
+	}
+	return members, scanNext(examined, count), nil
+}
+
+// ZScan iterates the members of the sorted set stored at key.
+// The returned members are not ordered by score.
+func (db *LazyDB) ZScan(key, cursor, match []byte, count int) ([][]byte, []float64, []byte, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return nil, nil, nil, nil
+	}
+	examined := idx.tree.ScanAfter(cursor, count)
+	var members [][]byte
+	var scores []float64
+	for _, zsetKey := range examined {
+		_, member := decodeKey(zsetKey)
+		if match != nil && !util.GlobMatch(match, member) {
+			continue
+		}
+		score, err := db.getValue(idx.tree, zsetKey, valueTypeZSet)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		members = append(members, member)
+		scores = append(scores, util.ByteToFloat64(score))
+	}
+	return members, scores, scanNext(examined, count), nil
+}
+
+// scanNext returns the cursor after examined, or nil if the walk is finished.
+func scanNext(examined [][]byte, count int) []byte {
+	if len(examined) < count {
+		return nil
+	}
+	last := examined[len(examined)-1]
+	next := make([]byte, len(last))
+	copy(next, last)
+	return next
+}
@@ -0,0 +1,263 @@
+package lazydb
+
+import (
+	"fmt"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestScanDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_scan")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func TestLazyDB_ScanKeys(t *testing.T) {
+	db := initTestScanDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 25; i++ {
+		_ = db.Set([]byte(fmt.Sprintf("str-%02d", i)), GetValue32())
+	}
+	for i := 0; i < 15; i++ {
+		_ = db.HSet([]byte(fmt.Sprintf("hash-%02d", i)), []byte("f"), []byte("v"))
+	}
+	_ = db.SAdd([]byte("str-00"), []byte("m1"))
+
+	tests := []struct {
+		name  string
+		match []byte
+		count int
+		typ   DataType
+		want  int
+	}{
+		{"all", nil, 7, DataTypeNone, 41},
+		{"match", []byte("*-1?"), 4, DataTypeNone, 15},
+		{"type", nil, 3, DataTypeHash, 15},
+		{"type and match", []byte("str-*"), 100, DataTypeSet, 1},
+		{"default count", nil, 0, DataTypeString, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cursor []byte
+			var keys [][]byte
+			var calls int
+			for {
+				batch, next, err := db.ScanKeys(cursor, tt.match, tt.count, tt.typ)
+				assert.NoError(t, err)
+				keys = append(keys, batch...)
+				calls++
+				if next == nil {
+					break
+				}
+				cursor = next
+			}
+			assert.Equal(t, tt.want, len(keys))
+			if tt.count > 0 {
+				assert.True(t, calls > 1 || tt.count >= tt.want)
+			}
+		})
+	}
+
+	_, _, err := db.ScanKeys([]byte{99}, nil, 10, DataTypeNone)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestLazyDB_ScanKeys_Resume(t *testing.T) {
+	db := initTestScanDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		_ = db.Set([]byte(fmt.Sprintf("k%d", i)), GetValue32())
+	}
+	keys, cursor, err := db.ScanKeys(nil, nil, 5, DataTypeString)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(keys))
+
+	// keys deleted or added behind the cursor do not break the walk
+	_ = db.Delete([]byte("k0"))
+	_ = db.Delete([]byte("k7"))
+	_ = db.Set([]byte("k00"), GetValue32())
+	rest, cursor, err := db.ScanKeys(cursor, nil, 10, DataTypeString)
+	assert.NoError(t, err)
+	assert.Nil(t, cursor)
+	assert.Equal(t, [][]byte{[]byte("k5"), []byte("k6"), []byte("k8"), []byte("k9")}, rest)
+}
+
+func TestLazyDB_ScanKeys_Collections(t *testing.T) {
+	db := initTestScanDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		_ = db.LPush(key, []byte("v"))
+		_ = db.HSet(key, []byte("f"), []byte("v"))
+		_ = db.SAdd(key, []byte("m"))
+		_ = db.ZAdd(key, util.Float64ToByte(1), []byte("m"))
+	}
+	for i := 0; i < 30; i += 3 {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		_, _ = db.LPop(key)
+		_, _ = db.Del(key)
+	}
+
+	// the ordered keys follow the index, also once it is rebuilt from the log files
+	check := func() {
+		for _, typ := range []valueType{valueTypeList, valueTypeHash, valueTypeSet, valueTypeZSet} {
+			want := db.collectionKeys(typ)
+			sort.Strings(want)
+			var got []string
+			for _, key := range db.orderedKeys(typ).ScanAfter(nil, 100) {
+				got = append(got, string(key))
+			}
+			assert.Equal(t, want, got)
+		}
+
+		var keys []string
+		var cursor []byte
+		for {
+			batch, next, err := db.ScanKeys(cursor, nil, 4, DataTypeList)
+			assert.NoError(t, err)
+			for _, key := range batch {
+				keys = append(keys, string(key))
+			}
+			if next == nil {
+				break
+			}
+			cursor = next
+		}
+		assert.Equal(t, 20, len(keys))
+		assert.True(t, sort.StringsAreSorted(keys))
+	}
+	check()
+
+	var err error
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	check()
+}
+
+func TestLazyDB_Scan(t *testing.T) {
+	db := initTestScanDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.Set([]byte("user-1"), []byte("a"))
+	_ = db.Set([]byte("user-2"), []byte("b"))
+	_ = db.Set([]byte("user-10"), []byte("c"))
+	_ = db.Set([]byte("order-1"), []byte("d"))
+
+	values, err := db.Scan([]byte("user-"), "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1"), []byte("a"), []byte("user-10"), []byte("c"), []byte("user-2"), []byte("b")}, values)
+
+	values, err = db.Scan([]byte("user-"), "^user-[0-9]$", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("user-1"), []byte("a"), []byte("user-2"), []byte("b")}, values)
+
+	values, err = db.Scan(nil, "", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("order-1"), []byte("d")}, values)
+
+	values, err = db.Scan([]byte("user-"), "", 0)
+	assert.NoError(t, err)
+	assert.Nil(t, values)
+
+	_, err = db.Scan(nil, "[", 10)
+	assert.Error(t, err)
+}
+
+func TestLazyDB_HScan(t *testing.T) {
+	db := initTestScanDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30; i++ {
+		_ = db.HSet([]byte("h"), []byte(fmt.Sprintf("field-%d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+
+	var cursor []byte
+	fields := make(map[string]string)
+	for {
+		values, next, err := db.HScan([]byte("h"), cursor, []byte("field-1*"), 4)
+		assert.NoError(t, err)
+		assert.True(t, len(values) <= 8)
+		for i := 0; i < len(values); i += 2 {
+			fields[string(values[i])] = string(values[i+1])
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 11, len(fields))
+	assert.Equal(t, "v12", fields["field-12"])
+
+	values, next, err := db.HScan([]byte("missing"), nil, nil, 10)
+	assert.NoError(t, err)
+	assert.Nil(t, values)
+	assert.Nil(t, next)
+}
+
+func TestLazyDB_SScan_ZScan(t *testing.T) {
+	db := initTestScanDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		member := fmt.Sprintf("m%d", i)
+		want = append(want, member)
+		_ = db.SAdd([]byte("s"), []byte(member))
+		_ = db.ZAdd([]byte("z"), util.Float64ToByte(float64(i)), []byte(member))
+	}
+	sort.Strings(want)
+
+	var cursor []byte
+	var members []string
+	for {
+		batch, next, err := db.SScan([]byte("s"), cursor, nil, 3)
+		assert.NoError(t, err)
+		for _, m := range batch {
+			members = append(members, string(m))
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(members)
+	assert.Equal(t, want, members)
+
+	cursor, members = nil, nil
+	scores := make(map[string]float64)
+	for {
+		batch, batchScores, next, err := db.ZScan([]byte("z"), cursor, nil, 6)
+		assert.NoError(t, err)
+		for i, m := range batch {
+			members = append(members, string(m))
+			scores[string(m)] = batchScores[i]
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(members)
+	assert.Equal(t, want, members)
+	assert.Equal(t, float64(7), scores["m7"])
+}
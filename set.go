@@ -3,25 +3,53 @@ package lazydb
 import (
 	"lazydb/ds"
 	"lazydb/logfile"
+	"lazydb/util"
 	"log"
+	"math/rand"
+)
+
+// setOp is an operation combining several sets or sorted sets.
+type setOp int
+
+const (
+	setOpUnion setOp = iota
+	setOpInter
+	setOpDiff
 )
 
 // SAdd add the values the set stored at key.
 func (db *LazyDB) SAdd(key []byte, members ...[]byte) error {
 	db.setIndex.mu.Lock()
 	defer db.setIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeSet, key); err != nil {
+		return err
+	}
+
+	added, err := db.sAdd(key, members...)
+	if err != nil {
+		return err
+	}
+	if added {
+		db.notifyKeyspaceEvent(notifySet, "sadd", key)
+	}
+	return nil
+}
 
+// sAdd is the same as SAdd, but the caller must hold the lock. It reports whether any member is written.
+func (db *LazyDB) sAdd(key []byte, members ...[]byte) (bool, error) {
 	if db.setIndex.trees[string(key)] == nil {
+		db.indexCollectionKey(valueTypeSet, key)
 		db.setIndex.trees[string(key)] = ds.NewART()
 	}
 
 	idxTree := db.setIndex.trees[string(key)]
+	var added bool
 	for _, mem := range members {
 		if len(mem) == 0 {
 			continue
 		}
 		if err := db.setIndex.murHash.Write(mem); err != nil {
-			return err
+			return false, err
 		}
 
 		sum := db.setIndex.murHash.EncodeSum128()
@@ -30,7 +58,7 @@ func (db *LazyDB) SAdd(key []byte, members ...[]byte) error {
 		ent := &logfile.LogEntry{Key: key, Value: mem}
 		valPos, err := db.writeLogEntry(valueTypeSet, ent)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		entry := &logfile.LogEntry{Key: sum, Value: mem}
@@ -38,10 +66,12 @@ func (db *LazyDB) SAdd(key []byte, members ...[]byte) error {
 		valPos.entrySize = size
 
 		if err := db.updateIndexTree(valueTypeSet, idxTree, entry, valPos, false); err != nil {
-			return err
+			return false, err
 		}
+		db.notifyChange(valueTypeSet, ent)
+		added = true
 	}
-	return nil
+	return added, nil
 }
 
 // SIsMember returns if the argument is the one value of the set stored at key.
@@ -49,10 +79,10 @@ func (db *LazyDB) SIsMember(key, member []byte) bool {
 	db.setIndex.mu.RLock()
 	defer db.setIndex.mu.RUnlock()
 
-	if db.setIndex.trees[string(key)] == nil {
+	idxTree := db.getSetTree(key)
+	if idxTree == nil {
 		return false
 	}
-	idxTree := db.setIndex.trees[string(key)]
 	if err := db.setIndex.murHash.Write(member); err != nil {
 		return false
 	}
@@ -74,12 +104,12 @@ func (db *LazyDB) SMembers(key []byte) ([][]byte, error) {
 
 // Helper for getting all members of the given set key.
 func (db *LazyDB) sMembers(key []byte) ([][]byte, error) {
-	if db.setIndex.trees[string(key)] == nil {
+	idxTree := db.getSetTree(key)
+	if idxTree == nil {
 		return nil, nil
 	}
 
 	var values [][]byte
-	idxTree := db.setIndex.trees[string(key)]
 	iterator := idxTree.Iterator()
 	for iterator.HasNext() {
 		node, _ := iterator.Next()
@@ -106,8 +136,7 @@ func (db *LazyDB) sremInternal(key []byte, member []byte) error {
 	sum := db.setIndex.murHash.EncodeSum128()
 	db.setIndex.murHash.Reset()
 
-	val, updated := idxTree.Delete(sum)
-	if !updated {
+	if idxTree.Get(sum) == nil {
 		return nil
 	}
 
@@ -116,6 +145,9 @@ func (db *LazyDB) sremInternal(key []byte, member []byte) error {
 	if err != nil {
 		return err
 	}
+	val, updated := idxTree.Delete(sum)
+
+	db.notifyChange(valueTypeSet, &logfile.LogEntry{Key: key, Value: member, Stat: logfile.SDelete})
 
 	// delete invalid entry
 	db.sendDiscard(val, updated, valueTypeSet)
@@ -134,6 +166,9 @@ func (db *LazyDB) sremInternal(key []byte, member []byte) error {
 func (db *LazyDB) SPop(key []byte, num uint) ([][]byte, error) {
 	db.setIndex.mu.Lock()
 	defer db.setIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeSet, key); err != nil {
+		return nil, err
+	}
 
 	if db.setIndex.trees[string(key)] == nil {
 		return nil, nil
@@ -162,6 +197,11 @@ func (db *LazyDB) SPop(key []byte, num uint) ([][]byte, error) {
 			return nil, err
 		}
 	}
+	if len(values) > 0 {
+		if err := db.notifySetRem(key, "spop"); err != nil {
+			return nil, err
+		}
+	}
 	return values, nil
 }
 
@@ -169,15 +209,378 @@ func (db *LazyDB) SPop(key []byte, num uint) ([][]byte, error) {
 func (db *LazyDB) SRem(key []byte, members ...[]byte) error {
 	db.setIndex.mu.Lock()
 	defer db.setIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeSet, key); err != nil {
+		return err
+	}
 
-	if db.setIndex.trees[string(key)] == nil {
+	idxTree := db.setIndex.trees[string(key)]
+	if idxTree == nil {
 		return nil
 	}
 
+	size := idxTree.Size()
 	for _, mem := range members {
 		if err := db.sremInternal(key, mem); err != nil {
 			return err
 		}
 	}
+	if idxTree.Size() < size {
+		return db.notifySetRem(key, "srem")
+	}
+	return nil
+}
+
+// notifySetRem publishes the keyspace event of removing members from key, and "del" if the set becomes empty.
+// The ttl of an emptied set is removed as well.
+func (db *LazyDB) notifySetRem(key []byte, event string) error {
+	db.notifyKeyspaceEvent(notifySet, event, key)
+	if idxTree := db.setIndex.trees[string(key)]; idxTree == nil || idxTree.Size() == 0 {
+		if err := db.setKeyExpire(valueTypeSet, key, 0); err != nil {
+			return err
+		}
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
 	return nil
 }
+
+// getSetTree returns the index of the set stored at key, or nil if it does not exist or has expired.
+func (db *LazyDB) getSetTree(key []byte) *ds.AdaptiveRadixTree {
+	if db.keyExpired(valueTypeSet, key) {
+		return nil
+	}
+	return db.setIndex.trees[string(key)]
+}
+
+// SCard returns the number of members of the set stored at key.
+func (db *LazyDB) SCard(key []byte) int {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	idxTree := db.getSetTree(key)
+	if idxTree == nil {
+		return 0
+	}
+	return idxTree.Size()
+}
+
+// SMIsMember returns whether each of members is a member of the set stored at key.
+func (db *LazyDB) SMIsMember(key []byte, members ...[]byte) []bool {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	res := make([]bool, len(members))
+	idxTree := db.getSetTree(key)
+	if idxTree == nil {
+		return res
+	}
+	for i, member := range members {
+		sum, err := setMemberSum(member)
+		res[i] = err == nil && idxTree.Get(sum) != nil
+	}
+	return res
+}
+
+// SMove moves member from the set stored at source to the set stored at destination, and reports whether it is moved.
+// The member is removed and added under the same lock, so no reader sees it in both sets or in none.
+func (db *LazyDB) SMove(source, destination, member []byte) (bool, error) {
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+	for _, key := range [][]byte{source, destination} {
+		if err := db.expireIfNeeded(valueTypeSet, key); err != nil {
+			return false, err
+		}
+	}
+
+	sum, err := setMemberSum(member)
+	if err != nil {
+		return false, err
+	}
+	srcTree := db.setIndex.trees[string(source)]
+	if srcTree == nil || srcTree.Get(sum) == nil {
+		return false, nil
+	}
+	if string(source) == string(destination) {
+		return true, nil
+	}
+	if err := db.sremInternal(source, member); err != nil {
+		return false, err
+	}
+	if err := db.notifySetRem(source, "srem"); err != nil {
+		return false, err
+	}
+	if dstTree := db.setIndex.trees[string(destination)]; dstTree != nil && dstTree.Get(sum) != nil {
+		return true, nil
+	}
+	if _, err := db.sAdd(destination, member); err != nil {
+		return false, err
+	}
+	db.notifyKeyspaceEvent(notifySet, "sadd", destination)
+	return true, nil
+}
+
+// SRandMember returns random members of the set stored at key without removing them.
+// If count is positive, at most count distinct members are returned.
+// If count is negative, -count members are returned and the same member may be returned more than once.
+func (db *LazyDB) SRandMember(key []byte, count int) ([][]byte, error) {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	idxTree := db.getSetTree(key)
+	if idxTree == nil || idxTree.Size() == 0 || count == 0 {
+		return nil, nil
+	}
+	sums := treeKeys(idxTree)
+	var picked [][]byte
+	if count > 0 {
+		// a partial Fisher-Yates shuffle picks distinct members
+		count = util.Min(count, len(sums))
+		for i := 0; i < count; i++ {
+			j := i + rand.Intn(len(sums)-i)
+			sums[i], sums[j] = sums[j], sums[i]
+		}
+		picked = sums[:count]
+	} else {
+		for i := 0; i < -count; i++ {
+			picked = append(picked, sums[rand.Intn(len(sums))])
+		}
+	}
+
+	members := make([][]byte, 0, len(picked))
+	for _, sum := range picked {
+		member, err := db.getValue(idxTree, sum, valueTypeSet)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// SInter returns the members of the intersection of the sets stored at keys.
+// Non existing keys are considered as empty sets.
+func (db *LazyDB) SInter(keys ...[]byte) ([][]byte, error) {
+	return db.sCombineRead(keys, setOpInter)
+}
+
+// SUnion returns the members of the union of the sets stored at keys.
+func (db *LazyDB) SUnion(keys ...[]byte) ([][]byte, error) {
+	return db.sCombineRead(keys, setOpUnion)
+}
+
+// SDiff returns the members of the first set that are not in the other sets.
+func (db *LazyDB) SDiff(keys ...[]byte) ([][]byte, error) {
+	return db.sCombineRead(keys, setOpDiff)
+}
+
+// SInterStore stores the intersection of the sets stored at keys in destination,
+// and returns the number of members of the resulting set.
+func (db *LazyDB) SInterStore(destination []byte, keys ...[]byte) (int, error) {
+	return db.sCombineStore(destination, keys, setOpInter, "sinterstore")
+}
+
+// SUnionStore stores the union of the sets stored at keys in destination,
+// and returns the number of members of the resulting set.
+func (db *LazyDB) SUnionStore(destination []byte, keys ...[]byte) (int, error) {
+	return db.sCombineStore(destination, keys, setOpUnion, "sunionstore")
+}
+
+// SDiffStore stores the difference between the first set and the other sets in destination,
+// and returns the number of members of the resulting set.
+func (db *LazyDB) SDiffStore(destination []byte, keys ...[]byte) (int, error) {
+	return db.sCombineStore(destination, keys, setOpDiff, "sdiffstore")
+}
+
+// SInterCard returns the number of members of the intersection of the sets stored at keys.
+// If limit is positive, counting stops when limit is reached. No member is read from the log files.
+func (db *LazyDB) SInterCard(limit int, keys ...[]byte) int {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	var count int
+	db.sCombine(keys, setOpInter, func(sum []byte, idxTree *ds.AdaptiveRadixTree) bool {
+		count++
+		return limit <= 0 || count < limit
+	})
+	return count
+}
+
+func (db *LazyDB) sCombineRead(keys [][]byte, op setOp) ([][]byte, error) {
+	db.setIndex.mu.RLock()
+	defer db.setIndex.mu.RUnlock()
+
+	var members [][]byte
+	var err error
+	db.sCombine(keys, op, func(sum []byte, idxTree *ds.AdaptiveRadixTree) bool {
+		var member []byte
+		member, err = db.getValue(idxTree, sum, valueTypeSet)
+		members = append(members, member)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// sCombineStore overwrites the set stored at destination with the result of op.
+// The lock is held from reading the sources to writing destination, and all entries of destination
+// are written into the log file at once.
+func (db *LazyDB) sCombineStore(destination []byte, keys [][]byte, op setOp, event string) (int, error) {
+	db.setIndex.mu.Lock()
+	defer db.setIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeSet, destination); err != nil {
+		return 0, err
+	}
+
+	result := make(map[string][]byte)
+	var err error
+	db.sCombine(keys, op, func(sum []byte, idxTree *ds.AdaptiveRadixTree) bool {
+		var member []byte
+		member, err = db.getValue(idxTree, sum, valueTypeSet)
+		result[string(sum)] = member
+		return err == nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	existed := db.keyExists(valueTypeSet, destination)
+	if err := db.sStore(destination, result); err != nil {
+		return 0, err
+	}
+	if len(result) > 0 {
+		db.notifyKeyspaceEvent(notifySet, event, destination)
+	} else if existed {
+		db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+	}
+	return len(result), nil
+}
+
+// sCombine calls fn with the sum of every member resulting from op on the sets stored at keys,
+// and the index holding the member, until fn returns false. The caller must hold the lock.
+func (db *LazyDB) sCombine(keys [][]byte, op setOp, fn func(sum []byte, idxTree *ds.AdaptiveRadixTree) bool) {
+	if len(keys) == 0 {
+		return
+	}
+	trees := make([]*ds.AdaptiveRadixTree, len(keys))
+	for i, key := range keys {
+		trees[i] = db.getSetTree(key)
+	}
+
+	switch op {
+	case setOpUnion:
+		seen := make(map[string]struct{})
+		for _, idxTree := range trees {
+			if idxTree == nil {
+				continue
+			}
+			for _, sum := range treeKeys(idxTree) {
+				if _, ok := seen[string(sum)]; ok {
+					continue
+				}
+				seen[string(sum)] = struct{}{}
+				if !fn(sum, idxTree) {
+					return
+				}
+			}
+		}
+	case setOpInter:
+		// walk the smallest set and look up the others
+		for i, idxTree := range trees {
+			if idxTree == nil {
+				return
+			}
+			if idxTree.Size() < trees[0].Size() {
+				trees[0], trees[i] = trees[i], trees[0]
+			}
+		}
+		for _, sum := range treeKeys(trees[0]) {
+			if setsContain(trees[1:], sum) == len(trees)-1 && !fn(sum, trees[0]) {
+				return
+			}
+		}
+	case setOpDiff:
+		if trees[0] == nil {
+			return
+		}
+		for _, sum := range treeKeys(trees[0]) {
+			if setsContain(trees[1:], sum) == 0 && !fn(sum, trees[0]) {
+				return
+			}
+		}
+	}
+}
+
+// setsContain returns the number of trees holding sum.
+func setsContain(trees []*ds.AdaptiveRadixTree, sum []byte) int {
+	var n int
+	for _, idxTree := range trees {
+		if idxTree != nil && idxTree.Get(sum) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// sStore overwrites the set stored at key with result, which maps the sums of members to members,
+// and removes its ttl. The caller must hold the lock.
+func (db *LazyDB) sStore(key []byte, result map[string][]byte) error {
+	if err := db.setKeyExpire(valueTypeSet, key, 0); err != nil {
+		return err
+	}
+	idxTree := db.setIndex.trees[string(key)]
+	if idxTree == nil {
+		if len(result) == 0 {
+			return nil
+		}
+		idxTree = ds.NewART()
+		db.indexCollectionKey(valueTypeSet, key)
+		db.setIndex.trees[string(key)] = idxTree
+	}
+
+	// members already in the set are kept as they are
+	var entries []*logfile.LogEntry
+	var sums [][]byte
+	for _, sum := range treeKeys(idxTree) {
+		if _, ok := result[string(sum)]; !ok {
+			entries = append(entries, &logfile.LogEntry{Key: key, Value: sum, Stat: logfile.SDelete})
+			sums = append(sums, sum)
+		}
+	}
+	for sum, member := range result {
+		if idxTree.Get([]byte(sum)) == nil {
+			entries = append(entries, &logfile.LogEntry{Key: key, Value: member})
+			sums = append(sums, []byte(sum))
+		}
+	}
+	valPos, err := db.writeLogEntries(valueTypeSet, entries)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if entry.Stat == logfile.SDelete {
+			member, _ := db.getValue(idxTree, sums[i], valueTypeSet)
+			val, updated := idxTree.Delete(sums[i])
+			db.notifyChange(valueTypeSet, &logfile.LogEntry{Key: key, Value: member, Stat: logfile.SDelete})
+			db.sendDiscard(val, updated, valueTypeSet)
+			db.sendDiscard(&Value{fid: valPos[i].fid, entrySize: valPos[i].entrySize}, true, valueTypeSet)
+			continue
+		}
+		idxEntry := &logfile.LogEntry{Key: sums[i], Value: entry.Value}
+		if err := db.updateIndexTree(valueTypeSet, idxTree, idxEntry, valPos[i], false); err != nil {
+			return err
+		}
+		db.notifyChange(valueTypeSet, entry)
+	}
+	return nil
+}
+
+// setMemberSum returns the key of member in the index of a set.
+// A new hash is used, so it is safe to call with the read lock held.
+func setMemberSum(member []byte) ([]byte, error) {
+	murHash := util.NewMurmur128()
+	if err := murHash.Write(member); err != nil {
+		return nil, err
+	}
+	return murHash.EncodeSum128(), nil
+}
@@ -1,6 +1,7 @@
 package lazydb
 
 import (
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -311,3 +312,169 @@ func TestLazyDB_SRem(t *testing.T) {
 		})
 	}
 }
+
+func sortedMembers(members [][]byte) []string {
+	res := make([]string, 0, len(members))
+	for _, m := range members {
+		res = append(res, string(m))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestLazyDB_SCard_SMIsMember(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.SAdd([]byte("s1"), []byte("a"), []byte("b"), []byte("c"), []byte("a"))
+	assert.Equal(t, 3, db.SCard([]byte("s1")))
+	assert.Equal(t, 0, db.SCard([]byte("missing")))
+	assert.Equal(t, []bool{true, false, true}, db.SMIsMember([]byte("s1"), []byte("a"), []byte("d"), []byte("c")))
+	assert.Equal(t, []bool{false}, db.SMIsMember([]byte("missing"), []byte("a")))
+}
+
+func TestLazyDB_SMove(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.SAdd([]byte("src"), []byte("a"), []byte("b"))
+	_ = db.SAdd([]byte("dst"), []byte("b"))
+
+	tests := []struct {
+		name        string
+		member      string
+		expected    bool
+		expectedSrc []string
+		expectedDst []string
+	}{
+		{"move", "a", true, []string{"b"}, []string{"a", "b"}},
+		{"already in destination", "b", true, []string{}, []string{"a", "b"}},
+		{"not a member", "c", false, []string{}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moved, err := db.SMove([]byte("src"), []byte("dst"), []byte(tt.member))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, moved)
+			src, _ := db.SMembers([]byte("src"))
+			dst, _ := db.SMembers([]byte("dst"))
+			assert.Equal(t, tt.expectedSrc, sortedMembers(src))
+			assert.Equal(t, tt.expectedDst, sortedMembers(dst))
+		})
+	}
+}
+
+func TestLazyDB_SRandMember(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.SAdd([]byte("s1"), []byte("a"), []byte("b"), []byte("c"))
+
+	members, err := db.SRandMember([]byte("s1"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(members))
+	assert.NotEqual(t, string(members[0]), string(members[1]))
+
+	members, err = db.SRandMember([]byte("s1"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, sortedMembers(members))
+
+	members, err = db.SRandMember([]byte("s1"), -10)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(members))
+	for _, m := range members {
+		assert.True(t, db.SIsMember([]byte("s1"), m))
+	}
+	assert.Equal(t, 3, db.SCard([]byte("s1")))
+
+	members, err = db.SRandMember([]byte("missing"), 1)
+	assert.NoError(t, err)
+	assert.Nil(t, members)
+}
+
+func TestLazyDB_SInter_SUnion_SDiff(t *testing.T) {
+	db := initTestDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.SAdd([]byte("s1"), []byte("a"), []byte("b"), []byte("c"), []byte("d"))
+	_ = db.SAdd([]byte("s2"), []byte("c"), []byte("d"), []byte("e"))
+	_ = db.SAdd([]byte("s3"), []byte("d"), []byte("e"), []byte("f"))
+
+	tests := []struct {
+		name     string
+		op       func(keys ...[]byte) ([][]byte, error)
+		keys     []string
+		expected []string
+	}{
+		{"inter", db.SInter, []string{"s1", "s2"}, []string{"c", "d"}},
+		{"inter three", db.SInter, []string{"s1", "s2", "s3"}, []string{"d"}},
+		{"inter missing", db.SInter, []string{"s1", "missing"}, []string{}},
+		{"union", db.SUnion, []string{"s1", "s3", "missing"}, []string{"a", "b", "c", "d", "e", "f"}},
+		{"diff", db.SDiff, []string{"s1", "s2"}, []string{"a", "b"}},
+		{"diff three", db.SDiff, []string{"s2", "s1", "s3"}, []string{}},
+		{"diff missing first", db.SDiff, []string{"missing", "s1"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys [][]byte
+			for _, key := range tt.keys {
+				keys = append(keys, []byte(key))
+			}
+			members, err := tt.op(keys...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, sortedMembers(members))
+		})
+	}
+
+	assert.Equal(t, 2, db.SInterCard(0, []byte("s1"), []byte("s2")))
+	assert.Equal(t, 1, db.SInterCard(1, []byte("s1"), []byte("s2")))
+	assert.Equal(t, 0, db.SInterCard(0, []byte("s1"), []byte("missing")))
+}
+
+func TestLazyDB_SStore(t *testing.T) {
+	db := initTestDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	_ = db.SAdd([]byte("s1"), []byte("a"), []byte("b"), []byte("c"))
+	_ = db.SAdd([]byte("s2"), []byte("b"), []byte("c"), []byte("d"))
+	_ = db.SAdd([]byte("dst"), []byte("old"), []byte("b"))
+
+	n, err := db.SInterStore([]byte("dst"), []byte("s1"), []byte("s2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	members, _ := db.SMembers([]byte("dst"))
+	assert.Equal(t, []string{"b", "c"}, sortedMembers(members))
+
+	n, err = db.SUnionStore([]byte("u"), []byte("s1"), []byte("s2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// the destination may be one of the sources
+	n, err = db.SDiffStore([]byte("s1"), []byte("s1"), []byte("s2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = db.SDiffStore([]byte("s2"), []byte("s2"), []byte("u"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// the stored sets are rebuilt from the log files
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	for key, expected := range map[string][]string{
+		"dst": {"b", "c"},
+		"u":   {"a", "b", "c", "d"},
+		"s1":  {"a"},
+		"s2":  {},
+	} {
+		members, err := db.SMembers([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, sortedMembers(members), key)
+	}
+}
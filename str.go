@@ -23,13 +23,11 @@ func (db *LazyDB) Set(key, value []byte) error {
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
-	entry := &logfile.LogEntry{Key: key, Value: value}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
-	if err != nil {
+	if err := db.setEX(key, value, 0); err != nil {
 		return err
 	}
-	err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
-	return err
+	db.notifyKeyspaceEvent(notifyString, "set", key)
+	return nil
 }
 
 // Get get the value of key.
@@ -114,6 +112,12 @@ func (db *LazyDB) GetDel(key []byte) ([]byte, error) {
 		return nil, err
 	}
 	delVal, updated := db.strIndex.idxTree.Delete(key)
+	db.setStrExpire(key, 0)
+	db.dropBitmapPages(key, true)
+	if updated {
+		db.notifyChange(valueTypeString, entry)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
 
 	// delete invalid entry
 	db.sendDiscard(delVal, updated, valueTypeString)
@@ -139,6 +143,12 @@ func (db *LazyDB) Delete(key []byte) error {
 		return err
 	}
 	delVal, updated := db.strIndex.idxTree.Delete(key)
+	db.setStrExpire(key, 0)
+	db.dropBitmapPages(key, true)
+	if updated {
+		db.notifyChange(valueTypeString, entry)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
 
 	// delete invalid entry
 	db.sendDiscard(delVal, updated, valueTypeString)
@@ -158,13 +168,26 @@ func (db *LazyDB) SetEX(key, value []byte, duration time.Duration) error {
 	db.strIndex.mu.Lock()
 	defer db.strIndex.mu.Unlock()
 
-	expiredAt := time.Now().Add(duration).Unix()
+	if err := db.setEX(key, value, time.Now().Add(duration).Unix()); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyString, "set", key)
+	db.notifyKeyspaceEvent(notifyGeneric, "expire", key)
+	return nil
+}
+
+// setEX writes the value with the unix time it expires at, 0 means no expiration.
+func (db *LazyDB) setEX(key, value []byte, expiredAt int64) error {
 	entry := &logfile.LogEntry{Key: key, Value: value, ExpiredAt: expiredAt}
 	valuePos, err := db.writeLogEntry(valueTypeString, entry)
 	if err != nil {
 		return err
 	}
-	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+	if err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true); err != nil {
+		return err
+	}
+	db.notifyChange(valueTypeString, entry)
+	return nil
 }
 
 // SetNX sets the key-value pair if it is not exist. It returns nil if the key already exists.
@@ -179,12 +202,11 @@ func (db *LazyDB) SetNX(key, value []byte) error {
 	if val != nil {
 		return nil
 	}
-	entry := &logfile.LogEntry{Key: key, Value: value}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
-	if err != nil {
+	if err := db.setEX(key, value, 0); err != nil {
 		return err
 	}
-	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+	db.notifyKeyspaceEvent(notifyString, "set", key)
+	return nil
 }
 
 // MSet is multiple set command. Parameter order should be like "key", "value", "key", "value", ...
@@ -197,15 +219,10 @@ func (db *LazyDB) MSet(args ...[]byte) error {
 
 	for i := 0; i < len(args); i += 2 {
 		key, val := args[i], args[i+1]
-		entry := &logfile.LogEntry{Key: key, Value: val}
-		valuePos, err := db.writeLogEntry(valueTypeString, entry)
-		if err != nil {
-			return err
-		}
-		err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
-		if err != nil {
+		if err := db.setEX(key, val, 0); err != nil {
 			return err
 		}
+		db.notifyKeyspaceEvent(notifyString, "set", key)
 	}
 	return nil
 }
@@ -236,15 +253,10 @@ func (db *LazyDB) MSetNX(args ...[]byte) error {
 		if _, ok := newKeys[h]; ok {
 			continue
 		}
-		entry := &logfile.LogEntry{Key: key, Value: value}
-		valPos, err := db.writeLogEntry(valueTypeString, entry)
-		if err != nil {
-			return err
-		}
-		err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valPos, true)
-		if err != nil {
+		if err := db.setEX(key, value, 0); err != nil {
 			return err
 		}
+		db.notifyKeyspaceEvent(notifyString, "set", key)
 		newKeys[h] = struct{}{}
 	}
 	return nil
@@ -263,12 +275,11 @@ func (db *LazyDB) Append(key, value []byte) error {
 	if val != nil {
 		value = append(val, value...)
 	}
-	entry := &logfile.LogEntry{Key: key, Value: value}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
-	if err != nil {
+	if err := db.setEX(key, value, 0); err != nil {
 		return err
 	}
-	return db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
+	db.notifyKeyspaceEvent(notifyString, "append", key)
+	return nil
 }
 
 // Decr decrements the number stored at key by one. If the key does not exist,
@@ -330,14 +341,13 @@ func (db *LazyDB) incrDecrBy(key []byte, incr int64) (int64, error) {
 	}
 	valInt64 += incr
 	val = []byte(strconv.FormatInt(valInt64, 10))
-	entry := &logfile.LogEntry{Key: key, Value: val}
-	valuePos, err := db.writeLogEntry(valueTypeString, entry)
-	if err != nil {
+	if err := db.setEX(key, val, 0); err != nil {
 		return 0, err
 	}
-	err = db.updateIndexTree(valueTypeString, db.strIndex.idxTree, entry, valuePos, true)
-	if err != nil {
-		return 0, err
+	if incr < 0 {
+		db.notifyKeyspaceEvent(notifyString, "decrby", key)
+	} else {
+		db.notifyKeyspaceEvent(notifyString, "incrby", key)
 	}
 	return valInt64, nil
 }
@@ -365,6 +375,7 @@ func (db *LazyDB) Count() int {
 // Parameter prefix will match key`s prefix, and pattern is a regular expression that also matchs the key.
 // Parameter count limits the number of keys, a nil slice will be returned if count is not a positive number.
 // The returned values will be a mixed data of keys and values, like [key1, value1, key2, value2, etc...].
+// Use ScanKeys to iterate with a cursor.
 func (db *LazyDB) Scan(prefix []byte, pattern string, count int) ([][]byte, error) {
 	if count <= 0 {
 		return nil, nil
@@ -401,23 +412,33 @@ func (db *LazyDB) Scan(prefix []byte, pattern string, count int) ([][]byte, erro
 	return values, nil
 }
 
-// Expire set the expiration time for the given key.
-func (db *LazyDB) Expire(key []byte, duration time.Duration) error {
-	if duration <= 0 {
-		return nil
-	}
-	db.strIndex.mu.RLock()
-	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
+// strExpire sets the expiration time of the string stored at key.
+func (db *LazyDB) strExpire(key []byte, expiredAt int64) error {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	return db.setStrExpiredAt(key, expiredAt)
+}
+
+// setStrExpiredAt rewrites the string stored at key with a new expiration time.
+// Only the header of a bitmap stored in pages is rewritten. The caller must hold the lock of strIndex.
+func (db *LazyDB) setStrExpiredAt(key []byte, expiredAt int64) error {
+	bm, err := db.openBitmap(key)
 	if err != nil {
-		db.strIndex.mu.RUnlock()
 		return err
 	}
-	db.strIndex.mu.RUnlock()
-	return db.SetEX(key, val, duration)
+	if !bm.exists {
+		return ErrKeyNotFound
+	}
+	if bm.paged {
+		bm.expiredAt = expiredAt
+		return bm.save()
+	}
+	return db.setEX(key, bm.plain, expiredAt)
 }
 
-// TTL get ttl(time to live) for the given key.
-func (db *LazyDB) TTL(key []byte) (int64, error) {
+// strTTL gets ttl(time to live) of the string stored at key.
+func (db *LazyDB) strTTL(key []byte) (int64, error) {
 	db.strIndex.mu.RLock()
 	defer db.strIndex.mu.RUnlock()
 
@@ -436,16 +457,12 @@ func (db *LazyDB) TTL(key []byte) (int64, error) {
 	return ttl, nil
 }
 
-// Persist remove the expiration time for the given key.
-func (db *LazyDB) Persist(key []byte) error {
-	db.strIndex.mu.RLock()
-	val, err := db.getValue(db.strIndex.idxTree, key, valueTypeString)
-	if err != nil {
-		db.strIndex.mu.RUnlock()
-		return err
-	}
-	db.strIndex.mu.RUnlock()
-	return db.Set(key, val)
+// strPersist removes the expiration time of the string stored at key.
+func (db *LazyDB) strPersist(key []byte) error {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	return db.setStrExpiredAt(key, 0)
 }
 
 // GetStrsKeys get all stored keys of type String.
@@ -0,0 +1,1123 @@
+package lazydb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lazydb/ds"
+	"lazydb/logfile"
+	"lazydb/util"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidStreamID     = errors.New("invalid stream id")
+	ErrStreamIDTooSmall    = errors.New("stream id is equal or smaller than the last one")
+	ErrStreamGroupExists   = errors.New("consumer group already exists")
+	ErrStreamGroupNotFound = errors.New("consumer group not found")
+)
+
+// Every stream has its own radix tree, keyed by sub keys whose first byte tells what they hold:
+// the entries keyed by their id, the consumer groups keyed by their name, the last id of the stream,
+// and the pending entries of the groups keyed by id and group name.
+// Log entries are keyed by encodeKey(key, subKey), and the key meta entry holding the ttl by the raw key.
+const (
+	streamKindEntry   byte = 'e'
+	streamKindGroup   byte = 'g'
+	streamKindMeta    byte = 'm'
+	streamKindPending byte = 'p'
+
+	streamIDSize = 16
+)
+
+var maxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// StreamID is the id of a stream entry, made of a unix time in milliseconds and a sequence number.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// StreamEntry is an entry of a stream.
+// Fields is a mixed data of fields and values, like [field1, value1, field2, value2, etc...].
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+// XStream holds the entries read from the stream stored at Key.
+type XStream struct {
+	Key     []byte
+	Entries []*StreamEntry
+}
+
+// XAddArgs are the options of XAdd.
+type XAddArgs struct {
+	// ID is the id of the new entry. It is generated from the current time if it is empty or "*",
+	// and only its sequence number is generated if it is like "<ms>-*".
+	ID string
+	// NoMkStream makes XAdd return ErrKeyNotFound instead of creating the stream.
+	NoMkStream bool
+	// MaxLen trims the stream to its MaxLen latest entries if it is positive.
+	MaxLen int
+	// MinID trims the entries with an id lower than MinID if it is not empty.
+	MinID string
+}
+
+// XReadArgs are the options of XRead.
+type XReadArgs struct {
+	Streams [][]byte
+	// IDs are the ids after which entries are read, one for each stream.
+	// "$" reads the entries added after the call.
+	IDs []string
+	// Count limits the number of entries read from each stream if it is positive.
+	Count int
+	// Block waits for entries if there are none, Timeout 0 waits forever.
+	Block   bool
+	Timeout time.Duration
+}
+
+// XReadGroupArgs are the options of XReadGroup.
+type XReadGroupArgs struct {
+	Group    []byte
+	Consumer []byte
+	Streams  [][]byte
+	// IDs are the ids to read from, one for each stream. ">" reads the entries never delivered to the group,
+	// other ids read the pending entries of the consumer after them.
+	IDs []string
+	// Count limits the number of entries read from each stream if it is positive.
+	Count int
+	// NoAck delivers the entries without adding them to the pending entries.
+	NoAck bool
+	// Block waits for entries if there are none and all ids are ">", Timeout 0 waits forever.
+	Block   bool
+	Timeout time.Duration
+}
+
+// XPendingSummary sums up the pending entries of a consumer group.
+type XPendingSummary struct {
+	Count int
+	// Lower and Higher are the smallest and the greatest pending ids, zero if Count is 0.
+	Lower     StreamID
+	Higher    StreamID
+	Consumers map[string]int
+}
+
+// XPendingArgs are the options of XPendingExt.
+type XPendingArgs struct {
+	// Start and End are the range of ids like XRange, "-" and "+" if they are empty.
+	Start string
+	End   string
+	// Count limits the number of entries returned if it is positive.
+	Count int
+	// Consumer only returns the entries of the consumer if it is not nil.
+	Consumer []byte
+	// Idle only returns the entries delivered at least Idle ago.
+	Idle time.Duration
+}
+
+// XPendingEntry is an entry delivered to a consumer but not acknowledged yet.
+type XPendingEntry struct {
+	ID            StreamID
+	Consumer      []byte
+	Idle          time.Duration
+	DeliveryCount int64
+}
+
+type stream struct {
+	tree   *ds.AdaptiveRadixTree
+	length int
+	// lastID is kept after the entries holding it are removed, so that new ids are still greater.
+	lastID StreamID
+	groups map[string]*streamGroup
+}
+
+type streamGroup struct {
+	lastID  StreamID // the last id delivered to the group
+	pending map[StreamID]*streamPending
+}
+
+type streamPending struct {
+	consumer    string
+	deliveredAt int64 // unix time in milliseconds
+	count       int64
+}
+
+// String returns the id like "<ms>-<seq>".
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less reports whether id is smaller than other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// next returns the smallest id greater than id, and false if there is none.
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// prev returns the greatest id smaller than id, and false if there is none.
+func (id StreamID) prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// ParseStreamID parses an id like "<ms>-<seq>", or "<ms>" whose sequence number is 0.
+func ParseStreamID(s string) (StreamID, error) {
+	return parseStreamID(s, 0)
+}
+
+// parseStreamID parses an id, seq is the sequence number if it is missing.
+func parseStreamID(s string, seq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// parseStreamBound parses a bound of a range of ids like XRange, and returns it as an inclusive bound.
+// It reports false if an exclusive bound leaves no id in the range.
+func parseStreamBound(s string, isEnd bool) (StreamID, bool, error) {
+	switch s {
+	case "-":
+		return StreamID{}, true, nil
+	case "+":
+		return maxStreamID, true, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	var seq uint64
+	if isEnd {
+		seq = math.MaxUint64
+	}
+	id, err := parseStreamID(s, seq)
+	if err != nil || !exclusive {
+		return id, err == nil, err
+	}
+	if isEnd {
+		id, ok := id.prev()
+		return id, ok, nil
+	}
+	id, ok := id.next()
+	return id, ok, nil
+}
+
+// parseStreamRange parses the bounds of a range of ids, and reports false if the range is empty.
+func parseStreamRange(start, end string) (StreamID, StreamID, bool, error) {
+	first, ok, err := parseStreamBound(start, false)
+	if err != nil || !ok {
+		return first, first, false, err
+	}
+	last, ok, err := parseStreamBound(end, true)
+	if err != nil || !ok {
+		return first, last, false, err
+	}
+	return first, last, !last.Less(first), nil
+}
+
+// nextStreamID returns the id of a new entry given like XAddArgs.ID, which must be greater than last.
+func nextStreamID(s string, last StreamID) (StreamID, error) {
+	if s == "" || s == "*" {
+		ms := uint64(time.Now().UnixMilli())
+		if ms > last.Ms {
+			return StreamID{Ms: ms}, nil
+		}
+		if id, ok := last.next(); ok {
+			return id, nil
+		}
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+	if strings.HasSuffix(s, "-*") {
+		ms, err := strconv.ParseUint(strings.TrimSuffix(s, "-*"), 10, 64)
+		if err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+		if ms > last.Ms {
+			return StreamID{Ms: ms}, nil
+		}
+		if ms == last.Ms && last.Seq < math.MaxUint64 {
+			return StreamID{Ms: ms, Seq: last.Seq + 1}, nil
+		}
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+	id, err := ParseStreamID(s)
+	if err != nil {
+		return StreamID{}, err
+	}
+	if !last.Less(id) {
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+	return id, nil
+}
+
+func encodeStreamID(id StreamID) []byte {
+	buf := make([]byte, streamIDSize)
+	binary.BigEndian.PutUint64(buf[:8], id.Ms)
+	binary.BigEndian.PutUint64(buf[8:], id.Seq)
+	return buf
+}
+
+func decodeStreamID(buf []byte) StreamID {
+	if len(buf) < streamIDSize {
+		return StreamID{}
+	}
+	return StreamID{Ms: binary.BigEndian.Uint64(buf[:8]), Seq: binary.BigEndian.Uint64(buf[8:streamIDSize])}
+}
+
+// entry ids are big endian, so that the entries are ordered by id in the tree.
+func streamEntryKey(id StreamID) []byte {
+	return append([]byte{streamKindEntry}, encodeStreamID(id)...)
+}
+
+func streamGroupKey(group []byte) []byte {
+	return append([]byte{streamKindGroup}, group...)
+}
+
+func streamPendingKey(id StreamID, group []byte) []byte {
+	subKey := append([]byte{streamKindPending}, encodeStreamID(id)...)
+	return append(subKey, group...)
+}
+
+// encodeStreamFields encodes fields and values, each one prefixed by its length.
+func encodeStreamFields(fields [][]byte) []byte {
+	var size int
+	for _, f := range fields {
+		size += binary.MaxVarintLen64 + len(f)
+	}
+	buf := make([]byte, size)
+	var index int
+	for _, f := range fields {
+		index += binary.PutUvarint(buf[index:], uint64(len(f)))
+		index += copy(buf[index:], f)
+	}
+	return buf[:index]
+}
+
+func decodeStreamFields(buf []byte) [][]byte {
+	var fields [][]byte
+	for len(buf) > 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			break
+		}
+		fields = append(fields, buf[n:n+int(size)])
+		buf = buf[n+int(size):]
+	}
+	return fields
+}
+
+func encodeStreamPending(p *streamPending) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(p.consumer)+16)
+	index := binary.PutUvarint(buf, uint64(len(p.consumer)))
+	index += copy(buf[index:], p.consumer)
+	binary.BigEndian.PutUint64(buf[index:], uint64(p.deliveredAt))
+	binary.BigEndian.PutUint64(buf[index+8:], uint64(p.count))
+	return buf[:index+16]
+}
+
+func decodeStreamPending(buf []byte) *streamPending {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size+16 {
+		return &streamPending{}
+	}
+	buf = buf[n:]
+	return &streamPending{
+		consumer:    string(buf[:size]),
+		deliveredAt: int64(binary.BigEndian.Uint64(buf[size : size+8])),
+		count:       int64(binary.BigEndian.Uint64(buf[size+8 : size+16])),
+	}
+}
+
+// buildStreamIndex applies a stream entry to the index, and returns the index value it replaced.
+func (db *LazyDB) buildStreamIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeStream, entry, vPos)
+	}
+	return db.applyStreamEntry(entry, vPos)
+}
+
+// applyStreamEntry applies a stream entry to the tree of the stream and to its decoded state,
+// and returns the index value it replaced. A stream whose tree is emptied is removed from the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) applyStreamEntry(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	key, subKey := decodeKey(entry.Key)
+	if len(subKey) == 0 {
+		return nil
+	}
+	s := db.streamIndex.streams[string(key)]
+	deleted := entry.Stat == logfile.SDelete
+	if s == nil {
+		if deleted {
+			return nil
+		}
+		s = &stream{tree: ds.NewART(), groups: make(map[string]*streamGroup)}
+		db.indexCollectionKey(valueTypeStream, key)
+		db.streamIndex.streams[string(key)] = s
+	}
+
+	var oldVal interface{}
+	if deleted {
+		oldVal, _ = s.tree.Delete(subKey)
+	} else {
+		oldVal, _ = s.tree.Put(subKey, &Value{fid: vPos.fid, offset: vPos.offset, entrySize: vPos.entrySize})
+	}
+	switch subKey[0] {
+	case streamKindEntry:
+		id := decodeStreamID(subKey[1:])
+		if deleted && oldVal != nil {
+			s.length--
+		} else if !deleted && oldVal == nil {
+			s.length++
+		}
+		if !deleted {
+			if s.lastID.Less(id) {
+				s.lastID = id
+			}
+			db.wakeStreamReaders()
+		}
+	case streamKindMeta:
+		if id := decodeStreamID(entry.Value); !deleted && s.lastID.Less(id) {
+			s.lastID = id
+		}
+	case streamKindGroup:
+		name := string(subKey[1:])
+		if deleted {
+			delete(s.groups, name)
+			break
+		}
+		g := s.groups[name]
+		if g == nil {
+			g = &streamGroup{pending: make(map[StreamID]*streamPending)}
+			s.groups[name] = g
+		}
+		g.lastID = decodeStreamID(entry.Value)
+	case streamKindPending:
+		if len(subKey) < 1+streamIDSize {
+			break
+		}
+		g := s.groups[string(subKey[1+streamIDSize:])]
+		if g == nil {
+			break
+		}
+		id := decodeStreamID(subKey[1:])
+		if deleted {
+			delete(g.pending, id)
+		} else {
+			g.pending[id] = decodeStreamPending(entry.Value)
+		}
+	}
+	if s.tree.Size() == 0 {
+		db.unindexCollectionKey(valueTypeStream, key)
+		delete(db.streamIndex.streams, string(key))
+	}
+	return oldVal
+}
+
+// writeStreamEntries writes entries of streams in one batch, and applies them to the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) writeStreamEntries(entries []*logfile.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	valPos, err := db.writeLogEntries(valueTypeStream, entries)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		oldVal := db.applyStreamEntry(entry, valPos[i])
+		db.sendDiscard(oldVal, true, valueTypeStream)
+		if entry.Stat == logfile.SDelete {
+			db.sendDiscard(&Value{fid: valPos[i].fid, entrySize: valPos[i].entrySize}, true, valueTypeStream)
+		}
+		db.notifyChange(valueTypeStream, entry)
+	}
+	return nil
+}
+
+// wakeStreamReaders wakes the readers blocked on any stream. The caller must hold the write lock of the index.
+func (db *LazyDB) wakeStreamReaders() {
+	close(db.streamIndex.added)
+	db.streamIndex.added = make(chan struct{})
+}
+
+// cancelStreamReaders wakes the blocked readers, which return ErrDatabaseClosed.
+func (db *LazyDB) cancelStreamReaders() {
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+	db.streamIndex.closed = true
+	db.wakeStreamReaders()
+}
+
+// getStream returns the stream stored at key, or nil if it does not exist or has expired.
+// The caller must hold the lock of the index.
+func (db *LazyDB) getStream(key []byte) *stream {
+	if db.keyExpired(valueTypeStream, key) {
+		return nil
+	}
+	return db.streamIndex.streams[util.ByteToString(key)]
+}
+
+// rangeKeys returns the sub keys of at most count entries with ids between first and last inclusive,
+// in descending order if rev is true. All entries in the range are returned if count is not positive.
+// The walk seeks to the bound it starts from, and stops at the other one.
+func (s *stream) rangeKeys(first, last StreamID, count int, rev bool) (keys [][]byte) {
+	if last.Less(first) {
+		return nil
+	}
+	collect := func(subKey []byte, _ interface{}) bool {
+		// entries come first in the tree, so the walk stops at the first sub key of another kind.
+		if subKey[0] != streamKindEntry {
+			return false
+		}
+		if id := decodeStreamID(subKey[1:]); id.Less(first) || last.Less(id) {
+			return false
+		}
+		keys = append(keys, subKey)
+		return count <= 0 || len(keys) < count
+	}
+	if rev {
+		s.tree.Descend(append(streamEntryKey(last), 0), collect)
+	} else {
+		s.tree.Ascend(streamEntryKey(first), collect)
+	}
+	return keys
+}
+
+// streamEntries reads the entries of the given sub keys. The caller must hold the lock of the index.
+func (db *LazyDB) streamEntries(s *stream, keys [][]byte) ([]*StreamEntry, error) {
+	entries := make([]*StreamEntry, 0, len(keys))
+	for _, subKey := range keys {
+		val, err := db.getValue(s.tree, subKey, valueTypeStream)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &StreamEntry{ID: decodeStreamID(subKey[1:]), Fields: decodeStreamFields(val)})
+	}
+	return entries, nil
+}
+
+// XAdd appends an entry with the given fields and values to the stream stored at key, and returns its id.
+// The stream is created if it does not exist, unless args.NoMkStream is true.
+func (db *LazyDB) XAdd(key []byte, args XAddArgs, fields ...[]byte) (StreamID, error) {
+	if len(fields) == 0 || len(fields)&1 == 1 {
+		return StreamID{}, ErrInvalidParam
+	}
+	var minID *StreamID
+	if args.MinID != "" {
+		id, err := ParseStreamID(args.MinID)
+		if err != nil {
+			return StreamID{}, err
+		}
+		minID = &id
+	}
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeStream, key); err != nil {
+		return StreamID{}, err
+	}
+
+	var last StreamID
+	if s := db.streamIndex.streams[string(key)]; s != nil {
+		last = s.lastID
+	} else if args.NoMkStream {
+		return StreamID{}, ErrKeyNotFound
+	}
+	id, err := nextStreamID(args.ID, last)
+	if err != nil {
+		return StreamID{}, err
+	}
+	entry := &logfile.LogEntry{Key: encodeKey(key, streamEntryKey(id)), Value: encodeStreamFields(fields)}
+	if err := db.writeStreamEntries([]*logfile.LogEntry{entry}); err != nil {
+		return StreamID{}, err
+	}
+	db.notifyKeyspaceEvent(notifyStream, "xadd", key)
+	if _, err := db.xTrim(key, args.MaxLen, minID); err != nil {
+		return StreamID{}, err
+	}
+	return id, nil
+}
+
+// XTrim removes the oldest entries of the stream stored at key beyond maxLen if it is positive,
+// and the entries with an id lower than minID if it is not empty. It returns the number of entries removed.
+func (db *LazyDB) XTrim(key []byte, maxLen int, minID string) (int, error) {
+	var min *StreamID
+	if minID != "" {
+		id, err := ParseStreamID(minID)
+		if err != nil {
+			return 0, err
+		}
+		min = &id
+	}
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeStream, key); err != nil {
+		return 0, err
+	}
+	return db.xTrim(key, maxLen, min)
+}
+
+// xTrim removes the entries of the stream like XTrim. The caller must hold the write lock of the index.
+func (db *LazyDB) xTrim(key []byte, maxLen int, minID *StreamID) (int, error) {
+	s := db.streamIndex.streams[string(key)]
+	if s == nil {
+		return 0, nil
+	}
+	// both trims remove the oldest entries, so the longer one covers the other.
+	var keys [][]byte
+	if maxLen > 0 && s.length > maxLen {
+		keys = s.rangeKeys(StreamID{}, maxStreamID, s.length-maxLen, false)
+	}
+	if minID != nil {
+		if below, ok := minID.prev(); ok {
+			if byMinID := s.rangeKeys(StreamID{}, below, 0, false); len(byMinID) > len(keys) {
+				keys = byMinID
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	entries := make([]*logfile.LogEntry, 0, len(keys)+1)
+	// the last id is written first, it outlives the entries and keeps the stream alive if they are all removed.
+	entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, []byte{streamKindMeta}), Value: encodeStreamID(s.lastID)})
+	for _, subKey := range keys {
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, subKey), Stat: logfile.SDelete})
+	}
+	if err := db.writeStreamEntries(entries); err != nil {
+		return 0, err
+	}
+	db.notifyKeyspaceEvent(notifyStream, "xtrim", key)
+	return len(keys), nil
+}
+
+// XLen returns the number of entries of the stream stored at key.
+func (db *LazyDB) XLen(key []byte) int {
+	db.streamIndex.mu.RLock()
+	defer db.streamIndex.mu.RUnlock()
+
+	s := db.getStream(key)
+	if s == nil {
+		return 0
+	}
+	return s.length
+}
+
+// XRange returns at most count entries of the stream stored at key with ids between start and end in ascending order.
+// "-" and "+" are the smallest and the greatest ids, a bound prefixed by "(" is exclusive,
+// and a bound without sequence number like "<ms>" covers all the ids of ms. All entries are returned if count is not positive.
+func (db *LazyDB) XRange(key []byte, start, end string, count int) ([]*StreamEntry, error) {
+	return db.xRange(key, start, end, count, false)
+}
+
+// XRevRange is the same as XRange, but the entries are returned in descending order.
+func (db *LazyDB) XRevRange(key []byte, end, start string, count int) ([]*StreamEntry, error) {
+	return db.xRange(key, start, end, count, true)
+}
+
+func (db *LazyDB) xRange(key []byte, start, end string, count int, rev bool) ([]*StreamEntry, error) {
+	first, last, ok, err := parseStreamRange(start, end)
+	if err != nil || !ok {
+		return nil, err
+	}
+	db.streamIndex.mu.RLock()
+	defer db.streamIndex.mu.RUnlock()
+
+	s := db.getStream(key)
+	if s == nil {
+		return nil, nil
+	}
+	return db.streamEntries(s, s.rangeKeys(first, last, count, rev))
+}
+
+// XRead returns the entries of the given streams with ids greater than the given ones.
+// Only the streams with entries are returned. If there are none and args.Block is true,
+// it waits until an entry is added or args.Timeout passes, and returns nil after the timeout.
+func (db *LazyDB) XRead(args XReadArgs) ([]*XStream, error) {
+	ctx, cancel := timeoutContext(args.Timeout)
+	defer cancel()
+	streams, err := db.xRead(ctx, args)
+	if err == context.DeadlineExceeded {
+		return nil, nil
+	}
+	return streams, err
+}
+
+// XReadContext is the same as XRead, but it waits until ctx is done instead of args.Timeout, and returns its error.
+func (db *LazyDB) XReadContext(ctx context.Context, args XReadArgs) ([]*XStream, error) {
+	return db.xRead(ctx, args)
+}
+
+func (db *LazyDB) xRead(ctx context.Context, args XReadArgs) ([]*XStream, error) {
+	if len(args.Streams) == 0 || len(args.Streams) != len(args.IDs) {
+		return nil, ErrInvalidParam
+	}
+	after := make([]StreamID, len(args.IDs))
+	for i, id := range args.IDs {
+		if id == "$" {
+			continue
+		}
+		var err error
+		if after[i], err = ParseStreamID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	db.streamIndex.mu.RLock()
+	// "$" is resolved once, so that entries added while blocked are read.
+	for i, id := range args.IDs {
+		if s := db.getStream(args.Streams[i]); id == "$" && s != nil {
+			after[i] = s.lastID
+		}
+	}
+	for {
+		var streams []*XStream
+		for i, key := range args.Streams {
+			s := db.getStream(key)
+			first, ok := after[i].next()
+			if s == nil || !ok {
+				continue
+			}
+			entries, err := db.streamEntries(s, s.rangeKeys(first, maxStreamID, args.Count, false))
+			if err != nil {
+				db.streamIndex.mu.RUnlock()
+				return nil, err
+			}
+			if len(entries) > 0 {
+				streams = append(streams, &XStream{Key: key, Entries: entries})
+			}
+		}
+		if len(streams) > 0 || !args.Block {
+			db.streamIndex.mu.RUnlock()
+			return streams, nil
+		}
+		if err := db.waitStreamEntries(ctx, true); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitStreamEntries releases the lock of the index held by a reader, waits until entries are added
+// to any stream or ctx is done, and takes the lock again unless it returns an error.
+func (db *LazyDB) waitStreamEntries(ctx context.Context, read bool) error {
+	closed, added := db.streamIndex.closed, db.streamIndex.added
+	if read {
+		db.streamIndex.mu.RUnlock()
+	} else {
+		db.streamIndex.mu.Unlock()
+	}
+	if closed {
+		return ErrDatabaseClosed
+	}
+	select {
+	case <-added:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if read {
+		db.streamIndex.mu.RLock()
+	} else {
+		db.streamIndex.mu.Lock()
+	}
+	return nil
+}
+
+// XGroupCreate creates a consumer group of the stream stored at key, which starts reading after id.
+// "$" is the last id of the stream. If the stream does not exist, it is created empty if mkStream is true,
+// or ErrKeyNotFound is returned.
+func (db *LazyDB) XGroupCreate(key, group []byte, id string, mkStream bool) error {
+	var lastID StreamID
+	if id != "$" {
+		var err error
+		if lastID, err = ParseStreamID(id); err != nil {
+			return err
+		}
+	}
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeStream, key); err != nil {
+		return err
+	}
+
+	var entries []*logfile.LogEntry
+	s := db.streamIndex.streams[string(key)]
+	switch {
+	case s == nil && !mkStream:
+		return ErrKeyNotFound
+	case s == nil:
+		// the empty stream lives on the last id, like a stream whose entries have all been trimmed.
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, []byte{streamKindMeta}), Value: encodeStreamID(StreamID{})})
+	case s.groups[string(group)] != nil:
+		return ErrStreamGroupExists
+	case id == "$":
+		lastID = s.lastID
+	}
+	entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, streamGroupKey(group)), Value: encodeStreamID(lastID)})
+	if err := db.writeStreamEntries(entries); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-create", key)
+	return nil
+}
+
+// XGroupDestroy removes the consumer group with its pending entries, and reports whether it existed.
+func (db *LazyDB) XGroupDestroy(key, group []byte) (bool, error) {
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+
+	s := db.getStream(key)
+	if s == nil || s.groups[string(group)] == nil {
+		return false, nil
+	}
+	g := s.groups[string(group)]
+	entries := make([]*logfile.LogEntry, 0, len(g.pending)+1)
+	for id := range g.pending {
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, streamPendingKey(id, group)), Stat: logfile.SDelete})
+	}
+	entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, streamGroupKey(group)), Stat: logfile.SDelete})
+	if err := db.writeStreamEntries(entries); err != nil {
+		return false, err
+	}
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key)
+	return true, nil
+}
+
+// XReadGroup reads the entries of the given streams for a consumer of a group.
+// The new entries read with ">" are delivered to the consumer and added to the pending entries of the group
+// until they are acknowledged by XAck, unless args.NoAck is true. It returns ErrStreamGroupNotFound
+// if a stream does not have the group. Blocking works like XRead when all ids are ">".
+func (db *LazyDB) XReadGroup(args XReadGroupArgs) ([]*XStream, error) {
+	ctx, cancel := timeoutContext(args.Timeout)
+	defer cancel()
+	streams, err := db.xReadGroup(ctx, args)
+	if err == context.DeadlineExceeded {
+		return nil, nil
+	}
+	return streams, err
+}
+
+// XReadGroupContext is the same as XReadGroup, but it waits until ctx is done instead of args.Timeout, and returns its error.
+func (db *LazyDB) XReadGroupContext(ctx context.Context, args XReadGroupArgs) ([]*XStream, error) {
+	return db.xReadGroup(ctx, args)
+}
+
+func (db *LazyDB) xReadGroup(ctx context.Context, args XReadGroupArgs) ([]*XStream, error) {
+	if len(args.Streams) == 0 || len(args.Streams) != len(args.IDs) || len(args.Consumer) == 0 {
+		return nil, ErrInvalidParam
+	}
+	// a nil id reads the new entries
+	after := make([]*StreamID, len(args.IDs))
+	block := args.Block
+	for i, id := range args.IDs {
+		if id == ">" {
+			continue
+		}
+		parsed, err := ParseStreamID(id)
+		if err != nil {
+			return nil, err
+		}
+		after[i], block = &parsed, false
+	}
+
+	db.streamIndex.mu.Lock()
+	for {
+		streams, err := db.xReadGroupOnce(args, after)
+		if err != nil || len(streams) > 0 || !block {
+			db.streamIndex.mu.Unlock()
+			return streams, err
+		}
+		if err := db.waitStreamEntries(ctx, false); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// xReadGroupOnce reads the entries for XReadGroup without blocking. The caller must hold the write lock of the index.
+func (db *LazyDB) xReadGroupOnce(args XReadGroupArgs, after []*StreamID) ([]*XStream, error) {
+	groups := make([]*streamGroup, len(args.Streams))
+	for i, key := range args.Streams {
+		s := db.getStream(key)
+		if s == nil || s.groups[string(args.Group)] == nil {
+			return nil, ErrStreamGroupNotFound
+		}
+		groups[i] = s.groups[string(args.Group)]
+	}
+
+	var streams []*XStream
+	now := time.Now().UnixMilli()
+	for i, key := range args.Streams {
+		s, g := db.getStream(key), groups[i]
+		if after[i] != nil {
+			entries, err := db.pendingEntries(s, g, string(args.Consumer), *after[i], args.Count)
+			if err != nil {
+				return nil, err
+			}
+			streams = append(streams, &XStream{Key: key, Entries: entries})
+			continue
+		}
+
+		first, ok := g.lastID.next()
+		if !ok {
+			continue
+		}
+		keys := s.rangeKeys(first, maxStreamID, args.Count, false)
+		if len(keys) == 0 {
+			continue
+		}
+		entries, err := db.streamEntries(s, keys)
+		if err != nil {
+			return nil, err
+		}
+		logEntries := []*logfile.LogEntry{{Key: encodeKey(key, streamGroupKey(args.Group)), Value: keys[len(keys)-1][1:]}}
+		if !args.NoAck {
+			for _, entry := range entries {
+				p := &streamPending{consumer: string(args.Consumer), deliveredAt: now, count: 1}
+				logEntries = append(logEntries, &logfile.LogEntry{
+					Key:   encodeKey(key, streamPendingKey(entry.ID, args.Group)),
+					Value: encodeStreamPending(p),
+				})
+			}
+		}
+		if err := db.writeStreamEntries(logEntries); err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			streams = append(streams, &XStream{Key: key, Entries: entries})
+		}
+	}
+	return streams, nil
+}
+
+// pendingEntries returns at most count pending entries of consumer with ids greater than after.
+// Entries removed from the stream are returned without fields. The caller must hold the lock of the index.
+func (db *LazyDB) pendingEntries(s *stream, g *streamGroup, consumer string, after StreamID, count int) ([]*StreamEntry, error) {
+	var ids []StreamID
+	for id, p := range g.pending {
+		if p.consumer == consumer && after.Less(id) {
+			ids = append(ids, id)
+		}
+	}
+	sortStreamIDs(ids)
+	if count > 0 && len(ids) > count {
+		ids = ids[:count]
+	}
+	entries := make([]*StreamEntry, 0, len(ids))
+	for _, id := range ids {
+		val, err := db.getValue(s.tree, streamEntryKey(id), valueTypeStream)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		entries = append(entries, &StreamEntry{ID: id, Fields: decodeStreamFields(val)})
+	}
+	return entries, nil
+}
+
+// XAck acknowledges the pending entries of a consumer group, and returns the number of entries acknowledged.
+func (db *LazyDB) XAck(key, group []byte, ids ...StreamID) (int, error) {
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+
+	s := db.getStream(key)
+	if s == nil {
+		return 0, nil
+	}
+	g := s.groups[string(group)]
+	if g == nil {
+		return 0, ErrStreamGroupNotFound
+	}
+	var entries []*logfile.LogEntry
+	acked := make(map[StreamID]struct{})
+	for _, id := range ids {
+		if _, ok := acked[id]; ok || g.pending[id] == nil {
+			continue
+		}
+		acked[id] = struct{}{}
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, streamPendingKey(id, group)), Stat: logfile.SDelete})
+	}
+	if err := db.writeStreamEntries(entries); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// XPending sums up the pending entries of a consumer group.
+func (db *LazyDB) XPending(key, group []byte) (*XPendingSummary, error) {
+	db.streamIndex.mu.RLock()
+	defer db.streamIndex.mu.RUnlock()
+
+	g, err := db.getStreamGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+	summary := &XPendingSummary{Count: len(g.pending), Consumers: make(map[string]int)}
+	first := true
+	for id, p := range g.pending {
+		summary.Consumers[p.consumer]++
+		if first || id.Less(summary.Lower) {
+			summary.Lower = id
+		}
+		if first || summary.Higher.Less(id) {
+			summary.Higher = id
+		}
+		first = false
+	}
+	return summary, nil
+}
+
+// XPendingExt returns the pending entries of a consumer group in ascending order of id.
+func (db *LazyDB) XPendingExt(key, group []byte, args XPendingArgs) ([]*XPendingEntry, error) {
+	if args.Start == "" {
+		args.Start = "-"
+	}
+	if args.End == "" {
+		args.End = "+"
+	}
+	first, last, ok, err := parseStreamRange(args.Start, args.End)
+	if err != nil {
+		return nil, err
+	}
+	db.streamIndex.mu.RLock()
+	defer db.streamIndex.mu.RUnlock()
+
+	g, err := db.getStreamGroup(key, group)
+	if err != nil || !ok {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	var ids []StreamID
+	for id, p := range g.pending {
+		if id.Less(first) || last.Less(id) || (args.Consumer != nil && p.consumer != string(args.Consumer)) {
+			continue
+		}
+		if time.Duration(now-p.deliveredAt)*time.Millisecond < args.Idle {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sortStreamIDs(ids)
+	if args.Count > 0 && len(ids) > args.Count {
+		ids = ids[:args.Count]
+	}
+	entries := make([]*XPendingEntry, 0, len(ids))
+	for _, id := range ids {
+		p := g.pending[id]
+		entries = append(entries, &XPendingEntry{
+			ID:            id,
+			Consumer:      []byte(p.consumer),
+			Idle:          time.Duration(now-p.deliveredAt) * time.Millisecond,
+			DeliveryCount: p.count,
+		})
+	}
+	return entries, nil
+}
+
+// XClaim transfers the pending entries idle for at least minIdle to consumer, and returns them.
+// Their idle time is reset and their delivery count is incremented.
+// Pending entries removed from the stream are acknowledged instead of being returned.
+func (db *LazyDB) XClaim(key, group, consumer []byte, minIdle time.Duration, ids ...StreamID) ([]*StreamEntry, error) {
+	if len(consumer) == 0 {
+		return nil, ErrInvalidParam
+	}
+	db.streamIndex.mu.Lock()
+	defer db.streamIndex.mu.Unlock()
+
+	g, err := db.getStreamGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+	s := db.getStream(key)
+	now := time.Now().UnixMilli()
+	var claimed []*StreamEntry
+	var logEntries []*logfile.LogEntry
+	seen := make(map[StreamID]struct{})
+	for _, id := range ids {
+		p := g.pending[id]
+		if _, ok := seen[id]; ok || p == nil || time.Duration(now-p.deliveredAt)*time.Millisecond < minIdle {
+			continue
+		}
+		seen[id] = struct{}{}
+		pendingKey := encodeKey(key, streamPendingKey(id, group))
+		val, err := db.getValue(s.tree, streamEntryKey(id), valueTypeStream)
+		if err == ErrKeyNotFound {
+			logEntries = append(logEntries, &logfile.LogEntry{Key: pendingKey, Stat: logfile.SDelete})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		claim := &streamPending{consumer: string(consumer), deliveredAt: now, count: p.count + 1}
+		logEntries = append(logEntries, &logfile.LogEntry{Key: pendingKey, Value: encodeStreamPending(claim)})
+		claimed = append(claimed, &StreamEntry{ID: id, Fields: decodeStreamFields(val)})
+	}
+	if err := db.writeStreamEntries(logEntries); err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// getStreamGroup returns the consumer group of the stream stored at key,
+// or ErrStreamGroupNotFound if either does not exist. The caller must hold the lock of the index.
+func (db *LazyDB) getStreamGroup(key, group []byte) (*streamGroup, error) {
+	s := db.getStream(key)
+	if s == nil || s.groups[string(group)] == nil {
+		return nil, ErrStreamGroupNotFound
+	}
+	return s.groups[string(group)], nil
+}
+
+// copyStream writes all entries, consumer groups and pending entries of the stream stored at src to dst.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) copyStream(src, dst []byte) error {
+	s := db.streamIndex.streams[string(src)]
+	var entries []*logfile.LogEntry
+	// groups come before their pending entries in the tree, so they are applied first.
+	for _, subKey := range treeKeys(s.tree) {
+		val, err := db.getValue(s.tree, subKey, valueTypeStream)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(dst, subKey), Value: val})
+	}
+	return db.writeStreamEntries(entries)
+}
+
+func sortStreamIDs(ids []StreamID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Less(ids[j])
+	})
+}
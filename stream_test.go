@@ -0,0 +1,429 @@
+package lazydb
+
+import (
+	"context"
+	"lazydb/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestStreamDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_stream")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func streamIDs(entries []*StreamEntry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ID.String())
+	}
+	return ids
+}
+
+func TestLazyDB_XAdd(t *testing.T) {
+	db := initTestStreamDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("s")
+	id, err := db.XAdd(key, XAddArgs{ID: "5-1"}, []byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.Equal(t, StreamID{Ms: 5, Seq: 1}, id)
+
+	tests := []struct {
+		name    string
+		args    XAddArgs
+		fields  [][]byte
+		want    string
+		wantErr error
+	}{
+		{"equal id", XAddArgs{ID: "5-1"}, [][]byte{[]byte("f"), []byte("v")}, "", ErrStreamIDTooSmall},
+		{"smaller id", XAddArgs{ID: "4"}, [][]byte{[]byte("f"), []byte("v")}, "", ErrStreamIDTooSmall},
+		{"invalid id", XAddArgs{ID: "a-1"}, [][]byte{[]byte("f"), []byte("v")}, "", ErrInvalidStreamID},
+		{"odd fields", XAddArgs{}, [][]byte{[]byte("f")}, "", ErrInvalidParam},
+		{"generated seq", XAddArgs{ID: "5-*"}, [][]byte{[]byte("f"), []byte("v")}, "5-2", nil},
+		{"generated seq new ms", XAddArgs{ID: "7-*"}, [][]byte{[]byte("f"), []byte("v")}, "7-0", nil},
+		{"explicit", XAddArgs{ID: "7-5"}, [][]byte{[]byte("a"), []byte("1"), []byte("b"), []byte("2")}, "7-5", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := db.XAdd(key, tt.args, tt.fields...)
+			assert.Equal(t, tt.wantErr, err)
+			if err == nil {
+				assert.Equal(t, tt.want, id.String())
+			}
+		})
+	}
+	assert.Equal(t, 4, db.XLen(key))
+
+	// generated ids come after the last one even if the clock is behind it
+	_, _ = db.XAdd([]byte("future"), XAddArgs{ID: "99999999999999-3"}, []byte("f"), []byte("v"))
+	id, err = db.XAdd([]byte("future"), XAddArgs{}, []byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.Equal(t, "99999999999999-4", id.String())
+
+	id, err = db.XAdd([]byte("now"), XAddArgs{}, []byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().UnixMilli(), int64(id.Ms), 1000)
+
+	_, err = db.XAdd([]byte("missing"), XAddArgs{NoMkStream: true}, []byte("f"), []byte("v"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, DataTypeStream, db.Type(key))
+	assert.Equal(t, DataTypeNone, db.Type([]byte("missing")))
+}
+
+func TestLazyDB_XTrim(t *testing.T) {
+	db := initTestStreamDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	key := []byte("s")
+	for i := 1; i <= 10; i++ {
+		_, err := db.XAdd(key, XAddArgs{ID: StreamID{Ms: uint64(i)}.String(), MaxLen: 5}, []byte("f"), []byte("v"))
+		assert.NoError(t, err)
+	}
+	entries, err := db.XRange(key, "-", "+", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"6-0", "7-0", "8-0", "9-0", "10-0"}, streamIDs(entries))
+
+	_, err = db.XAdd(key, XAddArgs{ID: "11", MinID: "9"}, []byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	entries, _ = db.XRange(key, "-", "+", 0)
+	assert.Equal(t, []string{"9-0", "10-0", "11-0"}, streamIDs(entries))
+
+	// trimming every entry keeps the stream and its last id
+	n, err := db.XTrim(key, 0, "100")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 0, db.XLen(key))
+	assert.Equal(t, DataTypeStream, db.Type(key))
+	_, err = db.XAdd(key, XAddArgs{ID: "11-0"}, []byte("f"), []byte("v"))
+	assert.Equal(t, ErrStreamIDTooSmall, err)
+
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, db.XLen(key))
+	id, err := db.XAdd(key, XAddArgs{ID: "11-*"}, []byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.Equal(t, "11-1", id.String())
+}
+
+func TestLazyDB_XRange(t *testing.T) {
+	db := initTestStreamDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("s")
+	for _, id := range []string{"1-0", "1-1", "2-0", "3-0", "3-1", "3-2"} {
+		_, err := db.XAdd(key, XAddArgs{ID: id}, []byte("id"), []byte(id))
+		assert.NoError(t, err)
+	}
+
+	tests := []struct {
+		name       string
+		start, end string
+		count      int
+		rev        bool
+		want       []string
+	}{
+		{"all", "-", "+", 0, false, []string{"1-0", "1-1", "2-0", "3-0", "3-1", "3-2"}},
+		{"count", "-", "+", 2, false, []string{"1-0", "1-1"}},
+		{"ms bounds", "1", "2", 0, false, []string{"1-0", "1-1", "2-0"}},
+		{"exclusive", "(1-1", "(3-2", 0, false, []string{"2-0", "3-0", "3-1"}},
+		{"empty", "3-3", "+", 0, false, []string{}},
+		{"reversed bounds", "3", "1", 0, false, []string{}},
+		{"rev", "-", "+", 0, true, []string{"3-2", "3-1", "3-0", "2-0", "1-1", "1-0"}},
+		{"rev count", "2", "+", 2, true, []string{"3-2", "3-1"}},
+		{"rev ms bounds", "1", "1", 0, true, []string{"1-1", "1-0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []*StreamEntry
+			var err error
+			if tt.rev {
+				entries, err = db.XRevRange(key, tt.end, tt.start, tt.count)
+			} else {
+				entries, err = db.XRange(key, tt.start, tt.end, tt.count)
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, streamIDs(entries))
+		})
+	}
+
+	entries, _ := db.XRange(key, "2", "2", 0)
+	assert.Equal(t, [][]byte{[]byte("id"), []byte("2-0")}, entries[0].Fields)
+	_, err := db.XRange(key, "x", "+", 0)
+	assert.Equal(t, ErrInvalidStreamID, err)
+	entries, err = db.XRange([]byte("missing"), "-", "+", 0)
+	assert.NoError(t, err)
+	assert.Nil(t, entries)
+}
+
+func TestLazyDB_XRead(t *testing.T) {
+	db := initTestStreamDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_, _ = db.XAdd([]byte("a"), XAddArgs{ID: "1"}, []byte("f"), []byte("1"))
+	_, _ = db.XAdd([]byte("a"), XAddArgs{ID: "2"}, []byte("f"), []byte("2"))
+	_, _ = db.XAdd([]byte("b"), XAddArgs{ID: "1"}, []byte("f"), []byte("1"))
+
+	streams, err := db.XRead(XReadArgs{Streams: [][]byte{[]byte("a"), []byte("b")}, IDs: []string{"1", "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(streams))
+	assert.Equal(t, "a", string(streams[0].Key))
+	assert.Equal(t, []string{"2-0"}, streamIDs(streams[0].Entries))
+
+	streams, err = db.XRead(XReadArgs{Streams: [][]byte{[]byte("a"), []byte("b")}, IDs: []string{"0", "0"}, Count: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(streams))
+	assert.Equal(t, []string{"1-0"}, streamIDs(streams[0].Entries))
+
+	_, err = db.XRead(XReadArgs{Streams: [][]byte{[]byte("a")}})
+	assert.Equal(t, ErrInvalidParam, err)
+
+	// a timeout returns nothing
+	start := time.Now()
+	streams, err = db.XRead(XReadArgs{Streams: [][]byte{[]byte("a")}, IDs: []string{"$"}, Block: true, Timeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Nil(t, streams)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// "$" reads the entries added while blocked
+	done := make(chan []*XStream)
+	go func() {
+		streams, err := db.XRead(XReadArgs{Streams: [][]byte{[]byte("b"), []byte("c")}, IDs: []string{"$", "$"}, Block: true})
+		assert.NoError(t, err)
+		done <- streams
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, _ = db.XAdd([]byte("a"), XAddArgs{ID: "3"}, []byte("f"), []byte("3"))
+	_, _ = db.XAdd([]byte("c"), XAddArgs{ID: "5"}, []byte("f"), []byte("5"))
+	select {
+	case streams = <-done:
+		assert.Equal(t, 1, len(streams))
+		assert.Equal(t, "c", string(streams[0].Key))
+		assert.Equal(t, []string{"5-0"}, streamIDs(streams[0].Entries))
+	case <-time.After(time.Second):
+		t.Fatal("blocked reader is not woken")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = db.XReadContext(ctx, XReadArgs{Streams: [][]byte{[]byte("d")}, IDs: []string{"$"}, Block: true})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestLazyDB_XReadGroup(t *testing.T) {
+	db := initTestStreamDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	key, group := []byte("s"), []byte("g")
+	assert.Equal(t, ErrKeyNotFound, db.XGroupCreate(key, group, "$", false))
+	assert.NoError(t, db.XGroupCreate(key, group, "$", true))
+	assert.Equal(t, ErrStreamGroupExists, db.XGroupCreate(key, group, "0", false))
+	assert.Equal(t, DataTypeStream, db.Type(key))
+	for _, id := range []string{"1", "2", "3"} {
+		_, _ = db.XAdd(key, XAddArgs{ID: id}, []byte("f"), []byte(id))
+	}
+
+	read := func(consumer, id string, count int) []string {
+		streams, err := db.XReadGroup(XReadGroupArgs{
+			Group: group, Consumer: []byte(consumer), Streams: [][]byte{key}, IDs: []string{id}, Count: count,
+		})
+		assert.NoError(t, err)
+		if len(streams) == 0 {
+			return nil
+		}
+		return streamIDs(streams[0].Entries)
+	}
+	assert.Equal(t, []string{"1-0", "2-0"}, read("alice", ">", 2))
+	assert.Equal(t, []string{"3-0"}, read("bob", ">", 0))
+	assert.Nil(t, read("bob", ">", 0))
+	// history of the consumer
+	assert.Equal(t, []string{"1-0", "2-0"}, read("alice", "0", 0))
+	assert.Equal(t, []string{"2-0"}, read("alice", "1", 0))
+	assert.Equal(t, []string{}, read("carol", "0", 0))
+
+	summary, err := db.XPending(key, group)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, summary.Count)
+	assert.Equal(t, "1-0", summary.Lower.String())
+	assert.Equal(t, "3-0", summary.Higher.String())
+	assert.Equal(t, map[string]int{"alice": 2, "bob": 1}, summary.Consumers)
+
+	n, err := db.XAck(key, group, StreamID{Ms: 1}, StreamID{Ms: 1}, StreamID{Ms: 9})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	pending, err := db.XPendingExt(key, group, XPendingArgs{Consumer: []byte("alice")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, "2-0", pending[0].ID.String())
+	assert.Equal(t, int64(1), pending[0].DeliveryCount)
+
+	_, err = db.XReadGroup(XReadGroupArgs{Group: []byte("none"), Consumer: []byte("c"), Streams: [][]byte{key}, IDs: []string{">"}})
+	assert.Equal(t, ErrStreamGroupNotFound, err)
+	_, err = db.XAck(key, []byte("none"), StreamID{Ms: 1})
+	assert.Equal(t, ErrStreamGroupNotFound, err)
+
+	// blocked group readers get new entries
+	done := make(chan []*XStream)
+	go func() {
+		streams, err := db.XReadGroup(XReadGroupArgs{
+			Group: group, Consumer: []byte("carol"), Streams: [][]byte{key}, IDs: []string{">"}, Block: true,
+		})
+		assert.NoError(t, err)
+		done <- streams
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, _ = db.XAdd(key, XAddArgs{ID: "4"}, []byte("f"), []byte("4"))
+	select {
+	case streams := <-done:
+		assert.Equal(t, []string{"4-0"}, streamIDs(streams[0].Entries))
+	case <-time.After(time.Second):
+		t.Fatal("blocked group reader is not woken")
+	}
+
+	// the group survives a reopen with its pending entries
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	summary, err = db.XPending(key, group)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"alice": 1, "bob": 1, "carol": 1}, summary.Consumers)
+	streams, err := db.XReadGroup(XReadGroupArgs{Group: group, Consumer: []byte("bob"), Streams: [][]byte{key}, IDs: []string{">"}})
+	assert.NoError(t, err)
+	assert.Nil(t, streams)
+
+	ok, err := db.XGroupDestroy(key, group)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, err = db.XPending(key, group)
+	assert.Equal(t, ErrStreamGroupNotFound, err)
+	assert.Equal(t, 4, db.XLen(key))
+}
+
+func TestLazyDB_XClaim(t *testing.T) {
+	db := initTestStreamDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key, group := []byte("s"), []byte("g")
+	for _, id := range []string{"1", "2", "3"} {
+		_, _ = db.XAdd(key, XAddArgs{ID: id}, []byte("f"), []byte(id))
+	}
+	assert.NoError(t, db.XGroupCreate(key, group, "0", false))
+	_, err := db.XReadGroup(XReadGroupArgs{Group: group, Consumer: []byte("alice"), Streams: [][]byte{key}, IDs: []string{">"}})
+	assert.NoError(t, err)
+
+	ids := []StreamID{{Ms: 1}, {Ms: 2}, {Ms: 3}}
+	claimed, err := db.XClaim(key, group, []byte("bob"), time.Hour, ids...)
+	assert.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	// a pending entry removed from the stream is acknowledged by the claim
+	_, _ = db.XTrim(key, 0, "2")
+	time.Sleep(20 * time.Millisecond)
+	claimedAt := time.Now()
+	claimed, err = db.XClaim(key, group, []byte("bob"), 10*time.Millisecond, ids...)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2-0", "3-0"}, streamIDs(claimed))
+	assert.Equal(t, [][]byte{[]byte("f"), []byte("2")}, claimed[0].Fields)
+
+	pending, err := db.XPendingExt(key, group, XPendingArgs{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(pending))
+	for _, p := range pending {
+		assert.Equal(t, "bob", string(p.Consumer))
+		assert.Equal(t, int64(2), p.DeliveryCount)
+		// the idle time is reset by the claim
+		assert.True(t, p.Idle <= time.Since(claimedAt)+time.Millisecond)
+	}
+	pending, err = db.XPendingExt(key, group, XPendingArgs{Start: "(2", Count: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pending))
+	pending, err = db.XPendingExt(key, group, XPendingArgs{Idle: time.Hour})
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestLazyDB_Stream_Keyspace(t *testing.T) {
+	db := initTestStreamDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("s")
+	_, _ = db.XAdd(key, XAddArgs{ID: "1"}, []byte("f"), []byte("v"))
+	assert.NoError(t, db.XGroupCreate(key, []byte("g"), "0", false))
+	_, _ = db.XReadGroup(XReadGroupArgs{Group: []byte("g"), Consumer: []byte("c"), Streams: [][]byte{key}, IDs: []string{">"}})
+
+	ok, err := db.Copy(key, []byte("copy"), false)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	entries, _ := db.XRange([]byte("copy"), "-", "+", 0)
+	assert.Equal(t, []string{"1-0"}, streamIDs(entries))
+	summary, err := db.XPending([]byte("copy"), []byte("g"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Count)
+
+	assert.NoError(t, db.Expire(key, time.Hour))
+	ttl, err := db.TTL(key)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+
+	n, err := db.Del(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, db.XLen(key))
+	assert.Equal(t, DataTypeNone, db.Type(key))
+	// a new stream starts over
+	id, err := db.XAdd(key, XAddArgs{ID: "0-1"}, []byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0-1", id.String())
+}
+
+func TestLazyDB_Stream_Merge(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_stream"))
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.NoError(t, err)
+	defer destroyDB(db)
+
+	key := []byte("s")
+	assert.NoError(t, db.XGroupCreate(key, []byte("g"), "$", true))
+	for i := 1; i <= 100; i++ {
+		_, err := db.XAdd(key, XAddArgs{ID: StreamID{Ms: uint64(i)}.String(), MaxLen: 3}, []byte("f"), GetValue(16))
+		assert.NoError(t, err)
+	}
+	_, err = db.XReadGroup(XReadGroupArgs{Group: []byte("g"), Consumer: []byte("c"), Streams: [][]byte{key}, IDs: []string{">"}, Count: 1})
+	assert.NoError(t, err)
+
+	fids := append([]uint32{}, db.fidsMap[valueTypeStream].fids...)
+	assert.True(t, len(fids) > 1)
+	// discards are counted in the background
+	time.Sleep(100 * time.Millisecond)
+	for _, fid := range fids {
+		assert.NoError(t, db.Merge(valueTypeStream, fid, 0.1))
+	}
+	assert.True(t, db.archivedLogFile[valueTypeStream].Size()+1 < len(fids))
+
+	entries, err := db.XRange(key, "-", "+", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"98-0", "99-0", "100-0"}, streamIDs(entries))
+	summary, err := db.XPending(key, []byte("g"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Count)
+}
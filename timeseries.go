@@ -0,0 +1,809 @@
+package lazydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"lazydb/ds"
+	"lazydb/logfile"
+	"lazydb/util"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTSKeyExists          = errors.New("time series already exists")
+	ErrTSSampleTooOld       = errors.New("timestamp is older than the retention period")
+	ErrTSInvalidAggregation = errors.New("unknown aggregation type")
+	ErrTSInvalidRule        = errors.New("invalid compaction rule")
+	ErrTSRuleNotFound       = errors.New("compaction rule not found")
+	ErrTSInvalidFilter      = errors.New("invalid label filter")
+)
+
+// Every time series has its own radix tree, keyed by sub keys whose first byte tells what they hold:
+// the info of the series with its retention, labels and compaction rules, and the samples keyed by
+// their big endian timestamp, so that they are ordered by time. The samples are also kept decoded in memory.
+// Log entries are keyed by encodeKey(key, subKey), and the key meta entry holding the ttl by the raw key.
+const (
+	tsKindInfo   byte = 'i'
+	tsKindSample byte = 's'
+)
+
+// TSAutoTimestamp is the timestamp of a sample added at the current time.
+const TSAutoTimestamp int64 = -1
+
+// TSAggregation is the function that reduces the samples of a bucket to one value.
+type TSAggregation string
+
+const (
+	TSAggAvg   TSAggregation = "avg"
+	TSAggMin   TSAggregation = "min"
+	TSAggMax   TSAggregation = "max"
+	TSAggSum   TSAggregation = "sum"
+	TSAggCount TSAggregation = "count"
+	TSAggLast  TSAggregation = "last"
+)
+
+// TSSample is a sample of a time series, Timestamp is a unix time in milliseconds.
+type TSSample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// TSKeySample is a sample added to the time series stored at Key by TSMAdd.
+type TSKeySample struct {
+	Key       []byte
+	Timestamp int64
+	Value     float64
+}
+
+// TSCreateArgs are the options of TSCreate.
+type TSCreateArgs struct {
+	// Retention is the max age of samples compared to the latest one, they are kept forever if it is 0.
+	Retention time.Duration
+	// Labels select the series read by TSMRange.
+	Labels map[string]string
+}
+
+// TSRangeArgs are the options of TSRange and TSMRange.
+type TSRangeArgs struct {
+	// Aggregation reduces the samples of every bucket of BucketDuration to one sample, whose timestamp
+	// is the start of the bucket. Buckets are aligned to the unix epoch. Samples are returned as is if it is empty.
+	Aggregation    TSAggregation
+	BucketDuration time.Duration
+	// Count limits the number of samples returned if it is positive.
+	Count int
+}
+
+// TSSeries holds the samples read from the time series stored at Key.
+type TSSeries struct {
+	Key     []byte
+	Labels  map[string]string
+	Samples []TSSample
+}
+
+// TSRule is a compaction rule, which writes the samples of its source aggregated by buckets to Dest.
+type TSRule struct {
+	Dest           []byte
+	Aggregation    TSAggregation
+	BucketDuration time.Duration
+}
+
+// TSInfo describes a time series.
+type TSInfo struct {
+	TotalSamples int
+	// FirstTimestamp and LastTimestamp are 0 if there are no samples.
+	FirstTimestamp int64
+	LastTimestamp  int64
+	Retention      time.Duration
+	Labels         map[string]string
+	// SourceKey is the key of the series compacted into this one, nil if there is none.
+	SourceKey []byte
+	Rules     []TSRule
+}
+
+type timeSeries struct {
+	tree    *ds.AdaptiveRadixTree
+	samples []TSSample // ordered by timestamp
+	info    tsInfo
+}
+
+type tsInfo struct {
+	retention int64 // in milliseconds
+	labels    map[string]string
+	source    string
+	rules     []tsRule
+}
+
+type tsRule struct {
+	dest        string
+	aggregation TSAggregation
+	bucket      int64 // in milliseconds
+}
+
+type tsFilter struct {
+	label  string
+	values []string
+	negate bool
+}
+
+func tsSampleKey(ts int64) []byte {
+	subKey := make([]byte, 9)
+	subKey[0] = tsKindSample
+	binary.BigEndian.PutUint64(subKey[1:], uint64(ts))
+	return subKey
+}
+
+func tsSampleEntry(key []byte, s TSSample) *logfile.LogEntry {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, math.Float64bits(s.Value))
+	return &logfile.LogEntry{Key: encodeKey(key, tsSampleKey(s.Timestamp)), Value: val}
+}
+
+func tsInfoEntry(key []byte, info tsInfo) *logfile.LogEntry {
+	return &logfile.LogEntry{Key: encodeKey(key, []byte{tsKindInfo}), Value: encodeTSInfo(info)}
+}
+
+// encodeTSInfo encodes the retention, the source, the labels and the rules like the fields of stream entries,
+// the labels and the rules are nested lists of fields.
+func encodeTSInfo(info tsInfo) []byte {
+	retention := make([]byte, 8)
+	binary.BigEndian.PutUint64(retention, uint64(info.retention))
+	names := make([]string, 0, len(info.labels))
+	for name := range info.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := make([][]byte, 0, len(names)*2)
+	for _, name := range names {
+		labels = append(labels, []byte(name), []byte(info.labels[name]))
+	}
+	rules := make([][]byte, 0, len(info.rules)*3)
+	for _, r := range info.rules {
+		bucket := make([]byte, 8)
+		binary.BigEndian.PutUint64(bucket, uint64(r.bucket))
+		rules = append(rules, []byte(r.dest), []byte(r.aggregation), bucket)
+	}
+	return encodeStreamFields([][]byte{retention, []byte(info.source), encodeStreamFields(labels), encodeStreamFields(rules)})
+}
+
+func decodeTSInfo(buf []byte) tsInfo {
+	info := tsInfo{labels: make(map[string]string)}
+	fields := decodeStreamFields(buf)
+	if len(fields) != 4 || len(fields[0]) != 8 {
+		return info
+	}
+	info.retention = int64(binary.BigEndian.Uint64(fields[0]))
+	info.source = string(fields[1])
+	labels := decodeStreamFields(fields[2])
+	for i := 0; i+1 < len(labels); i += 2 {
+		info.labels[string(labels[i])] = string(labels[i+1])
+	}
+	rules := decodeStreamFields(fields[3])
+	for i := 0; i+2 < len(rules); i += 3 {
+		if len(rules[i+2]) != 8 {
+			continue
+		}
+		info.rules = append(info.rules, tsRule{
+			dest:        string(rules[i]),
+			aggregation: TSAggregation(rules[i+1]),
+			bucket:      int64(binary.BigEndian.Uint64(rules[i+2])),
+		})
+	}
+	return info
+}
+
+// withoutRule returns a copy of the info without the rule writing to dest.
+func (info tsInfo) withoutRule(dest string) tsInfo {
+	rules := make([]tsRule, 0, len(info.rules))
+	for _, r := range info.rules {
+		if r.dest != dest {
+			rules = append(rules, r)
+		}
+	}
+	info.rules = rules
+	return info
+}
+
+// buildTSIndex applies a time series entry to the index, and returns the index value it replaced.
+func (db *LazyDB) buildTSIndex(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	db.tsIndex.mu.Lock()
+	defer db.tsIndex.mu.Unlock()
+	if entry.Stat == logfile.SKeyMeta {
+		return db.buildKeyMeta(valueTypeTimeSeries, entry, vPos)
+	}
+	return db.applyTSEntry(entry, vPos)
+}
+
+// applyTSEntry applies a time series entry to the tree of the series and to its decoded samples,
+// and returns the index value it replaced. A series whose tree is emptied is removed from the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) applyTSEntry(entry *logfile.LogEntry, vPos *ValuePos) interface{} {
+	key, subKey := decodeKey(entry.Key)
+	if len(subKey) == 0 {
+		return nil
+	}
+	ts := db.tsIndex.series[string(key)]
+	deleted := entry.Stat == logfile.SDelete
+	if ts == nil {
+		if deleted {
+			return nil
+		}
+		ts = &timeSeries{tree: ds.NewART(), info: tsInfo{labels: make(map[string]string)}}
+		db.indexCollectionKey(valueTypeTimeSeries, key)
+		db.tsIndex.series[string(key)] = ts
+	}
+
+	var oldVal interface{}
+	if deleted {
+		oldVal, _ = ts.tree.Delete(subKey)
+	} else {
+		oldVal, _ = ts.tree.Put(subKey, &Value{fid: vPos.fid, offset: vPos.offset, entrySize: vPos.entrySize})
+	}
+	switch subKey[0] {
+	case tsKindInfo:
+		if !deleted {
+			ts.info = decodeTSInfo(entry.Value)
+		}
+	case tsKindSample:
+		if len(subKey) != 9 || (!deleted && len(entry.Value) != 8) {
+			break
+		}
+		t := int64(binary.BigEndian.Uint64(subKey[1:]))
+		if deleted {
+			ts.remove(t)
+		} else {
+			ts.put(TSSample{Timestamp: t, Value: math.Float64frombits(binary.BigEndian.Uint64(entry.Value))})
+		}
+	}
+	if ts.tree.Size() == 0 {
+		db.unindexCollectionKey(valueTypeTimeSeries, key)
+		delete(db.tsIndex.series, string(key))
+	}
+	return oldVal
+}
+
+// writeTSEntries writes entries of time series in one batch, and applies them to the index.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) writeTSEntries(entries []*logfile.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	valPos, err := db.writeLogEntries(valueTypeTimeSeries, entries)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		oldVal := db.applyTSEntry(entry, valPos[i])
+		db.sendDiscard(oldVal, true, valueTypeTimeSeries)
+		if entry.Stat == logfile.SDelete {
+			db.sendDiscard(&Value{fid: valPos[i].fid, entrySize: valPos[i].entrySize}, true, valueTypeTimeSeries)
+		}
+		db.notifyChange(valueTypeTimeSeries, entry)
+	}
+	return nil
+}
+
+// getTimeSeries returns the time series stored at key, or nil if it does not exist or has expired.
+// The caller must hold the lock of the index.
+func (db *LazyDB) getTimeSeries(key []byte) *timeSeries {
+	if db.keyExpired(valueTypeTimeSeries, key) {
+		return nil
+	}
+	return db.tsIndex.series[util.ByteToString(key)]
+}
+
+// search returns the index of the first sample at or after t.
+func (ts *timeSeries) search(t int64) int {
+	return sort.Search(len(ts.samples), func(i int) bool {
+		return ts.samples[i].Timestamp >= t
+	})
+}
+
+func (ts *timeSeries) put(s TSSample) {
+	i := ts.search(s.Timestamp)
+	if i < len(ts.samples) && ts.samples[i].Timestamp == s.Timestamp {
+		ts.samples[i] = s
+		return
+	}
+	ts.samples = append(ts.samples, TSSample{})
+	copy(ts.samples[i+1:], ts.samples[i:])
+	ts.samples[i] = s
+}
+
+func (ts *timeSeries) remove(t int64) {
+	i := ts.search(t)
+	if i == len(ts.samples) || ts.samples[i].Timestamp != t {
+		return
+	}
+	// samples are mostly removed from the front by the retention
+	if i == 0 {
+		ts.samples = ts.samples[1:]
+		return
+	}
+	ts.samples = append(ts.samples[:i], ts.samples[i+1:]...)
+}
+
+// between returns the samples with a timestamp between from and to inclusive.
+func (ts *timeSeries) between(from, to int64) []TSSample {
+	first := ts.search(from)
+	last := sort.Search(len(ts.samples), func(i int) bool {
+		return ts.samples[i].Timestamp > to
+	})
+	if first >= last {
+		return nil
+	}
+	return ts.samples[first:last]
+}
+
+// TSCreate creates an empty time series at key, which must not exist.
+func (db *LazyDB) TSCreate(key []byte, args TSCreateArgs) error {
+	if args.Retention < 0 {
+		return ErrInvalidParam
+	}
+	labels := make(map[string]string, len(args.Labels))
+	for name, value := range args.Labels {
+		labels[name] = value
+	}
+	db.tsIndex.mu.Lock()
+	defer db.tsIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeTimeSeries, key); err != nil {
+		return err
+	}
+
+	if db.tsIndex.series[string(key)] != nil {
+		return ErrTSKeyExists
+	}
+	info := tsInfo{retention: args.Retention.Milliseconds(), labels: labels}
+	if err := db.writeTSEntries([]*logfile.LogEntry{tsInfoEntry(key, info)}); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "ts.create", key)
+	return nil
+}
+
+// TSAdd adds a sample to the time series stored at key, which is created without retention and labels
+// if it does not exist, and returns its timestamp. A sample with the same timestamp is replaced.
+// The timestamp is the current time if it is TSAutoTimestamp.
+func (db *LazyDB) TSAdd(key []byte, timestamp int64, value float64) (int64, error) {
+	timestamps, err := db.TSMAdd(TSKeySample{Key: key, Timestamp: timestamp, Value: value})
+	if err != nil {
+		return 0, err
+	}
+	return timestamps[0], nil
+}
+
+// TSMAdd adds samples to many time series like TSAdd, and returns their timestamps.
+// It stops at the first sample that cannot be added, the samples before it are kept.
+func (db *LazyDB) TSMAdd(samples ...TSKeySample) ([]int64, error) {
+	if len(samples) == 0 {
+		return nil, ErrInvalidParam
+	}
+	for _, s := range samples {
+		if (s.Timestamp < 0 && s.Timestamp != TSAutoTimestamp) || math.IsNaN(s.Value) {
+			return nil, ErrInvalidParam
+		}
+	}
+	now := time.Now().UnixMilli()
+	db.tsIndex.mu.Lock()
+	defer db.tsIndex.mu.Unlock()
+
+	timestamps := make([]int64, 0, len(samples))
+	for _, s := range samples {
+		if err := db.expireIfNeeded(valueTypeTimeSeries, s.Key); err != nil {
+			return nil, err
+		}
+		t := s.Timestamp
+		if t == TSAutoTimestamp {
+			t = now
+		}
+		if err := db.tsAdd(s.Key, TSSample{Timestamp: t, Value: s.Value}); err != nil {
+			return nil, err
+		}
+		timestamps = append(timestamps, t)
+	}
+	return timestamps, nil
+}
+
+// tsAdd upserts a sample into the time series stored at key, which is created if it does not exist,
+// removes the samples beyond its retention and applies its compaction rules.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) tsAdd(key []byte, sample TSSample) error {
+	ts := db.tsIndex.series[string(key)]
+	entries := make([]*logfile.LogEntry, 0, 2)
+	var prev *TSSample
+	if ts == nil {
+		entries = append(entries, tsInfoEntry(key, tsInfo{}))
+	} else if n := len(ts.samples); n > 0 {
+		last := ts.samples[n-1]
+		if ts.info.retention > 0 && sample.Timestamp < last.Timestamp-ts.info.retention {
+			return ErrTSSampleTooOld
+		}
+		prev = &last
+	}
+	entries = append(entries, tsSampleEntry(key, sample))
+	if err := db.writeTSEntries(entries); err != nil {
+		return err
+	}
+
+	ts = db.tsIndex.series[string(key)]
+	if ts.info.retention > 0 {
+		var trimmed []*logfile.LogEntry
+		min := ts.samples[len(ts.samples)-1].Timestamp - ts.info.retention
+		for _, s := range ts.samples {
+			if s.Timestamp >= min {
+				break
+			}
+			trimmed = append(trimmed, &logfile.LogEntry{Key: encodeKey(key, tsSampleKey(s.Timestamp)), Stat: logfile.SDelete})
+		}
+		if err := db.writeTSEntries(trimmed); err != nil {
+			return err
+		}
+	}
+	db.notifyKeyspaceEvent(notifyModule, "ts.add", key)
+
+	for _, rule := range ts.info.rules {
+		if err := db.tsCompact(ts, rule, sample.Timestamp, prev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tsCompact writes the bucket of rule closed by the sample at t to the destination series.
+// A bucket is closed once a later bucket has samples, so it is written when the sample opens a new bucket,
+// and written again when the sample lands in a closed bucket. prev is the latest sample before t was added.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) tsCompact(src *timeSeries, rule tsRule, t int64, prev *TSSample) error {
+	bucket := tsBucketStart(t, rule.bucket)
+	var start int64
+	switch {
+	case bucket < tsBucketStart(src.samples[len(src.samples)-1].Timestamp, rule.bucket):
+		start = bucket
+	case prev != nil && tsBucketStart(prev.Timestamp, rule.bucket) < bucket:
+		start = tsBucketStart(prev.Timestamp, rule.bucket)
+	default:
+		return nil
+	}
+	samples := src.between(start, start+rule.bucket-1)
+	if len(samples) == 0 || db.getTimeSeries([]byte(rule.dest)) == nil {
+		return nil
+	}
+	err := db.tsAdd([]byte(rule.dest), TSSample{Timestamp: start, Value: tsAggregate(rule.aggregation, samples)})
+	// the bucket has already left the retention of the destination
+	if err == ErrTSSampleTooOld {
+		return nil
+	}
+	return err
+}
+
+func tsBucketStart(t, bucket int64) int64 {
+	return t - t%bucket
+}
+
+func validTSAggregation(agg TSAggregation) bool {
+	switch agg {
+	case TSAggAvg, TSAggMin, TSAggMax, TSAggSum, TSAggCount, TSAggLast:
+		return true
+	}
+	return false
+}
+
+// tsAggregate reduces samples, which must not be empty, to one value.
+func tsAggregate(agg TSAggregation, samples []TSSample) float64 {
+	switch agg {
+	case TSAggCount:
+		return float64(len(samples))
+	case TSAggLast:
+		return samples[len(samples)-1].Value
+	}
+	sum, min, max := 0.0, samples[0].Value, samples[0].Value
+	for _, s := range samples {
+		sum += s.Value
+		min = math.Min(min, s.Value)
+		max = math.Max(max, s.Value)
+	}
+	switch agg {
+	case TSAggAvg:
+		return sum / float64(len(samples))
+	case TSAggMin:
+		return min
+	case TSAggMax:
+		return max
+	}
+	return sum
+}
+
+func checkTSRangeArgs(args TSRangeArgs) error {
+	if args.Aggregation == "" {
+		return nil
+	}
+	if !validTSAggregation(args.Aggregation) {
+		return ErrTSInvalidAggregation
+	}
+	if args.BucketDuration.Milliseconds() <= 0 {
+		return ErrInvalidParam
+	}
+	return nil
+}
+
+// tsRange returns the samples of ts between from and to inclusive, aggregated by args.
+func tsRange(ts *timeSeries, from, to int64, args TSRangeArgs) []TSSample {
+	samples := ts.between(from, to)
+	if args.Aggregation == "" {
+		if args.Count > 0 && len(samples) > args.Count {
+			samples = samples[:args.Count]
+		}
+		return append([]TSSample{}, samples...)
+	}
+	bucket := args.BucketDuration.Milliseconds()
+	result := []TSSample{}
+	for i := 0; i < len(samples) && (args.Count <= 0 || len(result) < args.Count); {
+		start := tsBucketStart(samples[i].Timestamp, bucket)
+		j := i + 1
+		for j < len(samples) && samples[j].Timestamp < start+bucket {
+			j++
+		}
+		result = append(result, TSSample{Timestamp: start, Value: tsAggregate(args.Aggregation, samples[i:j])})
+		i = j
+	}
+	return result
+}
+
+// TSRange returns the samples of the time series stored at key with a timestamp between from and to inclusive.
+func (db *LazyDB) TSRange(key []byte, from, to int64, args TSRangeArgs) ([]TSSample, error) {
+	if err := checkTSRangeArgs(args); err != nil {
+		return nil, err
+	}
+	db.tsIndex.mu.RLock()
+	defer db.tsIndex.mu.RUnlock()
+
+	ts := db.getTimeSeries(key)
+	if ts == nil {
+		return nil, ErrKeyNotFound
+	}
+	return tsRange(ts, from, to, args), nil
+}
+
+// TSMRange returns the samples between from and to of every time series whose labels match all filters,
+// ordered by key. A filter is one of:
+//
+//	label=value      the label equals value
+//	label!=value     the label does not equal value or is missing
+//	label=           the label is missing
+//	label!=          the label is present
+//	label=(v1,v2)    the label equals one of the values
+//	label!=(v1,v2)   the label equals none of the values or is missing
+//
+// At least one filter must match a value.
+func (db *LazyDB) TSMRange(from, to int64, args TSRangeArgs, filters ...string) ([]*TSSeries, error) {
+	if err := checkTSRangeArgs(args); err != nil {
+		return nil, err
+	}
+	matchers, err := parseTSFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	db.tsIndex.mu.RLock()
+	defer db.tsIndex.mu.RUnlock()
+
+	keys := make([]string, 0, len(db.tsIndex.series))
+	for key := range db.tsIndex.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var result []*TSSeries
+	for _, key := range keys {
+		ts := db.getTimeSeries([]byte(key))
+		if ts == nil || !matchTSFilters(ts.info.labels, matchers) {
+			continue
+		}
+		labels := make(map[string]string, len(ts.info.labels))
+		for name, value := range ts.info.labels {
+			labels[name] = value
+		}
+		result = append(result, &TSSeries{Key: []byte(key), Labels: labels, Samples: tsRange(ts, from, to, args)})
+	}
+	return result, nil
+}
+
+func parseTSFilters(filters []string) ([]tsFilter, error) {
+	var matchers []tsFilter
+	var positive bool
+	for _, filter := range filters {
+		i := strings.IndexByte(filter, '=')
+		if i <= 0 {
+			return nil, ErrTSInvalidFilter
+		}
+		f := tsFilter{label: filter[:i]}
+		if filter[i-1] == '!' {
+			f.negate = true
+			f.label = filter[:i-1]
+		}
+		if f.label == "" {
+			return nil, ErrTSInvalidFilter
+		}
+		value := filter[i+1:]
+		if strings.HasPrefix(value, "(") {
+			if !strings.HasSuffix(value, ")") {
+				return nil, ErrTSInvalidFilter
+			}
+			f.values = strings.Split(value[1:len(value)-1], ",")
+		} else if value != "" {
+			f.values = []string{value}
+		}
+		positive = positive || (!f.negate && len(f.values) > 0)
+		matchers = append(matchers, f)
+	}
+	if !positive {
+		return nil, ErrTSInvalidFilter
+	}
+	return matchers, nil
+}
+
+func matchTSFilters(labels map[string]string, filters []tsFilter) bool {
+	for _, f := range filters {
+		value, ok := labels[f.label]
+		// a filter without values only checks whether the label is present
+		if len(f.values) == 0 {
+			if ok != f.negate {
+				return false
+			}
+			continue
+		}
+		found := false
+		for _, v := range f.values {
+			found = found || (ok && v == value)
+		}
+		if found == f.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// TSCreateRule adds a compaction rule writing the samples of src aggregated by buckets of bucketDuration to dst.
+// Both series must exist, a bucket is written once a sample of a later bucket is added to src,
+// and the samples already in src are not compacted. A series compacted from another one cannot have rules
+// nor be compacted from a second one.
+func (db *LazyDB) TSCreateRule(src, dst []byte, agg TSAggregation, bucketDuration time.Duration) error {
+	if !validTSAggregation(agg) {
+		return ErrTSInvalidAggregation
+	}
+	if bucketDuration.Milliseconds() <= 0 {
+		return ErrInvalidParam
+	}
+	if bytes.Equal(src, dst) {
+		return ErrTSInvalidRule
+	}
+	db.tsIndex.mu.Lock()
+	defer db.tsIndex.mu.Unlock()
+	for _, key := range [][]byte{src, dst} {
+		if err := db.expireIfNeeded(valueTypeTimeSeries, key); err != nil {
+			return err
+		}
+	}
+
+	s, d := db.tsIndex.series[string(src)], db.tsIndex.series[string(dst)]
+	if s == nil || d == nil {
+		return ErrKeyNotFound
+	}
+	// rules never chain, so they cannot make a cycle
+	if s.info.source != "" || d.info.source != "" || len(d.info.rules) > 0 {
+		return ErrTSInvalidRule
+	}
+	srcInfo, dstInfo := s.info, d.info
+	srcInfo.rules = append(append([]tsRule{}, s.info.rules...), tsRule{dest: string(dst), aggregation: agg, bucket: bucketDuration.Milliseconds()})
+	dstInfo.source = string(src)
+	if err := db.writeTSEntries([]*logfile.LogEntry{tsInfoEntry(src, srcInfo), tsInfoEntry(dst, dstInfo)}); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "ts.createrule", src)
+	return nil
+}
+
+// TSDeleteRule removes the compaction rule from src to dst.
+func (db *LazyDB) TSDeleteRule(src, dst []byte) error {
+	db.tsIndex.mu.Lock()
+	defer db.tsIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeTimeSeries, src); err != nil {
+		return err
+	}
+
+	s := db.tsIndex.series[string(src)]
+	if s == nil {
+		return ErrKeyNotFound
+	}
+	found := false
+	for _, r := range s.info.rules {
+		found = found || r.dest == string(dst)
+	}
+	if !found {
+		return ErrTSRuleNotFound
+	}
+	entries := []*logfile.LogEntry{tsInfoEntry(src, s.info.withoutRule(string(dst)))}
+	if d := db.tsIndex.series[string(dst)]; d != nil {
+		info := d.info
+		info.source = ""
+		entries = append(entries, tsInfoEntry(dst, info))
+	}
+	if err := db.writeTSEntries(entries); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyModule, "ts.deleterule", src)
+	return nil
+}
+
+// TSInfo returns the info of the time series stored at key.
+func (db *LazyDB) TSInfo(key []byte) (*TSInfo, error) {
+	db.tsIndex.mu.RLock()
+	defer db.tsIndex.mu.RUnlock()
+
+	ts := db.getTimeSeries(key)
+	if ts == nil {
+		return nil, ErrKeyNotFound
+	}
+	info := &TSInfo{
+		TotalSamples: len(ts.samples),
+		Retention:    time.Duration(ts.info.retention) * time.Millisecond,
+		Labels:       make(map[string]string, len(ts.info.labels)),
+	}
+	if n := len(ts.samples); n > 0 {
+		info.FirstTimestamp, info.LastTimestamp = ts.samples[0].Timestamp, ts.samples[n-1].Timestamp
+	}
+	for name, value := range ts.info.labels {
+		info.Labels[name] = value
+	}
+	if ts.info.source != "" {
+		info.SourceKey = []byte(ts.info.source)
+	}
+	for _, r := range ts.info.rules {
+		info.Rules = append(info.Rules, TSRule{
+			Dest:           []byte(r.dest),
+			Aggregation:    r.aggregation,
+			BucketDuration: time.Duration(r.bucket) * time.Millisecond,
+		})
+	}
+	return info, nil
+}
+
+// deleteTimeSeries writes the delete entries of all sub keys of the series stored at key,
+// and removes the rules linking it to other series. The caller must hold the write lock of the index.
+func (db *LazyDB) deleteTimeSeries(key []byte) error {
+	ts := db.tsIndex.series[string(key)]
+	if ts == nil {
+		return nil
+	}
+	var entries []*logfile.LogEntry
+	for _, subKey := range treeKeys(ts.tree) {
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, subKey), Stat: logfile.SDelete})
+	}
+	if src := db.tsIndex.series[ts.info.source]; ts.info.source != "" && src != nil {
+		entries = append(entries, tsInfoEntry([]byte(ts.info.source), src.info.withoutRule(string(key))))
+	}
+	for _, r := range ts.info.rules {
+		if d := db.tsIndex.series[r.dest]; d != nil {
+			info := d.info
+			info.source = ""
+			entries = append(entries, tsInfoEntry([]byte(r.dest), info))
+		}
+	}
+	// the series is removed from the index with its last sub key
+	return db.writeTSEntries(entries)
+}
+
+// copyTimeSeries writes the samples, the retention and the labels of the series stored at src to dst.
+// Compaction rules are not copied, since a series is compacted from a single source.
+// The caller must hold the write lock of the index.
+func (db *LazyDB) copyTimeSeries(src, dst []byte) error {
+	ts := db.tsIndex.series[string(src)]
+	info := tsInfo{retention: ts.info.retention, labels: ts.info.labels}
+	entries := make([]*logfile.LogEntry, 0, len(ts.samples)+1)
+	entries = append(entries, tsInfoEntry(dst, info))
+	for _, s := range ts.samples {
+		entries = append(entries, tsSampleEntry(dst, s))
+	}
+	return db.writeTSEntries(entries)
+}
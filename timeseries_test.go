@@ -0,0 +1,344 @@
+package lazydb
+
+import (
+	"lazydb/util"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestTSDB() *LazyDB {
+	wd, _ := os.Getwd()
+	path := filepath.Join(wd, "test_ts")
+	if !util.PathExist(path) {
+		os.MkdirAll(path, os.ModePerm)
+	}
+	cfg := DefaultDBConfig(path)
+	db, _ := Open(cfg)
+	return db
+}
+
+func TestLazyDB_TSAdd_TSRange(t *testing.T) {
+	db := initTestTSDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("cpu")
+	// samples are ordered by timestamp whatever the order they are added in
+	for i := 10; i >= 1; i-- {
+		ts, err := db.TSAdd(key, int64(i*1000), float64(i))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i*1000), ts)
+	}
+	samples, err := db.TSRange(key, 0, math.MaxInt64, TSRangeArgs{})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(samples))
+	assert.Equal(t, TSSample{Timestamp: 1000, Value: 1}, samples[0])
+	assert.Equal(t, TSSample{Timestamp: 10000, Value: 10}, samples[9])
+
+	samples, _ = db.TSRange(key, 2500, 5000, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{3000, 3}, {4000, 4}, {5000, 5}}, samples)
+	samples, _ = db.TSRange(key, 2500, 5000, TSRangeArgs{Count: 2})
+	assert.Equal(t, []TSSample{{3000, 3}, {4000, 4}}, samples)
+	samples, _ = db.TSRange(key, 20000, 30000, TSRangeArgs{})
+	assert.Equal(t, 0, len(samples))
+
+	tests := []struct {
+		agg  TSAggregation
+		want []float64
+	}{
+		{TSAggAvg, []float64{1.5, 4, 7, 9.5}},
+		{TSAggMin, []float64{1, 3, 6, 9}},
+		{TSAggMax, []float64{2, 5, 8, 10}},
+		{TSAggSum, []float64{3, 12, 21, 19}},
+		{TSAggCount, []float64{2, 3, 3, 2}},
+		{TSAggLast, []float64{2, 5, 8, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.agg), func(t *testing.T) {
+			samples, err := db.TSRange(key, 0, math.MaxInt64, TSRangeArgs{Aggregation: tt.agg, BucketDuration: 3 * time.Second})
+			assert.NoError(t, err)
+			assert.Equal(t, 4, len(samples))
+			for i, s := range samples {
+				assert.Equal(t, int64(i*3000), s.Timestamp)
+				assert.Equal(t, tt.want[i], s.Value)
+			}
+		})
+	}
+	samples, _ = db.TSRange(key, 0, math.MaxInt64, TSRangeArgs{Aggregation: TSAggSum, BucketDuration: 3 * time.Second, Count: 1})
+	assert.Equal(t, []TSSample{{0, 3}}, samples)
+
+	// a sample with the same timestamp is replaced
+	_, err = db.TSAdd(key, 1000, 100)
+	assert.NoError(t, err)
+	samples, _ = db.TSRange(key, 0, 1000, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{1000, 100}}, samples)
+
+	ts, err := db.TSAdd([]byte("now"), TSAutoTimestamp, 1)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().UnixMilli(), ts, 1000)
+
+	_, err = db.TSAdd(key, -5, 1)
+	assert.Equal(t, ErrInvalidParam, err)
+	_, err = db.TSAdd(key, 1, math.NaN())
+	assert.Equal(t, ErrInvalidParam, err)
+	_, err = db.TSRange(key, 0, 1, TSRangeArgs{Aggregation: "median", BucketDuration: time.Second})
+	assert.Equal(t, ErrTSInvalidAggregation, err)
+	_, err = db.TSRange(key, 0, 1, TSRangeArgs{Aggregation: TSAggAvg})
+	assert.Equal(t, ErrInvalidParam, err)
+	_, err = db.TSRange([]byte("missing"), 0, 1, TSRangeArgs{})
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, DataTypeTimeSeries, db.Type(key))
+}
+
+func TestLazyDB_TSCreate_Retention(t *testing.T) {
+	db := initTestTSDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	key := []byte("temp")
+	assert.NoError(t, db.TSCreate(key, TSCreateArgs{Retention: 5 * time.Second, Labels: map[string]string{"room": "1"}}))
+	assert.Equal(t, ErrTSKeyExists, db.TSCreate(key, TSCreateArgs{}))
+	assert.Equal(t, ErrInvalidParam, db.TSCreate([]byte("x"), TSCreateArgs{Retention: -time.Second}))
+
+	info, err := db.TSInfo(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, info.TotalSamples)
+	assert.Equal(t, DataTypeTimeSeries, db.Type(key))
+
+	for i := 1; i <= 10; i++ {
+		_, err := db.TSAdd(key, int64(i*1000), float64(i))
+		assert.NoError(t, err)
+	}
+	// samples older than the latest one minus the retention are dropped
+	samples, _ := db.TSRange(key, 0, math.MaxInt64, TSRangeArgs{})
+	assert.Equal(t, 6, len(samples))
+	assert.Equal(t, int64(5000), samples[0].Timestamp)
+	_, err = db.TSAdd(key, 4000, 4)
+	assert.Equal(t, ErrTSSampleTooOld, err)
+	_, err = db.TSAdd(key, 5000, 50)
+	assert.NoError(t, err)
+
+	_, err = db.TSMAdd(TSKeySample{Key: key, Timestamp: 20000, Value: 20}, TSKeySample{Key: []byte("other"), Timestamp: 1, Value: 1})
+	assert.NoError(t, err)
+	info, _ = db.TSInfo(key)
+	assert.Equal(t, 1, info.TotalSamples)
+	assert.Equal(t, int64(20000), info.FirstTimestamp)
+	assert.Equal(t, int64(20000), info.LastTimestamp)
+	assert.Equal(t, 5*time.Second, info.Retention)
+	assert.Equal(t, map[string]string{"room": "1"}, info.Labels)
+
+	// TSMAdd stops at the first sample that cannot be added
+	_, err = db.TSMAdd(TSKeySample{Key: []byte("other"), Timestamp: 2, Value: 2}, TSKeySample{Key: key, Timestamp: 1, Value: 1},
+		TSKeySample{Key: []byte("other"), Timestamp: 3, Value: 3})
+	assert.Equal(t, ErrTSSampleTooOld, err)
+	samples, _ = db.TSRange([]byte("other"), 0, 10, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{1, 1}, {2, 2}}, samples)
+	_, err = db.TSMAdd()
+	assert.Equal(t, ErrInvalidParam, err)
+}
+
+func TestLazyDB_TSCreateRule(t *testing.T) {
+	db := initTestTSDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	src, dst := []byte("raw"), []byte("avg:10s")
+	assert.NoError(t, db.TSCreate(src, TSCreateArgs{}))
+	assert.NoError(t, db.TSCreate(dst, TSCreateArgs{}))
+	assert.Equal(t, ErrKeyNotFound, db.TSCreateRule(src, []byte("missing"), TSAggAvg, time.Second))
+	assert.Equal(t, ErrTSInvalidRule, db.TSCreateRule(src, src, TSAggAvg, time.Second))
+	assert.Equal(t, ErrTSInvalidAggregation, db.TSCreateRule(src, dst, "median", time.Second))
+	assert.Equal(t, ErrInvalidParam, db.TSCreateRule(src, dst, TSAggAvg, time.Microsecond))
+	assert.NoError(t, db.TSCreateRule(src, dst, TSAggAvg, 10*time.Second))
+	assert.Equal(t, ErrTSInvalidRule, db.TSCreateRule(src, dst, TSAggSum, time.Second))
+	assert.NoError(t, db.TSCreate([]byte("other"), TSCreateArgs{}))
+	assert.Equal(t, ErrTSInvalidRule, db.TSCreateRule(dst, []byte("other"), TSAggSum, time.Second))
+	assert.Equal(t, ErrTSInvalidRule, db.TSCreateRule([]byte("other"), src, TSAggSum, time.Second))
+
+	for i := 0; i <= 25; i++ {
+		_, err := db.TSAdd(src, int64(i*1000), float64(i))
+		assert.NoError(t, err)
+	}
+	// the bucket of 20s is still open
+	samples, _ := db.TSRange(dst, 0, math.MaxInt64, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{0, 4.5}, {10000, 14.5}}, samples)
+
+	// a sample in a closed bucket compacts it again
+	_, err := db.TSAdd(src, 5000, 105)
+	assert.NoError(t, err)
+	samples, _ = db.TSRange(dst, 0, math.MaxInt64, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{0, 14.5}, {10000, 14.5}}, samples)
+
+	info, _ := db.TSInfo(src)
+	assert.Equal(t, []TSRule{{Dest: dst, Aggregation: TSAggAvg, BucketDuration: 10 * time.Second}}, info.Rules)
+	info, _ = db.TSInfo(dst)
+	assert.Equal(t, src, info.SourceKey)
+
+	assert.NoError(t, db.TSDeleteRule(src, dst))
+	assert.Equal(t, ErrTSRuleNotFound, db.TSDeleteRule(src, dst))
+	_, _ = db.TSAdd(src, 40000, 40)
+	samples, _ = db.TSRange(dst, 0, math.MaxInt64, TSRangeArgs{})
+	assert.Equal(t, 2, len(samples))
+	info, _ = db.TSInfo(dst)
+	assert.Nil(t, info.SourceKey)
+
+	// deleting the destination removes the rule
+	assert.NoError(t, db.TSCreateRule(src, dst, TSAggMax, time.Minute))
+	n, err := db.Del(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	info, _ = db.TSInfo(src)
+	assert.Equal(t, 0, len(info.Rules))
+}
+
+func TestLazyDB_TSMRange(t *testing.T) {
+	db := initTestTSDB()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	series := map[string]map[string]string{
+		"temp:1": {"type": "temp", "room": "1"},
+		"temp:2": {"type": "temp", "room": "2"},
+		"hum:1":  {"type": "hum", "room": "1", "sensor": "x"},
+	}
+	for key, labels := range series {
+		assert.NoError(t, db.TSCreate([]byte(key), TSCreateArgs{Labels: labels}))
+		for i := 1; i <= 4; i++ {
+			_, err := db.TSAdd([]byte(key), int64(i*1000), float64(i))
+			assert.NoError(t, err)
+		}
+	}
+
+	tests := []struct {
+		filters []string
+		want    []string
+	}{
+		{[]string{"type=temp"}, []string{"temp:1", "temp:2"}},
+		{[]string{"room=1"}, []string{"hum:1", "temp:1"}},
+		{[]string{"type=temp", "room!=1"}, []string{"temp:2"}},
+		{[]string{"room=1", "sensor="}, []string{"temp:1"}},
+		{[]string{"room=1", "sensor!="}, []string{"hum:1"}},
+		{[]string{"type=(hum,temp)", "room!=(2,3)"}, []string{"hum:1", "temp:1"}},
+		{[]string{"type=none"}, nil},
+	}
+	for _, tt := range tests {
+		result, err := db.TSMRange(0, math.MaxInt64, TSRangeArgs{}, tt.filters...)
+		assert.NoError(t, err)
+		var keys []string
+		for _, s := range result {
+			keys = append(keys, string(s.Key))
+			assert.Equal(t, series[string(s.Key)], s.Labels)
+			assert.Equal(t, 4, len(s.Samples))
+		}
+		assert.Equal(t, tt.want, keys, tt.filters)
+	}
+
+	result, err := db.TSMRange(2000, 4000, TSRangeArgs{Aggregation: TSAggSum, BucketDuration: 2 * time.Second}, "type=temp")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, []TSSample{{2000, 5}, {4000, 4}}, result[0].Samples)
+
+	for _, filters := range [][]string{nil, {"room!=1"}, {"sensor="}, {"=1"}, {"room"}, {"room=(1"}, {"!=1"}} {
+		_, err := db.TSMRange(0, 1, TSRangeArgs{}, filters...)
+		assert.Equal(t, ErrTSInvalidFilter, err, filters)
+	}
+}
+
+func TestLazyDB_TS_Reopen(t *testing.T) {
+	db := initTestTSDB()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	src, dst := []byte("raw"), []byte("max:1m")
+	assert.NoError(t, db.TSCreate(src, TSCreateArgs{Retention: time.Hour, Labels: map[string]string{"host": "a"}}))
+	assert.NoError(t, db.TSCreate(dst, TSCreateArgs{}))
+	assert.NoError(t, db.TSCreateRule(src, dst, TSAggMax, time.Minute))
+	for i := 0; i < 10; i++ {
+		_, err := db.TSAdd(src, int64(i*30000), float64(i))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, db.Expire(src, time.Hour))
+	_, _ = db.TSAdd([]byte("tmp"), 1, 1)
+	_, _ = db.Del([]byte("tmp"))
+
+	db.Close()
+	var err error
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+
+	samples, err := db.TSRange(src, 0, math.MaxInt64, TSRangeArgs{})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(samples))
+	samples, _ = db.TSRange(dst, 0, math.MaxInt64, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{0, 1}, {60000, 3}, {120000, 5}, {180000, 7}}, samples)
+	info, err := db.TSInfo(src)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, info.Retention)
+	assert.Equal(t, map[string]string{"host": "a"}, info.Labels)
+	assert.Equal(t, 1, len(info.Rules))
+	ttl, err := db.TTL(src)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+	_, err = db.TSRange([]byte("tmp"), 0, 1, TSRangeArgs{})
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the rules keep working after reopening
+	_, _ = db.TSAdd(src, 300000, 10)
+	samples, _ = db.TSRange(dst, 240000, math.MaxInt64, TSRangeArgs{})
+	assert.Equal(t, []TSSample{{240000, 9}}, samples)
+
+	// a copy has the samples, retention and labels but no rules
+	copied, err := db.Copy(src, []byte("raw:copy"), false)
+	assert.NoError(t, err)
+	assert.True(t, copied)
+	info, _ = db.TSInfo([]byte("raw:copy"))
+	assert.Equal(t, 11, info.TotalSamples)
+	assert.Equal(t, time.Hour, info.Retention)
+	assert.Equal(t, map[string]string{"host": "a"}, info.Labels)
+	assert.Equal(t, 0, len(info.Rules))
+
+	n, err := db.Del(src)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = db.TSRange(src, 0, 1, TSRangeArgs{})
+	assert.Equal(t, ErrKeyNotFound, err)
+	info, _ = db.TSInfo(dst)
+	assert.Nil(t, info.SourceKey)
+}
+
+func TestLazyDB_TS_Merge(t *testing.T) {
+	wd, _ := os.Getwd()
+	cfg := DefaultDBConfig(filepath.Join(wd, "test_ts"))
+	cfg.MaxLogFileSize = 500
+	db, err := Open(cfg)
+	assert.NoError(t, err)
+	defer destroyDB(db)
+
+	key := []byte("gauge")
+	assert.NoError(t, db.TSCreate(key, TSCreateArgs{Retention: 10 * time.Second}))
+	for i := 0; i < 100; i++ {
+		_, err := db.TSAdd(key, int64(i*1000), float64(i))
+		assert.NoError(t, err)
+	}
+
+	fids := append([]uint32{}, db.fidsMap[valueTypeTimeSeries].fids...)
+	assert.True(t, len(fids) > 1)
+	// discards are counted in the background
+	time.Sleep(100 * time.Millisecond)
+	for _, fid := range fids {
+		assert.NoError(t, db.Merge(valueTypeTimeSeries, fid, 0.1))
+	}
+	assert.True(t, db.archivedLogFile[valueTypeTimeSeries].Size()+1 < len(fids))
+
+	samples, err := db.TSRange(key, 0, math.MaxInt64, TSRangeArgs{})
+	assert.NoError(t, err)
+	assert.Equal(t, 11, len(samples))
+	assert.Equal(t, TSSample{Timestamp: 89000, Value: 89}, samples[0])
+	info, _ := db.TSInfo(key)
+	assert.Equal(t, 10*time.Second, info.Retention)
+}
@@ -97,6 +97,9 @@ func (tx *Tx) IsClosed() bool {
 }
 
 func (db *LazyDB) Begin(txType TxType) (*Tx, error) {
+	if txType == RWTX && db.isReadOnly() {
+		return nil, ErrReadOnly
+	}
 	tx, err := newTx(db, txType)
 	if err != nil {
 		return nil, err
@@ -152,39 +155,61 @@ func (tx *Tx) Commit() error {
 
 	wg := sync.WaitGroup{}
 	wg.Add(5)
+	// an entry that fails to be written is neither indexed nor published, and the rest of its type is skipped.
+	errs := make([]error, 5)
 
 	go func() {
 		defer wg.Done()
 		for _, e := range tx.pendingStr {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeString, e)
+			e.TxID, e.TxStat = tx.id, logfile.TxCommited
+			valuePos, err := tx.db.writeLogEntry(valueTypeString, e)
+			if err != nil {
+				errs[0] = err
+				return
+			}
 			tx.db.updateIndexTree(valueTypeString, tx.db.strIndex.idxTree, e, valuePos, true)
+			tx.db.notifyChange(valueTypeString, e)
+			tx.db.notifyKeyspaceEvent(notifyString, "set", e.Key)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
 		for _, e := range tx.pendingList {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeList, e)
+			e.TxID, e.TxStat = tx.id, logfile.TxCommited
+			valuePos, err := tx.db.writeLogEntry(valueTypeList, e)
+			if err != nil {
+				errs[1] = err
+				return
+			}
 			tx.db.updateIndexTree(valueTypeList, tx.db.strIndex.idxTree, e, valuePos, true)
+			tx.db.notifyChange(valueTypeList, e)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
 		for _, e := range tx.pendingHash {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeHash, e)
+			e.TxID, e.TxStat = tx.id, logfile.TxCommited
+			valuePos, err := tx.db.writeLogEntry(valueTypeHash, e)
+			if err != nil {
+				errs[2] = err
+				return
+			}
 			tx.db.updateIndexTree(valueTypeHash, tx.db.strIndex.idxTree, e, valuePos, true)
+			tx.db.notifyChange(valueTypeHash, e)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
 		for _, ps := range tx.pendingSet {
-			ps.e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeSet, ps.e)
+			ps.e.TxID, ps.e.TxStat = tx.id, logfile.TxCommited
+			valuePos, err := tx.db.writeLogEntry(valueTypeSet, ps.e)
+			if err != nil {
+				errs[3] = err
+				return
+			}
 
 			entry := &logfile.LogEntry{Key: ps.sum, Value: ps.mem}
 			_, size := logfile.EncodeEntry(ps.e)
@@ -192,16 +217,22 @@ func (tx *Tx) Commit() error {
 
 			idxTree := tx.db.setIndex.trees[string(ps.e.Key)]
 			tx.db.updateIndexTree(valueTypeSet, idxTree, entry, valuePos, false)
-
+			tx.db.notifyChange(valueTypeSet, ps.e)
+			tx.db.notifyKeyspaceEvent(notifySet, "sadd", ps.e.Key)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
 		for _, e := range tx.pendingZSet {
-			e.TxStat = logfile.TxCommited
-			valuePos, _ := tx.db.writeLogEntry(valueTypeZSet, e)
+			e.TxID, e.TxStat = tx.id, logfile.TxCommited
+			valuePos, err := tx.db.writeLogEntry(valueTypeZSet, e)
+			if err != nil {
+				errs[4] = err
+				return
+			}
 			tx.db.updateIndexTree(valueTypeZSet, tx.db.strIndex.idxTree, e, valuePos, true)
+			tx.db.notifyChange(valueTypeZSet, e)
 		}
 	}()
 
@@ -217,5 +248,10 @@ func (tx *Tx) Commit() error {
 	tx.pendingHash = nil
 	tx.status = pending
 
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 
 func (tx *Tx) SAdd(key []byte, members ...[]byte) {
 	if tx.db.setIndex.trees[string(key)] == nil {
+		tx.db.indexCollectionKey(valueTypeSet, key)
 		tx.db.setIndex.trees[string(key)] = ds.NewART()
 	}
 
@@ -1,17 +1,24 @@
 package lazydb
 
 import (
+	"bytes"
 	"errors"
 	"github.com/gansidui/skiplist"
 	"lazydb/ds"
 	"lazydb/logfile"
 	"lazydb/util"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
 	ErrZSetKeyNotExist    = errors.New("zset key not exist")
 	ErrZSetMemberNotExist = errors.New("zset member not exist")
+	ErrInvalidRangeBound  = errors.New("range bound is invalid")
+	ErrZSetWeightsNumber  = errors.New("number of weights is not equal to number of keys")
 )
 
 type ZSetIndex struct {
@@ -24,14 +31,29 @@ type Node struct {
 	member string
 }
 
+// Less orders the nodes by score, and the nodes with the same score by member bytes like redis,
+// so every (score, member) pair is unique in the skip list.
 func (n *Node) Less(other interface{}) bool {
-	if n.score < other.(*Node).score {
-		return true
+	o := other.(*Node)
+	if n.score != o.score {
+		return n.score < o.score
 	}
-	if n.score == other.(*Node).score && len(n.member) < len(other.(*Node).member) {
-		return true
+	return n.member < o.member
+}
+
+// insertNode inserts member with score into the skip list, unless the same pair is already there.
+// The member is copied, so the caller may reuse it.
+func (idx *ZSetIndex) insertNode(score float64, member []byte) {
+	node := &Node{score: score, member: string(member)}
+	if idx.skl.Find(node) != nil {
+		return
 	}
-	return false
+	idx.skl.Insert(node)
+}
+
+// deleteNode deletes member with score from the skip list.
+func (idx *ZSetIndex) deleteNode(score float64, member []byte) {
+	idx.skl.Delete(&Node{score: score, member: util.ByteToString(member)})
 }
 
 // ZAdd adds the specified member with the specified score to the sorted set stored at key.
@@ -44,18 +66,31 @@ func (db *LazyDB) ZAdd(key []byte, args ...[]byte) error {
 	}
 	db.zSetIndex.mu.Lock()
 	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return err
+	}
+
+	if err := db.zAdd(key, args...); err != nil {
+		return err
+	}
+	db.notifyKeyspaceEvent(notifyZSet, "zadd", key)
+	return nil
+}
 
+// zAdd is the same as ZAdd, but the caller must hold the lock.
+func (db *LazyDB) zAdd(key []byte, args ...[]byte) error {
 	strKey := util.ByteToString(key)
 	if db.zSetIndex.indexes[strKey] == nil {
 		tree := ds.NewART()
 		skl := skiplist.New()
+		db.indexCollectionKey(valueTypeZSet, key)
 		db.zSetIndex.indexes[strKey] = &ZSetIndex{
 			tree: tree,
 			skl:  skl,
 		}
 	}
-	tree := db.zSetIndex.indexes[strKey].tree
-	skl := db.zSetIndex.indexes[strKey].skl
+	idx := db.zSetIndex.indexes[strKey]
+	tree := idx.tree
 	for i := 0; i < len(args); i += 2 {
 		score, member := args[i], args[i+1]
 		zsetKey := encodeKey(key, member)
@@ -69,13 +104,14 @@ func (db *LazyDB) ZAdd(key []byte, args ...[]byte) error {
 			if err != nil {
 				return err
 			}
-			skl.Delete(&Node{score: util.ByteToFloat64(oriScore), member: util.ByteToString(member)})
+			idx.deleteNode(util.ByteToFloat64(oriScore), member)
 		}
 		err = db.updateIndexTree(valueTypeZSet, tree, entry, valPos, true)
 		if err != nil {
 			return err
 		}
-		skl.Insert(&Node{score: util.ByteToFloat64(score), member: util.ByteToString(member)})
+		idx.insertNode(util.ByteToFloat64(score), member)
+		db.notifyChange(valueTypeZSet, entry)
 	}
 	return nil
 }
@@ -85,7 +121,7 @@ func (db *LazyDB) ZScore(key, member []byte) (score float64, err error) {
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.tree == nil {
 		return 0, ErrZSetKeyNotExist
 	}
@@ -103,7 +139,7 @@ func (db *LazyDB) ZCard(key []byte) int {
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.tree == nil {
 		return 0
 	}
@@ -143,7 +179,7 @@ func (db *LazyDB) ZRange(key []byte, start, stop int) (members [][]byte) {
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.skl == nil {
 		return nil
 	}
@@ -169,7 +205,7 @@ func (db *LazyDB) ZRangeWithScores(key []byte, start, stop int) (members [][]byt
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.skl == nil {
 		return nil, nil
 	}
@@ -198,7 +234,7 @@ func (db *LazyDB) ZRevRange(key []byte, start, stop int) (members [][]byte) {
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.skl == nil {
 		return nil
 	}
@@ -226,7 +262,7 @@ func (db *LazyDB) ZRevRangeWithScores(key []byte, start, stop int) (members [][]
 	db.zSetIndex.mu.RLock()
 	defer db.zSetIndex.mu.RUnlock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.skl == nil {
 		return nil, nil
 	}
@@ -252,12 +288,24 @@ func (db *LazyDB) ZRevRangeWithScores(key []byte, start, stop int) (members [][]
 // If member does not exist in the sorted set, it is added with increment as its score (as if its previous score was 0.0).
 // If key does not exist, a new sorted set with the specified member as its sole member is created.
 func (db *LazyDB) ZIncrBy(key []byte, increment float64, member []byte) (float64, error) {
-	score, _ := db.ZScore(key, member)
-	err := db.ZAdd(key, util.Float64ToByte(score+increment), member)
-	if err != nil {
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
+
+	var score float64
+	if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx != nil {
+		if val, err := db.getValue(idx.tree, encodeKey(key, member), valueTypeZSet); err == nil {
+			score = util.ByteToFloat64(val)
+		}
+	}
+	score += increment
+	if err := db.zAdd(key, util.Float64ToByte(score), member); err != nil {
 		return 0, err
 	}
-	return score + increment, nil
+	db.notifyKeyspaceEvent(notifyZSet, "zincr", key)
+	return score, nil
 }
 
 // ZRem removes the specified members from the sorted set stored at key. Non existing members are ignored.
@@ -265,7 +313,42 @@ func (db *LazyDB) ZIncrBy(key []byte, increment float64, member []byte) (float64
 func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
 	db.zSetIndex.mu.Lock()
 	defer db.zSetIndex.mu.Unlock()
+	if err = db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
+
+	number, err = db.zRem(key, members...)
+	if number > 0 {
+		if nerr := db.notifyZRem(key, "zrem"); err == nil {
+			err = nerr
+		}
+	}
+	return number, err
+}
+
+// notifyZRem publishes the keyspace event of removing members from key, and "del" if the sorted set becomes empty.
+// The ttl of an emptied sorted set is removed as well.
+func (db *LazyDB) notifyZRem(key []byte, event string) error {
+	db.notifyKeyspaceEvent(notifyZSet, event, key)
+	if idx := db.zSetIndex.indexes[util.ByteToString(key)]; idx == nil || idx.tree.Size() == 0 {
+		if err := db.setKeyExpire(valueTypeZSet, key, 0); err != nil {
+			return err
+		}
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return nil
+}
+
+// getZSetIndex returns the index of the sorted set stored at key, or nil if it does not exist or has expired.
+func (db *LazyDB) getZSetIndex(key []byte) *ZSetIndex {
+	if db.keyExpired(valueTypeZSet, key) {
+		return nil
+	}
+	return db.zSetIndex.indexes[util.ByteToString(key)]
+}
 
+// zRem is the same as ZRem, but the caller must hold the lock.
+func (db *LazyDB) zRem(key []byte, members ...[]byte) (int, error) {
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.tree == nil {
 		return 0, nil
@@ -286,8 +369,9 @@ func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
 			continue
 		}
 		val, updated := idx.tree.Delete(zSetKey)
-		idx.skl.Delete(&Node{score: util.ByteToFloat64(score), member: util.ByteToString(member)})
+		idx.deleteNode(util.ByteToFloat64(score), member)
 		count++
+		db.notifyChange(valueTypeZSet, entry)
 		// delete invalid entry
 		db.sendDiscard(val, updated, valueTypeZSet)
 		// also merge the delete entry
@@ -307,6 +391,10 @@ func (db *LazyDB) ZRem(key []byte, members ...[]byte) (number int, err error) {
 // Specifying a count value that is higher than the sorted set's cardinality will not produce an error.
 func (db *LazyDB) ZPopMax(key []byte) ([]byte, float64, error) {
 	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return nil, 0, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.tree == nil || idx.skl == nil || idx.skl.Len() == 0 {
@@ -316,20 +404,22 @@ func (db *LazyDB) ZPopMax(key []byte) ([]byte, float64, error) {
 	member := element.Value.(*Node).member
 	score := element.Value.(*Node).score
 
-	db.zSetIndex.mu.Unlock()
-
-	_, err := db.ZRem(key, util.StringToByte(member))
+	_, err := db.zRem(key, util.StringToByte(member))
 	if err != nil {
 		return nil, 0, err
 	}
+	if err := db.notifyZRem(key, "zpopmax"); err != nil {
+		return nil, 0, err
+	}
 	return util.StringToByte(member), score, nil
 }
 
 func (db *LazyDB) ZPopMaxWithCount(key []byte, count int) (members [][]byte, scores []float64, err error) {
 	db.zSetIndex.mu.Lock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.tree == nil || idx.skl == nil {
+		db.zSetIndex.mu.Unlock()
 		return nil, nil, nil
 	}
 	count = util.Min(count, idx.skl.Len())
@@ -352,6 +442,10 @@ func (db *LazyDB) ZPopMaxWithCount(key []byte, count int) (members [][]byte, sco
 // Specifying a count value that is higher than the sorted set's cardinality will not produce an error.
 func (db *LazyDB) ZPopMin(key []byte) ([]byte, float64, error) {
 	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return nil, 0, err
+	}
 
 	idx := db.zSetIndex.indexes[util.ByteToString(key)]
 	if idx == nil || idx.tree == nil || idx.skl == nil || idx.skl.Len() == 0 {
@@ -361,20 +455,22 @@ func (db *LazyDB) ZPopMin(key []byte) ([]byte, float64, error) {
 	member := element.Value.(*Node).member
 	score := element.Value.(*Node).score
 
-	db.zSetIndex.mu.Unlock()
-
-	_, err := db.ZRem(key, util.StringToByte(member))
+	_, err := db.zRem(key, util.StringToByte(member))
 	if err != nil {
 		return nil, 0, err
 	}
+	if err := db.notifyZRem(key, "zpopmin"); err != nil {
+		return nil, 0, err
+	}
 	return util.StringToByte(member), score, nil
 }
 
 func (db *LazyDB) ZPopMinWithCount(key []byte, count int) (members [][]byte, scores []float64, err error) {
 	db.zSetIndex.mu.Lock()
 
-	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	idx := db.getZSetIndex(key)
 	if idx == nil || idx.tree == nil || idx.skl == nil {
+		db.zSetIndex.mu.Unlock()
 		return nil, nil, nil
 	}
 	count = util.Min(count, idx.skl.Len())
@@ -391,3 +487,566 @@ func (db *LazyDB) ZPopMinWithCount(key []byte, count int) (members [][]byte, sco
 	}
 	return
 }
+
+// ScoreBound is a bound of a score range, use math.Inf for an unbounded side.
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// LexBound is a bound of a lexicographical range.
+// Inf -1 and 1 stand for the "-" and "+" bounds of redis, which are smaller and greater than any member.
+type LexBound struct {
+	Value     []byte
+	Exclusive bool
+	Inf       int
+}
+
+// ParseScoreBound parses a score bound in the format of redis, like "1.5", "(1.5", "-inf" or "+inf".
+func ParseScoreBound(s string) (ScoreBound, error) {
+	var bound ScoreBound
+	if strings.HasPrefix(s, "(") {
+		bound.Exclusive = true
+		s = s[1:]
+	}
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(val) {
+		return bound, ErrInvalidRangeBound
+	}
+	bound.Value = val
+	return bound, nil
+}
+
+// ParseLexBound parses a lexicographical bound in the format of redis, like "[a", "(a", "-" or "+".
+func ParseLexBound(s string) (LexBound, error) {
+	switch {
+	case s == "-":
+		return LexBound{Inf: -1}, nil
+	case s == "+":
+		return LexBound{Inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return LexBound{Value: []byte(s[1:])}, nil
+	case strings.HasPrefix(s, "("):
+		return LexBound{Value: []byte(s[1:]), Exclusive: true}, nil
+	}
+	return LexBound{}, ErrInvalidRangeBound
+}
+
+// ZRangeBy is the kind of range of ZRangeWithArgs.
+type ZRangeBy int
+
+const (
+	ZRangeByRank ZRangeBy = iota
+	ZRangeByScore
+	ZRangeByLex
+)
+
+// ZRangeArgs are the arguments of ZRangeWithArgs, which is the same as ZRANGE of redis 6.2.
+type ZRangeArgs struct {
+	By ZRangeBy
+	// Start and Stop are the 0-based ranks of ZRangeByRank, negative ones count from the end.
+	Start, Stop int
+	// Min and Max are the bounds of ZRangeByScore.
+	Min, Max ScoreBound
+	// LexMin and LexMax are the bounds of ZRangeByLex.
+	LexMin, LexMax LexBound
+	// Rev orders the elements from the highest to the lowest.
+	Rev bool
+	// Offset skips elements of the range, and Count limits the number of returned ones if it is positive.
+	Offset, Count int
+}
+
+// ZRangeByScore returns the members of the sorted set stored at key with a score between min and max,
+// ordered from the lowest to the highest score. Parameter offset skips members, and count limits
+// the number of members if it is positive.
+func (db *LazyDB) ZRangeByScore(key []byte, min, max ScoreBound, offset, count int) [][]byte {
+	members, _ := db.ZRangeWithArgs(key, ZRangeArgs{By: ZRangeByScore, Min: min, Max: max, Offset: offset, Count: count})
+	return members
+}
+
+// ZRangeByScoreWithScores is the same as ZRangeByScore, and it also returns the scores.
+func (db *LazyDB) ZRangeByScoreWithScores(key []byte, min, max ScoreBound, offset, count int) ([][]byte, []float64) {
+	return db.ZRangeWithArgs(key, ZRangeArgs{By: ZRangeByScore, Min: min, Max: max, Offset: offset, Count: count})
+}
+
+// ZRevRangeByScore returns the members of the sorted set stored at key with a score between max and min,
+// ordered from the highest to the lowest score.
+func (db *LazyDB) ZRevRangeByScore(key []byte, max, min ScoreBound, offset, count int) [][]byte {
+	members, _ := db.ZRangeWithArgs(key, ZRangeArgs{By: ZRangeByScore, Min: min, Max: max, Rev: true, Offset: offset, Count: count})
+	return members
+}
+
+// ZRevRangeByScoreWithScores is the same as ZRevRangeByScore, and it also returns the scores.
+func (db *LazyDB) ZRevRangeByScoreWithScores(key []byte, max, min ScoreBound, offset, count int) ([][]byte, []float64) {
+	return db.ZRangeWithArgs(key, ZRangeArgs{By: ZRangeByScore, Min: min, Max: max, Rev: true, Offset: offset, Count: count})
+}
+
+// ZRangeByLex returns the members of the sorted set stored at key between min and max in lexicographical order.
+// All members are expected to have the same score, like redis.
+func (db *LazyDB) ZRangeByLex(key []byte, min, max LexBound, offset, count int) [][]byte {
+	members, _ := db.ZRangeWithArgs(key, ZRangeArgs{By: ZRangeByLex, LexMin: min, LexMax: max, Offset: offset, Count: count})
+	return members
+}
+
+// ZRevRangeByLex returns the members of the sorted set stored at key between max and min
+// in reverse lexicographical order.
+func (db *LazyDB) ZRevRangeByLex(key []byte, max, min LexBound, offset, count int) [][]byte {
+	members, _ := db.ZRangeWithArgs(key, ZRangeArgs{By: ZRangeByLex, LexMin: min, LexMax: max, Rev: true, Offset: offset, Count: count})
+	return members
+}
+
+// ZCount returns the number of members of the sorted set stored at key with a score between min and max.
+func (db *LazyDB) ZCount(key []byte, min, max ScoreBound) int {
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return 0
+	}
+	first, last := zScoreRange(idx, min, max)
+	return util.Max(last-first+1, 0)
+}
+
+// ZLexCount returns the number of members of the sorted set stored at key between min and max.
+func (db *LazyDB) ZLexCount(key []byte, min, max LexBound) int {
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.getZSetIndex(key)
+	if idx == nil {
+		return 0
+	}
+	first, last := zLexRange(idx, min, max)
+	return util.Max(last-first+1, 0)
+}
+
+// ZRangeWithArgs returns the members and scores of the sorted set stored at key in the range given by args.
+// Ranges are located with the skip list, so only the returned elements are walked.
+func (db *LazyDB) ZRangeWithArgs(key []byte, args ZRangeArgs) (members [][]byte, scores []float64) {
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	idx := db.getZSetIndex(key)
+	if idx == nil || idx.skl == nil {
+		return nil, nil
+	}
+	var first, last int
+	switch args.By {
+	case ZRangeByScore:
+		first, last = zScoreRange(idx, args.Min, args.Max)
+	case ZRangeByLex:
+		first, last = zLexRange(idx, args.LexMin, args.LexMax)
+	default:
+		first, last = zRankRange(idx, args.Start, args.Stop, args.Rev)
+	}
+	return zCollect(idx, first, last, args.Rev, args.Offset, args.Count)
+}
+
+// ZRemRangeByScore removes the members of the sorted set stored at key with a score between min and max,
+// and returns the number of removed members.
+func (db *LazyDB) ZRemRangeByScore(key []byte, min, max ScoreBound) (int, error) {
+	return db.zRemRange(key, "zremrangebyscore", func(idx *ZSetIndex) (int, int) {
+		return zScoreRange(idx, min, max)
+	})
+}
+
+// ZRemRangeByRank removes the members of the sorted set stored at key between the 0-based ranks start and stop,
+// and returns the number of removed members. Negative ranks count from the member with the highest score.
+func (db *LazyDB) ZRemRangeByRank(key []byte, start, stop int) (int, error) {
+	return db.zRemRange(key, "zremrangebyrank", func(idx *ZSetIndex) (int, int) {
+		return zRankRange(idx, start, stop, false)
+	})
+}
+
+// ZRemRangeByLex removes the members of the sorted set stored at key between min and max,
+// and returns the number of removed members. All members are expected to have the same score, like redis.
+func (db *LazyDB) ZRemRangeByLex(key []byte, min, max LexBound) (int, error) {
+	return db.zRemRange(key, "zremrangebylex", func(idx *ZSetIndex) (int, int) {
+		return zLexRange(idx, min, max)
+	})
+}
+
+// zRemRange removes the members between the 1-based ranks returned by rank.
+// The tombstones of all members are written into the log file at once.
+func (db *LazyDB) zRemRange(key []byte, event string, rank func(*ZSetIndex) (int, int)) (int, error) {
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, key); err != nil {
+		return 0, err
+	}
+
+	idx := db.zSetIndex.indexes[util.ByteToString(key)]
+	if idx == nil || idx.tree == nil || idx.skl == nil {
+		return 0, nil
+	}
+	first, last := rank(idx)
+	members, scores := zCollect(idx, first, last, false, 0, 0)
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	entries := make([]*logfile.LogEntry, len(members))
+	for i, member := range members {
+		entries[i] = &logfile.LogEntry{Key: encodeKey(key, member), Stat: logfile.SDelete}
+	}
+	valPos, err := db.writeLogEntries(valueTypeZSet, entries)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		val, updated := idx.tree.Delete(entry.Key)
+		idx.deleteNode(scores[i], members[i])
+		db.notifyChange(valueTypeZSet, entry)
+		db.sendDiscard(val, updated, valueTypeZSet)
+		db.sendDiscard(&Value{fid: valPos[i].fid, entrySize: valPos[i].entrySize}, true, valueTypeZSet)
+	}
+	if err := db.notifyZRem(key, event); err != nil {
+		return len(members), err
+	}
+	return len(members), nil
+}
+
+// zScoreRange returns the 1-based ranks of the first and last elements with a score between min and max.
+func zScoreRange(idx *ZSetIndex, min, max ScoreBound) (first, last int) {
+	first = zLowerBound(idx, func(n *Node) bool {
+		return n.score > min.Value || !min.Exclusive && n.score == min.Value
+	})
+	last = zLowerBound(idx, func(n *Node) bool {
+		return n.score > max.Value || max.Exclusive && n.score == max.Value
+	}) - 1
+	return first, last
+}
+
+// zLexRange returns the 1-based ranks of the first and last elements with a member between min and max.
+func zLexRange(idx *ZSetIndex, min, max LexBound) (first, last int) {
+	first = zLowerBound(idx, func(n *Node) bool {
+		return !lexBelow(n.member, min, true)
+	})
+	last = zLowerBound(idx, func(n *Node) bool {
+		return lexBelow(n.member, max, false)
+	}) - 1
+	return first, last
+}
+
+// lexBelow reports whether member is out of the range on the side of bound, which is the lower side if isMin is true.
+func lexBelow(member string, bound LexBound, isMin bool) bool {
+	if bound.Inf != 0 {
+		// "-" excludes nothing as a min and everything as a max, "+" the other way around.
+		return (bound.Inf > 0) == isMin
+	}
+	cmp := bytes.Compare(util.StringToByte(member), bound.Value)
+	if isMin {
+		return cmp < 0 || bound.Exclusive && cmp == 0
+	}
+	return cmp > 0 || bound.Exclusive && cmp == 0
+}
+
+// zRankRange returns the 1-based ranks of the first and last elements between the 0-based ranks start and stop,
+// which count from the highest score if rev is true.
+func zRankRange(idx *ZSetIndex, start, stop int, rev bool) (first, last int) {
+	length := idx.skl.Len()
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = util.Max(start, 0)
+	stop = util.Min(stop, length-1)
+	if rev {
+		return length - stop, length - start
+	}
+	return start + 1, stop + 1
+}
+
+// zLowerBound returns the 1-based rank of the first element matching pred, or the length plus one if none matches.
+// pred must be false for a prefix of the elements and true for the rest of them.
+func zLowerBound(idx *ZSetIndex, pred func(*Node) bool) int {
+	return sort.Search(idx.skl.Len(), func(i int) bool {
+		return pred(idx.skl.GetElementByRank(i + 1).Value.(*Node))
+	}) + 1
+}
+
+// zCollect returns the elements between the 1-based ranks first and last, skipping offset of them
+// and returning at most count of them if count is positive. Elements are walked backward if rev is true.
+func zCollect(idx *ZSetIndex, first, last int, rev bool, offset, count int) (members [][]byte, scores []float64) {
+	if offset < 0 || first > last {
+		return nil, nil
+	}
+	n := last - first + 1 - offset
+	if count > 0 {
+		n = util.Min(n, count)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	rank := first + offset
+	if rev {
+		rank = last - offset
+	}
+	e := idx.skl.GetElementByRank(rank)
+	for i := 0; i < n && e != nil; i++ {
+		node := e.Value.(*Node)
+		members = append(members, util.StringToByte(node.member))
+		scores = append(scores, node.score)
+		if rev {
+			e = e.Prev()
+		} else {
+			e = e.Next()
+		}
+	}
+	return members, scores
+}
+
+// ZAggregate is the way the scores of a member in several sorted sets are aggregated.
+type ZAggregate int
+
+const (
+	ZAggregateSum ZAggregate = iota
+	ZAggregateMin
+	ZAggregateMax
+)
+
+// ZStoreOptions are the options of ZUnion and ZInter, which are the same as WEIGHTS and AGGREGATE of redis.
+type ZStoreOptions struct {
+	// Weights multiply the scores of the sorted set at the same position of keys, every weight is 1 if it is nil.
+	Weights []float64
+	// Aggregate is the way the weighted scores of a member are aggregated, ZAggregateSum by default.
+	Aggregate ZAggregate
+}
+
+// ZUnion returns the union of the sorted sets stored at keys, ordered by score.
+// Non existing keys are considered as empty sorted sets.
+func (db *LazyDB) ZUnion(keys [][]byte, opts ZStoreOptions) ([][]byte, []float64, error) {
+	return db.zCombineRead(keys, opts, setOpUnion)
+}
+
+// ZUnionStore stores the union of the sorted sets stored at keys in destination,
+// and returns the number of members of the resulting sorted set.
+func (db *LazyDB) ZUnionStore(destination []byte, keys [][]byte, opts ZStoreOptions) (int, error) {
+	return db.zCombineStore(destination, keys, opts, setOpUnion, "zunionstore")
+}
+
+// ZInter returns the intersection of the sorted sets stored at keys, ordered by score.
+func (db *LazyDB) ZInter(keys [][]byte, opts ZStoreOptions) ([][]byte, []float64, error) {
+	return db.zCombineRead(keys, opts, setOpInter)
+}
+
+// ZInterStore stores the intersection of the sorted sets stored at keys in destination,
+// and returns the number of members of the resulting sorted set.
+func (db *LazyDB) ZInterStore(destination []byte, keys [][]byte, opts ZStoreOptions) (int, error) {
+	return db.zCombineStore(destination, keys, opts, setOpInter, "zinterstore")
+}
+
+// ZDiff returns the members of the first sorted set that are not in the other ones with their scores, ordered by score.
+func (db *LazyDB) ZDiff(keys ...[]byte) ([][]byte, []float64) {
+	members, scores, _ := db.zCombineRead(keys, ZStoreOptions{}, setOpDiff)
+	return members, scores
+}
+
+// ZDiffStore stores the difference between the first sorted set and the other ones in destination,
+// and returns the number of members of the resulting sorted set.
+func (db *LazyDB) ZDiffStore(destination []byte, keys ...[]byte) (int, error) {
+	return db.zCombineStore(destination, keys, ZStoreOptions{}, setOpDiff, "zdiffstore")
+}
+
+func (db *LazyDB) zCombineRead(keys [][]byte, opts ZStoreOptions, op setOp) ([][]byte, []float64, error) {
+	db.zSetIndex.mu.RLock()
+	defer db.zSetIndex.mu.RUnlock()
+
+	result, err := db.zCombine(keys, opts, op)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, scores := zSortScores(result)
+	return members, scores, nil
+}
+
+// zCombineStore overwrites the sorted set stored at destination with the result of op.
+// The index lock is held from reading the sources to writing destination, and all entries of destination
+// are written into the log file at once, so destination is replaced as a whole.
+func (db *LazyDB) zCombineStore(destination []byte, keys [][]byte, opts ZStoreOptions, op setOp, event string) (int, error) {
+	db.zSetIndex.mu.Lock()
+	defer db.zSetIndex.mu.Unlock()
+	if err := db.expireIfNeeded(valueTypeZSet, destination); err != nil {
+		return 0, err
+	}
+
+	result, err := db.zCombine(keys, opts, op)
+	if err != nil {
+		return 0, err
+	}
+	existed := db.keyExists(valueTypeZSet, destination)
+	if err := db.zStore(destination, result); err != nil {
+		return 0, err
+	}
+	if len(result) > 0 {
+		db.notifyKeyspaceEvent(notifyZSet, event, destination)
+	} else if existed {
+		db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+	}
+	return len(result), nil
+}
+
+// zCombine returns the scores of the members resulting from op on the sorted sets stored at keys.
+// The caller must hold the lock.
+func (db *LazyDB) zCombine(keys [][]byte, opts ZStoreOptions, op setOp) (map[string]float64, error) {
+	if opts.Weights != nil && len(opts.Weights) != len(keys) {
+		return nil, ErrZSetWeightsNumber
+	}
+	if len(keys) == 0 {
+		return map[string]float64{}, nil
+	}
+	sets := make([]map[string]float64, len(keys))
+	for i, key := range keys {
+		weight := 1.0
+		if opts.Weights != nil {
+			weight = opts.Weights[i]
+		}
+		sets[i] = db.zScores(key, weight)
+	}
+
+	result := make(map[string]float64)
+	switch op {
+	case setOpUnion:
+		for _, set := range sets {
+			for member, score := range set {
+				if acc, ok := result[member]; ok {
+					score = zAggregate(opts.Aggregate, acc, score)
+				}
+				result[member] = score
+			}
+		}
+	case setOpInter:
+	inter:
+		for member, score := range sets[0] {
+			for _, set := range sets[1:] {
+				other, ok := set[member]
+				if !ok {
+					continue inter
+				}
+				score = zAggregate(opts.Aggregate, score, other)
+			}
+			result[member] = score
+		}
+	case setOpDiff:
+	diff:
+		for member, score := range sets[0] {
+			for _, set := range sets[1:] {
+				if _, ok := set[member]; ok {
+					continue diff
+				}
+			}
+			result[member] = score
+		}
+	}
+	return result, nil
+}
+
+// zScores returns the scores of the members of the sorted set stored at key multiplied by weight.
+// Scores are read from the skip list, so no log file is read.
+func (db *LazyDB) zScores(key []byte, weight float64) map[string]float64 {
+	idx := db.getZSetIndex(key)
+	if idx == nil || idx.skl == nil {
+		return nil
+	}
+	scores := make(map[string]float64, idx.skl.Len())
+	for e := idx.skl.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*Node)
+		score := node.score * weight
+		// like redis, 0 * inf is 0
+		if math.IsNaN(score) {
+			score = 0
+		}
+		scores[node.member] = score
+	}
+	return scores
+}
+
+func zAggregate(aggregate ZAggregate, a, b float64) float64 {
+	switch aggregate {
+	case ZAggregateMin:
+		return math.Min(a, b)
+	case ZAggregateMax:
+		return math.Max(a, b)
+	}
+	// like redis, inf + -inf is 0
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// zSortScores returns the members and scores of result ordered by score, then by member.
+func zSortScores(result map[string]float64) ([][]byte, []float64) {
+	if len(result) == 0 {
+		return nil, nil
+	}
+	nodes := make([]*Node, 0, len(result))
+	for member, score := range result {
+		nodes = append(nodes, &Node{score: score, member: member})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Less(nodes[j]) })
+	members := make([][]byte, len(nodes))
+	scores := make([]float64, len(nodes))
+	for i, node := range nodes {
+		members[i], scores[i] = []byte(node.member), node.score
+	}
+	return members, scores
+}
+
+// zStore overwrites the sorted set stored at key with result, and removes its ttl.
+// The caller must hold the lock.
+func (db *LazyDB) zStore(key []byte, result map[string]float64) error {
+	if err := db.setKeyExpire(valueTypeZSet, key, 0); err != nil {
+		return err
+	}
+	strKey := util.ByteToString(key)
+	idx := db.zSetIndex.indexes[strKey]
+	if idx == nil {
+		if len(result) == 0 {
+			return nil
+		}
+		idx = &ZSetIndex{tree: ds.NewART(), skl: skiplist.New()}
+		db.indexCollectionKey(valueTypeZSet, key)
+		db.zSetIndex.indexes[strKey] = idx
+	}
+
+	// the members to remove are taken from the skip list before it is changed
+	var entries []*logfile.LogEntry
+	oldScores := make(map[string]float64, idx.skl.Len())
+	for e := idx.skl.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*Node)
+		oldScores[node.member] = node.score
+		if _, ok := result[node.member]; !ok {
+			entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, []byte(node.member)), Stat: logfile.SDelete})
+		}
+	}
+	for member, score := range result {
+		entries = append(entries, &logfile.LogEntry{Key: encodeKey(key, []byte(member)), Value: util.Float64ToByte(score)})
+	}
+	valPos, err := db.writeLogEntries(valueTypeZSet, entries)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		_, member := decodeKey(entry.Key)
+		if oldScore, ok := oldScores[string(member)]; ok {
+			idx.deleteNode(oldScore, member)
+		}
+		if entry.Stat == logfile.SDelete {
+			val, updated := idx.tree.Delete(entry.Key)
+			db.sendDiscard(val, updated, valueTypeZSet)
+			db.sendDiscard(&Value{fid: valPos[i].fid, entrySize: valPos[i].entrySize}, true, valueTypeZSet)
+		} else {
+			if err := db.updateIndexTree(valueTypeZSet, idx.tree, entry, valPos[i], true); err != nil {
+				return err
+			}
+			idx.insertNode(util.ByteToFloat64(entry.Value), member)
+		}
+		db.notifyChange(valueTypeZSet, entry)
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package lazydb
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"lazydb/util"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 )
 
 func initTestZset() *LazyDB {
@@ -827,3 +831,399 @@ func TestLazyDB_ZPopMinWithCount(t *testing.T) {
 		})
 	}
 }
+
+func TestLazyDB_ZRangeByScore(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i, member := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		_ = db.ZAdd([]byte("k1"), util.Float64ToByte(float64(i+1)), []byte(member))
+	}
+	inf := ScoreBound{Value: math.Inf(1)}
+	negInf := ScoreBound{Value: math.Inf(-1)}
+
+	tests := []struct {
+		name            string
+		min, max        ScoreBound
+		offset, count   int
+		rev             bool
+		expectedMembers []string
+		expectedScores  []float64
+	}{
+		{"inclusive", ScoreBound{Value: 2}, ScoreBound{Value: 4}, 0, 0, false,
+			[]string{"m2", "m3", "m4"}, []float64{2, 3, 4}},
+		{"exclusive", ScoreBound{Value: 2, Exclusive: true}, ScoreBound{Value: 4, Exclusive: true}, 0, 0, false,
+			[]string{"m3"}, []float64{3}},
+		{"infinite", negInf, inf, 0, 0, false,
+			[]string{"m1", "m2", "m3", "m4", "m5"}, []float64{1, 2, 3, 4, 5}},
+		{"limit", negInf, inf, 1, 2, false,
+			[]string{"m2", "m3"}, []float64{2, 3}},
+		{"offset out of range", negInf, inf, 5, 2, false, nil, nil},
+		{"empty range", ScoreBound{Value: 3, Exclusive: true}, ScoreBound{Value: 3}, 0, 0, false, nil, nil},
+		{"rev", ScoreBound{Value: 2}, inf, 0, 0, true,
+			[]string{"m5", "m4", "m3", "m2"}, []float64{5, 4, 3, 2}},
+		{"rev limit", negInf, ScoreBound{Value: 4, Exclusive: true}, 1, 1, true,
+			[]string{"m2"}, []float64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var members [][]byte
+			var scores []float64
+			if tt.rev {
+				members, scores = db.ZRevRangeByScoreWithScores([]byte("k1"), tt.max, tt.min, tt.offset, tt.count)
+				assert.Equal(t, members, db.ZRevRangeByScore([]byte("k1"), tt.max, tt.min, tt.offset, tt.count))
+			} else {
+				members, scores = db.ZRangeByScoreWithScores([]byte("k1"), tt.min, tt.max, tt.offset, tt.count)
+				assert.Equal(t, members, db.ZRangeByScore([]byte("k1"), tt.min, tt.max, tt.offset, tt.count))
+			}
+			var got []string
+			for _, m := range members {
+				got = append(got, string(m))
+			}
+			assert.Equal(t, tt.expectedMembers, got)
+			assert.Equal(t, tt.expectedScores, scores)
+		})
+	}
+
+	assert.Equal(t, 3, db.ZCount([]byte("k1"), ScoreBound{Value: 1, Exclusive: true}, ScoreBound{Value: 4}))
+	assert.Equal(t, 0, db.ZCount([]byte("k1"), ScoreBound{Value: 6}, inf))
+	assert.Equal(t, 0, db.ZCount([]byte("k2"), negInf, inf))
+	assert.Nil(t, db.ZRangeByScore([]byte("k2"), negInf, inf, 0, 0))
+}
+
+func TestLazyDB_ZRangeByLex(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for _, member := range []string{"a", "bb", "ccc", "dddd", "eeeee"} {
+		_ = db.ZAdd([]byte("k1"), util.Float64ToByte(0), []byte(member))
+	}
+	parse := func(s string) LexBound {
+		bound, err := ParseLexBound(s)
+		assert.NoError(t, err)
+		return bound
+	}
+
+	tests := []struct {
+		name          string
+		min, max      string
+		offset, count int
+		rev           bool
+		expected      []string
+	}{
+		{"all", "-", "+", 0, 0, false, []string{"a", "bb", "ccc", "dddd", "eeeee"}},
+		{"inclusive", "[bb", "[dddd", 0, 0, false, []string{"bb", "ccc", "dddd"}},
+		{"exclusive", "(bb", "(dddd", 0, 0, false, []string{"ccc"}},
+		{"between members", "[b", "[d", 0, 0, false, []string{"bb", "ccc"}},
+		{"limit", "-", "+", 2, 2, false, []string{"ccc", "dddd"}},
+		{"empty range", "+", "-", 0, 0, false, nil},
+		{"rev", "[bb", "+", 0, 0, true, []string{"eeeee", "dddd", "ccc", "bb"}},
+		{"rev limit", "-", "(eeeee", 1, 2, true, []string{"ccc", "bb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var members [][]byte
+			if tt.rev {
+				members = db.ZRevRangeByLex([]byte("k1"), parse(tt.max), parse(tt.min), tt.offset, tt.count)
+			} else {
+				members = db.ZRangeByLex([]byte("k1"), parse(tt.min), parse(tt.max), tt.offset, tt.count)
+			}
+			var got []string
+			for _, m := range members {
+				got = append(got, string(m))
+			}
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+
+	assert.Equal(t, 2, db.ZLexCount([]byte("k1"), parse("(a"), parse("[ccc")))
+	assert.Equal(t, 5, db.ZLexCount([]byte("k1"), parse("-"), parse("+")))
+	assert.Equal(t, 0, db.ZLexCount([]byte("k2"), parse("-"), parse("+")))
+
+	_, err := ParseLexBound("a")
+	assert.Equal(t, ErrInvalidRangeBound, err)
+}
+
+func TestLazyDB_ZRangeWithArgs(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	for i, member := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		_ = db.ZAdd([]byte("k1"), util.Float64ToByte(float64(i+1)), []byte(member))
+	}
+	min, err := ParseScoreBound("(1")
+	assert.NoError(t, err)
+	max, err := ParseScoreBound("+inf")
+	assert.NoError(t, err)
+	_, err = ParseScoreBound("x")
+	assert.Equal(t, ErrInvalidRangeBound, err)
+
+	tests := []struct {
+		name            string
+		args            ZRangeArgs
+		expectedMembers []string
+		expectedScores  []float64
+	}{
+		{"rank", ZRangeArgs{Start: 1, Stop: -2}, []string{"m2", "m3", "m4"}, []float64{2, 3, 4}},
+		{"rank rev", ZRangeArgs{Start: 0, Stop: 1, Rev: true}, []string{"m5", "m4"}, []float64{5, 4}},
+		{"rank limit", ZRangeArgs{Start: 0, Stop: -1, Offset: 3, Count: 5}, []string{"m4", "m5"}, []float64{4, 5}},
+		{"rank out of range", ZRangeArgs{Start: 7, Stop: 9}, nil, nil},
+		{"score", ZRangeArgs{By: ZRangeByScore, Min: min, Max: max}, []string{"m2", "m3", "m4", "m5"}, []float64{2, 3, 4, 5}},
+		{"score rev limit", ZRangeArgs{By: ZRangeByScore, Min: min, Max: max, Rev: true, Offset: 1, Count: 2},
+			[]string{"m4", "m3"}, []float64{4, 3}},
+		{"lex", ZRangeArgs{By: ZRangeByLex, LexMin: LexBound{Value: []byte("m3")}, LexMax: LexBound{Inf: 1}},
+			[]string{"m3", "m4", "m5"}, []float64{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, scores := db.ZRangeWithArgs([]byte("k1"), tt.args)
+			var got []string
+			for _, m := range members {
+				got = append(got, string(m))
+			}
+			assert.Equal(t, tt.expectedMembers, got)
+			assert.Equal(t, tt.expectedScores, scores)
+		})
+	}
+}
+
+func TestNode_Less(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     *Node
+		expected bool
+	}{
+		{"lower score", &Node{1, "b"}, &Node{2, "a"}, true},
+		{"higher score", &Node{2, "a"}, &Node{1, "b"}, false},
+		{"same length", &Node{1, "ab"}, &Node{1, "ac"}, true},
+		{"longer but smaller", &Node{1, "ab"}, &Node{1, "b"}, true},
+		{"prefix", &Node{1, "a"}, &Node{1, "ab"}, true},
+		{"equal", &Node{1, "a"}, &Node{1, "a"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.a.Less(tt.b))
+		})
+	}
+}
+
+func TestLazyDB_ZSet_EqualScores(t *testing.T) {
+	db := initTestZset()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	key := []byte("k1")
+	var want []string
+	for i := 199; i >= 0; i-- {
+		member := fmt.Sprintf("m%03d", i)
+		want = append(want, member)
+		assert.NoError(t, db.ZAdd(key, util.Float64ToByte(1), []byte(member)))
+	}
+	for _, member := range []string{"b", "ab", "m1"} {
+		want = append(want, member)
+		assert.NoError(t, db.ZAdd(key, util.Float64ToByte(1), []byte(member)))
+	}
+	// adding a member again with the same score keeps a single node
+	assert.NoError(t, db.ZAdd(key, util.Float64ToByte(1), []byte("m100")))
+	sort.Strings(want)
+
+	check := func() {
+		assert.Equal(t, len(want), db.ZCard(key))
+		assert.Equal(t, len(want), db.zSetIndex.indexes[string(key)].skl.Len())
+		var got []string
+		for _, m := range db.ZRange(key, 0, -1) {
+			got = append(got, string(m))
+		}
+		assert.Equal(t, want, got)
+		for i, member := range want {
+			rank, err := db.ZRank(key, []byte(member))
+			assert.NoError(t, err)
+			assert.Equal(t, i, rank)
+			rank, err = db.ZRevRank(key, []byte(member))
+			assert.NoError(t, err)
+			assert.Equal(t, len(want)-1-i, rank)
+		}
+	}
+	check()
+
+	n, err := db.ZRem(key, []byte("m050"), []byte("m051"), []byte("ab"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	kept := want[:0]
+	for _, member := range want {
+		if member != "m050" && member != "m051" && member != "ab" {
+			kept = append(kept, member)
+		}
+	}
+	want = kept
+	check()
+
+	// the skip list is rebuilt in the same order from the log files
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	check()
+}
+
+func TestLazyDB_ZRemRange(t *testing.T) {
+	db := initTestZset()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	fill := func() {
+		for i, member := range []string{"a", "b", "c", "d", "e"} {
+			_ = db.ZAdd([]byte("k1"), util.Float64ToByte(float64(i+1)), []byte(member))
+			_ = db.ZAdd([]byte("k2"), util.Float64ToByte(0), []byte(member))
+		}
+	}
+	members := func(key string) []string {
+		var got []string
+		for _, m := range db.ZRange([]byte(key), 0, -1) {
+			got = append(got, string(m))
+		}
+		return got
+	}
+
+	tests := []struct {
+		name     string
+		remove   func() (int, error)
+		key      string
+		expected []string
+	}{
+		{"by score", func() (int, error) {
+			return db.ZRemRangeByScore([]byte("k1"), ScoreBound{Value: 2}, ScoreBound{Value: 4, Exclusive: true})
+		}, "k1", []string{"a", "d", "e"}},
+		{"by score none", func() (int, error) {
+			return db.ZRemRangeByScore([]byte("k1"), ScoreBound{Value: 6}, ScoreBound{Value: math.Inf(1)})
+		}, "k1", []string{"a", "b", "c", "d", "e"}},
+		{"by rank", func() (int, error) {
+			return db.ZRemRangeByRank([]byte("k1"), 1, -2)
+		}, "k1", []string{"a", "e"}},
+		{"by lex", func() (int, error) {
+			return db.ZRemRangeByLex([]byte("k2"), LexBound{Inf: -1}, LexBound{Value: []byte("c")})
+		}, "k2", []string{"d", "e"}},
+		{"all", func() (int, error) {
+			return db.ZRemRangeByRank([]byte("k2"), 0, -1)
+		}, "k2", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fill()
+			n, err := tt.remove()
+			assert.NoError(t, err)
+			assert.Equal(t, 5-len(tt.expected), n)
+			assert.Equal(t, tt.expected, members(tt.key))
+			assert.Equal(t, len(tt.expected), db.ZCard([]byte(tt.key)))
+		})
+	}
+
+	n, err := db.ZRemRangeByRank([]byte("missing"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// the tombstones are persisted
+	fill()
+	_, err = db.ZRemRangeByScore([]byte("k1"), ScoreBound{Value: math.Inf(-1)}, ScoreBound{Value: 3})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "e"}, members("k1"))
+}
+
+func TestLazyDB_ZUnion_ZInter_ZDiff(t *testing.T) {
+	db := initTestZset()
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+
+	_ = db.ZAdd([]byte("k1"), util.Float64ToByte(1), []byte("a"), util.Float64ToByte(2), []byte("b"), util.Float64ToByte(3), []byte("c"))
+	_ = db.ZAdd([]byte("k2"), util.Float64ToByte(10), []byte("b"), util.Float64ToByte(20), []byte("c"), util.Float64ToByte(30), []byte("d"))
+	keys := [][]byte{[]byte("k1"), []byte("k2"), []byte("missing")}
+
+	tests := []struct {
+		name            string
+		op              func() ([][]byte, []float64, error)
+		expectedMembers []string
+		expectedScores  []float64
+		expectedErr     error
+	}{
+		{"union", func() ([][]byte, []float64, error) {
+			return db.ZUnion(keys, ZStoreOptions{})
+		}, []string{"a", "b", "c", "d"}, []float64{1, 12, 23, 30}, nil},
+		{"union weights max", func() ([][]byte, []float64, error) {
+			return db.ZUnion(keys[:2], ZStoreOptions{Weights: []float64{10, 1}, Aggregate: ZAggregateMax})
+		}, []string{"a", "b", "c", "d"}, []float64{10, 20, 30, 30}, nil},
+		{"inter", func() ([][]byte, []float64, error) {
+			return db.ZInter(keys[:2], ZStoreOptions{Aggregate: ZAggregateMin})
+		}, []string{"b", "c"}, []float64{2, 3}, nil},
+		{"inter with missing key", func() ([][]byte, []float64, error) {
+			return db.ZInter(keys, ZStoreOptions{})
+		}, nil, nil, nil},
+		{"diff", func() ([][]byte, []float64, error) {
+			members, scores := db.ZDiff(keys...)
+			return members, scores, nil
+		}, []string{"a"}, []float64{1}, nil},
+		{"wrong weights", func() ([][]byte, []float64, error) {
+			return db.ZUnion(keys, ZStoreOptions{Weights: []float64{1}})
+		}, nil, nil, ErrZSetWeightsNumber},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, scores, err := tt.op()
+			var got []string
+			for _, m := range members {
+				got = append(got, string(m))
+			}
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.expectedMembers, got)
+			assert.Equal(t, tt.expectedScores, scores)
+		})
+	}
+}
+
+func TestLazyDB_ZStore(t *testing.T) {
+	db := initTestZset()
+	defer func() { destroyDB(db) }()
+	assert.NotNil(t, db)
+
+	_ = db.ZAdd([]byte("k1"), util.Float64ToByte(1), []byte("a"), util.Float64ToByte(2), []byte("b"))
+	_ = db.ZAdd([]byte("k2"), util.Float64ToByte(3), []byte("b"), util.Float64ToByte(4), []byte("c"))
+	_ = db.ZAdd([]byte("dst"), util.Float64ToByte(9), []byte("old"), util.Float64ToByte(9), []byte("b"))
+	assert.NoError(t, db.Expire([]byte("dst"), time.Hour))
+
+	n, err := db.ZUnionStore([]byte("dst"), [][]byte{[]byte("k1"), []byte("k2")}, ZStoreOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	members, scores := db.ZRangeWithScores([]byte("dst"), 0, -1)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c"), []byte("b")}, members)
+	assert.Equal(t, []float64{1, 4, 5}, scores)
+	ttl, _ := db.TTL([]byte("dst"))
+	assert.Equal(t, int64(0), ttl)
+
+	// the destination may be one of the sources
+	n, err = db.ZInterStore([]byte("dst"), [][]byte{[]byte("dst"), []byte("k2")}, ZStoreOptions{Weights: []float64{1, 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = db.ZDiffStore([]byte("k3"), []byte("k1"), []byte("k2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = db.ZDiffStore([]byte("k1"), []byte("k1"), []byte("k1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 0, db.ZCard([]byte("k1")))
+
+	// the stored sets are rebuilt from the log files
+	assert.NoError(t, db.Close())
+	db, err = Open(*db.cfg)
+	assert.NoError(t, err)
+	members, scores = db.ZRangeWithScores([]byte("dst"), 0, -1)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, members)
+	assert.Equal(t, []float64{11, 12}, scores)
+	assert.Equal(t, [][]byte{[]byte("a")}, db.ZRange([]byte("k3"), 0, -1))
+	assert.Equal(t, 0, db.ZCard([]byte("k1")))
+}